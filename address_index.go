@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"log"
+)
+
+// addressIndexBucket is the bucket mapping addresses to their unspent outputs
+const addressIndexBucket = "addrindex"
+
+// The address index is a secondary index of the UTXO set. Every unspent output
+// is stored under a key made of the owner address, the transaction ID and the
+// output index:
+//
+//	len(address) (2 bytes) | address | txid | vout (4 bytes)
+//
+// Because stores keep keys sorted, all outputs of an address are next to each
+// other and can be read with a single range scan over the address prefix.
+
+// addressIndexPrefix returns the key prefix shared by all outputs of an address
+func addressIndexPrefix(address string) []byte {
+	prefix := make([]byte, 2, 2+len(address))
+	binary.BigEndian.PutUint16(prefix, uint16(len(address)))
+
+	return append(prefix, address...)
+}
+
+// addressIndexKey returns the address index key of an output
+func addressIndexKey(address string, txID []byte, vout int) []byte {
+	key := append(addressIndexPrefix(address), txID...)
+	return binary.BigEndian.AppendUint32(key, uint32(vout))
+}
+
+// splitAddressIndexKey extracts the transaction ID and output index from an
+// address index key
+// Parameters:
+//   - key: The address index key
+//   - prefixLen: Length of the address prefix of the key
+func splitAddressIndexKey(key []byte, prefixLen int) ([]byte, int) {
+	txID := key[prefixLen : len(key)-4]
+	vout := int(binary.BigEndian.Uint32(key[len(key)-4:]))
+
+	return txID, vout
+}
+
+// serializeOutput converts a single output into a byte array using GOB encoding
+func serializeOutput(out TXOutput) []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(out)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+// deserializeOutput converts a byte array back into a single output
+func deserializeOutput(data []byte) TXOutput {
+	var out TXOutput
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&out)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return out
+}
+
+// forEachAddressOutput calls fn for every unspent output of an address, in key
+// order, until fn returns false
+// Parameters:
+//   - tx: The database transaction to read from
+//   - address: The address whose outputs to visit
+//   - fn: Called with the transaction ID, output index and output
+func forEachAddressOutput(tx StoreTx, address string, fn func(txID []byte, vout int, out TXOutput) bool) {
+	prefix := addressIndexPrefix(address)
+	c := tx.Bucket([]byte(addressIndexBucket)).Cursor()
+
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		txID, vout := splitAddressIndexKey(k, len(prefix))
+		if !fn(txID, vout, deserializeOutput(v)) {
+			return
+		}
+	}
+}
+
+// updateAddressIndex applies a new block to the address index: outputs spent
+// by the block are removed from their owner's entries and new outputs are added.
+// Parameters:
+//   - tx: The database transaction storing the block
+//   - block: The block being added to the chain
+//   - spent: The outputs spent by the block, see findSpentOutputs
+func updateAddressIndex(tx StoreTx, block *Block, spent map[string]TXOutput) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(addressIndexBucket))
+	if err != nil {
+		return err
+	}
+
+	for _, transaction := range block.Transactions {
+		if !transaction.IsCoinbase() {
+			for _, vin := range transaction.Vin {
+				out, ok := spent[outpointKey(hex.EncodeToString(vin.Txid), vin.Vout)]
+				if !ok {
+					continue
+				}
+
+				err = b.Delete(addressIndexKey(out.ScriptPubKey, vin.Txid, vin.Vout))
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		for outIdx, out := range transaction.Vout {
+			if out.IsDataCarrier() {
+				continue
+			}
+			err = b.Put(addressIndexKey(out.ScriptPubKey, transaction.ID, outIdx), serializeOutput(out))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// reindexAddresses rebuilds the address index from a full UTXO set
+// Parameters:
+//   - tx: The database transaction to write to
+//   - UTXO: Transaction ID -> its unspent outputs
+func reindexAddresses(tx StoreTx, UTXO map[string]TXOutputs) error {
+	err := tx.DeleteBucket([]byte(addressIndexBucket))
+	if err != nil && err != errBucketNotFound {
+		return err
+	}
+
+	b, err := tx.CreateBucket([]byte(addressIndexBucket))
+	if err != nil {
+		return err
+	}
+
+	for txID, outs := range UTXO {
+		key, err := hex.DecodeString(txID)
+		if err != nil {
+			return err
+		}
+
+		for outIdx, out := range outs.Outputs {
+			err = b.Put(addressIndexKey(out.ScriptPubKey, key, outIdx), serializeOutput(out))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
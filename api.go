@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// maxRequestBodySize is the largest request body the API reads
+const maxRequestBodySize = 1024 * 1024
+
+// apiReadHeaderTimeout is how long a client may take to send the request headers
+const apiReadHeaderTimeout = 10 * time.Second
+
+// errNoChain is returned by the API while a node has no chain yet
+var errNoChain = errors.New("no blockchain yet, the node is still downloading it")
+
+// BlockInfo is a block in the JSON format of the API
+type BlockInfo struct {
+	Hash              string            `json:"hash"`                   // Hex hash of the block
+	PreviousBlockHash string            `json:"previousblockhash"`      // Hex hash of the parent, empty for the genesis block
+	Height            int               `json:"height"`                 // Height of the block
+	Time              int64             `json:"time"`                   // Unix timestamp of the block
+	Nonce             int               `json:"nonce"`                  // Proof-of-work nonce
+	Bits              string            `json:"bits"`                   // Hex proof-of-work target in compact form
+	Version           int32             `json:"version"`                // Version bits signaling deployments
+	PowAlgorithm      string            `json:"powalgorithm,omitempty"` // Proof-of-work algorithm recorded by a genesis block not using SHA-256
+	Difficulty        float64           `json:"difficulty"`             // How many times harder the target is than the easiest one
+	ChainWork         string            `json:"chainwork"`              // Hex total work of the chain up to and including the block
+	MerkleRoot        string            `json:"merkleroot"`             // Hex Merkle root of the transactions
+	Confirmations     int               `json:"confirmations"`          // Blocks from the tip down to this one, 0 if not on the active chain
+	Tx                []TransactionInfo `json:"tx"`                     // The transactions
+	Pruned            bool              `json:"pruned,omitempty"`       // Whether the transactions were pruned, leaving Tx empty
+}
+
+// TransactionInfo is a transaction in the JSON format of the API
+type TransactionInfo struct {
+	Txid          string       `json:"txid"`                    // Hex ID of the transaction
+	Vin           []InputInfo  `json:"vin"`                     // Inputs
+	Vout          []OutputInfo `json:"vout"`                    // Outputs
+	BlockHash     string       `json:"blockhash,omitempty"`     // Hex hash of the containing block, when looked up on its own
+	Confirmations int          `json:"confirmations,omitempty"` // Confirmations of the containing block, when looked up on its own
+}
+
+// InputInfo is a transaction input in the JSON format of the API
+type InputInfo struct {
+	Txid      string `json:"txid,omitempty"`     // Hex ID of the transaction with the spent output, empty for a coinbase
+	Vout      int    `json:"vout"`               // Index of the spent output
+	ScriptSig string `json:"scriptsig"`          // Unlocking data
+	Coinbase  bool   `json:"coinbase,omitempty"` // Whether this is the input of a coinbase transaction
+}
+
+// OutputInfo is a transaction output in the JSON format of the API
+type OutputInfo struct {
+	N       int    `json:"n"`              // Index of the output
+	Value   int    `json:"value"`          // Amount of coins
+	Address string `json:"address"`        // Address the output pays, empty for a data carrier
+	Data    string `json:"data,omitempty"` // Hex data of a data-carrier output
+	Text    string `json:"text,omitempty"` // Data of a data-carrier output, when it's UTF-8 text
+	NFT     string `json:"nft,omitempty"`  // Hex ID of the NFT the output carries
+
+	LockHeight int `json:"lock_height,omitempty"` // Height of the first block that may spend it
+}
+
+// NewTransactionInfo converts a transaction to the API format
+func NewTransactionInfo(tx *Transaction) TransactionInfo {
+	info := TransactionInfo{Txid: hex.EncodeToString(tx.ID), Vin: []InputInfo{}, Vout: []OutputInfo{}}
+
+	for _, in := range tx.Vin {
+		info.Vin = append(info.Vin, InputInfo{
+			Txid:      hex.EncodeToString(in.Txid),
+			Vout:      in.Vout,
+			ScriptSig: in.ScriptSig,
+			Coinbase:  tx.IsCoinbase(),
+		})
+	}
+	for i, out := range tx.Vout {
+		if out.IsDataCarrier() {
+			data := out.CarriedData()
+			output := OutputInfo{N: i, Value: out.Value, Data: hex.EncodeToString(data)}
+			if utf8.Valid(data) {
+				output.Text = string(data)
+			}
+			info.Vout = append(info.Vout, output)
+			continue
+		}
+		info.Vout = append(info.Vout, OutputInfo{N: i, Value: out.Value, Address: out.ScriptPubKey, NFT: hex.EncodeToString(out.NFT), LockHeight: out.LockHeight})
+	}
+
+	return info
+}
+
+// NewBlockInfo converts a block to the API format
+// Parameters:
+//   - bc: The blockchain the block is stored in, to count its confirmations
+//   - block: The block
+func NewBlockInfo(bc *Blockchain, block *Block) BlockInfo {
+	info := BlockInfo{
+		Hash:              hex.EncodeToString(block.Hash),
+		PreviousBlockHash: hex.EncodeToString(block.PrevBlockHash),
+		Height:            block.Height,
+		Time:              block.Timestamp,
+		Nonce:             block.Nonce,
+		Bits:              fmt.Sprintf("%08x", bigToCompact(block.Target())),
+		Version:           block.Version,
+		PowAlgorithm:      block.PowAlgorithm,
+		Difficulty:        block.Difficulty(),
+		MerkleRoot:        hex.EncodeToString(block.HashTransactions()),
+		Tx:                []TransactionInfo{},
+		Pruned:            block.IsPruned(),
+	}
+
+	// Blocks of side branches have no confirmations
+	info.Confirmations, _ = bc.Confirmations(block)
+
+	if work, err := bc.ChainWork(block.Hash); err == nil {
+		info.ChainWork = fmt.Sprintf("%064x", work)
+	}
+
+	for _, tx := range block.Transactions {
+		info.Tx = append(info.Tx, NewTransactionInfo(tx))
+	}
+
+	return info
+}
+
+// APIServer serves the blockchain over HTTP, so web apps and scripts can use it
+// without running the CLI. It is either run on its own by the serve command,
+// owning the chain, or by a node next to the network protocol.
+type APIServer struct {
+	mu     sync.Locker              // Held while using the chain, the node's lock when run by a node
+	chain  func() *Blockchain       // Returns the chain, nil while a node is still without one
+	submit func(*Transaction) error // Mines or relays a posted transaction, called without holding mu
+	block  func(*Block) error       // Adds a block mined by an external miner, called without holding mu
+	events *eventFeed               // Blocks connected to the chain and accepted transactions
+}
+
+// NewAPIServer creates an API server owning a chain. Posted transactions are
+// mined into a block right away, or handed to a node if one is given.
+// Parameters:
+//   - bc: The blockchain
+//   - node: The node to send posted transactions to, with an empty address to mine them locally
+func NewAPIServer(bc *Blockchain, node nodeClientOptions) (*APIServer, error) {
+	a := &APIServer{mu: &sync.Mutex{}, chain: func() *Blockchain { return bc }, events: newEventFeed()}
+	a.block = func(block *Block) error {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		err := bc.SubmitBlock(block)
+		if err != nil {
+			return err
+		}
+		if bc.IsInActiveChain(block) {
+			a.events.publish(Event{Type: eventBlockConnected, Block: block})
+		}
+		return nil
+	}
+
+	if node.Addr == "" {
+		a.submit = func(tx *Transaction) error {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+
+			err := UTXOSet{bc}.VerifyTransaction(tx)
+			if err != nil {
+				return err
+			}
+			a.events.publish(Event{Type: eventTxAccepted, Tx: tx})
+			block, err := bc.MineBlock(context.Background(), []*Transaction{tx})
+			if err != nil {
+				return err
+			}
+			a.events.publish(Event{Type: eventBlockConnected, Block: block})
+			return nil
+		}
+		return a, nil
+	}
+
+	var config *tls.Config
+	if node.TLS {
+		var err error
+		config, err = clientTLSConfig(node.TLSPinFile, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	a.submit = func(tx *Transaction) error {
+		return SendTransaction(node.Addr, config, tx)
+	}
+
+	return a, nil
+}
+
+// API creates an API server for the node's chain. Posted transactions and
+// submitted blocks are handled like the ones relayed by a peer.
+func (s *Server) API() *APIServer {
+	return &APIServer{
+		mu:    &s.mu,
+		chain: func() *Blockchain { return s.bc },
+		submit: func(tx *Transaction) error {
+			return s.acceptTransaction(tx, nil)
+		},
+		block:  s.submitBlock,
+		events: s.events,
+	}
+}
+
+// Handler returns the HTTP handler of the API. The endpoints are:
+// - GET /blocks/{hash}: The block with the hex hash
+// - GET /blocks/height/{n}: The block at height n of the active chain
+// - GET /address/{addr}/balance: The balance of an address
+// - GET /tx/{id}: The transaction with the hex ID, with its block and confirmations
+// - POST /tx: Broadcast a signed transaction, in the format of broadcasttx files
+// - POST /: JSON-RPC 2.0 requests, see rpc.go
+// - GET /ws: WebSocket feed of block and transaction events, see ws.go
+// - GET /backup: A snapshot of the database, see backup.go
+func (a *APIServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /blocks/{hash}", a.handleBlock)
+	mux.HandleFunc("GET /blocks/height/{n}", a.handleBlockAtHeight)
+	mux.HandleFunc("GET /address/{addr}/balance", a.handleBalance)
+	mux.HandleFunc("GET /tx/{id}", a.handleGetTransaction)
+	mux.HandleFunc("POST /tx", a.handlePostTransaction)
+	mux.HandleFunc("POST /{$}", a.handleRPC)
+	mux.HandleFunc("GET /ws", a.handleWebSocket)
+	mux.HandleFunc("GET /backup", a.handleBackup)
+
+	return mux
+}
+
+// ListenAndServe serves the API until the listener fails
+// Parameters:
+//   - addr: Address to listen on, for example ":8080"
+//   - config: TLS configuration to serve HTTPS with, see serverTLSConfig, nil for plain HTTP
+func (a *APIServer) ListenAndServe(addr string, config *tls.Config) error {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           a.Handler(),
+		ReadHeaderTimeout: apiReadHeaderTimeout,
+		TLSConfig:         config,
+	}
+
+	slog.Info("HTTP API listening", "addr", addr, "tls", config != nil)
+	if config != nil {
+		// The certificate comes with the configuration
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// apiError is an error with the HTTP status to answer it with
+type apiError struct {
+	status int
+	err    error
+}
+
+func (e *apiError) Error() string {
+	return e.err.Error()
+}
+
+// notFound wraps an error into a 404 response
+func notFound(err error) error {
+	return &apiError{http.StatusNotFound, err}
+}
+
+// badRequest wraps an error into a 400 response
+func badRequest(err error) error {
+	return &apiError{http.StatusBadRequest, err}
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Warn("Writing HTTP response failed", "err", err)
+	}
+}
+
+// respond writes the result of a request as JSON, or the error with its status
+func respond(w http.ResponseWriter, v any, err error) {
+	if err == nil {
+		writeJSON(w, http.StatusOK, v)
+		return
+	}
+
+	status := http.StatusInternalServerError
+	var e *apiError
+	if errors.As(err, &e) {
+		status = e.status
+	} else if errors.Is(err, errNoChain) {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// withChain runs a request against the chain while holding the lock
+func (a *APIServer) withChain(fn func(bc *Blockchain) (any, error)) (any, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	bc := a.chain()
+	if bc == nil {
+		return nil, errNoChain
+	}
+
+	return fn(bc)
+}
+
+// handleBlock answers GET /blocks/{hash}
+func (a *APIServer) handleBlock(w http.ResponseWriter, r *http.Request) {
+	v, err := a.withChain(func(bc *Blockchain) (any, error) {
+		hash, err := hex.DecodeString(r.PathValue("hash"))
+		if err != nil {
+			return nil, badRequest(fmt.Errorf("invalid block hash: %w", err))
+		}
+
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			return nil, notFound(err)
+		}
+
+		return NewBlockInfo(bc, block), nil
+	})
+
+	respond(w, v, err)
+}
+
+// handleBlockAtHeight answers GET /blocks/height/{n}
+func (a *APIServer) handleBlockAtHeight(w http.ResponseWriter, r *http.Request) {
+	v, err := a.withChain(func(bc *Blockchain) (any, error) {
+		height, err := strconv.Atoi(r.PathValue("n"))
+		if err != nil || height < 0 {
+			return nil, badRequest(fmt.Errorf("invalid height %q", r.PathValue("n")))
+		}
+
+		hash, err := bc.GetBlockHash(height)
+		if err != nil {
+			return nil, notFound(err)
+		}
+
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewBlockInfo(bc, block), nil
+	})
+
+	respond(w, v, err)
+}
+
+// handleBalance answers GET /address/{addr}/balance
+func (a *APIServer) handleBalance(w http.ResponseWriter, r *http.Request) {
+	v, err := a.withChain(func(bc *Blockchain) (any, error) {
+		address := r.PathValue("addr")
+
+		return struct {
+			Address string `json:"address"`
+			Balance int    `json:"balance"`
+		}{address, UTXOSet{bc}.GetBalance(address)}, nil
+	})
+
+	respond(w, v, err)
+}
+
+// handleGetTransaction answers GET /tx/{id}
+func (a *APIServer) handleGetTransaction(w http.ResponseWriter, r *http.Request) {
+	v, err := a.withChain(func(bc *Blockchain) (any, error) {
+		id, err := hex.DecodeString(r.PathValue("id"))
+		if err != nil {
+			return nil, badRequest(fmt.Errorf("invalid transaction ID: %w", err))
+		}
+
+		block, err := bc.TransactionBlock(id)
+		if err != nil {
+			return nil, notFound(err)
+		}
+
+		tx, err := bc.FindTransaction(id)
+		if err != nil {
+			return nil, err
+		}
+
+		info := NewTransactionInfo(&tx)
+		info.BlockHash = hex.EncodeToString(block.Hash)
+		info.Confirmations, err = bc.Confirmations(block)
+		if err != nil {
+			return nil, err
+		}
+
+		return info, nil
+	})
+
+	respond(w, v, err)
+}
+
+// handlePostTransaction answers POST /tx. The body is a signed transaction in
+// the format written by signtx.
+func (a *APIServer) handlePostTransaction(w http.ResponseWriter, r *http.Request) {
+	var ptx PortableTransaction
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodySize)).Decode(&ptx)
+	if err != nil {
+		respond(w, nil, badRequest(fmt.Errorf("invalid transaction: %w", err)))
+		return
+	}
+
+	v, err := a.withChain(func(bc *Blockchain) (any, error) {
+		err := ptx.Verify(&UTXOSet{bc})
+		if err != nil {
+			return nil, badRequest(err)
+		}
+
+		return ptx.Transaction()
+	})
+	if err != nil {
+		respond(w, nil, err)
+		return
+	}
+
+	tx := v.(*Transaction)
+	err = a.submit(tx)
+	if err != nil {
+		respond(w, nil, badRequest(err))
+		return
+	}
+
+	respond(w, map[string]string{"txid": hex.EncodeToString(tx.ID)}, nil)
+}
+
+// handleBackup answers GET /backup with a snapshot of the database. The
+// snapshot is taken into a temporary file first, so a slow download doesn't
+// hold a read transaction of the database open.
+func (a *APIServer) handleBackup(w http.ResponseWriter, r *http.Request) {
+	f, err := os.CreateTemp("", "backup-*.db")
+	if err != nil {
+		respond(w, nil, err)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, err = a.withChain(func(bc *Blockchain) (any, error) {
+		return nil, bc.db.Backup(f)
+	})
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		respond(w, nil, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, err = io.Copy(w, f)
+	if err != nil {
+		slog.Warn("Sending a backup failed", "err", err)
+	}
+}
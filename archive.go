@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"log"
+
+	"github.com/golang/snappy"
+)
+
+// compressedBlockMarker prefixes blocks stored compressed. A GOB stream never
+// starts with a zero byte, so compressed and plain blocks can't be confused.
+// Only the bodies of the blocks are compressed, see blockstore.go, older
+// versions compressed whole blocks.
+const compressedBlockMarker = 0x00
+
+// Archiving keeps the blocks near the tip as plain GOB, since they're the ones
+// read when building transactions and serving recent history, and compresses
+// the body of every block of the active chain that is more than the archive
+// depth below the tip. The depth is stored in the database, so each node
+// chooses its own trade-off between CPU and disk space. A depth of 0 turns
+// archiving off.
+
+// compressBlock compresses a serialized block for archival storage
+func compressBlock(data []byte) []byte {
+	return append([]byte{compressedBlockMarker}, snappy.Encode(nil, data)...)
+}
+
+// decompressBlock returns the serialized block from stored block data,
+// decompressing it if it was archived
+func decompressBlock(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != compressedBlockMarker {
+		return data, nil
+	}
+
+	return snappy.Decode(nil, data[1:])
+}
+
+// readArchiveDepth returns the archive depth stored in the meta bucket, 0 if unset
+func readArchiveDepth(tx StoreTx) int {
+	b := tx.Bucket([]byte(metaBucket))
+	if b == nil {
+		return 0
+	}
+
+	data := b.Get([]byte(metaArchiveDepthKey))
+	if data == nil {
+		return 0
+	}
+
+	return int(HexToInt(data))
+}
+
+// ArchiveDepth returns the number of blocks below the tip kept uncompressed,
+// 0 if archiving is off
+func (bc *Blockchain) ArchiveDepth() int {
+	depth := 0
+
+	err := bc.db.View(func(tx StoreTx) error {
+		depth = readArchiveDepth(tx)
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return depth
+}
+
+// SetArchiveDepth changes the archive depth and rewrites the blocks of the
+// active chain to match it: blocks more than depth below the tip are
+// compressed and the others are stored plain again.
+// Parameters:
+//   - depth: Number of blocks below the tip to keep uncompressed, 0 to turn archiving off
+//
+// Returns:
+//   - int: Number of blocks stored compressed afterwards
+func (bc *Blockchain) SetArchiveDepth(depth int) int {
+	compressed := 0
+
+	err := bc.db.Update(func(tx StoreTx) error {
+		err := tx.Bucket([]byte(metaBucket)).Put([]byte(metaArchiveDepthKey), IntToHex(int64(depth)))
+		if err != nil {
+			return err
+		}
+
+		blocks := tx.Bucket([]byte(blocksBucket))
+		bodies := tx.Bucket([]byte(bodiesBucket))
+		tipHeight := DeserializeBlock(blocks.Get(bc.tip)).Height
+
+		for hash := bc.tip; len(hash) > 0; {
+			block := DeserializeBlock(blocks.Get(hash))
+
+			// Pruned blocks have no body left to compress
+			if data := bodies.Get(hash); data != nil {
+				archive := depth > 0 && block.Height <= tipHeight-depth
+				isCompressed := data[0] == compressedBlockMarker
+
+				switch {
+				case archive && !isCompressed:
+					err = bodies.Put(hash, compressBlock(data))
+				case !archive && isCompressed:
+					var plain []byte
+					plain, err = decompressBlock(data)
+					if err == nil {
+						err = bodies.Put(hash, plain)
+					}
+				}
+				if err != nil {
+					return err
+				}
+
+				if archive {
+					compressed++
+				}
+			}
+			hash = block.PrevBlockHash
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return compressed
+}
+
+// archiveBlocks compresses the block of the active chain that a new block has
+// pushed beyond the archive depth
+// Parameters:
+//   - tx: The database transaction storing the block
+//   - block: The block being added to the chain
+func archiveBlocks(tx StoreTx, block *Block) error {
+	depth := readArchiveDepth(tx)
+	if depth == 0 || block.Height < depth {
+		return nil
+	}
+
+	hash := tx.Bucket([]byte(heightsBucket)).Get(heightKey(block.Height - depth))
+	if hash == nil {
+		return nil
+	}
+
+	bodies := tx.Bucket([]byte(bodiesBucket))
+	data := bodies.Get(hash)
+	if data == nil || data[0] == compressedBlockMarker {
+		return nil
+	}
+
+	// Copy the key, Put may invalidate memory returned by Get
+	return bodies.Put(bytes.Clone(hash), compressBlock(data))
+}
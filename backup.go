@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Backups are snapshots of the database taken while it's in use: a snapshot
+// is what one read transaction sees (see Store.Backup), so a block connected
+// meanwhile is either wholly in it, with its UTXO set and indexes, or not at
+// all. A running node holds the lock of its database file, so its snapshot is
+// downloaded from GET /backup of its HTTP API instead. A snapshot is a
+// blockchain file itself, and restore only puts it in place of the database
+// after checking it belongs to this chain and its tip has valid proof of work.
+
+// saveFile writes a file through a temporary file renamed over it, so the
+// file is never left half written
+// Parameters:
+//   - path: The file
+//   - write: Writes the content
+func saveFile(path string, write func(w io.Writer) error) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// downloadBackup fetches the snapshot of a running node's database from its
+// HTTP API
+// Parameters:
+//   - addr: Address of the API, as given to -http
+//   - w: Where to write the snapshot
+func downloadBackup(addr string, w io.Writer) error {
+	// -http :8080 listens on every interface, including this machine's
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+
+	resp, err := http.Get("http://" + addr + "/backup")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("node answered %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// verifySnapshot checks that a snapshot is a database of this chain whose tip
+// has valid proof of work
+// Parameters:
+//   - path: The snapshot file
+//
+// Returns:
+//   - *Block: The tip of the snapshot
+func verifySnapshot(path string) (*Block, error) {
+	// Opening a missing file would create it
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	db, err := openBoltStore(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't a blockchain database: %w", path, err)
+	}
+	defer db.Close()
+
+	var tip *Block
+	var stored, genesisHash []byte
+	err = db.View(func(tx StoreTx) error {
+		blocks := tx.Bucket([]byte(blocksBucket))
+		meta := tx.Bucket([]byte(metaBucket))
+		if blocks == nil || meta == nil {
+			return fmt.Errorf("%s has no chain", path)
+		}
+
+		hash := blocks.Get([]byte("l"))
+		data := blocks.Get(hash)
+		if data == nil {
+			return fmt.Errorf("tip %x of %s not found", hash, path)
+		}
+		tip = DeserializeBlock(data)
+
+		stored = bytes.Clone(meta.Get([]byte(metaFingerprintKey)))
+		genesisHash = bytes.Clone(meta.Get([]byte(metaGenesisKey)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The fingerprint and proof of work depend on the parameters of the chain
+	applyStoredParams(db)
+	if expected := chainFingerprint(genesisHash); stored != nil && string(stored) != expected {
+		return nil, fmt.Errorf("%s belongs to chain %s, but this node runs chain %s", path, stored, expected)
+	}
+	if !NewProofOfWork(tip).Validate() {
+		return nil, fmt.Errorf("tip %x of %s has invalid proof of work", tip.Hash, path)
+	}
+
+	return tip, nil
+}
+
+// restoreSnapshot replaces the database with a snapshot, once verified
+// Parameters:
+//   - path: The snapshot file
+//
+// Returns:
+//   - *Block: The tip of the restored chain
+func restoreSnapshot(path string) (*Block, error) {
+	if ephemeral {
+		return nil, errors.New("an ephemeral chain can't be restored, run without -ephemeral")
+	}
+
+	tip, err := verifySnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if dbExists() && boltFileInUse(dbFile) {
+		return nil, fmt.Errorf("%s is in use, stop the node before restoring it", dbFile)
+	}
+
+	snapshot, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Close()
+
+	err = saveFile(dbFile, func(w io.Writer) error {
+		_, err := io.Copy(w, snapshot)
+		return err
+	})
+
+	return tip, err
+}
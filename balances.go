@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log"
+	"sort"
+)
+
+// balancesBucket is the bucket caching the total unspent value of every address
+const balancesBucket = "balances"
+
+// BalanceDrift describes an address whose cached balance doesn't match the UTXO set
+type BalanceDrift struct {
+	Address string // The address
+	Cached  int    // Balance stored in the balance cache
+	Actual  int    // Balance recomputed from the UTXO set
+}
+
+// GetBalance returns the cached balance of an address, the sum of all its
+// unspent outputs
+// Parameters:
+//   - address: The address to look up
+//
+// Returns:
+//   - int: The balance, 0 for unknown addresses
+func (u UTXOSet) GetBalance(address string) int {
+	balance := 0
+
+	err := u.Blockchain.db.View(func(tx StoreTx) error {
+		balance = readBalance(tx.Bucket([]byte(balancesBucket)), address)
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return balance
+}
+
+// CheckBalances recomputes the balance of every address from the UTXO set and
+// compares it with the balance cache
+// Returns:
+//   - []BalanceDrift: Addresses whose cached balance is wrong, sorted by address
+func (u UTXOSet) CheckBalances() []BalanceDrift {
+	actual := make(map[string]int)
+	cached := make(map[string]int)
+
+	err := u.Blockchain.db.View(func(tx StoreTx) error {
+		c := tx.Bucket([]byte(utxoBucket)).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			for _, out := range DeserializeOutputs(v).Outputs {
+				actual[out.ScriptPubKey] += out.Value
+			}
+		}
+
+		c = tx.Bucket([]byte(balancesBucket)).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			cached[string(k)] = decodeBalance(v)
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var drift []BalanceDrift
+	for address, balance := range actual {
+		if cached[address] != balance {
+			drift = append(drift, BalanceDrift{address, cached[address], balance})
+		}
+	}
+	for address, balance := range cached {
+		if _, ok := actual[address]; !ok {
+			drift = append(drift, BalanceDrift{address, balance, 0})
+		}
+	}
+	sort.Slice(drift, func(i, j int) bool { return drift[i].Address < drift[j].Address })
+
+	return drift
+}
+
+// decodeBalance converts a stored balance back into an int
+func decodeBalance(data []byte) int {
+	return int(HexToInt(data))
+}
+
+// readBalance returns the balance of an address stored in the balances bucket
+func readBalance(b StoreBucket, address string) int {
+	data := b.Get([]byte(address))
+	if data == nil {
+		return 0
+	}
+
+	return decodeBalance(data)
+}
+
+// addBalance adds a (possibly negative) amount to the balance of an address.
+// Addresses whose balance drops to 0 are removed from the cache.
+func addBalance(b StoreBucket, address string, amount int) error {
+	balance := readBalance(b, address) + amount
+	if balance == 0 {
+		return b.Delete([]byte(address))
+	}
+
+	return b.Put([]byte(address), IntToHex(int64(balance)))
+}
+
+// updateBalances applies a new block to the balance cache: the value of spent
+// outputs is subtracted from their owners and new outputs are credited.
+// Parameters:
+//   - tx: The database transaction storing the block
+//   - block: The block being added to the chain
+//   - spent: The outputs spent by the block, see findSpentOutputs
+func updateBalances(tx StoreTx, block *Block, spent map[string]TXOutput) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(balancesBucket))
+	if err != nil {
+		return err
+	}
+
+	for _, out := range spent {
+		err = addBalance(b, out.ScriptPubKey, -out.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, transaction := range block.Transactions {
+		for _, out := range transaction.Vout {
+			err = addBalance(b, out.ScriptPubKey, out.Value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// reindexBalances rebuilds the balance cache from a full UTXO set
+// Parameters:
+//   - tx: The database transaction to write to
+//   - UTXO: Transaction ID -> its unspent outputs
+func reindexBalances(tx StoreTx, UTXO map[string]TXOutputs) error {
+	err := tx.DeleteBucket([]byte(balancesBucket))
+	if err != nil && err != errBucketNotFound {
+		return err
+	}
+
+	b, err := tx.CreateBucket([]byte(balancesBucket))
+	if err != nil {
+		return err
+	}
+
+	for _, outs := range UTXO {
+		for _, out := range outs.Outputs {
+			err = addBalance(b, out.ScriptPubKey, out.Value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/big"
+	"time"
+)
+
+// MiningBenchmark is the result of mining throwaway blocks at a difficulty
+type MiningBenchmark struct {
+	Bits             int           // Leading zero bits the block hashes needed
+	Duration         time.Duration // Time spent mining
+	Blocks           int           // Blocks found
+	Hashes           uint64        // Hashes tried
+	HashRate         float64       // Hashes per second
+	HashesPerBlock   float64       // Hashes a block needs on average at the difficulty
+	ExpectedInterval time.Duration // Time a block takes on average at the hash rate
+	MeasuredInterval time.Duration // Time the blocks found took on average, 0 if none was found
+	SpacingBits      int           // Difficulty at which a block takes targetSpacing on average at the hash rate
+}
+
+// benchmarkMining mines throwaway blocks at a difficulty for a while, with
+// the same proof of work as real blocks but without touching the database,
+// to measure the hash rate of the machine
+// Parameters:
+//   - bits: Leading zero bits the block hashes need, like targetBits
+//   - duration: How long to mine
+func benchmarkMining(bits int, duration time.Duration) MiningBenchmark {
+	target := new(big.Int).Lsh(big.NewInt(1), uint(256-bits))
+	compact := bigToCompact(target)
+	coinbase := NewCoinbaseTX("bench", "Mining benchmark", 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+
+	result := MiningBenchmark{Bits: bits}
+	started := time.Now()
+	for timestamp := int64(0); ctx.Err() == nil; timestamp++ {
+		// Every block has another timestamp, so it has other hashes to find
+		block := &Block{
+			Timestamp:     timestamp,
+			Transactions:  []*Transaction{coinbase},
+			PrevBlockHash: make([]byte, 32),
+			Bits:          compact,
+			Version:       versionBitsTopBits,
+		}
+
+		pow := NewProofOfWork(block)
+		pow.quiet = true
+		_, _, err := pow.Run(ctx)
+		hashes, _ := hashRate.last()
+		result.Hashes += hashes
+		if err == nil {
+			result.Blocks++
+		} else if !errors.Is(err, errNoncesExhausted) {
+			break
+		}
+	}
+	result.Duration = time.Since(started)
+
+	result.HashRate = float64(result.Hashes) / result.Duration.Seconds()
+	block := Block{Bits: compact}
+	result.HashesPerBlock, _ = new(big.Float).SetInt(blockWork(&block)).Float64()
+	if result.HashRate > 0 {
+		result.ExpectedInterval = time.Duration(result.HashesPerBlock / result.HashRate * float64(time.Second))
+		result.SpacingBits = int(math.Round(math.Log2(result.HashRate * float64(targetSpacing))))
+	}
+	if result.Blocks > 0 {
+		result.MeasuredInterval = result.Duration / time.Duration(result.Blocks)
+	}
+
+	return result
+}
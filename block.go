@@ -2,12 +2,21 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"context"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"log"
+	"math"
+	"slices"
 	"time"
 )
 
+// maxBlockSize is the largest serialized size of a block, in bytes as
+// stored in the database (see Block.Size). It's a parameter of the network,
+// set by selectNetwork.
+var maxBlockSize = 1000000
+
 // Block represents a block in the blockchain.
 // Each block contains:
 // - Timestamp: When the block was created
@@ -15,12 +24,24 @@ import (
 // - PrevBlockHash: Hash of the previous block (forms the chain)
 // - Hash: Hash of the current block
 // - Nonce: Number used in the proof-of-work algorithm
+// - Height: Number of blocks before this one in the chain
+// - Bits: Target of the proof of work, in compact form
+// - Version: Version bits signaling deployments, see deployments.go
+// - PowAlgorithm: Proof-of-work algorithm of the chain, see powhash.go
+// - MerkleRoot: Merkle root of the transactions, on headers without them
 type Block struct {
 	Timestamp     int64          // Unix timestamp when the block was created
 	Transactions  []*Transaction // List of transactions included in this block
 	PrevBlockHash []byte         // Reference to previous block's hash
 	Hash          []byte         // This block's hash (computed based on block contents)
 	Nonce         int            // Nonce used to generate a hash meeting the mining difficulty requirements
+	Height        int            // Position of the block in the chain, the genesis block has height 0
+	Bits          uint32         // Proof-of-work target in compact form, see Target and difficulty.go
+	Version       int32          // Version bits signaling deployments, 0 for blocks mined before versions existed
+	PowAlgorithm  string         // Proof-of-work algorithm of the chain, set on the genesis block only and empty for SHA-256
+	// Merkle root of the transactions of a block stored or read without them,
+	// see blockstore.go and prune.go. nil for blocks with their transactions.
+	MerkleRoot []byte
 }
 
 // Serialize converts the Block struct into a byte array.
@@ -44,25 +65,94 @@ func (b *Block) Serialize() []byte {
 
 // HashTransactions creates a hash of all transactions in the block.
 // This hash is used as part of the block's header and ensures that
-// transaction data cannot be tampered with.
-// The function:
-// 1. Collects all transaction IDs
-// 2. Concatenates them
-// 3. Creates a SHA-256 hash of the concatenated data
+// transaction data cannot be tampered with. It is the root of a Merkle tree
+// over the transaction IDs (see merkle.go), so the inclusion of a single
+// transaction can be proven without the rest of the block. Headers return
+// the root stored with them.
 // Returns:
 //   - []byte: Hash of all transactions
 func (b *Block) HashTransactions() []byte {
-	var txHashes [][]byte
-	var txHash [32]byte
+	if b.IsPruned() {
+		return b.MerkleRoot
+	}
+
+	var txIDs [][]byte
 
 	// Collect all transaction IDs
 	for _, tx := range b.Transactions {
-		txHashes = append(txHashes, tx.ID)
+		txIDs = append(txIDs, tx.ID)
+	}
+
+	return MerkleRoot(txIDs)
+}
+
+// Size returns the serialized size of the block, which is limited by
+// maxBlockSize
+func (b *Block) Size() int {
+	return len(b.Serialize())
+}
+
+// extraNonceFormat is appended to the coinbase data of a block whose nonces
+// all failed, see Block.Mine. It has a fixed width, so the space it takes
+// can be reserved when packing the block.
+const extraNonceFormat = " extranonce %08x"
+
+// blockOverhead returns the size of a block holding only its coinbase, with
+// the largest header values and extranonce, to reserve when packing a new
+// block, see blockSpace
+// Parameters:
+//   - coinbase: The coinbase of the new block
+//   - address: The address it pays
+func blockOverhead(coinbase *Transaction, address string) int {
+	rolled := *coinbase
+	rolled.Vin = slices.Clone(coinbase.Vin)
+	rolled.Vin[0].ScriptSig += fmt.Sprintf(extraNonceFormat, uint32(math.MaxUint32))
+	// The fees are added to the reward once the transactions are picked, in
+	// an output of its own if the subsidy ran out
+	rolled.Vout = []TXOutput{{Value: math.MaxInt, ScriptPubKey: address}}
+
+	template := Block{
+		Timestamp:     math.MaxInt64,
+		Transactions:  []*Transaction{&rolled},
+		PrevBlockHash: make([]byte, 32),
+		Hash:          make([]byte, 32),
+		Nonce:         maxNonce,
+		Height:        math.MaxInt64,
+		Bits:          math.MaxUint32,
+		Version:       math.MaxInt32,
+	}
+
+	return template.Size()
+}
+
+// blockSpace returns at most how many bytes each transaction adds to a block.
+// A block encodes the transaction type once for all of its transactions, so
+// that's less than a transaction's own serialized size: the transactions are
+// measured on an encoder that already sent the type.
+// Parameters:
+//   - txs: The transactions
+//
+// Returns:
+//   - []int: The size of each transaction in a block
+func blockSpace(txs []*Transaction) []int {
+	var buff bytes.Buffer
+	encoder := gob.NewEncoder(&buff)
+	err := encoder.Encode(Transaction{})
+	if err != nil {
+		log.Panic(err)
 	}
-	// Create a single hash of all transaction hashes
-	txHash = sha256.Sum256(bytes.Join(txHashes, []byte{}))
 
-	return txHash[:]
+	sizes := make([]int, len(txs))
+	for i, tx := range txs {
+		buff.Reset()
+		err = encoder.Encode(tx)
+		if err != nil {
+			log.Panic(err)
+		}
+		sizes[i] = buff.Len()
+	}
+
+	return sizes
 }
 
 // NewBlock creates and returns a new Block.
@@ -71,31 +161,79 @@ func (b *Block) HashTransactions() []byte {
 // 2. Performs proof-of-work to generate valid hash
 // 3. Sets the computed hash and nonce
 // Parameters:
+//   - ctx: Cancels the mining, see ProofOfWork.Run
 //   - transactions: List of transactions to include in the block
 //   - prevBlockHash: Hash of the previous block in the chain
+//   - height: Height of the new block
+//   - version: Version bits of the new block, see blockVersion
+//   - bits: Target of the new block in compact form, see nextTarget
+//   - timestamp: Unix time of the new block, usually the current time
 //
 // Returns:
 //   - *Block: Newly created and mined block
-func NewBlock(transactions []*Transaction, prevBlockHash []byte) *Block {
-	// Create basic block structure with current timestamp
+//   - error: errMiningCancelled if ctx was cancelled first
+func NewBlock(ctx context.Context, transactions []*Transaction, prevBlockHash []byte, height int, version int32, bits uint32, timestamp int64) (*Block, error) {
+	// Create basic block structure
 	block := &Block{
-		Timestamp:     time.Now().Unix(),
+		Timestamp:     timestamp,
 		Transactions:  transactions,
 		PrevBlockHash: prevBlockHash,
 		Hash:          []byte{},
 		Nonce:         0,
+		Height:        height,
+		Bits:          bits,
+		Version:       version,
 	}
 
-	// Create a proof-of-work instance for this block
-	pow := NewProofOfWork(block)
-	// Run mining process to find valid hash and nonce
-	nonce, hash := pow.Run()
+	err := block.Mine(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-	// Set the computed values
-	block.Hash = hash[:]
-	block.Nonce = nonce
+	return block, nil
+}
 
-	return block
+// Mine performs the proof of work of a block, setting its nonce and hash.
+// When no nonce gives a valid hash the block is changed and mined again,
+// like Bitcoin miners do: the timestamp is refreshed if the clock moved on,
+// and otherwise the extranonce of the coinbase is increased, changing the
+// Merkle root. Blocks without a coinbase move their timestamp a second ahead
+// instead. So mining only ends with a valid block or a cancellation.
+// Parameters:
+//   - ctx: Cancels the mining, see ProofOfWork.Run
+func (b *Block) Mine(ctx context.Context) error {
+	var coinbase *Transaction
+	var scriptSig string
+	if len(b.Transactions) > 0 && b.Transactions[0].IsCoinbase() {
+		coinbase = b.Transactions[0]
+		scriptSig = coinbase.Vin[0].ScriptSig
+	}
+
+	for extraNonce := uint32(1); ; extraNonce++ {
+		// Create a proof-of-work instance for this block
+		pow := NewProofOfWork(b)
+		// Run mining process to find valid hash and nonce
+		nonce, hash, err := pow.Run(ctx)
+		if err == nil {
+			// Set the computed values
+			b.Hash = hash
+			b.Nonce = nonce
+			return nil
+		}
+		if !errors.Is(err, errNoncesExhausted) {
+			return err
+		}
+
+		switch now := time.Now().Unix(); {
+		case now > b.Timestamp:
+			b.Timestamp = now
+		case coinbase != nil:
+			coinbase.Vin[0].ScriptSig = scriptSig + fmt.Sprintf(extraNonceFormat, extraNonce)
+			coinbase.SetID()
+		default:
+			b.Timestamp++
+		}
+	}
 }
 
 // NewGenesisBlock creates and returns the genesis block.
@@ -108,26 +246,61 @@ func NewBlock(transactions []*Transaction, prevBlockHash []byte) *Block {
 //   - *Block: The genesis block
 func NewGenesisBlock(coinbase *Transaction) *Block {
 	// Create new block with no previous hash (empty byte array)
-	return NewBlock([]*Transaction{coinbase}, []byte{})
+	block := &Block{
+		Timestamp:     time.Now().Unix(),
+		Transactions:  []*Transaction{coinbase},
+		PrevBlockHash: []byte{},
+		Hash:          []byte{},
+		Height:        0,
+		Bits:          bigToCompact(powLimit()),
+		Version:       versionBitsTopBits,
+	}
+	// Record the proof-of-work algorithm of the chain, SHA-256 is implied
+	if name := powHasher.Name(); name != defaultPowAlgorithm {
+		block.PowAlgorithm = name
+	}
+
+	err := block.Mine(context.Background())
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return block
 }
 
 // DeserializeBlock converts a byte array back into a Block struct.
-// This is used when reading blocks from the database.
+// This is used when reading blocks from the database. Blocks compressed by
+// the archiver are decompressed first.
 // Parameters:
 //   - d: Serialized block data
 //
 // Returns:
 //   - *Block: Deserialized block structure
 func DeserializeBlock(d []byte) *Block {
+	block, err := decodeBlock(d)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return block
+}
+
+// decodeBlock is DeserializeBlock returning an error for damaged data
+func decodeBlock(d []byte) (*Block, error) {
 	var block Block
 
+	d, err := decompressBlock(d)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create a GOB decoder reading from our bytes
 	decoder := gob.NewDecoder(bytes.NewReader(d))
 	// Decode bytes into a Block structure
-	err := decoder.Decode(&block)
+	err = decoder.Decode(&block)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
-	return &block
+	return &block, nil
 }
@@ -1,60 +1,134 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-
-	"github.com/boltdb/bolt"
+	"slices"
+	"time"
 )
 
 // Database configuration constants
-const dbFile = "blockchain.db" // The file where the blockchain data is stored
-const blocksBucket = "blocks"  // The bucket (similar to a table) name in BoltDB
+var dbFile = "blockchain.db"  // The file where the blockchain data is stored, moved by selectNetwork
+const blocksBucket = "blocks" // The bucket (similar to a table) name in the Store
 // The message included in the genesis block, referencing The Times headline
-// This is the same message that was included in Bitcoin's genesis block
-const genesisCoinbaseData = "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks"
+// This is the same message that was included in Bitcoin's genesis block. Other
+// networks use their own, see network.go
+var genesisCoinbaseData = "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks"
 
-// Blockchain represents a chain of blocks stored in a BoltDB database.
+// Blockchain represents a chain of blocks stored in a Store, see store.go.
 // It maintains a reference to the last block (tip) and the database connection.
 type Blockchain struct {
-	tip []byte   // Hash of the last block in the chain
-	db  *bolt.DB // Database connection
+	tip []byte // Hash of the last block in the chain
+	db  Store  // Database connection
 }
 
 // BlockchainIterator provides functionality to iterate over blockchain blocks
 // from newest to oldest (back to genesis block)
 type BlockchainIterator struct {
-	currentHash []byte   // Hash of the current block
-	db          *bolt.DB // Database connection
+	currentHash []byte // Hash of the current block
+	db          Store  // Database connection
 }
 
+// errStaleBlock is returned for a mined block whose parent is no longer the
+// tip, because another block was added while it was being mined
+var errStaleBlock = errors.New("the chain tip changed while the block was mined")
+
 // MineBlock creates a new block with the provided transactions and adds it to the chain.
 // This simulates the mining process in a real blockchain network.
 // Parameters:
+//   - ctx: Cancels the mining, see ProofOfWork.Run
 //   - transactions: Array of transactions to include in the new block
-func (bc *Blockchain) MineBlock(transactions []*Transaction) {
-	var lastHash []byte
+//
+// Returns:
+//   - *Block: The new block
+//   - error: errMiningCancelled if ctx was cancelled first
+func (bc *Blockchain) MineBlock(ctx context.Context, transactions []*Transaction) (*Block, error) {
+	newBlock := bc.blockTemplate(transactions)
+
+	err := newBlock.Mine(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return newBlock, bc.storeMinedBlock(newBlock)
+}
 
-	// Retrieve the last block's hash from the database
-	err := bc.db.View(func(tx *bolt.Tx) error {
+// blockTemplate returns the next block of the chain with the provided
+// transactions, ready to be mined
+// Parameters:
+//   - transactions: Array of transactions to include in the new block
+func (bc *Blockchain) blockTemplate(transactions []*Transaction) *Block {
+	var lastHash []byte
+	var lastHeight int
+	var bits uint32
+	var version int32
+	var mtp int64
+
+	// Retrieve the last block's hash and height, the next target, the version
+	// and the median time past from the database
+	err := bc.db.View(func(tx StoreTx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		lastHash = b.Get([]byte("l")) // 'l' key stores the last block's hash
-		return nil
+		// 'l' key stores the last block's hash, copied since values are only valid during the transaction
+		lastHash = bytes.Clone(b.Get([]byte("l")))
+		lastBlock := DeserializeBlock(b.Get(lastHash))
+		lastHeight = lastBlock.Height
+
+		var err error
+		bits, err = nextTarget(tx, lastBlock)
+		if err != nil {
+			return err
+		}
+
+		version, err = blockVersion(tx, lastBlock)
+		if err != nil {
+			return err
+		}
+
+		mtp, err = medianTimePast(tx, lastBlock)
+		return err
 	})
 	if err != nil {
 		log.Panic(err)
 	}
 
-	// Create new block with the transactions
-	newBlock := NewBlock(transactions, lastHash)
+	// Its timestamp must be after the median time past, which blocks mined
+	// in quick succession can catch up with.
+	return &Block{
+		Timestamp:     max(time.Now().Unix(), mtp+1),
+		Transactions:  transactions,
+		PrevBlockHash: lastHash,
+		Hash:          []byte{},
+		Height:        lastHeight + 1,
+		Bits:          bits,
+		Version:       version,
+	}
+}
 
+// storeMinedBlock adds a block mined from blockTemplate to the chain
+// Parameters:
+//   - newBlock: The mined block
+//
+// Returns:
+//   - error: errStaleBlock if the tip changed since the template was made
+func (bc *Blockchain) storeMinedBlock(newBlock *Block) error {
 	// Store the new block in the database
-	err = bc.db.Update(func(tx *bolt.Tx) error {
+	return bc.db.Update(func(tx StoreTx) error {
 		b := tx.Bucket([]byte(blocksBucket))
+		if !bytes.Equal(b.Get([]byte("l")), newBlock.PrevBlockHash) {
+			return errStaleBlock
+		}
+
 		// Store the serialized block
-		err := b.Put(newBlock.Hash, newBlock.Serialize())
+		err := putBlock(tx, newBlock)
+		if err != nil {
+			log.Panic(err)
+		}
+		err = storeChainWork(tx, newBlock)
 		if err != nil {
 			log.Panic(err)
 		}
@@ -65,61 +139,158 @@ func (bc *Blockchain) MineBlock(transactions []*Transaction) {
 			log.Panic(err)
 		}
 
+		// Update the UTXO set along with the block
+		err = connectBlock(tx, newBlock)
+		if err != nil {
+			log.Panic(err)
+		}
+
 		// Update the tip
 		bc.tip = newBlock.Hash
 
 		return nil
 	})
+}
+
+// AddBlock stores a block received from another node. A block extending the
+// active tip is validated and connected. A block on a side branch is checked
+// against its parent and stored, and the best chain is activated again, which switches to the branch if it
+// now has the most work.
+// Parameters:
+//   - block: The block to add
+//
+// Returns:
+//   - bool: false if the block was already known
+func (bc *Blockchain) AddBlock(block *Block) (bool, error) {
+	if bc.hasBlock(block.Hash) {
+		return false, nil
+	}
+
+	err := checkBlockHeader(block)
 	if err != nil {
-		log.Panic(err)
+		return false, err
+	}
+
+	extendsTip := bytes.Equal(block.PrevBlockHash, bc.tip)
+
+	err = bc.db.Update(func(tx StoreTx) error {
+		err := checkCheckpoints(tx, block)
+		if err != nil {
+			return err
+		}
+		err = checkPrunedFork(tx, block)
+		if err != nil {
+			return err
+		}
+
+		b := tx.Bucket([]byte(blocksBucket))
+		encodedParent := b.Get(block.PrevBlockHash)
+		if encodedParent == nil {
+			return fmt.Errorf("parent %x of block %x not found", block.PrevBlockHash, block.Hash)
+		}
+		parent := DeserializeBlock(encodedParent)
+
+		if !extendsTip {
+			err = checkBlockContext(tx, block, parent)
+			if err != nil {
+				return err
+			}
+			err = putBlock(tx, block)
+			if err != nil {
+				return err
+			}
+			return storeChainWork(tx, block)
+		}
+
+		err = validateBlock(tx, block, parent)
+		if err != nil {
+			return err
+		}
+
+		err = putBlock(tx, block)
+		if err != nil {
+			return err
+		}
+
+		err = storeChainWork(tx, block)
+		if err != nil {
+			return err
+		}
+
+		err = b.Put([]byte("l"), block.Hash)
+		if err != nil {
+			return err
+		}
+
+		return connectBlock(tx, block)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if extendsTip {
+		bc.tip = block.Hash
+		return true, nil
 	}
+
+	return true, bc.activateBestChain()
 }
 
-// FindUnspentTransactions scans the blockchain and returns all unspent transactions
-// for a given address. This is a key function for the UTXO (Unspent Transaction Output) model.
+// FindUTXO scans the whole blockchain and returns all unspent transaction outputs,
+// grouped by the ID of the transaction that created them.
+// This is used to build the UTXO set from scratch.
 // Parameters:
-//   - address: The address to find unspent transactions for
-func (bc *Blockchain) FindUnspentTransactions(address string) []Transaction {
-	var unspentTXs []Transaction
+//   - progress: Updated with the blocks scanned, may be nil
+//
+// Returns:
+//   - map[string]TXOutputs: Transaction ID -> its unspent outputs
+func (bc *Blockchain) FindUTXO(progress *progressTracker) map[string]TXOutputs {
+	UTXO := make(map[string]TXOutputs)
 	spentTXOs := make(map[string][]int) // Maps transaction IDs to spent output indices
 	bci := bc.Iterator()
+	scanned := 0
+	total := bc.GetBestHeight() + 1
 
-	// Iterate through all blocks
+	// Iterate through all blocks and their transactions, newest first, so
+	// spends are seen before the outputs they spend
 	for {
 		block := bci.Next()
 
-		// Look at each transaction in the block
-		for _, tx := range block.Transactions {
+		for _, tx := range slices.Backward(block.Transactions) {
 			txID := hex.EncodeToString(tx.ID)
 
-			// Check each output in the transaction
 		Outputs:
 			for outIdx, out := range tx.Vout {
+				// Data carriers can't be spent
+				if out.IsDataCarrier() {
+					continue
+				}
+
 				// Skip if output was already spent
-				if spentTXOs[txID] != nil {
-					for _, spentOut := range spentTXOs[txID] {
-						if spentOut == outIdx {
-							continue Outputs
-						}
+				for _, spentOutIdx := range spentTXOs[txID] {
+					if spentOutIdx == outIdx {
+						continue Outputs
 					}
 				}
 
-				// If output can be unlocked by the provided address, it's unspent
-				if out.CanBeUnlockedWith(address) {
-					unspentTXs = append(unspentTXs, *tx)
+				outs, ok := UTXO[txID]
+				if !ok {
+					outs = TXOutputs{make(map[int]TXOutput)}
+					UTXO[txID] = outs
 				}
+				outs.Outputs[outIdx] = out
 			}
 
 			// If not a coinbase transaction, mark its inputs as spent
 			if !tx.IsCoinbase() {
 				for _, in := range tx.Vin {
-					if in.CanUnlockOutputWith(address) {
-						inTxID := hex.EncodeToString(in.Txid)
-						spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Vout)
-					}
+					inTxID := hex.EncodeToString(in.Txid)
+					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Vout)
 				}
 			}
 		}
+		scanned++
+		progress.update(scanned, total)
 
 		// Break when we reach the genesis block
 		if len(block.PrevBlockHash) == 0 {
@@ -127,60 +298,7 @@ func (bc *Blockchain) FindUnspentTransactions(address string) []Transaction {
 		}
 	}
 
-	return unspentTXs
-}
-
-// FindUTXO finds all unspent transaction outputs for an address
-// and returns them. This is used to calculate account balance.
-// Parameters:
-//   - address: The address to find UTXOs for
-func (bc *Blockchain) FindUTXO(address string) []TXOutput {
-	var UTXOs []TXOutput
-	unspentTransactions := bc.FindUnspentTransactions(address)
-
-	// Collect all outputs that can be unlocked by the address
-	for _, tx := range unspentTransactions {
-		for _, out := range tx.Vout {
-			if out.CanBeUnlockedWith(address) {
-				UTXOs = append(UTXOs, out)
-			}
-		}
-	}
-
-	return UTXOs
-}
-
-// FindSpendableOutputs finds enough unspent outputs to cover the requested amount.
-// This is used when creating new transactions, to find outputs to use as inputs.
-// Parameters:
-//   - address: The address to find spendable outputs for
-//   - amount: The amount needed
-//
-// Returns:
-//   - accumulated: The total amount found
-//   - unspentOutputs: Map of transaction IDs to output indices
-func (bc *Blockchain) FindSpendableOutputs(address string, amount int) (int, map[string][]int) {
-	unspentOutputs := make(map[string][]int)
-	unspentTXs := bc.FindUnspentTransactions(address)
-	accumulated := 0
-
-Work:
-	for _, tx := range unspentTXs {
-		txID := hex.EncodeToString(tx.ID)
-
-		for outIdx, out := range tx.Vout {
-			if out.CanBeUnlockedWith(address) && accumulated < amount {
-				accumulated += out.Value
-				unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
-
-				if accumulated >= amount {
-					break Work
-				}
-			}
-		}
-	}
-
-	return accumulated, unspentOutputs
+	return UTXO
 }
 
 // Iterator creates and returns a BlockchainIterator instance
@@ -194,10 +312,8 @@ func (i *BlockchainIterator) Next() *Block {
 	var block *Block
 
 	// Read the block from database
-	err := i.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		encodedBlock := b.Get(i.currentHash)
-		block = DeserializeBlock(encodedBlock)
+	err := i.db.View(func(tx StoreTx) error {
+		block = getBlock(tx, i.currentHash)
 		return nil
 	})
 	if err != nil {
@@ -210,8 +326,97 @@ func (i *BlockchainIterator) Next() *Block {
 	return block
 }
 
-// dbExists checks if the blockchain database file exists
+// connectBlock updates the chain state for a block being added to the chain.
+// It runs inside the database transaction that stores the block, so the
+// chain state is written atomically with the block.
+// Parameters:
+//   - tx: The database transaction storing the block
+//   - block: The block being added to the chain
+func connectBlock(tx StoreTx, block *Block) error {
+	err := updateHeightIndex(tx, block)
+	if err != nil {
+		return err
+	}
+
+	err = updateTransactionIndex(tx, block)
+	if err != nil {
+		return err
+	}
+
+	// Spent outputs are looked up in the UTXO set, so this goes before updating it
+	spent := findSpentOutputs(tx, block)
+
+	err = storeUndoData(tx, block, spent)
+	if err != nil {
+		return err
+	}
+
+	err = updateAddressIndex(tx, block, spent)
+	if err != nil {
+		return err
+	}
+
+	err = updateBalances(tx, block, spent)
+	if err != nil {
+		return err
+	}
+
+	err = updateUTXOSet(tx, block)
+	if err != nil {
+		return err
+	}
+
+	err = updateMempool(tx, block)
+	if err != nil {
+		return err
+	}
+
+	err = connectContracts(tx, block)
+	if err != nil {
+		return err
+	}
+
+	err = archiveBlocks(tx, block)
+	if err != nil {
+		return err
+	}
+
+	err = pruneBlocks(tx, block)
+	if err != nil {
+		return err
+	}
+
+	return storeChainStateTip(tx, block.Hash)
+}
+
+// chainStateBuckets are the buckets derived from the active chain by connectBlock
+var chainStateBuckets = []string{heightsBucket, utxoBucket, addressIndexBucket, balancesBucket, txIndexBucket}
+
+// reindexChainState rebuilds everything derived from the active chain: the
+// height index, the UTXO set with its address index and balance cache, the
+// transaction index and the contract storage.
+// Reorganizations need it when the blocks to disconnect have no undo data,
+// see reorganize.
+func (bc *Blockchain) reindexChainState() {
+	bc.reindexHeights()
+	UTXOSet{bc}.Reindex(logProgress{})
+	bc.reindexTransactions(logProgress{})
+	bc.reindexContracts()
+
+	err := bc.db.Update(func(tx StoreTx) error {
+		return storeChainStateTip(tx, bc.tip)
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// dbExists checks if the blockchain database file exists, or when ephemeral
+// if a chain was created in memory
 func dbExists() bool {
+	if ephemeral {
+		return ephemeralStore != nil
+	}
 	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
 		return false
 	}
@@ -228,15 +433,31 @@ func NewBlockchain(address string) *Blockchain {
 	}
 
 	var tip []byte
-	db, err := bolt.Open(dbFile, 0600, nil)
+	db, err := openStore()
+	if errors.Is(err, errDatabaseInUse) {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	if err != nil {
 		log.Panic(err)
 	}
 
 	// Get the last block hash
-	err = db.Update(func(tx *bolt.Tx) error {
+	hasChainState, hasChainWork := true, true
+	err = db.Update(func(tx StoreTx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		tip = b.Get([]byte("l"))
+		// Copy the hash, values are only valid during the transaction
+		tip = bytes.Clone(b.Get([]byte("l")))
+
+		for _, bucket := range chainStateBuckets {
+			hasChainState = hasChainState && tx.Bucket([]byte(bucket)) != nil
+		}
+		hasChainWork = tx.Bucket([]byte(chainWorkBucket)) != nil
+
+		// Databases storing whole blocks get their headers and bodies split
+		if tx.Bucket([]byte(bodiesBucket)) == nil {
+			return splitBlocks(tx)
+		}
 		return nil
 	})
 	if err != nil {
@@ -244,6 +465,26 @@ func NewBlockchain(address string) *Blockchain {
 	}
 
 	bc := Blockchain{tip, db}
+
+	// Refuse to work with a database of a different network or chain, and
+	// run with the parameters the chain was created with
+	err = checkNetwork(db)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	applyStoredParams(db)
+	bc.checkTip(hasChainState)
+	bc.checkFingerprint()
+
+	// Databases created before some of the chain state existed need it built once
+	if !hasChainState {
+		bc.reindexChainState()
+	}
+	if !hasChainWork {
+		bc.reindexChainWork()
+	}
+
 	return &bc
 }
 
@@ -256,26 +497,46 @@ func CreateBlockchain(address string) *Blockchain {
 		os.Exit(1)
 	}
 
-	var tip []byte
-	db, err := bolt.Open(dbFile, 0600, nil)
+	// Create the coinbase transaction for genesis block
+	cbtx := NewCoinbaseTX(address, genesisCoinbaseData, blockSubsidy(0))
+	genesis := NewGenesisBlock(cbtx)
+
+	return InitBlockchain(genesis)
+}
+
+// InitBlockchain creates a new blockchain DB starting from a given genesis
+// block. This is used to create a new chain, and by nodes joining an existing
+// chain with the genesis block received from a peer.
+// Parameters:
+//   - genesis: The genesis block
+func InitBlockchain(genesis *Block) *Blockchain {
+	db, err := openStore()
+	if errors.Is(err, errDatabaseInUse) {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	if err != nil {
 		log.Panic(err)
 	}
 
 	// Initialize the blockchain with genesis block
-	err = db.Update(func(tx *bolt.Tx) error {
-		// Create the coinbase transaction for genesis block
-		cbtx := NewCoinbaseTX(address, genesisCoinbaseData)
-		genesis := NewGenesisBlock(cbtx)
-
-		// Create the blocks bucket
+	err = db.Update(func(tx StoreTx) error {
+		// Create the buckets of the block headers and bodies
 		b, err := tx.CreateBucket([]byte(blocksBucket))
 		if err != nil {
 			log.Panic(err)
 		}
+		_, err = tx.CreateBucket([]byte(bodiesBucket))
+		if err != nil {
+			log.Panic(err)
+		}
 
 		// Store the genesis block
-		err = b.Put(genesis.Hash, genesis.Serialize())
+		err = putBlock(tx, genesis)
+		if err != nil {
+			log.Panic(err)
+		}
+		err = storeChainWork(tx, genesis)
 		if err != nil {
 			log.Panic(err)
 		}
@@ -285,7 +546,24 @@ func CreateBlockchain(address string) *Blockchain {
 		if err != nil {
 			log.Panic(err)
 		}
-		tip = genesis.Hash
+
+		// Create the UTXO set with the genesis reward
+		err = connectBlock(tx, genesis)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		// Record which chain this database belongs to and its parameters. A
+		// node joining the chain hashes with the algorithm of its genesis.
+		powHasher = blockHasher(genesis)
+		err = storeFingerprint(tx, genesis.Hash)
+		if err != nil {
+			log.Panic(err)
+		}
+		err = storeParams(tx)
+		if err != nil {
+			log.Panic(err)
+		}
 
 		return nil
 	})
@@ -293,6 +571,6 @@ func CreateBlockchain(address string) *Blockchain {
 		log.Panic(err)
 	}
 
-	bc := Blockchain{tip, db}
+	bc := Blockchain{genesis.Hash, db}
 	return &bc
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// BlockStats holds per-block statistics, named after the fields of bitcoind's
+// getblockstats call. The coinbase transaction is excluded from all fee, size,
+// input and total_out statistics, as in bitcoind.
+// Fee rates are expressed in coins per 1000 bytes of serialized transaction.
+type BlockStats struct {
+	AvgFee             int    `json:"avgfee"`              // Average fee per transaction
+	AvgFeeRate         int    `json:"avgfeerate"`          // Average fee rate
+	AvgTxSize          int    `json:"avgtxsize"`           // Average serialized transaction size
+	BlockHash          string `json:"blockhash"`           // Hash of the block
+	FeeRatePercentiles [5]int `json:"feerate_percentiles"` // Fee rates at the 10th, 25th, 50th, 75th and 90th percentile
+	Height             int    `json:"height"`              // Height of the block
+	Ins                int    `json:"ins"`                 // Number of inputs
+	MaxFee             int    `json:"maxfee"`              // Highest fee of a transaction
+	MaxFeeRate         int    `json:"maxfeerate"`          // Highest fee rate of a transaction
+	MaxTxSize          int    `json:"maxtxsize"`           // Largest transaction size
+	MedianFee          int    `json:"medianfee"`           // Median fee
+	MedianTxSize       int    `json:"mediantxsize"`        // Median transaction size
+	MinFee             int    `json:"minfee"`              // Lowest fee of a transaction
+	MinFeeRate         int    `json:"minfeerate"`          // Lowest fee rate of a transaction
+	MinTxSize          int    `json:"mintxsize"`           // Smallest transaction size
+	Outs               int    `json:"outs"`                // Number of outputs, including the coinbase's
+	Subsidy            int    `json:"subsidy"`             // The reward paid by the coinbase transaction beyond the fees, 0 if the block has none
+	Time               int64  `json:"time"`                // Block timestamp
+	TotalOut           int    `json:"total_out"`           // Total value of all outputs
+	TotalSize          int    `json:"total_size"`          // Total size of all transactions
+	TotalWeight        int    `json:"total_weight"`        // Total weight of all transactions
+	TotalFee           int    `json:"totalfee"`            // Sum of all fees
+	Txs                int    `json:"txs"`                 // Number of transactions, including the coinbase
+	UTXOIncrease       int    `json:"utxo_increase"`       // Outputs added to the UTXO set minus outputs spent, data carriers never being added
+	Weight             int    `json:"weight"`              // Weight of the block
+}
+
+// witnessScaleFactor converts sizes into weight units. There's no segregated
+// witness data on this chain, so weight is always four times the size.
+const witnessScaleFactor = 4
+
+// GetBlockStats computes the statistics of the block at a given height.
+// The genesis block has height 0.
+// Parameters:
+//   - height: Height of the block
+//
+// Returns:
+//   - *BlockStats: Statistics of the block
+func (bc *Blockchain) GetBlockStats(height int) (*BlockStats, error) {
+	hash, err := bc.GetBlockHash(height)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := bc.GetBlock(hash)
+	if err != nil {
+		return nil, err
+	}
+	if block.IsPruned() {
+		return nil, fmt.Errorf("block %x: %w", block.Hash, errPrunedData)
+	}
+
+	// Transactions created in this block, for transactions spending them in the same block
+	created := make(map[string]*Transaction)
+
+	stats := BlockStats{
+		BlockHash: hex.EncodeToString(block.Hash),
+		Height:    height,
+		Time:      block.Timestamp,
+		Txs:       len(block.Transactions),
+		Weight:    len(block.Serialize()) * witnessScaleFactor,
+	}
+
+	var fees, feeRates, sizes []int
+	unspendable := 0
+	for _, tx := range block.Transactions {
+		stats.Outs += len(tx.Vout)
+		for _, vout := range tx.Vout {
+			if vout.IsDataCarrier() {
+				unspendable++
+			}
+		}
+
+		created[hex.EncodeToString(tx.ID)] = tx
+
+		if tx.IsCoinbase() {
+			for _, vout := range tx.Vout {
+				stats.Subsidy += vout.Value
+			}
+			continue
+		}
+
+		in := 0
+		for _, vin := range tx.Vin {
+			prevTx, ok := created[hex.EncodeToString(vin.Txid)]
+			if !ok {
+				found, err := bc.FindTransaction(vin.Txid)
+				if err != nil {
+					return nil, err
+				}
+				prevTx = &found
+			}
+
+			if vin.Vout >= len(prevTx.Vout) {
+				return nil, fmt.Errorf("transaction %x spends unknown output %x:%d", tx.ID, vin.Txid, vin.Vout)
+			}
+			in += prevTx.Vout[vin.Vout].Value
+		}
+
+		out := 0
+		for _, vout := range tx.Vout {
+			out += vout.Value
+		}
+
+		size := len(tx.Serialize())
+		fee := in - out
+
+		stats.Ins += len(tx.Vin)
+		stats.TotalOut += out
+		stats.TotalSize += size
+		stats.TotalFee += fee
+
+		fees = append(fees, fee)
+		feeRates = append(feeRates, fee*1000/size)
+		sizes = append(sizes, size)
+	}
+
+	// The coinbase collects the fees on top of the subsidy
+	stats.Subsidy = max(stats.Subsidy-stats.TotalFee, 0)
+	stats.TotalWeight = stats.TotalSize * witnessScaleFactor
+	// Data-carrier outputs can't be spent and stay out of the UTXO set, see updateUTXOSet
+	stats.UTXOIncrease = stats.Outs - unspendable - stats.Ins
+
+	if len(fees) > 0 {
+		sort.Ints(fees)
+		sort.Ints(feeRates)
+		sort.Ints(sizes)
+
+		stats.AvgFee = stats.TotalFee / len(fees)
+		stats.AvgFeeRate = stats.TotalFee * 1000 / stats.TotalSize
+		stats.AvgTxSize = stats.TotalSize / len(sizes)
+		stats.MinFee, stats.MedianFee, stats.MaxFee = fees[0], median(fees), fees[len(fees)-1]
+		stats.MinFeeRate, stats.MaxFeeRate = feeRates[0], feeRates[len(feeRates)-1]
+		stats.MinTxSize, stats.MedianTxSize, stats.MaxTxSize = sizes[0], median(sizes), sizes[len(sizes)-1]
+
+		for i, percentile := range []int{10, 25, 50, 75, 90} {
+			stats.FeeRatePercentiles[i] = feeRates[(len(feeRates)-1)*percentile/100]
+		}
+	}
+
+	return &stats, nil
+}
+
+// median returns the median of a sorted, non-empty slice
+func median(sorted []int) int {
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+
+	return sorted[middle]
+}
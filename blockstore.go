@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log"
+)
+
+// bodiesBucket holds the transactions of the blocks, keyed by block hash like
+// their headers in blocksBucket
+const bodiesBucket = "bodies"
+
+// Blocks are stored in two parts. blocksBucket holds the headers: the blocks
+// without their transactions but with the Merkle root of them (see
+// Block.MerkleRoot), so their proof of work can be checked on their own.
+// bodiesBucket holds the transactions. Walking the chain for the fork choice,
+// the difficulty, the deployments or the chain tips only decodes the small
+// headers, archiving compresses only the bodies and pruning deletes them.
+// getBlock puts the two back together. Databases that stored whole blocks in
+// blocksBucket are split once when opened, see splitBlocks.
+
+// putBlock stores the header and the body of a block
+// Parameters:
+//   - tx: The database transaction
+//   - block: The block, with its transactions
+func putBlock(tx StoreTx, block *Block) error {
+	header := *block
+	header.Transactions = nil
+	header.MerkleRoot = block.HashTransactions()
+
+	err := tx.Bucket([]byte(blocksBucket)).Put(block.Hash, header.Serialize())
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket([]byte(bodiesBucket)).Put(block.Hash, serializeBody(block.Transactions))
+}
+
+// getBlock reads a block with its transactions. A pruned block has none, only
+// its header is returned.
+// Parameters:
+//   - tx: The database transaction
+//   - hash: Hash of the block
+//
+// Returns:
+//   - *Block: The block, nil if it isn't stored
+func getBlock(tx StoreTx, hash []byte) *Block {
+	data := tx.Bucket([]byte(blocksBucket)).Get(hash)
+	if data == nil {
+		return nil
+	}
+	block := DeserializeBlock(data)
+
+	body := tx.Bucket([]byte(bodiesBucket)).Get(hash)
+	if body == nil {
+		return block
+	}
+
+	transactions, err := cachedTransactions(hash, body)
+	if err != nil {
+		log.Panic(err)
+	}
+	block.Transactions = transactions
+	block.MerkleRoot = nil
+
+	return block
+}
+
+// serializeBody encodes the transactions of a block for bodiesBucket
+func serializeBody(transactions []*Transaction) []byte {
+	var result bytes.Buffer
+
+	err := gob.NewEncoder(&result).Encode(transactions)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return result.Bytes()
+}
+
+// decodeBody decodes the transactions of a block stored in bodiesBucket,
+// decompressing them if they were archived
+func decodeBody(data []byte) ([]*Transaction, error) {
+	var transactions []*Transaction
+
+	data, err := decompressBlock(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&transactions)
+	if err != nil {
+		return nil, err
+	}
+
+	return transactions, nil
+}
+
+// splitBlocks moves the transactions of the whole blocks stored by older
+// versions in blocksBucket to bodiesBucket, leaving the headers. Archived
+// blocks keep their body compressed and pruned blocks get no body.
+// Parameters:
+//   - tx: The database transaction opening the chain
+func splitBlocks(tx StoreTx) error {
+	bodies, err := tx.CreateBucket([]byte(bodiesBucket))
+	if err != nil {
+		return err
+	}
+	blocks := tx.Bucket([]byte(blocksBucket))
+
+	// The bucket can't be written while iterating it
+	var hashes [][]byte
+	err = blocks.ForEach(func(k, v []byte) error {
+		if !bytes.Equal(k, []byte("l")) {
+			hashes = append(hashes, bytes.Clone(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		data := blocks.Get(hash)
+		archived := data[0] == compressedBlockMarker
+		plain, err := decompressBlock(data)
+		if err != nil {
+			return fmt.Errorf("block %x: %w", hash, err)
+		}
+
+		block := DeserializeBlock(plain)
+
+		// Pruned blocks kept the Merkle root of their discarded transactions
+		// under another name
+		var pruned struct {
+			Hash             []byte
+			PrunedMerkleRoot []byte
+		}
+		err = gob.NewDecoder(bytes.NewReader(plain)).Decode(&pruned)
+		if err != nil {
+			return fmt.Errorf("block %x: %w", hash, err)
+		}
+
+		block.MerkleRoot = pruned.PrunedMerkleRoot
+		if block.MerkleRoot == nil {
+			body := serializeBody(block.Transactions)
+			if archived {
+				body = compressBlock(body)
+			}
+			err = bodies.Put(hash, body)
+			if err != nil {
+				return err
+			}
+			block.MerkleRoot = block.HashTransactions()
+		}
+		block.Transactions = nil
+
+		err = blocks.Put(hash, block.Serialize())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// External miners get the block to mine from getblocktemplate and hand the
+// solved block back with submitblock, like bitcoind's getblocktemplate
+// mining. The proof-of-work hash is the hash of the header data with the
+// chain's algorithm, powalgorithm, SHA-256 by default (see powhash.go):
+//
+//	previousblockhash || merkleroot || curtime || bits || nonce || version
+//
+// with the integers as 8-byte big-endian values. A miner running out of
+// nonces can move the timestamp forward, up to maxFutureBlockTime ahead of
+// the clock, or append an extranonce to the ScriptSig of the coinbase, which
+// changes its ID and so the Merkle root.
+
+// errDuplicateBlock is returned for a submitted block the chain already has
+var errDuplicateBlock = errors.New("duplicate")
+
+// BlockTemplate is the next block of the active chain for an external miner,
+// in the JSON format of getblocktemplate
+type BlockTemplate struct {
+	Version           int32                 `json:"version"`           // Version bits to set
+	PreviousBlockHash string                `json:"previousblockhash"` // Hex hash of the tip the block extends
+	Height            int                   `json:"height"`            // Height of the block
+	Bits              string                `json:"bits"`              // Hex proof-of-work target in compact form
+	PowAlgorithm      string                `json:"powalgorithm"`      // Hash function of the proof of work
+	Target            string                `json:"target"`            // Hex target the block hash must not exceed
+	CurTime           int64                 `json:"curtime"`           // Timestamp to use
+	MinTime           int64                 `json:"mintime"`           // Earliest valid timestamp, after the median time past
+	SizeLimit         int                   `json:"sizelimit"`         // Largest serialized size of the block
+	CoinbaseValue     int                   `json:"coinbasevalue"`     // Reward the coinbase may pay, the subsidy plus the fees
+	CoinbaseTxn       TemplateCoinbase      `json:"coinbasetxn"`       // The coinbase transaction
+	Transactions      []TemplateTransaction `json:"transactions"`      // The mempool transactions to include after the coinbase
+	MerkleRoot        string                `json:"merkleroot"`        // Hex Merkle root of the coinbase and the transactions
+}
+
+// TemplateTransaction is a transaction of a block template
+type TemplateTransaction struct {
+	Data string `json:"data"` // Hex encoding of the transaction, the Transaction message of protocol.proto
+	Txid string `json:"txid"` // Hex ID of the transaction
+}
+
+// TemplateCoinbase is the coinbase of a block template, paying the reward to
+// the address the template was asked for
+type TemplateCoinbase struct {
+	TemplateTransaction
+	ScriptSig string `json:"scriptsig"` // Coinbase data, an extranonce may be appended to it
+	Value     int    `json:"value"`     // Reward paid
+	Address   string `json:"address"`   // Address the reward is paid to
+}
+
+// newTemplateTransaction converts a transaction to the template format
+func newTemplateTransaction(tx *Transaction) TemplateTransaction {
+	return TemplateTransaction{hex.EncodeToString(marshalTransaction(tx)), hex.EncodeToString(tx.ID)}
+}
+
+// GetBlockTemplate assembles the next block of the active chain for an
+// external miner: the mempool transactions with the highest fee rates that
+// fit, after a coinbase paying the reward and their fees to an address
+// Parameters:
+//   - address: The address the reward is paid to
+func (bc *Blockchain) GetBlockTemplate(address string) BlockTemplate {
+	txs := Mempool{bc}.AssembleBlock(address)
+	reward := txs[0]
+	block := bc.blockTemplate(txs)
+
+	// A coinbase paying nothing has no outputs
+	value := 0
+	if len(reward.Vout) > 0 {
+		value = reward.Vout[0].Value
+	}
+
+	var mtp int64
+	err := bc.db.View(func(tx StoreTx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+
+		var err error
+		mtp, err = medianTimePast(tx, DeserializeBlock(b.Get(block.PrevBlockHash)))
+		return err
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	template := BlockTemplate{
+		Version:           block.Version,
+		PreviousBlockHash: hex.EncodeToString(block.PrevBlockHash),
+		Height:            block.Height,
+		Bits:              fmt.Sprintf("%08x", block.Bits),
+		PowAlgorithm:      powHasher.Name(),
+		Target:            fmt.Sprintf("%064x", block.Target()),
+		CurTime:           block.Timestamp,
+		MinTime:           mtp + 1,
+		SizeLimit:         maxBlockSize,
+		CoinbaseValue:     value,
+		CoinbaseTxn: TemplateCoinbase{
+			TemplateTransaction: newTemplateTransaction(reward),
+			ScriptSig:           reward.Vin[0].ScriptSig,
+			Value:               value,
+			Address:             address,
+		},
+		Transactions: []TemplateTransaction{},
+		MerkleRoot:   hex.EncodeToString(block.HashTransactions()),
+	}
+	for _, tx := range txs[1:] {
+		template.Transactions = append(template.Transactions, newTemplateTransaction(tx))
+	}
+
+	return template
+}
+
+// SubmitBlock adds a block mined by an external miner to the chain, with the
+// checks of a block received from a peer
+// Parameters:
+//   - block: The block
+//
+// Returns:
+//   - error: errDuplicateBlock if the chain already has it
+func (bc *Blockchain) SubmitBlock(block *Block) error {
+	if !bc.hasBlock(block.PrevBlockHash) {
+		return fmt.Errorf("parent %x of block %x not found", block.PrevBlockHash, block.Hash)
+	}
+
+	added, err := bc.AddBlock(block)
+	if err != nil {
+		return err
+	}
+	if !added {
+		return errDuplicateBlock
+	}
+
+	return nil
+}
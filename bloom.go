@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"math"
+)
+
+// Bloom filter limits, the same as BIP 37 uses so a peer can't make a node
+// spend unbounded memory or CPU on a filter
+const (
+	maxBloomFilterSize = 36000 // Maximum filter size in bytes
+	maxBloomHashFuncs  = 50    // Maximum number of hash functions
+	maxBloomElement    = 520   // Maximum size of an element added with filteradd
+)
+
+// A light client doesn't keep the chain, it loads a Bloom filter of its
+// addresses into a full node with filterload, like BIP 37. From then on the
+// node only relays it the transactions matching the filter, and answers its
+// getdata for blocks with merkleblock messages: the header, and the matching
+// transactions with the Merkle branches proving they're in the block, so the
+// client only has to trust the headers. Outputs of matching transactions are
+// added to the filter as they match, so the transactions spending them match
+// too. filteradd adds an element, such as a new address, to the loaded filter
+// and filterclear drops it, going back to relaying everything.
+
+// Bloom filter false positive rates. A light client reveals its addresses to
+// the node it loads a filter into, so the rate shouldn't be tuned too low:
+// false positives are what hide the client's own transactions among others.
+const (
+	defaultBloomFalsePositiveRate = 0.01   // Rate used when a client doesn't pick one
+	minBloomFalsePositiveRate     = 0.0001 // Lower rates identify the client's addresses too easily
+)
+
+// BloomFilter is a probabilistic set of addresses, transaction IDs and
+// outpoints a light client is interested in. Testing for membership never
+// gives false negatives, but gives false positives at a tunable rate.
+type BloomFilter struct {
+	Filter    []byte // The bit field
+	HashFuncs int    // Number of hash functions
+	Tweak     uint32 // Random value mixed into the hashes, so filters of different clients differ
+}
+
+// NewBloomFilter creates an empty filter sized for an expected number of
+// elements and a false positive rate, with a random tweak
+// Parameters:
+//   - elements: Expected number of elements
+//   - fpRate: Acceptable false positive rate, clamped to minBloomFalsePositiveRate
+//
+// Returns:
+//   - *BloomFilter: The empty filter
+func NewBloomFilter(elements int, fpRate float64) *BloomFilter {
+	if elements < 1 {
+		elements = 1
+	}
+	if fpRate <= 0 {
+		fpRate = defaultBloomFalsePositiveRate
+	}
+	fpRate = math.Max(fpRate, minBloomFalsePositiveRate)
+
+	// Optimal sizes for n elements and false positive rate p:
+	// m = -n*ln(p) / ln(2)^2 bits and k = m/n * ln(2) hash functions
+	size := int(-float64(elements) * math.Log(fpRate) / (math.Ln2 * math.Ln2) / 8)
+	size = min(max(size, 1), maxBloomFilterSize)
+
+	hashFuncs := int(float64(size*8) / float64(elements) * math.Ln2)
+	hashFuncs = min(max(hashFuncs, 1), maxBloomHashFuncs)
+
+	var tweak [4]byte
+	_, err := rand.Read(tweak[:])
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return &BloomFilter{
+		Filter:    make([]byte, size),
+		HashFuncs: hashFuncs,
+		Tweak:     binary.BigEndian.Uint32(tweak[:]),
+	}
+}
+
+// bitIndexes returns the bits of the filter set for an element, derived from a
+// single SHA-256 hash by double hashing
+func (f *BloomFilter) bitIndexes(data []byte) []uint64 {
+	hash := sha256.Sum256(append(binary.BigEndian.AppendUint32(nil, f.Tweak), data...))
+	h1 := binary.BigEndian.Uint64(hash[0:8])
+	h2 := binary.BigEndian.Uint64(hash[8:16])
+	bits := uint64(len(f.Filter) * 8)
+
+	indexes := make([]uint64, f.HashFuncs)
+	for i := range indexes {
+		indexes[i] = (h1 + uint64(i)*h2) % bits
+	}
+
+	return indexes
+}
+
+// Add inserts an element into the filter
+func (f *BloomFilter) Add(data []byte) {
+	if len(f.Filter) == 0 {
+		return
+	}
+
+	for _, idx := range f.bitIndexes(data) {
+		f.Filter[idx/8] |= 1 << (idx % 8)
+	}
+}
+
+// Contains checks whether an element may have been added to the filter
+func (f *BloomFilter) Contains(data []byte) bool {
+	if len(f.Filter) == 0 {
+		return false
+	}
+
+	for _, idx := range f.bitIndexes(data) {
+		if f.Filter[idx/8]&(1<<(idx%8)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// MatchesTransaction checks whether a transaction is relevant to the filter: its
+// ID, an address it pays or an outpoint or address it spends is in the filter.
+// Like BIP 37 with BLOOM_UPDATE_ALL, the outpoints of matching outputs are added
+// to the filter, so later transactions spending them match as well.
+// Parameters:
+//   - tx: The transaction to test
+//
+// Returns:
+//   - bool: true if the transaction should be relayed to the filter's owner
+func (f *BloomFilter) MatchesTransaction(tx *Transaction) bool {
+	matched := f.Contains(tx.ID)
+
+	txID := hex.EncodeToString(tx.ID)
+	for outIdx, out := range tx.Vout {
+		if f.Contains([]byte(out.ScriptPubKey)) {
+			matched = true
+			f.Add([]byte(outpointKey(txID, outIdx)))
+		}
+	}
+	if matched || tx.IsCoinbase() {
+		return matched
+	}
+
+	for _, in := range tx.Vin {
+		if f.Contains([]byte(outpointKey(hex.EncodeToString(in.Txid), in.Vout))) || f.Contains([]byte(in.ScriptSig)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterAdd is the payload of filteradd
+type filterAdd struct {
+	Data []byte // Element to add to the loaded filter
+}
+
+// filteredTx is a transaction of a merkleBlock with its Merkle branch
+type filteredTx struct {
+	Tx    *Transaction
+	Proof MerkleProof
+}
+
+// merkleBlock is a block as sent to a peer that loaded a filter
+type merkleBlock struct {
+	Header     *Block       // The block without its transactions
+	MerkleRoot []byte       // Merkle root of its transactions
+	Matches    []filteredTx // Its transactions matching the filter, in order
+}
+
+// validate checks that a filter loaded by a peer is within the limits
+func (f *BloomFilter) validate() error {
+	switch {
+	case len(f.Filter) == 0 || len(f.Filter) > maxBloomFilterSize:
+		return fmt.Errorf("filter of %d bytes, must be between 1 and %d", len(f.Filter), maxBloomFilterSize)
+	case f.HashFuncs < 1 || f.HashFuncs > maxBloomHashFuncs:
+		return fmt.Errorf("filter with %d hash functions, must be between 1 and %d", f.HashFuncs, maxBloomHashFuncs)
+	}
+
+	return nil
+}
+
+// hasFilter checks whether the peer loaded a filter
+func (p *peer) hasFilter() bool {
+	p.filterMu.Lock()
+	defer p.filterMu.Unlock()
+
+	return p.filter != nil
+}
+
+// matchesFilter checks whether a transaction is relayed to the peer: all of
+// them without a filter, otherwise the ones matching it
+func (p *peer) matchesFilter(tx *Transaction) bool {
+	p.filterMu.Lock()
+	defer p.filterMu.Unlock()
+
+	return p.filter == nil || p.filter.MatchesTransaction(tx)
+}
+
+// handleFilterLoad replaces the filter of a peer
+func (s *Server) handleFilterLoad(p *peer, payload []byte) error {
+	var filter BloomFilter
+	err := decodePayload(payload, &filter)
+	if err != nil {
+		return err
+	}
+	err = filter.validate()
+	if err != nil {
+		return err
+	}
+
+	p.filterMu.Lock()
+	p.filter = &filter
+	p.filterMu.Unlock()
+
+	slog.Info("Filter loaded", "peer", p.addr, "size", len(filter.Filter), "hashfuncs", filter.HashFuncs)
+	return nil
+}
+
+// handleFilterAdd adds an element to the filter of a peer
+func (s *Server) handleFilterAdd(p *peer, payload []byte) error {
+	var add filterAdd
+	err := decodePayload(payload, &add)
+	if err != nil {
+		return err
+	}
+	if len(add.Data) > maxBloomElement {
+		return fmt.Errorf("filteradd element of %d bytes, more than %d", len(add.Data), maxBloomElement)
+	}
+
+	p.filterMu.Lock()
+	defer p.filterMu.Unlock()
+
+	if p.filter == nil {
+		return errors.New("filteradd without a loaded filter")
+	}
+	p.filter.Add(add.Data)
+
+	return nil
+}
+
+// handleFilterClear drops the filter of a peer
+func (s *Server) handleFilterClear(p *peer) error {
+	p.filterMu.Lock()
+	p.filter = nil
+	p.filterMu.Unlock()
+
+	return nil
+}
+
+// sendMerkleBlock sends a block to a peer that loaded a filter, with only
+// its transactions matching the filter
+// Parameters:
+//   - p: The peer
+//   - block: The block, with its transactions
+func sendMerkleBlock(p *peer, block *Block) error {
+	header := *block
+	header.Transactions = nil
+	mb := merkleBlock{Header: &header, MerkleRoot: block.HashTransactions()}
+
+	for _, tx := range block.Transactions {
+		if !p.matchesFilter(tx) {
+			continue
+		}
+
+		proof, err := block.MerkleProof(tx.ID)
+		if err != nil {
+			return err
+		}
+		mb.Matches = append(mb.Matches, filteredTx{tx, *proof})
+	}
+
+	return p.send(cmdMerkleBlock, encodePayload(mb))
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// boltOpenTimeout is how long opening a BoltDB file waits for another
+// process holding it to release it
+const boltOpenTimeout = time.Second
+
+// errDatabaseInUse is returned when another process, like a running node,
+// holds the database open
+var errDatabaseInUse = errors.New("is in use by another process, like a running node")
+
+// boltStore is a Store kept in a BoltDB file
+type boltStore struct {
+	db *bolt.DB
+}
+
+// openBoltStore opens the BoltDB file at a path, creating it if it doesn't
+// exist. The file is locked until the store is closed, and a file another
+// process holds gives errDatabaseInUse instead of waiting for it.
+func openBoltStore(path string) (Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("%s %w", path, errDatabaseInUse)
+	}
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("Opened the database", "file", path)
+
+	return boltStore{db}, nil
+}
+
+func (s boltStore) View(fn func(tx StoreTx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error { return fn(boltTx{tx}) })
+}
+
+func (s boltStore) Update(fn func(tx StoreTx) error) error {
+	started := time.Now()
+	err := s.db.Update(func(tx *bolt.Tx) error { return fn(boltTx{tx}) })
+	slog.Debug("Updated the database", "duration", time.Since(started), "committed", err == nil)
+
+	return err
+}
+
+func (s boltStore) Backup(w io.Writer) error {
+	// The copy is the state seen by one read transaction
+	return s.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+func (s boltStore) Close() error {
+	slog.Debug("Closing the database", "file", s.db.Path())
+	return s.db.Close()
+}
+
+// boltFileInUse checks whether another process, like a running node, holds
+// the BoltDB file at a path open
+func boltFileInUse(path string) bool {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout, ReadOnly: true})
+	if err != nil {
+		return err == bolt.ErrTimeout
+	}
+
+	db.Close()
+	return false
+}
+
+// boltTx is a StoreTx of a boltStore
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) Bucket(name []byte) StoreBucket {
+	// A nil *bolt.Bucket must be a nil StoreBucket, not one wrapping nil
+	b := t.tx.Bucket(name)
+	if b == nil {
+		return nil
+	}
+
+	return boltBucket{b}
+}
+
+func (t boltTx) CreateBucket(name []byte) (StoreBucket, error) {
+	b, err := t.tx.CreateBucket(name)
+	if err == bolt.ErrBucketExists {
+		return nil, errBucketExists
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return boltBucket{b}, nil
+}
+
+func (t boltTx) CreateBucketIfNotExists(name []byte) (StoreBucket, error) {
+	b, err := t.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return boltBucket{b}, nil
+}
+
+func (t boltTx) DeleteBucket(name []byte) error {
+	err := t.tx.DeleteBucket(name)
+	if err == bolt.ErrBucketNotFound {
+		return errBucketNotFound
+	}
+
+	return err
+}
+
+// boltBucket is a StoreBucket of a boltStore
+type boltBucket struct {
+	b *bolt.Bucket
+}
+
+func (b boltBucket) Get(key []byte) []byte {
+	return b.b.Get(key)
+}
+
+func (b boltBucket) Put(key, value []byte) error {
+	return b.b.Put(key, value)
+}
+
+func (b boltBucket) Delete(key []byte) error {
+	return b.b.Delete(key)
+}
+
+func (b boltBucket) Cursor() StoreCursor {
+	return b.b.Cursor()
+}
+
+func (b boltBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.b.ForEach(fn)
+}
+
+func (b boltBucket) KeyCount() int {
+	return b.b.Stats().KeyN
+}
@@ -0,0 +1,798 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// chaintest is a system-level regression suite: it runs real node
+// processes of this binary on regtest, each with a data directory of its
+// own, and drives them over JSON-RPC through what users do with a chain:
+// creating it, mining with getblocktemplate and submitblock, sending from
+// the wallets of two nodes, restarting a node and reorganizing two chains
+// that grew apart, checking the state the nodes agree on after each step.
+// Pointed at running nodes with -rpc instead, it only runs the steps that
+// leave them running and their chain valid on any network: agreeing on the
+// chain, and optionally sending and mining.
+
+// chainTestPollInterval is how often chaintest polls the nodes while waiting
+// for them to reach a state
+const chainTestPollInterval = 200 * time.Millisecond
+
+// chainTestNetwork is the network of the nodes chaintest starts, whose blocks
+// take no time to mine
+const chainTestNetwork = "regtest"
+
+// ChainTestOptions configure a chaintest run
+type ChainTestOptions struct {
+	RPC     []string      // JSON-RPC URLs of running nodes to test, none to start nodes
+	From    string        // With RPC, the address to send a coin from through the first node, empty to send nothing
+	To      string        // With RPC, the address receiving the coin, From by default
+	Mine    string        // With RPC, the address to mine a block to through the first node, empty to mine nothing
+	Timeout time.Duration // How long to wait for the nodes to reach a state
+	Keep    bool          // Keep the data directories of the started nodes
+}
+
+// chainTestNode is a node tested by chaintest
+type chainTestNode struct {
+	name     string        // Name in the output
+	url      string        // URL of its JSON-RPC server
+	dir      string        // Data directory, for started nodes
+	port     int           // P2P port, for started nodes
+	httpAddr string        // Address of its HTTP API, for started nodes
+	process  *os.Process   // The running process, nil while it's stopped or for running nodes
+	exited   chan struct{} // Closed once the running process exited
+}
+
+// chainTest runs the steps of chaintest
+type chainTest struct {
+	options ChainTestOptions
+	binary  string       // The executable started for the nodes
+	client  *http.Client // Client of the JSON-RPC servers
+}
+
+// RunChainTest runs the chain test, printing each step as it passes
+// Parameters:
+//   - options: The nodes to test and how
+//
+// Returns:
+//   - error: Why the first failing step failed
+func RunChainTest(options ChainTestOptions) error {
+	t := &chainTest{options: options, client: &http.Client{Timeout: 10 * time.Second}}
+	if len(options.RPC) > 0 {
+		return t.runRemote()
+	}
+
+	binary, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	t.binary = binary
+
+	root, err := os.MkdirTemp("", "chaintest")
+	if err != nil {
+		return err
+	}
+	nodes := make([]*chainTestNode, 2)
+	for i := range nodes {
+		nodes[i], err = t.newNode(root, fmt.Sprintf("node%d", i))
+		if err != nil {
+			return err
+		}
+	}
+	defer func() {
+		for _, node := range nodes {
+			t.stop(node)
+		}
+		if options.Keep || err != nil {
+			fmt.Printf("Data directories and node logs kept in %s\n", root)
+			return
+		}
+		os.RemoveAll(root)
+	}()
+
+	err = t.runLocal(nodes[0], nodes[1])
+	return err
+}
+
+// runLocal runs the steps on two started nodes. The balances checked are
+// those of addresses that only receive, the same on every node whatever
+// change addresses their wallets know.
+func (t *chainTest) runLocal(a, b *chainTestNode) error {
+	var spent string // A transaction the reorg disconnects
+	carol := 0       // Rewards of the blocks mined to carol, who only receives them
+
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"create the chain and the wallet of the first node", func() error {
+			err := t.command(a, "createblockchain", "-address", "alice")
+			if err == nil {
+				err = t.start(a)
+			}
+			return err
+		}},
+		{"download the chain to the second node", func() error {
+			err := t.start(b, a)
+			if err != nil {
+				return err
+			}
+			return t.waitSynced(a, b)
+		}},
+		{"mine blocks with getblocktemplate and submitblock", func() error {
+			_, err := t.mineBlocks(a, "alice", 2)
+			if err != nil {
+				return err
+			}
+			return t.waitHeight(2, a, b)
+		}},
+		{"send coins and mine them on the other node", func() error {
+			txID, err := t.send(a, "bob", 4, "alice", 1)
+			if err != nil {
+				return err
+			}
+			err = t.waitInMempool(txID, a, b)
+			if err != nil {
+				return err
+			}
+			// The reward of carol's block collects the fee
+			reward, err := t.mineBlocks(b, "carol", 1)
+			if err != nil {
+				return err
+			}
+			carol += reward
+			err = t.waitSynced(a, b)
+			if err != nil {
+				return err
+			}
+			err = t.waitBalance("carol", carol, a, b)
+			if err != nil {
+				return err
+			}
+			return t.waitBalance("bob", 4, a, b)
+		}},
+		{"send from the wallet of the second node", func() error {
+			txID, err := t.send(b, "dave", 2, "bob", 0)
+			if err != nil {
+				return err
+			}
+			err = t.waitInMempool(txID, a)
+			if err != nil {
+				return err
+			}
+			_, err = t.mineBlocks(a, "alice", 1)
+			if err != nil {
+				return err
+			}
+			err = t.waitBalance("dave", 2, a, b)
+			if err != nil {
+				return err
+			}
+			// Only the wallet of the second node knows the change of bob
+			return t.waitBalance("bob", 2, b)
+		}},
+		{"restart the second node and catch up", func() error {
+			t.stop(b)
+			_, err := t.mineBlocks(a, "alice", 1)
+			if err != nil {
+				return err
+			}
+			err = t.start(b, a)
+			if err != nil {
+				return err
+			}
+			err = t.waitSynced(a, b)
+			if err != nil {
+				return err
+			}
+			return t.waitBalance("dave", 2, b)
+		}},
+		{"reorganize onto the chain with more work", func() error {
+			// Apart, without the peers they remember, the chains grow apart
+			t.stop(a)
+			t.stop(b)
+			for _, node := range []*chainTestNode{a, b} {
+				err := t.forgetPeers(node)
+				if err != nil {
+					return err
+				}
+			}
+			err := t.start(a)
+			if err == nil {
+				err = t.start(b)
+			}
+			if err != nil {
+				return err
+			}
+
+			spent, err = t.send(a, "erin", 3, "alice", 1)
+			if err != nil {
+				return err
+			}
+			_, err = t.mineBlocks(a, "alice", 1)
+			if err != nil {
+				return err
+			}
+			err = t.waitBalance("erin", 3, a)
+			if err != nil {
+				return err
+			}
+			reward, err := t.mineBlocks(b, "carol", 2)
+			if err != nil {
+				return err
+			}
+			carol += reward
+
+			t.stop(a)
+			err = t.start(a, b)
+			if err != nil {
+				return err
+			}
+			err = t.waitSynced(a, b)
+			if err != nil {
+				return err
+			}
+
+			// The disconnected payment waits in the mempool again
+			err = t.waitBalance("erin", 0, a, b)
+			if err != nil {
+				return err
+			}
+			return t.waitInMempool(spent, a)
+		}},
+		{"mine the payment the reorg disconnected", func() error {
+			_, err := t.mineBlocks(a, "alice", 1)
+			if err != nil {
+				return err
+			}
+			return t.waitBalance("erin", 3, a, b)
+		}},
+		{"agree on the final state", func() error {
+			err := t.waitSynced(a, b)
+			if err != nil {
+				return err
+			}
+			err = t.checkBlocks(10, a, b)
+			if err != nil {
+				return err
+			}
+
+			var tips []ChainTip
+			err = t.call(a, "getchaintips", &tips)
+			if err != nil {
+				return err
+			}
+			if !slices.ContainsFunc(tips, func(tip ChainTip) bool { return tip.BranchLen > 0 }) {
+				return fmt.Errorf("%s has no tip of the branch it reorganized away from: %v", a.name, tips)
+			}
+
+			for address, balance := range map[string]int{"carol": carol, "dave": 2, "erin": 3} {
+				err = t.waitBalance(address, balance, a, b)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+	}
+
+	for _, step := range steps {
+		err := t.step(step.name, step.run)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runRemote runs the steps that leave running nodes as they were, but for
+// the coin sent and the block mined when asked to
+func (t *chainTest) runRemote() error {
+	var nodes []*chainTestNode
+	for _, url := range t.options.RPC {
+		nodes = append(nodes, &chainTestNode{name: url, url: url})
+	}
+	first := nodes[0]
+
+	err := t.step("reach every node", func() error {
+		for _, node := range nodes {
+			var height int
+			err := t.call(node, "getblockcount", &height)
+			if err != nil {
+				return fmt.Errorf("%s: %w", node.name, err)
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = t.step("agree on the chain", func() error {
+			err := t.waitSynced(nodes...)
+			if err != nil {
+				return err
+			}
+			return t.checkBlocks(10, nodes...)
+		})
+	}
+	if err == nil && t.options.From != "" {
+		err = t.step("relay a payment", func() error {
+			to := t.options.To
+			if to == "" {
+				to = t.options.From
+			}
+			txID, err := t.send(first, to, 1, t.options.From, 1)
+			if err != nil {
+				return err
+			}
+			return t.waitKnown(txID, nodes...)
+		})
+	}
+	if err == nil && t.options.Mine != "" {
+		err = t.step("mine a block and relay it", func() error {
+			var height int
+			err := t.call(first, "getblockcount", &height)
+			if err != nil {
+				return err
+			}
+			_, err = t.mineBlocks(first, t.options.Mine, 1)
+			if err != nil {
+				return err
+			}
+			return t.waitHeight(height+1, nodes...)
+		})
+	}
+
+	return err
+}
+
+// step runs a step, printing it once it passed
+func (t *chainTest) step(name string, run func() error) error {
+	started := time.Now()
+	err := run()
+	if err != nil {
+		return fmt.Errorf("step %q failed: %w", name, err)
+	}
+
+	fmt.Printf("ok   %s (%v)\n", name, time.Since(started).Round(time.Millisecond))
+	return nil
+}
+
+// newNode prepares a node to start, with a data directory and free ports
+// Parameters:
+//   - root: The directory holding the data directories
+//   - name: Name of the node, and of its data directory
+func (t *chainTest) newNode(root, name string) (*chainTestNode, error) {
+	dir := filepath.Join(root, name)
+	err := os.Mkdir(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	httpPort, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+
+	httpAddr := fmt.Sprintf("127.0.0.1:%d", httpPort)
+	return &chainTestNode{name: name, url: "http://" + httpAddr + "/", dir: dir, port: port, httpAddr: httpAddr}, nil
+}
+
+// freePort returns a TCP port of the loopback interface nothing listens on
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// nodeArgs returns the global flags of the processes of a node
+func (t *chainTest) nodeArgs(node *chainTestNode) []string {
+	return []string{"-network", chainTestNetwork, "-datadir", node.dir}
+}
+
+// chainTestEnv returns the environment of the processes of the nodes: that of
+// chaintest without the BC_ variables setting flags, see env.go, so the
+// nodes only get the flags chaintest gives them
+func chainTestEnv() []string {
+	return slices.DeleteFunc(os.Environ(), func(v string) bool { return strings.HasPrefix(v, envPrefix) })
+}
+
+// forgetPeers deletes the peers a stopped node remembers, so it only
+// connects to the peers it's started with
+func (t *chainTest) forgetPeers(node *chainTestNode) error {
+	for _, n := range networks {
+		if n.Name != chainTestNetwork {
+			continue
+		}
+
+		err := os.Remove(filepath.Join(node.dir, n.DataDir, filepath.Base(peersFile)))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+// command runs a command of this binary on the data directory of a node
+// Parameters:
+//   - node: The node, which must be stopped
+//   - args: The command and its flags
+func (t *chainTest) command(node *chainTestNode, args ...string) error {
+	cmd := exec.Command(t.binary, append(t.nodeArgs(node), args...)...)
+	cmd.Env = chainTestEnv()
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %v: %w: %s", node.name, args, err, output)
+	}
+
+	return nil
+}
+
+// start starts the process of a node, logging to node.log in its data
+// directory, and waits for its JSON-RPC server
+// Parameters:
+//   - node: The node
+//   - peers: The nodes it connects to
+func (t *chainTest) start(node *chainTestNode, peers ...*chainTestNode) error {
+	var addresses []string
+	for _, peer := range peers {
+		addresses = append(addresses, fmt.Sprintf("127.0.0.1:%d", peer.port))
+	}
+	args := append(t.nodeArgs(node), "startnode", "-port", strconv.Itoa(node.port), "-http", node.httpAddr, "-peers", strings.Join(addresses, ","))
+
+	logPath := filepath.Join(node.dir, "node.log")
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(t.binary, args...)
+	cmd.Env = chainTestEnv()
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	node.process = cmd.Process
+	node.exited = make(chan struct{})
+	go func(exited chan struct{}) {
+		cmd.Wait()
+		close(exited)
+	}(node.exited)
+
+	return t.waitFor(node.name+" to answer", func() (bool, error) {
+		select {
+		case <-node.exited:
+			return false, fmt.Errorf("%s exited, see %s", node.name, logPath)
+		default:
+		}
+
+		var height int
+		return t.call(node, "getblockcount", &height) == nil, nil
+	}, node.exited)
+}
+
+// stop stops the process of a node, letting it close its database, and
+// kills it if it doesn't exit in time
+func (t *chainTest) stop(node *chainTestNode) {
+	if node.process == nil {
+		return
+	}
+
+	err := node.process.Signal(syscall.SIGTERM)
+	if err != nil {
+		node.process.Kill()
+	}
+	select {
+	case <-node.exited:
+	case <-time.After(t.options.Timeout):
+		node.process.Kill()
+		<-node.exited
+	}
+	node.process = nil
+}
+
+// call calls a JSON-RPC method of a node
+// Parameters:
+//   - node: The node
+//   - method: The method
+//   - result: Decodes the result, nil to ignore it
+//   - params: The positional params
+func (t *chainTest) call(node *chainTestNode, method string, result any, params ...any) error {
+	if params == nil {
+		params = []any{}
+	}
+	encodedParams, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(rpcRequest{"2.0", method, encodedParams, json.RawMessage("1")})
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(node.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var response rpcResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return fmt.Errorf("%s: %s: %w", node.name, method, err)
+	}
+	if response.Error != nil {
+		return fmt.Errorf("%s: %s: %w", node.name, method, response.Error)
+	}
+	if result == nil {
+		return nil
+	}
+
+	return json.Unmarshal(response.Result, result)
+}
+
+// waitFor polls a condition until it holds or the timeout passes
+// Parameters:
+//   - what: What is waited for, for the error
+//   - done: Checks the condition, failing the wait with an error
+//   - abort: Closed when waiting longer is pointless, nil for never
+func (t *chainTest) waitFor(what string, done func() (bool, error), abort <-chan struct{}) error {
+	deadline := time.Now().Add(t.options.Timeout)
+	for {
+		ok, err := done()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v waiting for %s", t.options.Timeout, what)
+		}
+
+		select {
+		case <-abort:
+		case <-time.After(chainTestPollInterval):
+		}
+	}
+}
+
+// waitSynced waits for the nodes to have the same best block
+func (t *chainTest) waitSynced(nodes ...*chainTestNode) error {
+	var tips []string
+	err := t.waitFor("the nodes to agree on the best block", func() (bool, error) {
+		tips = nil
+		for _, node := range nodes {
+			var tip string
+			if t.call(node, "getbestblockhash", &tip) != nil {
+				return false, nil
+			}
+			tips = append(tips, tip)
+		}
+		return !slices.ContainsFunc(tips, func(tip string) bool { return tip != tips[0] }), nil
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("%w, they have %v", err, tips)
+	}
+
+	return nil
+}
+
+// waitHeight waits for the nodes to reach a height
+func (t *chainTest) waitHeight(height int, nodes ...*chainTestNode) error {
+	for _, node := range nodes {
+		err := t.waitFor(fmt.Sprintf("%s to reach height %d", node.name, height), func() (bool, error) {
+			var got int
+			err := t.call(node, "getblockcount", &got)
+			return err == nil && got >= height, nil
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// waitBalance waits for an address to have a balance on the nodes
+func (t *chainTest) waitBalance(address string, balance int, nodes ...*chainTestNode) error {
+	for _, node := range nodes {
+		got := 0
+		err := t.waitFor(fmt.Sprintf("%s to have a balance of %d on %s", address, balance, node.name), func() (bool, error) {
+			err := t.call(node, "getbalance", &got, address)
+			return err == nil && got == balance, nil
+		}, nil)
+		if err != nil {
+			return fmt.Errorf("%w, it has %d", err, got)
+		}
+	}
+
+	return nil
+}
+
+// waitInMempool waits for a transaction to be in the mempools of the nodes
+func (t *chainTest) waitInMempool(txID string, nodes ...*chainTestNode) error {
+	for _, node := range nodes {
+		err := t.waitFor(fmt.Sprintf("transaction %s in the mempool of %s", txID, node.name), func() (bool, error) {
+			var ids []string
+			err := t.call(node, "getrawmempool", &ids)
+			return err == nil && slices.Contains(ids, txID), nil
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// waitKnown waits for the nodes to have a transaction in their mempool or
+// their chain
+func (t *chainTest) waitKnown(txID string, nodes ...*chainTestNode) error {
+	for _, node := range nodes {
+		err := t.waitFor(fmt.Sprintf("%s to know transaction %s", node.name, txID), func() (bool, error) {
+			var ids []string
+			if t.call(node, "getrawmempool", &ids) == nil && slices.Contains(ids, txID) {
+				return true, nil
+			}
+			return t.call(node, "getrawtransaction", nil, txID) == nil, nil
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkBlocks checks that the nodes have the same last blocks
+// Parameters:
+//   - count: How many blocks back from the tip to compare
+//   - nodes: The nodes, on the same best block
+func (t *chainTest) checkBlocks(count int, nodes ...*chainTestNode) error {
+	var height int
+	err := t.call(nodes[0], "getblockcount", &height)
+	if err != nil {
+		return err
+	}
+
+	for h := height; h >= 0 && h > height-count; h-- {
+		var want string
+		err = t.call(nodes[0], "getblockhash", &want, h)
+		if err != nil {
+			return err
+		}
+		for _, node := range nodes[1:] {
+			var got string
+			err = t.call(node, "getblockhash", &got, h)
+			if err != nil {
+				return err
+			}
+			if got != want {
+				return fmt.Errorf("block %d is %s on %s but %s on %s", h, want, nodes[0].name, got, node.name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// send sends coins from the wallet of a node with sendtoaddress
+// Returns:
+//   - string: ID of the transaction
+func (t *chainTest) send(node *chainTestNode, to string, amount int, from string, fee int) (string, error) {
+	var txID string
+	err := t.call(node, "sendtoaddress", &txID, to, amount, from, fee)
+
+	return txID, err
+}
+
+// mineBlocks mines blocks on a node like an external miner: it gets a
+// template with getblocktemplate, does its proof of work and hands it back
+// with submitblock
+// Parameters:
+//   - node: The node
+//   - address: The address the rewards are paid to
+//   - count: The number of blocks
+//
+// Returns:
+//   - int: The rewards paid to the address, the subsidies plus the fees
+func (t *chainTest) mineBlocks(node *chainTestNode, address string, count int) (int, error) {
+	rewards := 0
+	for range count {
+		var template BlockTemplate
+		err := t.call(node, "getblocktemplate", &template, address)
+		if err != nil {
+			return 0, err
+		}
+
+		block, err := solveTemplate(template, t.options.Timeout)
+		if err != nil {
+			return 0, fmt.Errorf("%s: block %d: %w", node.name, template.Height, err)
+		}
+
+		var result *string
+		err = t.call(node, "submitblock", &result, hex.EncodeToString(marshalBlock(block)))
+		if err != nil {
+			return 0, err
+		}
+		if result != nil {
+			return 0, fmt.Errorf("%s: submitblock: %s", node.name, *result)
+		}
+		rewards += template.CoinbaseValue
+	}
+
+	return rewards, nil
+}
+
+// solveTemplate builds the block of a template and does its proof of work
+// Parameters:
+//   - template: The template, see getblocktemplate
+//   - timeout: How long mining may take
+func solveTemplate(template BlockTemplate, timeout time.Duration) (*Block, error) {
+	prevHash, err := hex.DecodeString(template.PreviousBlockHash)
+	if err != nil {
+		return nil, err
+	}
+	bits, err := strconv.ParseUint(template.Bits, 16, 32)
+	if err != nil {
+		return nil, err
+	}
+	hasher, err := lookupHasher(template.PowAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	// This process has no chain of its own, it hashes like the node's
+	powHasher = hasher
+
+	var transactions []*Transaction
+	for _, encoded := range append([]TemplateTransaction{template.CoinbaseTxn.TemplateTransaction}, template.Transactions...) {
+		data, err := hex.DecodeString(encoded.Data)
+		if err != nil {
+			return nil, err
+		}
+		var tx Transaction
+		err = unmarshalTransaction(data, &tx)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, &tx)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	block, err := NewBlock(ctx, transactions, prevHash, template.Height, template.Version, uint32(bits), template.CurTime)
+	if errors.Is(err, errMiningCancelled) {
+		return nil, fmt.Errorf("no proof of work found in %v", timeout)
+	}
+
+	return block, err
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"math/big"
+	"sort"
+)
+
+// invalidBlocksBucket holds the hashes of blocks marked invalid with invalidateblock
+const invalidBlocksBucket = "invalid"
+
+// Chain tip statuses, as reported by bitcoind's getchaintips
+const (
+	tipStatusActive    = "active"     // The tip of the active chain
+	tipStatusValidFork = "valid-fork" // A valid branch that isn't part of the active chain
+	tipStatusInvalid   = "invalid"    // A branch containing at least one invalid block
+)
+
+// ChainTip describes the tip of a branch of the block tree
+type ChainTip struct {
+	Height    int    `json:"height"`    // Height of the tip
+	Hash      string `json:"hash"`      // Hash of the tip
+	BranchLen int    `json:"branchlen"` // Number of blocks between the tip and the active chain, 0 for the active tip
+	Status    string `json:"status"`    // One of the tipStatus values
+}
+
+// blockTree is an in-memory view of every block stored in the database,
+// including blocks that aren't part of the active chain
+type blockTree struct {
+	parents  map[string]string   // Block hash -> parent hash, "" for the genesis block
+	heights  map[string]int      // Block hash -> height
+	work     map[string]*big.Int // Block hash -> chain work, see chainwork.go
+	invalid  map[string]bool     // Hashes of blocks marked invalid
+	active   map[string]bool     // Hashes of blocks on the active chain
+	activeID string              // Hash of the active tip
+}
+
+// loadBlockTree reads every stored block and builds the block tree
+func (bc *Blockchain) loadBlockTree() *blockTree {
+	tree := blockTree{
+		parents:  make(map[string]string),
+		heights:  make(map[string]int),
+		work:     make(map[string]*big.Int),
+		invalid:  make(map[string]bool),
+		active:   make(map[string]bool),
+		activeID: hex.EncodeToString(bc.tip),
+	}
+
+	err := bc.db.View(func(tx StoreTx) error {
+		c := tx.Bucket([]byte(blocksBucket)).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			// Skip special keys like 'l', block hashes are 32 bytes long
+			if len(k) != 32 {
+				continue
+			}
+			block := DeserializeBlock(v)
+			tree.parents[hex.EncodeToString(k)] = hex.EncodeToString(block.PrevBlockHash)
+		}
+
+		c = tx.Bucket([]byte(chainWorkBucket)).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			tree.work[hex.EncodeToString(k)] = new(big.Int).SetBytes(v)
+		}
+
+		if b := tx.Bucket([]byte(invalidBlocksBucket)); b != nil {
+			c = b.Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				tree.invalid[hex.EncodeToString(k)] = true
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	for hash := tree.activeID; hash != ""; hash = tree.parents[hash] {
+		tree.active[hash] = true
+	}
+
+	return &tree
+}
+
+// height returns the height of a block, computing and caching the heights of its ancestors
+func (t *blockTree) height(hash string) int {
+	if h, ok := t.heights[hash]; ok {
+		return h
+	}
+
+	h := 0
+	if parent := t.parents[hash]; parent != "" {
+		h = t.height(parent) + 1
+	}
+	t.heights[hash] = h
+
+	return h
+}
+
+// isValid checks that neither the block nor any of its ancestors is marked invalid
+func (t *blockTree) isValid(hash string) bool {
+	for ; hash != ""; hash = t.parents[hash] {
+		if t.invalid[hash] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// tips returns the hashes of all blocks without children, sorted for stable output
+func (t *blockTree) tips() []string {
+	hasChild := make(map[string]bool)
+	for _, parent := range t.parents {
+		hasChild[parent] = true
+	}
+
+	var tips []string
+	for hash := range t.parents {
+		if !hasChild[hash] {
+			tips = append(tips, hash)
+		}
+	}
+	sort.Strings(tips)
+
+	return tips
+}
+
+// GetChainTips returns the active tip and the tips of all side branches, highest first
+func (bc *Blockchain) GetChainTips() []ChainTip {
+	tree := bc.loadBlockTree()
+
+	var tips []ChainTip
+	for _, hash := range tree.tips() {
+		tip := ChainTip{Height: tree.height(hash), Hash: hash}
+
+		// Walk back to the block where the branch forks off the active chain
+		for ancestor := hash; !tree.active[ancestor]; ancestor = tree.parents[ancestor] {
+			tip.BranchLen++
+		}
+
+		switch {
+		case hash == tree.activeID:
+			tip.Status = tipStatusActive
+		case !tree.isValid(hash):
+			tip.Status = tipStatusInvalid
+		default:
+			tip.Status = tipStatusValidFork
+		}
+
+		tips = append(tips, tip)
+	}
+
+	// The active tip can have children if they were invalidated
+	if !containsTip(tips, tree.activeID) {
+		tips = append(tips, ChainTip{tree.height(tree.activeID), tree.activeID, 0, tipStatusActive})
+	}
+
+	sort.SliceStable(tips, func(i, j int) bool { return tips[i].Height > tips[j].Height })
+
+	return tips
+}
+
+// containsTip checks whether a tip with the given hash is in the list
+func containsTip(tips []ChainTip, hash string) bool {
+	for _, tip := range tips {
+		if tip.Hash == hash {
+			return true
+		}
+	}
+
+	return false
+}
+
+// InvalidateBlock marks a block and all of its descendants invalid. If the
+// block is on the active chain, the chain is rewound to the best remaining
+// valid tip. This is meant for steering fork choice manually during testing.
+// Parameters:
+//   - hash: Hash of the block to invalidate
+func (bc *Blockchain) InvalidateBlock(hash []byte) error {
+	tree := bc.loadBlockTree()
+
+	id := hex.EncodeToString(hash)
+	if _, ok := tree.parents[id]; !ok {
+		return fmt.Errorf("block %s not found", id)
+	}
+	if tree.parents[id] == "" {
+		return errors.New("the genesis block can't be invalidated")
+	}
+	if height := bc.PrunedHeight(); height >= 0 {
+		if block, err := bc.GetBlock(hash); err == nil && block.IsPruned() {
+			return fmt.Errorf("block %s was pruned, the chain can't be rewound below height %d", id, height+1)
+		}
+	}
+
+	bc.markInvalid(hash)
+
+	return bc.activateBestChain()
+}
+
+// markInvalid stores the invalid mark of a block
+func (bc *Blockchain) markInvalid(hash []byte) {
+	err := bc.db.Update(func(tx StoreTx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(invalidBlocksBucket))
+		if err != nil {
+			return err
+		}
+
+		return b.Put(hash, []byte{1})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// ReconsiderBlock removes the invalid mark from a block and its ancestors, and
+// switches to the branch containing it if that branch is now the best chain.
+// Parameters:
+//   - hash: Hash of the block to reconsider
+func (bc *Blockchain) ReconsiderBlock(hash []byte) error {
+	tree := bc.loadBlockTree()
+
+	id := hex.EncodeToString(hash)
+	if _, ok := tree.parents[id]; !ok {
+		return fmt.Errorf("block %s not found", id)
+	}
+
+	err := bc.db.Update(func(tx StoreTx) error {
+		b := tx.Bucket([]byte(invalidBlocksBucket))
+		if b == nil {
+			return nil
+		}
+
+		for ancestor := id; ancestor != ""; ancestor = tree.parents[ancestor] {
+			key, err := hex.DecodeString(ancestor)
+			if err != nil {
+				return err
+			}
+
+			err = b.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return bc.activateBestChain()
+}
+
+// activateBestChain makes the valid tip with the most chain work the active
+// tip, which is usually but not always the highest one. On a tie the current
+// tip is kept. When the tip changes, the chain is reorganized onto the new
+// branch. A block of that branch that turns out invalid is marked so, and the
+// best remaining tip is tried instead.
+// Returns:
+//   - error: Why a block of a better branch is invalid, nil if there was none
+func (bc *Blockchain) activateBestChain() error {
+	var invalid error
+
+	for {
+		tree := bc.loadBlockTree()
+		best := tree.best()
+		if best == tree.activeID {
+			return invalid
+		}
+
+		bad, err := bc.reorganize(tree, best)
+		if err == nil {
+			return invalid
+		}
+		if bad == nil {
+			log.Panic(err)
+		}
+
+		slog.Warn("Block is invalid", hashAttr("hash", bad), "err", err)
+		if invalid == nil {
+			invalid = fmt.Errorf("block %x is invalid: %w", bad, err)
+		}
+		bc.markInvalid(bad)
+	}
+}
+
+// best returns the valid tip with the most chain work, the active tip on a tie
+func (t *blockTree) best() string {
+	best := ""
+	if t.isValid(t.activeID) {
+		best = t.activeID
+	}
+
+	// Visit blocks in a fixed order so ties between branches are broken the same way every time
+	var hashes []string
+	for hash := range t.parents {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	for _, hash := range hashes {
+		if !t.isValid(hash) {
+			continue
+		}
+
+		if best == "" || t.work[hash].Cmp(t.work[best]) > 0 {
+			best = hash
+		}
+	}
+
+	return best
+}
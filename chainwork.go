@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/big"
+)
+
+// chainWorkBucket maps the hash of every stored block, side branches
+// included, to the total proof of work of the chain ending with it, as a
+// big-endian integer. The active chain is the valid one with the most work.
+const chainWorkBucket = "chainwork"
+
+// blockWork returns the proof of work of a block: the number of hashes
+// needed on average to meet its target, 2^256 / (target + 1)
+func blockWork(block *Block) *big.Int {
+	denominator := new(big.Int).Add(block.Target(), big.NewInt(1))
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denominator)
+}
+
+// storeChainWork records the total work of the chain ending with a newly
+// stored block, from the work of its parent
+// Parameters:
+//   - tx: The database transaction storing the block
+//   - block: The block
+func storeChainWork(tx StoreTx, block *Block) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(chainWorkBucket))
+	if err != nil {
+		return err
+	}
+
+	work := blockWork(block)
+	if len(block.PrevBlockHash) > 0 {
+		parentWork := b.Get(block.PrevBlockHash)
+		if parentWork == nil {
+			return fmt.Errorf("chain work of block %x not found", block.PrevBlockHash)
+		}
+		work.Add(work, new(big.Int).SetBytes(parentWork))
+	}
+
+	return b.Put(block.Hash, work.Bytes())
+}
+
+// ChainWork returns the total work of the chain ending with a stored block
+// Parameters:
+//   - hash: Hash of the block
+//
+// Returns:
+//   - *big.Int: Sum of the work of the block and its ancestors
+func (bc *Blockchain) ChainWork(hash []byte) (*big.Int, error) {
+	var work *big.Int
+
+	err := bc.db.View(func(tx StoreTx) error {
+		data := tx.Bucket([]byte(chainWorkBucket)).Get(hash)
+		if data == nil {
+			return fmt.Errorf("block %x not found", hash)
+		}
+		work = new(big.Int).SetBytes(data)
+
+		return nil
+	})
+
+	return work, err
+}
+
+// reindexChainWork computes the chain work of every stored block. Databases
+// created before the chain work was stored need it once.
+func (bc *Blockchain) reindexChainWork() {
+	err := bc.db.Update(func(tx StoreTx) error {
+		err := tx.DeleteBucket([]byte(chainWorkBucket))
+		if err != nil && err != errBucketNotFound {
+			return err
+		}
+
+		blocks := make(map[string]*Block)
+		c := tx.Bucket([]byte(blocksBucket)).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			// Skip special keys like 'l', block hashes are 32 bytes long
+			if len(k) != 32 {
+				continue
+			}
+			blocks[hex.EncodeToString(k)] = DeserializeBlock(v)
+		}
+
+		// Parents go before their children
+		stored := make(map[string]bool)
+		var store func(block *Block) error
+		store = func(block *Block) error {
+			id := hex.EncodeToString(block.Hash)
+			if stored[id] {
+				return nil
+			}
+			if parent, ok := blocks[hex.EncodeToString(block.PrevBlockHash)]; ok {
+				err := store(parent)
+				if err != nil {
+					return err
+				}
+			}
+			stored[id] = true
+
+			return storeChainWork(tx, block)
+		}
+
+		for _, block := range blocks {
+			err = store(block)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
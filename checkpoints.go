@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Checkpoint is a block known to be part of the network's chain, like the
+// checkpoints Bitcoin Core ships with. No branch forking off below the last
+// checkpoint is accepted, so the blocks up to it form a single chain that
+// must lead to the checkpoints. They're trusted to be valid, and their
+// transactions aren't checked against the UTXO set.
+type Checkpoint struct {
+	Height int    // Height of the block
+	Hash   string // Hex hash of the block
+}
+
+// checkpoints are the checkpoints of the active network, lowest first, set
+// by selectNetwork and extended with -checkpoints. Mainnet's are listed
+// here; there are none yet, since the genesis block is mined when the chain
+// is created and so every chain has its own.
+var checkpoints []Checkpoint
+
+// errCheckpointConflict is returned for blocks of a chain that doesn't
+// contain the checkpoints. The peer offering them is on another chain.
+var errCheckpointConflict = errors.New("conflicts with a checkpoint")
+
+// parseCheckpoints parses a comma-separated list of HEIGHT:HASH checkpoints
+func parseCheckpoints(list string) ([]Checkpoint, error) {
+	var parsed []Checkpoint
+
+	for _, item := range strings.Split(list, ",") {
+		heightStr, hash, ok := strings.Cut(strings.TrimSpace(item), ":")
+		if !ok {
+			return nil, fmt.Errorf("checkpoint %q isn't HEIGHT:HASH", item)
+		}
+
+		height, err := strconv.Atoi(heightStr)
+		if err != nil || height < 0 {
+			return nil, fmt.Errorf("checkpoint %q has an invalid height", item)
+		}
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("checkpoint %q has an invalid hash", item)
+		}
+
+		parsed = append(parsed, Checkpoint{height, strings.ToLower(hash)})
+	}
+
+	return parsed, nil
+}
+
+// addCheckpoints adds checkpoints to the ones of the active network
+func addCheckpoints(extra []Checkpoint) error {
+	merged := slices.Clone(checkpoints)
+
+	for _, cp := range extra {
+		for _, known := range merged {
+			if known.Height == cp.Height && known.Hash != cp.Hash {
+				return fmt.Errorf("checkpoint at height %d is already %s", cp.Height, known.Hash)
+			}
+		}
+		merged = append(merged, cp)
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].Height < merged[j].Height })
+	checkpoints = merged
+
+	return nil
+}
+
+// lastCheckpointHeight returns the height of the last checkpoint, -1 without
+// checkpoints. Blocks up to it skip the transaction checks of validateBlock.
+func lastCheckpointHeight() int {
+	if len(checkpoints) == 0 {
+		return -1
+	}
+
+	return checkpoints[len(checkpoints)-1].Height
+}
+
+// checkCheckpoints rejects a block conflicting with the checkpoints: a block
+// at the height of a checkpoint must be that block, and a block at or below
+// the last checkpoint's height must extend the active tip. Side branches
+// forking off below the last checkpoint are never stored, so the blocks whose
+// transactions checkBlockTransactions trusts are all on the chain leading to
+// the checkpoints.
+// Parameters:
+//   - tx: The database transaction
+//   - block: The block
+func checkCheckpoints(tx StoreTx, block *Block) error {
+	if bytes.Equal(tx.Bucket([]byte(heightsBucket)).Get(heightKey(block.Height)), block.Hash) {
+		return nil
+	}
+
+	for _, cp := range checkpoints {
+		if cp.Height == block.Height && cp.Hash != hex.EncodeToString(block.Hash) {
+			return fmt.Errorf("block %x %w: the block at height %d is %s", block.Hash, errCheckpointConflict, cp.Height, cp.Hash)
+		}
+	}
+
+	last := lastCheckpointHeight()
+	if block.Height <= last && !bytes.Equal(block.PrevBlockHash, tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))) {
+		return fmt.Errorf("block %x at height %d forks off below the checkpoint at height %d: %w", block.Hash, block.Height, last, errCheckpointConflict)
+	}
+
+	return nil
+}
+
+// CheckCheckpoints rejects a block conflicting with the checkpoints, see
+// checkCheckpoints
+func (bc *Blockchain) CheckCheckpoints(block *Block) error {
+	var err error
+
+	dbErr := bc.db.View(func(tx StoreTx) error {
+		err = checkCheckpoints(tx, block)
+		return nil
+	})
+	if dbErr != nil {
+		log.Panic(dbErr)
+	}
+
+	return err
+}
@@ -1,11 +1,24 @@
 package main
 
 import (
-	"flag"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 // CLI represents the Command Line Interface for the blockchain application.
@@ -19,15 +32,27 @@ type CLI struct{}
 // blockchain already exists, this operation will fail.
 // Parameters:
 //   - address: The wallet address that will receive the genesis block reward
-func (cli *CLI) createBlockchain(address string) {
+//   - paramsFile: JSON file with the chain parameters, empty for the network's
+func (cli *CLI) createBlockchain(address, paramsFile string) {
+	cli.applyParams(paramsFile)
 	bc := CreateBlockchain(address)
 	// Ensure we close the database connection when done
-	bc.db.Close()
+	defer bc.db.Close()
+	rememberAddress(address)
+
+	if jsonOutput {
+		printJSON(struct {
+			Chain   string `json:"chain"`
+			Genesis string `json:"genesis"`
+		}{bc.Fingerprint(), hex.EncodeToString(bc.tip)})
+		return
+	}
 	fmt.Println("Done!")
 }
 
 // getBalance calculates and displays the balance for a given wallet address by
-// finding all Unspent Transaction Outputs (UTXOs) associated with that address.
+// finding all Unspent Transaction Outputs (UTXOs) associated with that address
+// and with the change addresses the wallet derived for it.
 // Parameters:
 //   - address: The wallet address to check the balance for
 func (cli *CLI) getBalance(address string) {
@@ -36,35 +61,69 @@ func (cli *CLI) getBalance(address string) {
 	// Ensure database connection is closed after we're done
 	defer bc.db.Close()
 
-	balance := 0
-	// Find all unspent transaction outputs for this address
-	UTXOs := bc.FindUTXO(address)
+	UTXOSet := UTXOSet{bc}
+	wallet := NewWallet()
 
-	// Sum up the values of all UTXOs
-	for _, out := range UTXOs {
-		balance += out.Value
+	balance := 0
+	// Add up the cached balances of this address and its change addresses
+	for _, addr := range wallet.Addresses(address) {
+		balance += UTXOSet.GetBalance(addr)
 	}
 
+	if jsonOutput {
+		printJSON(struct {
+			Address string `json:"address"`
+			Balance int    `json:"balance"`
+		}{address, balance})
+		return
+	}
 	fmt.Printf("Balance of '%s': %d\n", address, balance)
 }
 
-// printUsage displays help information showing all available commands and their
-// usage. This is shown when invalid commands are used or when help is requested.
-func (cli *CLI) printUsage() {
-	fmt.Println("Usage:")
-	fmt.Println("  getbalance -address ADDRESS - Get balance of ADDRESS")
-	fmt.Println("  createblockchain -address ADDRESS - Create a blockchain and send genesis block reward to ADDRESS")
-	fmt.Println("  printchain - Print all the blocks of the blockchain")
-	fmt.Println("  send -from FROM -to TO -amount AMOUNT - Send AMOUNT of coins from FROM address to TO")
-}
+// getWalletBalance displays the balance of every address of the wallet, each
+// owner followed by its change addresses, and their total
+func (cli *CLI) getWalletBalance() {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
 
-// validateArgs checks if any command line arguments were provided.
-// If no arguments were given, it prints usage information and exits.
-func (cli *CLI) validateArgs() {
-	if len(os.Args) < 2 {
-		cli.printUsage()
-		os.Exit(1)
+	UTXOSet := UTXOSet{bc}
+	wallet := NewWallet()
+
+	type addressBalance struct {
+		Address string `json:"address"`
+		Owner   string `json:"owner,omitempty"` // Owner of a change address
+		Balance int    `json:"balance"`
+	}
+	var balances []addressBalance
+	total := 0
+	for _, owner := range wallet.Owners() {
+		for _, addr := range wallet.Addresses(owner) {
+			balance := UTXOSet.GetBalance(addr)
+			total += balance
+
+			entry := addressBalance{Address: addr, Balance: balance}
+			if addr != owner {
+				entry.Owner = owner
+			}
+			balances = append(balances, entry)
+		}
+	}
+
+	if jsonOutput {
+		printJSON(struct {
+			Addresses []addressBalance `json:"addresses"`
+			Total     int              `json:"total"`
+		}{append([]addressBalance{}, balances...), total})
+		return
+	}
+	for _, entry := range balances {
+		if entry.Owner != "" {
+			fmt.Printf("  Balance of '%s' (change of '%s'): %d\n", entry.Address, entry.Owner, entry.Balance)
+		} else {
+			fmt.Printf("Balance of '%s': %d\n", entry.Address, entry.Balance)
+		}
 	}
+	fmt.Printf("Total: %d\n", total)
 }
 
 // printChain displays the entire blockchain, starting from the most recent block
@@ -72,7 +131,11 @@ func (cli *CLI) validateArgs() {
 // - The previous block's hash
 // - The current block's hash
 // - Proof of Work validation status
-func (cli *CLI) printChain() {
+// With verbose, it also shows the time of each block and its transactions
+// with their inputs and outputs decoded. The JSON output always has them.
+// Parameters:
+//   - verbose: Whether to print the transactions
+func (cli *CLI) printChain(verbose bool) {
 	// Open blockchain without specifying an address since we're just reading
 	bc := NewBlockchain("")
 	defer bc.db.Close()
@@ -80,119 +143,2055 @@ func (cli *CLI) printChain() {
 	// Create an iterator to move through the blockchain
 	bci := bc.Iterator()
 
+	// The blocks in the format of getblock, from the tip down
+	var blocks []BlockInfo
+
 	// Iterate through all blocks until we reach the genesis block
 	for {
 		block := bci.Next()
 
-		// Display block information
-		fmt.Printf("Prev. hash: %x\n", block.PrevBlockHash)
-		fmt.Printf("Hash: %x\n", block.Hash)
-		pow := NewProofOfWork(block)
-		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
-		fmt.Println()
+		if jsonOutput {
+			blocks = append(blocks, NewBlockInfo(bc, block))
+		} else {
+			// Display block information
+			fmt.Printf("Height: %d\n", block.Height)
+			fmt.Printf("Prev. hash: %x\n", block.PrevBlockHash)
+			fmt.Printf("Hash: %x\n", block.Hash)
+			pow := NewProofOfWork(block)
+			fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
+			if verbose {
+				fmt.Printf("Time: %s\n", time.Unix(block.Timestamp, 0).UTC().Format(time.RFC3339))
+				if block.IsPruned() {
+					fmt.Println("Transactions: pruned")
+				} else {
+					fmt.Printf("Transactions: %d\n", len(block.Transactions))
+				}
+				for _, tx := range block.Transactions {
+					printDecodedTransaction(tx)
+				}
+			}
+			fmt.Println()
+		}
 
 		// Break when we reach the genesis block (it has no previous hash)
 		if len(block.PrevBlockHash) == 0 {
 			break
 		}
 	}
+
+	if jsonOutput {
+		printJSON(blocks)
+	}
 }
 
-// send creates a new transaction to transfer coins from one address to another.
-// It creates a new transaction, adds it to a new block, and mines the block.
-// Parameters:
-//   - from: Source wallet address
-//   - to: Destination wallet address
-//   - amount: Number of coins to transfer
-func (cli *CLI) send(from, to string, amount int) {
-	// Load the blockchain with the sender's address
-	bc := NewBlockchain(from)
-	defer bc.db.Close()
+// printDecodedTransaction prints a transaction of printchain -verbose, an
+// input or output a line: the spent output and its unlocker, the value and
+// the address paid
+func printDecodedTransaction(tx *Transaction) {
+	if tx.IsCoinbase() {
+		fmt.Printf("  Transaction %x (coinbase)\n", tx.ID)
+	} else {
+		fmt.Printf("  Transaction %x\n", tx.ID)
+	}
+	if tx.LockTime != 0 {
+		fmt.Printf("    Lock time: %s\n", describeLockTime(tx.LockTime))
+	}
 
-	// Create a new UTXO transaction
-	tx := NewUTXOTransaction(from, to, amount, bc)
-	// Add the transaction to a new block and mine it
-	bc.MineBlock([]*Transaction{tx})
-	fmt.Println("Success!")
-}
-
-// Run is the entry point for the CLI application. It parses command line
-// arguments and executes the appropriate command. The supported commands are:
-// - getbalance: Check the balance of an address
-// - createblockchain: Create a new blockchain
-// - printchain: Display all blocks in the chain
-// - send: Transfer coins between addresses
-func (cli *CLI) Run() {
-	cli.validateArgs()
-
-	// Create flag sets for each command
-	// flag.ExitOnError means the program will exit if there's an error parsing flags
-	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
-	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
-	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
-	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
-
-	// Define flags for each command
-	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
-	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
-	sendFrom := sendCmd.String("from", "", "Source wallet address")
-	sendTo := sendCmd.String("to", "", "Destination wallet address")
-	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
-
-	// Parse the command from command line arguments
-	switch os.Args[1] {
-	case "getbalance":
-		err := getBalanceCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
+	for i, in := range tx.Vin {
+		if tx.IsCoinbase() {
+			fmt.Printf("    In %d: coinbase %q\n", i, in.ScriptSig)
+			continue
 		}
-	case "createblockchain":
-		err := createBlockchainCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
+		fmt.Printf("    In %d: %x:%d unlocked by %s\n", i, in.Txid, in.Vout, in.ScriptSig)
+	}
+
+	for i, out := range tx.Vout {
+		line := fmt.Sprintf("    Out %d: %d to %s", i, out.Value, out.ScriptPubKey)
+		if out.IsDataCarrier() {
+			line = fmt.Sprintf("    Out %d: %d, data %q", i, out.Value, out.CarriedData())
 		}
-	case "printchain":
-		err := printChainCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
+		if len(out.NFT) > 0 {
+			line += fmt.Sprintf(", NFT %x", out.NFT)
 		}
-	case "send":
-		err := sendCmd.Parse(os.Args[2:])
+		if out.LockHeight != 0 {
+			line += fmt.Sprintf(", locked until height %d", out.LockHeight)
+		}
+		fmt.Println(line)
+	}
+}
+
+// getChainInfo prints the chain fingerprint along with the current height and
+// best block hash.
+func (cli *CLI) getChainInfo() {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	work, err := bc.ChainWork(bc.tip)
+	if err != nil {
+		log.Panic(err)
+	}
+	height := bc.GetBestHeight()
+	difficulty := targetDifficulty(compactToBig(bc.NextTarget()))
+	subsidy := blockSubsidy(height + 1)
+	pending := len(Mempool{bc}.Transactions())
+
+	if jsonOutput {
+		printJSON(struct {
+			Chain               string  `json:"chain"`
+			Height              int     `json:"height"`
+			BestBlockHash       string  `json:"bestblockhash"`
+			ChainWork           string  `json:"chainwork"`
+			NextDifficulty      float64 `json:"nextdifficulty"`
+			NextSubsidy         int     `json:"nextsubsidy"`
+			ArchiveDepth        int     `json:"archivedepth"`
+			PruneDepth          int     `json:"prunedepth"`
+			PrunedHeight        int     `json:"prunedheight"`
+			PendingTransactions int     `json:"pendingtransactions"`
+		}{bc.Fingerprint(), height, hex.EncodeToString(bc.tip), fmt.Sprintf("%064x", work), difficulty, subsidy,
+			bc.ArchiveDepth(), bc.PruneDepth(), bc.PrunedHeight(), pending})
+		return
+	}
+
+	fmt.Printf("Chain: %s\n", bc.Fingerprint())
+	fmt.Printf("Height: %d\n", height)
+	fmt.Printf("Best block: %x\n", bc.tip)
+	fmt.Printf("Chain work: %064x\n", work)
+	fmt.Printf("Next difficulty: %g\n", difficulty)
+	fmt.Printf("Next block subsidy: %d\n", subsidy)
+	fmt.Printf("Archive depth: %d\n", bc.ArchiveDepth())
+	fmt.Printf("Prune depth: %d\n", bc.PruneDepth())
+	if height := bc.PrunedHeight(); height >= 0 {
+		fmt.Printf("Pruned up to height: %d\n", height)
+	}
+	fmt.Printf("Pending transactions: %d\n", pending)
+}
+
+// getBlockchainInfo prints the status of the blockchain at a glance: the tip,
+// its total work and difficulty, the size of the UTXO set and the coins in
+// it, whether blocks are pruned and the size of the database
+func (cli *CLI) getBlockchainInfo() {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	tip, err := bc.GetBlockHeader(bc.tip)
+	if err != nil {
+		log.Panic(err)
+	}
+	work, err := bc.ChainWork(bc.tip)
+	if err != nil {
+		log.Panic(err)
+	}
+	outputs, supply := UTXOSet{bc}.Stats()
+
+	// An ephemeral chain has no database file
+	var size int64
+	if !ephemeral {
+		info, err := os.Stat(dbFile)
 		if err != nil {
 			log.Panic(err)
 		}
+		size = info.Size()
+	}
+
+	if jsonOutput {
+		printJSON(struct {
+			Chain         string  `json:"chain"`
+			Height        int     `json:"height"`
+			BestBlockHash string  `json:"bestblockhash"`
+			ChainWork     string  `json:"chainwork"`
+			Difficulty    float64 `json:"difficulty"`
+			UTXOs         int     `json:"utxos"`
+			TotalSupply   int     `json:"totalsupply"`
+			Pruned        bool    `json:"pruned"`
+			PruneDepth    int     `json:"prunedepth"`
+			PrunedHeight  int     `json:"prunedheight"`
+			SizeOnDisk    int64   `json:"sizeondisk"`
+		}{bc.Fingerprint(), tip.Height, hex.EncodeToString(bc.tip), fmt.Sprintf("%064x", work), tip.Difficulty(),
+			outputs, supply, bc.PrunedHeight() >= 0, bc.PruneDepth(), bc.PrunedHeight(), size})
+		return
+	}
+
+	fmt.Printf("Chain: %s\n", bc.Fingerprint())
+	fmt.Printf("Height: %d\n", tip.Height)
+	fmt.Printf("Best block: %x\n", bc.tip)
+	fmt.Printf("Chain work: %064x\n", work)
+	fmt.Printf("Difficulty: %g\n", tip.Difficulty())
+	fmt.Printf("Unspent outputs: %d\n", outputs)
+	fmt.Printf("Total supply: %d\n", supply)
+	switch {
+	case bc.PrunedHeight() >= 0:
+		fmt.Printf("Pruning: blocks up to height %d pruned, depth %d\n", bc.PrunedHeight(), bc.PruneDepth())
+	case bc.PruneDepth() > 0:
+		fmt.Printf("Pruning: depth %d, no blocks pruned yet\n", bc.PruneDepth())
 	default:
-		cli.printUsage()
+		fmt.Println("Pruning: off")
+	}
+	if ephemeral {
+		fmt.Println("Database size: in memory")
+	} else {
+		fmt.Printf("Database size: %d bytes\n", size)
+	}
+}
+
+// setArchiveDepth sets the number of blocks below the tip kept uncompressed.
+// Older blocks of the active chain are compressed to save disk space.
+// Parameters:
+//   - depth: Number of uncompressed blocks below the tip, 0 to turn archiving off
+func (cli *CLI) setArchiveDepth(depth int) {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	compressed := bc.SetArchiveDepth(depth)
+	if jsonOutput {
+		printJSON(struct {
+			ArchiveDepth int `json:"archivedepth"`
+			Compressed   int `json:"compressed"`
+		}{depth, compressed})
+		return
+	}
+	fmt.Printf("Done! %d blocks are stored compressed.\n", compressed)
+}
+
+// setPruneDepth sets the number of blocks below the tip whose transactions
+// are kept. Older blocks of the active chain are pruned to their headers.
+// Parameters:
+//   - depth: Number of whole blocks below the tip, 0 to stop pruning
+func (cli *CLI) setPruneDepth(depth int) {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	pruned := bc.SetPruneDepth(depth)
+	if jsonOutput {
+		printJSON(struct {
+			PruneDepth   int `json:"prunedepth"`
+			PrunedHeight int `json:"prunedheight"`
+		}{depth, pruned})
+		return
+	}
+	if pruned < 0 {
+		fmt.Println("Done! No blocks are pruned.")
+		return
+	}
+	fmt.Printf("Done! Blocks up to height %d are pruned.\n", pruned)
+}
+
+// backup saves a snapshot of the database, which a node may be using
+// Parameters:
+//   - out: The file to save the snapshot to
+//   - httpAddr: Address of the HTTP API of the node using the database, empty to read it directly
+func (cli *CLI) backup(out, httpAddr string) {
+	if _, err := os.Stat(out); err == nil {
+		fmt.Printf("%s already exists.\n", out)
 		os.Exit(1)
 	}
 
-	// Execute the appropriate command with its parsed flags
-	if getBalanceCmd.Parsed() {
-		if *getBalanceAddress == "" {
-			getBalanceCmd.Usage()
-			os.Exit(1)
-		}
-		cli.getBalance(*getBalanceAddress)
+	var err error
+	if httpAddr != "" {
+		err = saveFile(out, func(w io.Writer) error { return downloadBackup(httpAddr, w) })
+	} else {
+		bc := NewBlockchain("")
+		err = saveFile(out, bc.db.Backup)
+		bc.db.Close()
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	tip, err := verifySnapshot(out)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printJSON(struct {
+			File   string `json:"file"`
+			Height int    `json:"height"`
+			Hash   string `json:"hash"`
+		}{out, tip.Height, hex.EncodeToString(tip.Hash)})
+		return
 	}
+	fmt.Printf("Done! Saved the chain at height %d, block %x, to %s.\n", tip.Height, tip.Hash, out)
+}
+
+// restore replaces the database with a snapshot saved by backup
+// Parameters:
+//   - in: The snapshot file
+func (cli *CLI) restore(in string) {
+	tip, err := restoreSnapshot(in)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printJSON(struct {
+			File   string `json:"file"`
+			Height int    `json:"height"`
+			Hash   string `json:"hash"`
+		}{in, tip.Height, hex.EncodeToString(tip.Hash)})
+		return
+	}
+	fmt.Printf("Done! Restored the chain at height %d, block %x.\n", tip.Height, tip.Hash)
+}
+
+// exportChain saves the blocks of the active chain to a file
+// Parameters:
+//   - out: The file
+func (cli *CLI) exportChain(out string) {
+	if _, err := os.Stat(out); err == nil {
+		fmt.Printf("%s already exists.\n", out)
+		os.Exit(1)
+	}
+
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	n := 0
+	err := saveFile(out, func(w io.Writer) error {
+		var err error
+		n, err = exportChain(bc, w)
+		return err
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printJSON(struct {
+			File   string `json:"file"`
+			Blocks int    `json:"blocks"`
+		}{out, n})
+		return
+	}
+	fmt.Printf("Done! Saved %d blocks to %s.\n", n, out)
+}
+
+// importChain validates and adds the blocks of a file saved by exportchain,
+// printing its progress
+// Parameters:
+//   - in: The file
+func (cli *CLI) importChain(in string) {
+	n, height, err := importChain(in, cliProgress{})
+	if err != nil {
+		fmt.Printf("%v, after %d blocks.\n", err, n)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printJSON(struct {
+			File   string `json:"file"`
+			Blocks int    `json:"blocks"`
+			Height int    `json:"height"`
+		}{in, n, height})
+		return
+	}
+	fmt.Printf("Done! Read %d blocks from %s.\n", n, in)
+}
+
+// getBlock prints a block with all of its transactions. The block is looked up
+// by its height in the active chain, or by its hash if a hash is given.
+// Parameters:
+//   - height: Height of the block in the active chain
+//   - hash: Hex hash of the block, used instead of the height if not empty
+func (cli *CLI) getBlock(height int, hash string) {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
 
-	if createBlockchainCmd.Parsed() {
-		if *createBlockchainAddress == "" {
-			createBlockchainCmd.Usage()
+	var blockHash []byte
+	var err error
+	if hash != "" {
+		blockHash, err = hex.DecodeString(hash)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else {
+		blockHash, err = bc.GetBlockHash(height)
+		if err != nil {
+			fmt.Println(err)
 			os.Exit(1)
 		}
-		cli.createBlockchain(*createBlockchainAddress)
 	}
 
-	if printChainCmd.Parsed() {
-		cli.printChain()
+	block, err := bc.GetBlock(blockHash)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if jsonOutput {
+		printJSON(NewBlockInfo(bc, block))
+		return
+	}
+
+	fmt.Printf("============ Block %x ============\n", block.Hash)
+	fmt.Printf("Height: %d\n", block.Height)
+	fmt.Printf("Prev. block: %x\n", block.PrevBlockHash)
+	fmt.Printf("Time: %s\n", time.Unix(block.Timestamp, 0).UTC().Format(time.RFC3339))
+	fmt.Printf("Nonce: %d\n", block.Nonce)
+	fmt.Printf("Bits: %08x\n", bigToCompact(block.Target()))
+	fmt.Printf("Version: %08x\n", uint32(block.Version))
+	fmt.Printf("Difficulty: %g\n", block.Difficulty())
+	if block.PowAlgorithm != "" {
+		fmt.Printf("PoW algorithm: %s\n", block.PowAlgorithm)
+	}
+	pow := NewProofOfWork(block)
+	fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
+	fmt.Printf("Active chain: %s\n", strconv.FormatBool(bc.IsInActiveChain(block)))
+	if block.IsPruned() {
+		fmt.Printf("Merkle root: %x\n", block.MerkleRoot)
+		fmt.Println("Transactions: pruned")
+	}
+	for _, tx := range block.Transactions {
+		fmt.Println(tx)
+	}
+	fmt.Println()
+}
+
+// getTransaction prints a transaction of the active chain with its inputs,
+// outputs, the block containing it and its number of confirmations.
+// Parameters:
+//   - txID: Hex ID of the transaction
+func (cli *CLI) getTransaction(txID string) {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	id, err := hex.DecodeString(txID)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	block, err := bc.TransactionBlock(id)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	tx, err := bc.FindTransaction(id)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	confirmations, err := bc.Confirmations(block)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if jsonOutput {
+		info := NewTransactionInfo(&tx)
+		info.BlockHash = hex.EncodeToString(block.Hash)
+		info.Confirmations = confirmations
+		printJSON(info)
+		return
+	}
+
+	fmt.Println(tx)
+	fmt.Printf("Block: %x\n", block.Hash)
+	fmt.Printf("Confirmations: %d\n", confirmations)
+}
+
+// getMerkleProof saves the proof that a transaction is included in its block
+// Parameters:
+//   - txID: Hex ID of the transaction
+//   - outFile: File to save the proof to
+func (cli *CLI) getMerkleProof(txID, outFile string) {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	id, err := hex.DecodeString(txID)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	proof, err := NewTxOutProof(bc, id)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = proof.WriteToFile(outFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printJSON(struct {
+			Txid string `json:"txid"`
+			File string `json:"file"`
+		}{txID, outFile})
+		return
+	}
+	fmt.Printf("Merkle proof saved to %s\n", outFile)
+}
+
+// verifyMerkleProof checks a proof file against the Merkle root it contains.
+// This doesn't need the blockchain, the root only has to be compared with a
+// trusted block header.
+// Parameters:
+//   - inFile: File with the proof
+func (cli *CLI) verifyMerkleProof(inFile string) {
+	proof, err := ReadTxOutProof(inFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = proof.Verify()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printJSON(struct {
+			Txid       string `json:"txid"`
+			BlockHash  string `json:"blockhash"`
+			MerkleRoot string `json:"merkleroot"`
+		}{proof.Txid, proof.BlockHash, proof.MerkleRoot})
+		return
+	}
+	fmt.Printf("Transaction %s is included in block %s (merkle root %s)\n", proof.Txid, proof.BlockHash, proof.MerkleRoot)
+}
+
+// getChainTips prints the tips of all known branches as JSON, in the same
+// format as bitcoind's getchaintips.
+func (cli *CLI) getChainTips() {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	printJSON(bc.GetChainTips())
+}
+
+// invalidateBlock marks a block invalid so the chain switches away from it.
+// Parameters:
+//   - hash: Hex hash of the block to invalidate
+func (cli *CLI) invalidateBlock(hash string) {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	blockHash, err := hex.DecodeString(hash)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = bc.InvalidateBlock(blockHash)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	printTip(bc)
+}
+
+// reconsiderBlock removes the invalid mark from a block, switching back to
+// its branch if that branch is the best chain.
+// Parameters:
+//   - hash: Hex hash of the block to reconsider
+func (cli *CLI) reconsiderBlock(hash string) {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	blockHash, err := hex.DecodeString(hash)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = bc.ReconsiderBlock(blockHash)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	printTip(bc)
+}
+
+// printTip prints the active tip after the fork choice changed
+// Parameters:
+//   - bc: The blockchain
+func printTip(bc *Blockchain) {
+	if jsonOutput {
+		printJSON(struct {
+			Height        int    `json:"height"`
+			BestBlockHash string `json:"bestblockhash"`
+		}{bc.GetBestHeight(), hex.EncodeToString(bc.tip)})
+		return
+	}
+	fmt.Printf("Active tip: %x\n", bc.tip)
+}
+
+// reindexUTXO rebuilds the UTXO set from scratch by scanning the whole blockchain.
+// This is only needed if the UTXO set gets out of sync with the blocks.
+func (cli *CLI) reindexUTXO() {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	err := bc.checkUnpruned("Rebuilding the UTXO set")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	UTXOSet := UTXOSet{bc}
+	UTXOSet.Reindex(cliProgress{})
+
+	count := UTXOSet.CountTransactions()
+	if jsonOutput {
+		printJSON(struct {
+			Transactions int `json:"transactions"`
+		}{count})
+		return
 	}
+	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
+}
 
-	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
-			sendCmd.Usage()
+// checkBalances recomputes every balance from the UTXO set and reports the
+// addresses whose cached balance differs. Exits with status 1 on drift.
+func (cli *CLI) checkBalances() {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	drift := UTXOSet{bc}.CheckBalances()
+	if jsonOutput {
+		type balanceDrift struct {
+			Address string `json:"address"`
+			Cached  int    `json:"cached"`
+			Actual  int    `json:"actual"`
+		}
+		drifted := []balanceDrift{}
+		for _, d := range drift {
+			drifted = append(drifted, balanceDrift{d.Address, d.Cached, d.Actual})
+		}
+		printJSON(struct {
+			Consistent bool           `json:"consistent"`
+			Drift      []balanceDrift `json:"drift"`
+		}{len(drift) == 0, drifted})
+		if len(drift) > 0 {
 			os.Exit(1)
 		}
+		return
+	}
+	if len(drift) == 0 {
+		fmt.Println("Balance cache is consistent with the UTXO set.")
+		return
+	}
+
+	for _, d := range drift {
+		fmt.Printf("%s: cached %d, actual %d\n", d.Address, d.Cached, d.Actual)
+	}
+	fmt.Printf("%d balances drifted, run reindexutxo to rebuild the cache.\n", len(drift))
+	os.Exit(1)
+}
+
+// getBlockStats prints the statistics of the block at a given height as JSON,
+// in the same format as bitcoind's getblockstats.
+// Parameters:
+//   - height: Height of the block, the genesis block has height 0
+func (cli *CLI) getBlockStats(height int) {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
 
-		cli.send(*sendFrom, *sendTo, *sendAmount)
+	stats, err := bc.GetBlockStats(height)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
+
+	printJSON(stats)
+}
+
+// getMempoolInfo prints the state of the mempool as JSON, in the same format
+// as bitcoind's getmempoolinfo.
+func (cli *CLI) getMempoolInfo() {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	printJSON(Mempool{bc}.Info())
+}
+
+// getDeploymentInfo prints the state of the deployments for the next block as
+// JSON, similar to bitcoind's getdeploymentinfo
+func (cli *CLI) getDeploymentInfo() {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	printJSON(bc.DeploymentInfo())
+}
+
+// getMiningInfo prints the state of mining on the active chain as JSON,
+// similar to bitcoind's getmininginfo. The command mines nothing itself, so
+// its hashespersec is 0; a node reports its own over the API.
+func (cli *CLI) getMiningInfo() {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	printJSON(bc.MiningInfo())
+}
+
+// nodeClientOptions says how a wallet command reaches a node
+type nodeClientOptions struct {
+	Addr       string // Address (host:port) of the node, empty to mine locally instead
+	TLS        bool   // Whether the node uses TLS
+	TLSPinFile string // PEM file with the node's certificate, empty to accept any
+}
+
+// sendToNode hands a transaction to a node, exiting if the node can't be
+// reached or rejects it
+func sendToNode(node nodeClientOptions, tx *Transaction) {
+	var config *tls.Config
+	if node.TLS {
+		var err error
+		config, err = clientTLSConfig(node.TLSPinFile, nil)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	err := SendTransaction(node.Addr, config, tx)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printSentTransaction(tx, node.Addr)
+		return
+	}
+	fmt.Printf("Transaction %x sent to %s\n", tx.ID, node.Addr)
+}
+
+// printSentTransaction prints the ID of a transaction sent to a node or
+// added to the mempool as JSON
+// Parameters:
+//   - tx: The transaction
+//   - node: The node it was sent to, empty for the local mempool
+func printSentTransaction(tx *Transaction, node string) {
+	printJSON(struct {
+		Txid string `json:"txid"`
+		Node string `json:"node,omitempty"`
+	}{hex.EncodeToString(tx.ID), node})
+}
+
+// send creates a new transaction to transfer coins from one address to another.
+// It creates a new transaction, adds it to a new block, and mines the block.
+// If a node is given the transaction is handed to it instead, to be relayed
+// and mined by the network.
+// Any change is paid to a fresh change address which is saved in the wallet.
+// A dry run builds, signs and validates the transaction and prints it,
+// without saving the change address, sending or queueing it.
+// Parameters:
+//   - from: Source wallet address
+//   - to: Destination wallet address
+//   - amount: Number of coins to transfer
+//   - options: The fee, data and lock time, see SendOptions
+//   - node: The node to send the transaction to, with an empty address to mine locally
+//   - dryRun: Whether to only print the transaction
+func (cli *CLI) send(from, to string, amount int, options SendOptions, node nodeClientOptions, dryRun bool) {
+	// Load the blockchain with the sender's address
+	bc := NewBlockchain(from)
+	defer bc.db.Close()
+
+	UTXOSet := UTXOSet{bc}
+	wallet := NewWallet()
+	// Outputs spent by expired transactions can be selected again
+	cli.expireMempool(bc)
+
+	// Create a new UTXO transaction
+	tx := NewUTXOTransaction(from, to, amount, options, &UTXOSet, wallet)
+	if dryRun {
+		printDryRun(bc, tx, wallet.ChangeAddresses[from])
+		return
+	}
+	// Persist the change address before the block is mined so it's never lost
+	wallet.SaveToFile()
+
+	relayTransaction(bc, tx, node)
+}
+
+// bumpFee replaces a pending transaction of the wallet in the local mempool
+// with one paying a higher fee, see NewFeeBumpTransaction, and records the
+// replacement in the wallet for its history
+// Parameters:
+//   - txID: Hex ID of the pending transaction
+//   - fee: The new fee, 0 for the default
+func (cli *CLI) bumpFee(txID string, fee int) {
+	id, err := hex.DecodeString(txID)
+	if err != nil {
+		fmt.Printf("Invalid transaction ID %q: %v\n", txID, err)
+		os.Exit(1)
+	}
+
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	wallet := NewWallet()
+	cli.expireMempool(bc)
+
+	original := Mempool{bc}.Get(id)
+	if original == nil {
+		fmt.Printf("Transaction %s isn't pending in the mempool\n", txID)
+		os.Exit(1)
+	}
+
+	tx, err := NewFeeBumpTransaction(original, fee, &UTXOSet{bc}, wallet)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	printNote("Replacing transaction %x, paying a fee of %d, with %x paying %d\n", original.ID, Mempool{bc}.Fee(original), tx.ID, Mempool{bc}.Fee(tx))
+	relayTransaction(bc, tx, nodeClientOptions{})
+	// Only a replacement the mempool accepted is recorded, with its change address
+	wallet.AddReplacement(tx.ID, original.ID)
+	wallet.SaveToFile()
+}
+
+// printDryRun validates a transaction the way the mempool would and prints
+// its inputs, outputs, fee and change, exiting if it's invalid
+// Parameters:
+//   - bc: The blockchain
+//   - tx: The signed transaction
+//   - changeAddresses: The change addresses of the sender
+func printDryRun(bc *Blockchain, tx *Transaction, changeAddresses []string) {
+	err := UTXOSet{bc}.VerifyTransaction(tx)
+	if err == nil {
+		err = checkDust(tx)
+	}
+	if err == nil {
+		err = bc.db.View(func(dbTx StoreTx) error { return checkRelayFee(dbTx, tx) })
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	type inputInfo struct {
+		Txid    string `json:"txid"`
+		Vout    int    `json:"vout"`
+		Value   int    `json:"value"`
+		Address string `json:"address"`
+	}
+	type outputInfo struct {
+		N       int    `json:"n"`
+		Value   int    `json:"value"`
+		Address string `json:"address,omitempty"`
+		Data    string `json:"data,omitempty"`
+		Change  bool   `json:"change,omitempty"`
+	}
+	var inputs []inputInfo
+	var outputs []outputInfo
+	fee, change := 0, 0
+
+	for _, in := range tx.Vin {
+		out, ok := UTXOSet{bc}.FindOutput(in.Txid, in.Vout)
+		if !ok {
+			log.Panic("ERROR: Selected output not found")
+		}
+		inputs = append(inputs, inputInfo{hex.EncodeToString(in.Txid), in.Vout, out.Value, out.ScriptPubKey})
+		fee += out.Value
+	}
+	for i, out := range tx.Vout {
+		output := outputInfo{N: i, Value: out.Value, Address: out.ScriptPubKey}
+		if out.IsDataCarrier() {
+			output.Address, output.Data = "", string(out.CarriedData())
+		}
+		if slices.Contains(changeAddresses, out.ScriptPubKey) {
+			output.Change = true
+			change += out.Value
+		}
+		outputs = append(outputs, output)
+		fee -= out.Value
+	}
+	size := len(tx.Serialize())
+
+	if jsonOutput {
+		printJSON(struct {
+			Txid    string       `json:"txid"`
+			Size    int          `json:"size"`
+			Inputs  []inputInfo  `json:"inputs"`
+			Outputs []outputInfo `json:"outputs"`
+			Fee     int          `json:"fee"`
+			Change  int          `json:"change"`
+			Hex     string       `json:"hex"`
+		}{hex.EncodeToString(tx.ID), size, inputs, outputs, fee, change, EncodeRawTransaction(tx)})
+		return
+	}
+
+	fmt.Printf("Dry run of transaction %x, %d bytes, neither sent nor added to the mempool\n", tx.ID, size)
+	for i, in := range inputs {
+		fmt.Printf("  In %d: %s:%d, %d from %s\n", i, in.Txid, in.Vout, in.Value, in.Address)
+	}
+	for _, out := range outputs {
+		switch {
+		case out.Data != "":
+			fmt.Printf("  Out %d: %d, data %q\n", out.N, out.Value, out.Data)
+		case out.Change:
+			fmt.Printf("  Out %d: %d to %s (change)\n", out.N, out.Value, out.Address)
+		default:
+			fmt.Printf("  Out %d: %d to %s\n", out.N, out.Value, out.Address)
+		}
+	}
+	fmt.Printf("Fee: %d\n", fee)
+	fmt.Printf("Change: %d\n", change)
+}
+
+// relayTransaction hands a new transaction of the wallet to a node, or queues
+// it in the local mempool for the next mined block, exiting if it's rejected
+// Parameters:
+//   - bc: The blockchain
+//   - tx: The transaction
+//   - node: The node to send the transaction to, with an empty address to use the local mempool
+func relayTransaction(bc *Blockchain, tx *Transaction, node nodeClientOptions) {
+	if node.Addr != "" {
+		sendToNode(node, tx)
+		return
+	}
+
+	err := Mempool{bc}.Add(tx)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printSentTransaction(tx, "")
+		return
+	}
+	fmt.Printf("Transaction %x added to the mempool, mine it with mine -address ADDRESS\n", tx.ID)
+}
+
+// nftMint mints an NFT to an address, which pays for it, in a new transaction
+// Parameters:
+//   - address: The address minting and receiving the NFT
+//   - data: The content of the NFT, such as the hash of a document
+//   - options: The fee
+//   - node: The node to send the transaction to, with an empty address to use the local mempool
+func (cli *CLI) nftMint(address string, data []byte, options SendOptions, node nodeClientOptions) {
+	bc := NewBlockchain(address)
+	defer bc.db.Close()
+
+	wallet := NewWallet()
+	cli.expireMempool(bc)
+
+	tx := NewNFTMintTransaction(address, data, options, &UTXOSet{bc}, wallet)
+	// Persist the change address so it's never lost
+	wallet.SaveToFile()
+
+	fmt.Printf("Minting NFT %x\n", tx.Vout[0].NFT)
+	relayTransaction(bc, tx, node)
+}
+
+// nftTransfer passes an NFT on to another address in a new transaction
+// Parameters:
+//   - id: Hex ID of the NFT
+//   - from: Address owning the NFT, directly or through a change address
+//   - to: Recipient's address
+//   - options: The fee
+//   - node: The node to send the transaction to, with an empty address to use the local mempool
+func (cli *CLI) nftTransfer(id []byte, from, to string, options SendOptions, node nodeClientOptions) {
+	bc := NewBlockchain(from)
+	defer bc.db.Close()
+
+	wallet := NewWallet()
+	cli.expireMempool(bc)
+
+	tx, err := NewNFTTransferTransaction(id, from, to, options, &UTXOSet{bc}, wallet)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	wallet.SaveToFile()
+
+	relayTransaction(bc, tx, node)
+}
+
+// nftOwner prints the owner of an NFT, its content and the transactions
+// that carried it since it was minted
+// Parameters:
+//   - id: Hex ID of the NFT
+func (cli *CLI) nftOwner(id []byte) {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	lineage, data, err := bc.NFTLineage(id)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if jsonOutput {
+		type transfer struct {
+			Txid  string `json:"txid"`
+			Vout  int    `json:"vout"`
+			Owner string `json:"owner"`
+		}
+		var transfers []transfer
+		for _, t := range lineage {
+			transfers = append(transfers, transfer{hex.EncodeToString(t.Txid), t.Vout, t.Owner})
+		}
+		printJSON(struct {
+			NFT       string     `json:"nft"`
+			Owner     string     `json:"owner"`
+			Data      string     `json:"data"`
+			Transfers []transfer `json:"transfers"`
+		}{hex.EncodeToString(id), lineage[0].Owner, hex.EncodeToString(data), transfers})
+		return
+	}
+
+	fmt.Printf("NFT: %x\n", id)
+	fmt.Printf("Owner: %s\n", lineage[0].Owner)
+	fmt.Printf("Output: %x:%d\n", lineage[0].Txid, lineage[0].Vout)
+	fmt.Printf("Data: %x\n", data)
+	fmt.Printf("Minted in: %x\n", lineage[len(lineage)-1].Txid)
+	fmt.Printf("Transfers: %d\n", len(lineage)-1)
+	for _, t := range lineage {
+		fmt.Printf("  %x:%d %s\n", t.Txid, t.Vout, t.Owner)
+	}
+}
+
+// contractDeploy deploys a contract in a new transaction paid for by an
+// address
+// Parameters:
+//   - from: The address paying the fee
+//   - code: The bytecode of the contract, see contractvm.go
+//   - options: The fee
+//   - node: The node to send the transaction to, with an empty address to use the local mempool
+func (cli *CLI) contractDeploy(from string, code []byte, options SendOptions, node nodeClientOptions) {
+	bc := NewBlockchain(from)
+	defer bc.db.Close()
+
+	if !contractsEnabled {
+		fmt.Println(errContractsDisabled)
+		os.Exit(1)
+	}
+
+	wallet := NewWallet()
+	cli.expireMempool(bc)
+
+	tx := NewContractTransaction(from, contractDeployData(code), options, &UTXOSet{bc}, wallet)
+	wallet.SaveToFile()
+
+	printNote("Deploying contract %x\n", contractID(tx.ID, 0))
+	relayTransaction(bc, tx, node)
+}
+
+// contractCall calls a contract in a new transaction paid for by an
+// address. The call is first run against the current storage, so a call
+// that would fail isn't sent.
+// Parameters:
+//   - from: The address paying the fee
+//   - call: The contract and arguments
+//   - options: The fee
+//   - node: The node to send the transaction to, with an empty address to use the local mempool
+func (cli *CLI) contractCall(from string, call ContractCall, options SendOptions, node nodeClientOptions) {
+	bc := NewBlockchain(from)
+	defer bc.db.Close()
+
+	result, err := bc.SimulateContractCall(call)
+	if err != nil {
+		fmt.Printf("Call fails: %v\n", err)
+		os.Exit(1)
+	}
+	printNote("Call uses %d gas and writes %d storage keys at the tip\n", result.GasUsed, len(result.Writes))
+
+	wallet := NewWallet()
+	cli.expireMempool(bc)
+
+	tx := NewContractTransaction(from, contractCallData(call), options, &UTXOSet{bc}, wallet)
+	wallet.SaveToFile()
+
+	relayTransaction(bc, tx, node)
+}
+
+// contractGet prints a storage value of a contract
+// Parameters:
+//   - id: ID of the contract
+//   - key: The storage key
+func (cli *CLI) contractGet(id []byte, key int64) {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	v, err := bc.GetContractStorage(id, key)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if jsonOutput {
+		printJSON(struct {
+			Contract string `json:"contract"`
+			Key      int64  `json:"key"`
+			Value    int64  `json:"value"`
+		}{hex.EncodeToString(id), key, v})
+		return
+	}
+	fmt.Printf("Contract %x key %d: %d\n", id, key, v)
+}
+
+// mine mines the mempool into a new block, paying the block reward to an address
+// Parameters:
+//   - address: The address to pay the block reward to
+func (cli *CLI) mine(address string) {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	mempool := Mempool{bc}
+	cli.expireMempool(bc)
+	for txID, err := range mempool.DropInvalid() {
+		printNote("Dropped pending transaction %s: %v\n", txID, err)
+	}
+
+	txs := mempool.AssembleBlock(address)
+	block := cli.mineBlock(bc, txs)
+	rememberAddress(address)
+	if jsonOutput {
+		printJSON(struct {
+			Hash         string `json:"hash"`
+			Height       int    `json:"height"`
+			Transactions int    `json:"transactions"`
+		}{hex.EncodeToString(block.Hash), block.Height, len(txs)})
+		return
+	}
+	fmt.Printf("Mined block %x with %d transactions\n", block.Hash, len(txs))
+}
+
+// expireMempool evicts the mempool transactions that waited longer than
+// -mempoolexpiry to be mined, printing each with its raw transaction so it
+// can be sent again with sendrawtransaction
+// Parameters:
+//   - bc: The blockchain
+func (cli *CLI) expireMempool(bc *Blockchain) {
+	for _, tx := range (Mempool{bc}).Expire() {
+		printNote("Pending transaction %x expired after %v unmined: %s\n", tx.ID, mempoolExpiry, EncodeRawTransaction(tx))
+	}
+}
+
+// benchMine mines throwaway blocks for a while and prints the hash rate and
+// the block interval it gives, at the benchmarked difficulty and at the one
+// that would keep blocks targetSpacing apart
+// Parameters:
+//   - bits: Leading zero bits the block hashes need
+//   - duration: How long to mine
+func (cli *CLI) benchMine(bits int, duration time.Duration) {
+	printNote("Mining blocks needing %d zero bits for %v with %d workers...\n", bits, duration, max(miningWorkers, 1))
+	result := benchmarkMining(bits, duration)
+
+	if jsonOutput {
+		printJSON(struct {
+			Bits             int     `json:"bits"`
+			Workers          int     `json:"workers"`
+			Seconds          float64 `json:"seconds"`
+			Blocks           int     `json:"blocks"`
+			Hashes           uint64  `json:"hashes"`
+			HashesPerSec     float64 `json:"hashespersec"`
+			HashesPerBlock   float64 `json:"hashesperblock"`
+			ExpectedInterval float64 `json:"expectedinterval"`
+			MeasuredInterval float64 `json:"measuredinterval,omitempty"`
+			SpacingBits      int     `json:"spacingbits"`
+		}{result.Bits, max(miningWorkers, 1), result.Duration.Seconds(), result.Blocks, result.Hashes, result.HashRate,
+			result.HashesPerBlock, result.ExpectedInterval.Seconds(), result.MeasuredInterval.Seconds(), result.SpacingBits})
+		return
+	}
+
+	fmt.Printf("Blocks found: %d\n", result.Blocks)
+	fmt.Printf("Hashes: %d\n", result.Hashes)
+	fmt.Printf("Hash rate: %s\n", formatHashRate(result.HashRate))
+	fmt.Printf("Expected block interval: %v (%.0f hashes a block on average)\n", result.ExpectedInterval, result.HashesPerBlock)
+	if result.Blocks > 0 {
+		fmt.Printf("Measured block interval: %v\n", result.MeasuredInterval)
+	}
+	fmt.Printf("Bits for a block every %ds: %d\n", targetSpacing, result.SpacingBits)
+}
+
+// mineBlock mines transactions into a new block until it's found or the user
+// interrupts it with Ctrl-C, which exits
+// Parameters:
+//   - bc: The blockchain
+//   - txs: The transactions of the block
+func (cli *CLI) mineBlock(bc *Blockchain, txs []*Transaction) *Block {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	block, err := bc.MineBlock(ctx, txs)
+	if err != nil {
+		fmt.Println(err)
+		bc.db.Close()
+		os.Exit(1)
+	}
+
+	return block
+}
+
+// createUnsignedTx builds a transaction like send does, but instead of mining it
+// saves it unsigned to a file so it can be signed on an offline machine.
+// Parameters:
+//   - from: Source wallet address
+//   - to: Destination wallet address
+//   - amount: Number of coins to transfer
+//   - options: The fee and lock time, see SendOptions
+//   - outFile: File to save the unsigned transaction to
+func (cli *CLI) createUnsignedTx(from, to string, amount int, options SendOptions, outFile string) {
+	bc := NewBlockchain(from)
+	defer bc.db.Close()
+
+	UTXOSet := UTXOSet{bc}
+	wallet := NewWallet()
+
+	ptx := NewUnsignedTransaction(from, to, amount, options, &UTXOSet, wallet)
+	// Persist the change address so it's never lost
+	wallet.SaveToFile()
+
+	err := ptx.WriteToFile(outFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printJSON(struct {
+			File string `json:"file"`
+		}{outFile})
+		return
+	}
+	fmt.Printf("Unsigned transaction saved to %s\n", outFile)
+}
+
+// signTx signs a transaction file with the local wallet. This doesn't need the
+// blockchain, so it can be run on an air-gapped machine holding the wallet.
+// Parameters:
+//   - inFile: File with the unsigned transaction
+//   - outFile: File to save the signed transaction to
+func (cli *CLI) signTx(inFile, outFile string) {
+	ptx, err := ReadPortableTransaction(inFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	wallet := NewWallet()
+	err = ptx.Sign(wallet)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// Signing may have discovered change addresses derived by the online wallet
+	wallet.SaveToFile()
+
+	err = ptx.WriteToFile(outFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printJSON(struct {
+			File string `json:"file"`
+		}{outFile})
+		return
+	}
+	fmt.Printf("Signed transaction saved to %s\n", outFile)
+}
+
+// broadcastTx verifies a signed transaction file against the blockchain and
+// adds the transaction to a new block, or hands it to a node if one is given.
+// Parameters:
+//   - inFile: File with the signed transaction
+//   - node: The node to send the transaction to, with an empty address to mine locally
+func (cli *CLI) broadcastTx(inFile string, node nodeClientOptions) {
+	ptx, err := ReadPortableTransaction(inFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	bc := NewBlockchain(ptx.From)
+	defer bc.db.Close()
+
+	err = ptx.Verify(&UTXOSet{bc})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	tx, err := ptx.Transaction()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if node.Addr != "" {
+		sendToNode(node, tx)
+		return
+	}
+
+	// Mined blocks aren't validated again, so a locked transaction must wait
+	err = UTXOSet{bc}.VerifyTransaction(tx)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	block := cli.mineBlock(bc, []*Transaction{tx})
+	if jsonOutput {
+		printJSON(struct {
+			Txid      string `json:"txid"`
+			BlockHash string `json:"blockhash"`
+		}{hex.EncodeToString(tx.ID), hex.EncodeToString(block.Hash)})
+		return
+	}
+	fmt.Printf("Success! Transaction %x\n", tx.ID)
+}
+
+// createRawTransaction prints an unsigned raw transaction spending and
+// creating the given outputs. This needs neither the blockchain nor the
+// wallet: the outputs spent are checked when the transaction is signed.
+// Parameters:
+//   - inputs: The outputs to spend
+//   - outputs: The new outputs
+//   - lockTime: Height or Unix time before which it can't be mined
+func (cli *CLI) createRawTransaction(inputs []TXInput, outputs []TXOutput, lockTime int64) {
+	tx, err := NewRawTransaction(inputs, outputs, lockTime)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	printRawTransaction(tx, false)
+}
+
+// printRawTransaction prints a hex encoded transaction, as JSON with its ID
+// and whether it's fully signed with -json
+// Parameters:
+//   - tx: The transaction
+//   - complete: Whether every input is signed
+func printRawTransaction(tx *Transaction, complete bool) {
+	if jsonOutput {
+		printJSON(struct {
+			Hex      string `json:"hex"`
+			Txid     string `json:"txid"`
+			Complete bool   `json:"complete"`
+		}{EncodeRawTransaction(tx), hex.EncodeToString(tx.ID), complete})
+		return
+	}
+	fmt.Println(EncodeRawTransaction(tx))
+}
+
+// signRawTransaction signs the inputs of a raw transaction spending outputs
+// of an address or its change addresses, and prints the transaction. Inputs
+// of other addresses are left unsigned, which is reported on stderr so the
+// output can still be piped to the next signer.
+// Parameters:
+//   - data: The hex encoded transaction
+//   - from: The address whose outputs to unlock
+func (cli *CLI) signRawTransaction(data, from string) {
+	tx, err := DecodeRawTransaction(data)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	bc := NewBlockchain(from)
+	defer bc.db.Close()
+
+	wallet := NewWallet()
+	complete, err := SignRawTransaction(tx, from, &UTXOSet{bc}, wallet)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// Signing may have discovered change addresses derived by another copy of the wallet
+	wallet.SaveToFile()
+
+	printRawTransaction(tx, complete)
+	if !complete && !jsonOutput {
+		fmt.Fprintln(os.Stderr, "Some inputs spend outputs of other addresses and are still unsigned")
+	}
+}
+
+// psbtCreate saves an unsigned raw transaction to a file as a partially
+// signed transaction, with the outputs it spends
+// Parameters:
+//   - data: The hex encoded unsigned transaction
+//   - outFile: File to save the partially signed transaction to
+func (cli *CLI) psbtCreate(data, outFile string) {
+	tx, err := DecodeRawTransaction(data)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	psbt, err := NewPSBT(tx, &UTXOSet{bc})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = psbt.WriteToFile(outFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printJSON(struct {
+			File     string `json:"file"`
+			Inputs   int    `json:"inputs"`
+			Unsigned int    `json:"unsigned"`
+		}{outFile, len(psbt.Inputs), psbt.Unsigned()})
+		return
+	}
+	fmt.Printf("Partially signed transaction with %d inputs to sign saved to %s\n", len(psbt.Inputs), outFile)
+}
+
+// psbtSign signs the inputs of a partially signed transaction spending
+// outputs of an address or its change addresses. This doesn't need the
+// blockchain, so each owner can sign on their own machine.
+// Parameters:
+//   - inFile: File with the partially signed transaction
+//   - from: The address whose outputs to unlock
+//   - outFile: File to save the transaction to
+func (cli *CLI) psbtSign(inFile, from, outFile string) {
+	psbt, err := ReadPSBT(inFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	wallet := NewWallet()
+	signed := psbt.Sign(from, wallet)
+	// Signing may have discovered change addresses derived by another copy of the wallet
+	wallet.SaveToFile()
+
+	err = psbt.WriteToFile(outFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printJSON(struct {
+			File     string `json:"file"`
+			Inputs   int    `json:"inputs"`
+			Unsigned int    `json:"unsigned"`
+		}{outFile, len(psbt.Inputs), psbt.Unsigned()})
+		return
+	}
+	fmt.Printf("Signed %d inputs, %d left unsigned, saved to %s\n", signed, psbt.Unsigned(), outFile)
+}
+
+// psbtCombine merges copies of a partially signed transaction signed
+// separately
+// Parameters:
+//   - inFiles: Files with the copies
+//   - outFile: File to save the combined transaction to
+func (cli *CLI) psbtCombine(inFiles []string, outFile string) {
+	var psbts []*PSBT
+	for _, inFile := range inFiles {
+		psbt, err := ReadPSBT(inFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		psbts = append(psbts, psbt)
+	}
+
+	combined, err := CombinePSBTs(psbts)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = combined.WriteToFile(outFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printJSON(struct {
+			File     string `json:"file"`
+			Inputs   int    `json:"inputs"`
+			Unsigned int    `json:"unsigned"`
+		}{outFile, len(combined.Inputs), combined.Unsigned()})
+		return
+	}
+	fmt.Printf("Combined %d copies, %d inputs left unsigned, saved to %s\n", len(psbts), combined.Unsigned(), outFile)
+}
+
+// psbtFinalize prints a fully signed partially signed transaction as a raw
+// transaction, ready for sendrawtransaction
+// Parameters:
+//   - inFile: File with the partially signed transaction
+func (cli *CLI) psbtFinalize(inFile string) {
+	psbt, err := ReadPSBT(inFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	tx, err := psbt.Finalize()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	printRawTransaction(tx, true)
+}
+
+// sendRawTransaction validates a signed raw transaction and adds it to the
+// mempool, or hands it to a node if one is given.
+// Parameters:
+//   - data: The hex encoded transaction
+//   - node: The node to send the transaction to, with an empty address to use the local mempool
+func (cli *CLI) sendRawTransaction(data string, node nodeClientOptions) {
+	tx, err := DecodeRawTransaction(data)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if node.Addr != "" {
+		sendToNode(node, tx)
+		return
+	}
+
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	err = Mempool{bc}.Add(tx)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printSentTransaction(tx, "")
+		return
+	}
+	fmt.Printf("Transaction %x added to the mempool, mine it with mine -address ADDRESS\n", tx.ID)
+}
+
+// lockUnspent locks or unlocks an output in the wallet. Locked outputs are
+// skipped by coin selection, so send won't spend them until they're unlocked.
+// Parameters:
+//   - txID: Hex ID of the transaction containing the output
+//   - vout: Index of the output in the transaction
+//   - unlock: Unlock the output instead of locking it
+func (cli *CLI) lockUnspent(txID string, vout int, unlock bool) {
+	// Coin selection looks outputs up by the lowercase hex ID
+	id, err := hex.DecodeString(txID)
+	if err != nil {
+		fmt.Printf("Invalid transaction ID %q: %v\n", txID, err)
+		os.Exit(1)
+	}
+	txID = hex.EncodeToString(id)
+
+	wallet := NewWallet()
+
+	if unlock {
+		if !wallet.UnlockOutput(txID, vout) {
+			fmt.Printf("Output %s is not locked.\n", outpointKey(txID, vout))
+			os.Exit(1)
+		}
+		wallet.SaveToFile()
+		printLockedOutput(txID, vout, false)
+		return
+	}
+
+	wallet.LockOutput(txID, vout)
+	wallet.SaveToFile()
+	printLockedOutput(txID, vout, true)
+}
+
+// printLockedOutput prints an output that was locked or unlocked
+// Parameters:
+//   - txID: Hex ID of the transaction containing the output
+//   - vout: Index of the output in the transaction
+//   - locked: Whether it's locked now
+func printLockedOutput(txID string, vout int, locked bool) {
+	switch {
+	case jsonOutput:
+		printJSON(struct {
+			Txid   string `json:"txid"`
+			Vout   int    `json:"vout"`
+			Locked bool   `json:"locked"`
+		}{txID, vout, locked})
+	case locked:
+		fmt.Printf("Locked %s\n", outpointKey(txID, vout))
+	default:
+		fmt.Printf("Unlocked %s\n", outpointKey(txID, vout))
+	}
+}
+
+// listLockUnspent prints every output locked in the wallet
+func (cli *CLI) listLockUnspent() {
+	wallet := NewWallet()
+
+	var outpoints []string
+	for outpoint := range wallet.LockedOutputs {
+		outpoints = append(outpoints, outpoint)
+	}
+	sort.Strings(outpoints)
+
+	if jsonOutput {
+		// An empty list rather than null
+		printJSON(append([]string{}, outpoints...))
+		return
+	}
+
+	for _, outpoint := range outpoints {
+		fmt.Println(outpoint)
+	}
+}
+
+// listUnspent prints the unspent outputs of an address and its change
+// addresses, or of every address of the wallet, with their confirmations and
+// whether coin selection may spend them
+// Parameters:
+//   - address: The owner address, ignored with all
+//   - all: Whether to list the outputs of every address of the wallet
+func (cli *CLI) listUnspent(address string, all bool) {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	UTXOSet := UTXOSet{bc}
+	wallet := NewWallet()
+
+	owners := []string{address}
+	if all {
+		owners = wallet.Owners()
+	}
+
+	type unspentInfo struct {
+		Txid          string `json:"txid"`
+		Vout          int    `json:"vout"`
+		Address       string `json:"address"`
+		Value         int    `json:"value"`
+		Confirmations int    `json:"confirmations"`
+		Spendable     bool   `json:"spendable"`
+		Reason        string `json:"reason,omitempty"` // Why it isn't spendable
+	}
+	outputs := []unspentInfo{}
+	for _, owner := range owners {
+		for _, addr := range wallet.Addresses(owner) {
+			for _, u := range UTXOSet.ListUnspent(addr, wallet.LockedOutputs) {
+				outputs = append(outputs, unspentInfo{
+					Txid:          hex.EncodeToString(u.Txid),
+					Vout:          u.Vout,
+					Address:       addr,
+					Value:         u.Output.Value,
+					Confirmations: u.Confirmations,
+					Spendable:     u.Unspendable == "",
+					Reason:        u.Unspendable,
+				})
+			}
+		}
+	}
+
+	if jsonOutput {
+		printJSON(outputs)
+		return
+	}
+
+	for _, out := range outputs {
+		spendable := "spendable"
+		if !out.Spendable {
+			spendable = "not spendable, " + out.Reason
+		}
+		fmt.Printf("%s:%d %d to '%s', %d confirmations, %s\n", out.Txid, out.Vout, out.Value, out.Address, out.Confirmations, spendable)
+	}
+}
+
+// history prints the transactions of the active chain paying an address or
+// its change addresses or spending their outputs, oldest first, with the
+// amount each moved and the balance after it
+// Parameters:
+//   - address: The owner address
+func (cli *CLI) history(address string) {
+	bc := NewBlockchain("")
+	defer bc.db.Close()
+
+	wallet := NewWallet()
+	history, err := bc.AddressHistory(wallet.Addresses(address))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	type historyInfo struct {
+		Txid      string `json:"txid"`
+		Height    int    `json:"height"`
+		Time      int64  `json:"time"`
+		Direction string `json:"direction"`
+		Amount    int    `json:"amount"`
+		Balance   int    `json:"balance"`
+		Replaces  string `json:"replaces,omitempty"` // The transaction it replaced, see bumpfee
+	}
+	entries := []historyInfo{}
+	balance := 0
+	for _, entry := range history {
+		balance += entry.Net()
+		txID := hex.EncodeToString(entry.Txid)
+		entries = append(entries, historyInfo{
+			Txid:      txID,
+			Height:    entry.Height,
+			Time:      entry.Timestamp,
+			Direction: entry.Direction(),
+			Amount:    entry.Net(),
+			Balance:   balance,
+			Replaces:  wallet.Replacements[txID],
+		})
+	}
+
+	if jsonOutput {
+		printJSON(entries)
+		return
+	}
+
+	for _, entry := range entries {
+		replaces := ""
+		if entry.Replaces != "" {
+			replaces = ", replaces " + entry.Replaces
+		}
+		fmt.Printf("%d %s %s %-8s %+d, balance %d%s\n", entry.Height,
+			time.Unix(entry.Time, 0).UTC().Format(time.RFC3339), entry.Txid, entry.Direction, entry.Amount, entry.Balance, replaces)
+	}
+}
+
+// watch prints a line for each block connected to the chain of a running
+// node, as it arrives, connecting to the node's block feed again whenever
+// it's lost. It runs until interrupted.
+// Parameters:
+//   - api: HOST:PORT of the HTTP API of the node, or the URL of its feed
+//   - address: Only print the blocks touching this address or its change
+//     addresses, empty for every block
+func (cli *CLI) watch(api, address string) {
+	url := watchFeedURL(api)
+	addresses := make(map[string]bool)
+	if address != "" {
+		for _, addr := range NewWallet().Addresses(address) {
+			addresses[addr] = true
+		}
+	}
+
+	for {
+		err := watchBlocks(url, func() {
+			slog.Info("Watching blocks", "feed", url)
+		}, func(block *BlockInfo) {
+			if address != "" && !blockTouches(block, addresses) {
+				return
+			}
+
+			if jsonOutput {
+				printJSONLine(struct {
+					Height        int    `json:"height"`
+					Hash          string `json:"hash"`
+					Transactions  int    `json:"transactions"`
+					RewardAddress string `json:"rewardaddress"`
+				}{block.Height, block.Hash, len(block.Tx), rewardAddress(block)})
+				return
+			}
+			fmt.Println(formatWatchedBlock(block))
+		})
+		slog.Warn("Lost the block feed, connecting again", "feed", url, "err", err, "retry", watchRetryInterval)
+		time.Sleep(watchRetryInterval)
+	}
+}
+
+// paperWallet prints a paper wallet for an address: the address and all of
+// its change addresses as text and QR codes, ready to be printed for cold storage.
+// Parameters:
+//   - address: The wallet address to export
+//   - pngFile: Optional PNG file to write the address QR code to
+func (cli *CLI) paperWallet(address, pngFile string) {
+	wallet := NewWallet()
+	pw := NewPaperWallet(address, wallet)
+
+	if pngFile != "" {
+		err := pw.WritePNG(pngFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if jsonOutput {
+		printJSON(struct {
+			Address         string   `json:"address"`
+			ChangeAddresses []string `json:"changeaddresses"`
+			Seed            string   `json:"seed"`
+			PNG             string   `json:"png,omitempty"`
+		}{pw.Address, append([]string{}, pw.ChangeAddresses...), pw.Seed, pngFile})
+		return
+	}
+
+	fmt.Println(pw)
+	if pngFile != "" {
+		fmt.Printf("QR code saved to %s\n", pngFile)
+	}
+}
+
+// dumpSeed prints the seed the wallet derives change addresses from, to copy
+// it to another wallet with importseed
+func (cli *CLI) dumpSeed() {
+	wallet := NewWallet()
+	// A seed printed for the first time must stay the wallet's
+	wallet.SaveToFile()
+
+	seed := hex.EncodeToString(wallet.Seed)
+	if jsonOutput {
+		printJSON(struct {
+			Seed string `json:"seed"`
+		}{seed})
+		return
+	}
+	fmt.Println(seed)
+}
+
+// importSeed makes the wallet derive change addresses from the seed of
+// another wallet, printed by dumpseed, so both recognize the same change
+// addresses
+// Parameters:
+//   - seedHex: The seed in hex
+func (cli *CLI) importSeed(seedHex string) {
+	wallet := NewWallet()
+	seed, err := hex.DecodeString(seedHex)
+	if err == nil {
+		err = wallet.SetSeed(seed)
+	}
+	if err != nil {
+		fmt.Printf("Invalid seed: %v\n", err)
+		os.Exit(1)
+	}
+	wallet.SaveToFile()
+	if jsonOutput {
+		printJSON(struct {
+			Seed string `json:"seed"`
+		}{hex.EncodeToString(seed)})
+		return
+	}
+	fmt.Println("Seed imported")
+}
+
+// splitList splits a comma separated flag value, ignoring empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// loadWebhooks reads the webhooks file of the -webhooks flag, exiting if it's invalid
+// Parameters:
+//   - filename: The webhooks file, empty for none
+func (cli *CLI) loadWebhooks(filename string) []Webhook {
+	if filename == "" {
+		return nil
+	}
+
+	hooks, err := LoadWebhooks(filename)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	return hooks
+}
+
+// applyParams runs with the chain parameters of the -params file, exiting if
+// it's invalid
+// Parameters:
+//   - filename: The parameters file, empty for the network's parameters
+func (cli *CLI) applyParams(filename string) {
+	if filename == "" {
+		return
+	}
+
+	params, err := loadChainParams(filename)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	params.apply()
+}
+
+// nodeFlags are the flags shared by the commands running a node
+type nodeFlags struct {
+	port        *int    // TCP port to listen on, 0 for the network's port
+	peers       *string // Comma separated addresses of the nodes to connect to
+	seeds       *string // Comma separated addresses of seed nodes
+	dnsSeeds    *string // Comma separated DNS names resolving to seed nodes
+	maxOutbound *int    // Maximum number of connections to discovered nodes
+	http        *string // Address to serve the HTTP API on
+	grpc        *string // Address to serve the gRPC API on
+	webhooks    *string // JSON file with the webhooks to notify
+	compress    *bool   // Compress block messages
+	tls         *bool   // Encrypt connections with TLS
+	tlsPin      *string // PEM file with the certificates of the nodes to trust
+	params      *string // JSON file with the parameters of the chain to download
+}
+
+// addNodeFlags defines the flags shared by the commands running a node
+// Parameters:
+//   - cmd: The flags of the command
+func addNodeFlags(cmd *pflag.FlagSet) *nodeFlags {
+	return &nodeFlags{
+		port:        cmd.Int("port", 0, "TCP port to listen on, by default the network's port"),
+		peers:       cmd.String("peers", "", "Comma separated addresses of the nodes to connect to"),
+		seeds:       cmd.String("seeds", "", "Comma separated addresses of seed nodes to discover peers with"),
+		dnsSeeds:    cmd.String("dnsseeds", "", "Comma separated DNS names resolving to seed nodes"),
+		maxOutbound: cmd.Int("maxoutbound", defaultMaxOutbound, "Maximum number of connections to discovered nodes"),
+		http:        cmd.String("http", "", "Address to serve the HTTP API on, for example :8080"),
+		grpc:        cmd.String("grpc", "", "Address to serve the gRPC API on, for example :9090"),
+		webhooks:    cmd.String("webhooks", "", "JSON file with the webhooks to notify"),
+		compress:    cmd.Bool("compress", false, "Compress block messages to peers that also use -compress"),
+		tls:         cmd.Bool("tls", false, "Encrypt connections with TLS, generating a certificate on the first run"),
+		tlsPin:      cmd.String("tlspin", "", "PEM file with the certificates of the nodes to trust"),
+		params:      cmd.String("params", "", "JSON file with the parameters of the chain to download, ignored once it's stored"),
+	}
+}
+
+// nodeConfig returns the configuration of a node given by the parsed node
+// flags of a command, loading its webhooks and chain parameters. The role
+// and reward address are left to the command.
+// Parameters:
+//   - cmd: The command, whose usage is printed for invalid flags
+//   - flags: The node flags of the command
+func (cli *CLI) nodeConfig(cmd *cobra.Command, flags *nodeFlags) ServerConfig {
+	if *flags.port < 0 {
+		exitUsage(cmd)
+	}
+	if *flags.port == 0 {
+		*flags.port = defaultNodePort
+	}
+	webhooks := cli.loadWebhooks(*flags.webhooks)
+	cli.applyParams(*flags.params)
+
+	return ServerConfig{
+		Port:        *flags.port,
+		Peers:       splitList(*flags.peers),
+		Seeds:       splitList(*flags.seeds),
+		DNSSeeds:    splitList(*flags.dnsSeeds),
+		MaxOutbound: *flags.maxOutbound,
+		Compress:    *flags.compress,
+		HTTPAddr:    *flags.http,
+		GRPCAddr:    *flags.grpc,
+		Webhooks:    webhooks,
+		TLS:         *flags.tls || *flags.tlsPin != "",
+		TLSPinFile:  *flags.tlsPin,
+	}
+}
+
+// chainTest runs the chaintest suite, exiting if a step fails
+// Parameters:
+//   - options: The nodes to test and how, see ChainTestOptions
+func (cli *CLI) chainTest(options ChainTestOptions) {
+	err := RunChainTest(options)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("All steps passed")
+}
+
+// startNode runs a network node until it's interrupted. Without a local
+// blockchain the node downloads the chain from its peers, the seeds or the
+// peers it remembers from earlier runs. With -ephemeral and no peers, a miner
+// starts a new chain in memory instead, paying its genesis reward to its
+// reward address.
+// Parameters:
+//   - config: The node options
+func (cli *CLI) startNode(config ServerConfig) {
+	switch config.Role {
+	case roleFull, roleWallet:
+	case roleMiner:
+		if config.RewardAddress == "" {
+			fmt.Println("A miner needs -rewardaddress to pay its block rewards to.")
+			os.Exit(1)
+		}
+		rememberAddress(config.RewardAddress)
+	default:
+		fmt.Printf("Unknown role %q, expected %s, %s or %s.\n", config.Role, roleFull, roleMiner, roleWallet)
+		os.Exit(1)
+	}
+
+	var bc *Blockchain
+	if dbExists() {
+		bc = NewBlockchain("")
+	} else if ephemeral && len(config.Peers) == 0 && len(config.Seeds) == 0 && len(config.DNSSeeds) == 0 && config.RewardAddress != "" {
+		// A demo chain of its own, gone when the node stops
+		bc = CreateBlockchain(config.RewardAddress)
+	} else if len(config.Peers) == 0 && len(config.Seeds) == 0 && len(config.DNSSeeds) == 0 && len(LoadPeerStore().Addresses()) == 0 {
+		fmt.Println("No existing blockchain found. Create one first, or give -peers or seeds to download it.")
+		os.Exit(1)
+	}
+
+	server := NewServer(config, bc)
+
+	// Close the database cleanly on Ctrl-C
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		server.Shutdown()
+		os.Exit(0)
+	}()
+
+	err := server.Start()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// serve runs the HTTP and gRPC APIs over the local blockchain until it's interrupted
+// Parameters:
+//   - httpAddr: Address to serve the HTTP API on, empty for none
+//   - grpcAddr: Address to serve the gRPC API on, empty for none
+//   - webhooks: The webhooks to notify of new blocks
+//   - node: The node to send posted transactions to, with an empty address to
+//     mine them locally. With TLS the APIs are served over TLS too.
+func (cli *CLI) serve(httpAddr, grpcAddr string, webhooks []Webhook, node nodeClientOptions) {
+	var config *tls.Config
+	if node.TLS {
+		cert, err := loadOrCreateCertificate()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		config = serverTLSConfig(cert)
+		slog.Info("TLS certificate", hashAttr("fingerprint", certFingerprint(cert.Certificate[0])))
+	}
+
+	bc := NewBlockchain("")
+
+	api, err := NewAPIServer(bc, node)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// Close the database cleanly on Ctrl-C
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		api.mu.Lock()
+		bc.db.Close()
+		os.Exit(0)
+	}()
+
+	api.RunWebhooks(webhooks)
+
+	// Stop on the first API failing
+	errs := make(chan error, 2)
+	if httpAddr != "" {
+		go func() { errs <- api.ListenAndServe(httpAddr, config) }()
+	}
+	if grpcAddr != "" {
+		go func() { errs <- api.ServeGRPC(grpcAddr, config) }()
+	}
+
+	fmt.Println(<-errs)
+	os.Exit(1)
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Coin selection picks the outputs a new transaction spends among the
+// spendable outputs of the sender, see FindSpendableOutputs. The strategies
+// are deterministic: the same outputs give the same selection.
+//   - first: The outputs in the order of the address index, the sender's
+//     address first and then its change addresses, until the amount is covered
+//   - largest: The largest outputs first, spending as few outputs as possible
+//   - smallest: The smallest outputs first, consolidating small outputs into
+//     the change
+//   - bnb: Branch and bound, like Bitcoin Core's: outputs adding up to the
+//     amount exactly, so the transaction needs no change output, falling
+//     back to largest first when no combination does
+
+// defaultCoinSelection is the coin selection strategy of transactions that
+// don't choose one
+const defaultCoinSelection = "first"
+
+// bnbMaxTries bounds the branches the branch and bound search visits, like
+// Bitcoin Core's 100,000
+const bnbMaxTries = 100000
+
+// SpendableOutput is an unspent output of the wallet that coin selection
+// can spend
+type SpendableOutput struct {
+	Txid   []byte   // ID of the transaction containing the output
+	Vout   int      // Index of the output in the transaction
+	Output TXOutput // The output, its ScriptPubKey is the address unlocking it
+}
+
+// CoinSelector chooses outputs whose values add up to at least a target
+// Parameters:
+//   - candidates: The spendable outputs, which it must not reorder
+//   - target: The value to cover
+//
+// Returns:
+//   - []SpendableOutput: The selected outputs, nil if all of them aren't enough
+type CoinSelector func(candidates []SpendableOutput, target int) []SpendableOutput
+
+// coinSelectors are the coin selection strategies, by name
+var coinSelectors = map[string]CoinSelector{
+	"first":    selectFirst,
+	"largest":  selectLargestFirst,
+	"smallest": selectSmallestFirst,
+	"bnb":      selectBranchAndBound,
+}
+
+// lookupCoinSelector returns the coin selection strategy with a name, an
+// empty one being defaultCoinSelection
+// Parameters:
+//   - name: Name of the strategy
+//
+// Returns:
+//   - CoinSelector: The strategy
+//   - error: If there is none with that name
+func lookupCoinSelector(name string) (CoinSelector, error) {
+	if name == "" {
+		name = defaultCoinSelection
+	}
+
+	selector, ok := coinSelectors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown coin selection %q, use one of %s", name, strings.Join(coinSelectionNames(), ", "))
+	}
+
+	return selector, nil
+}
+
+// coinSelectionNames returns the names of the coin selection strategies, sorted
+func coinSelectionNames() []string {
+	names := make([]string, 0, len(coinSelectors))
+	for n := range coinSelectors {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// selectFirst takes the outputs in order until they cover the target
+func selectFirst(candidates []SpendableOutput, target int) []SpendableOutput {
+	var selected []SpendableOutput
+	total := 0
+	for _, c := range candidates {
+		if total >= target {
+			break
+		}
+		selected = append(selected, c)
+		total += c.Output.Value
+	}
+
+	if total < target {
+		return nil
+	}
+	return selected
+}
+
+// selectLargestFirst takes the largest outputs first
+func selectLargestFirst(candidates []SpendableOutput, target int) []SpendableOutput {
+	return selectFirst(sortedByValue(candidates, true), target)
+}
+
+// selectSmallestFirst takes the smallest outputs first
+func selectSmallestFirst(candidates []SpendableOutput, target int) []SpendableOutput {
+	return selectFirst(sortedByValue(candidates, false), target)
+}
+
+// selectBranchAndBound searches, the largest outputs first, for a set of
+// outputs adding up to exactly the target. A branch is abandoned once it
+// exceeds the target or the outputs left can't reach it, and excluding an
+// output also excludes the following ones of the same value, whose branches
+// would add up to the same sums. Without an exact match after bnbMaxTries
+// branches it falls back to selectLargestFirst.
+func selectBranchAndBound(candidates []SpendableOutput, target int) []SpendableOutput {
+	sorted := sortedByValue(candidates, true)
+
+	// remaining[i] is the value of the outputs from i on
+	remaining := make([]int, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + sorted[i].Output.Value
+	}
+
+	var chosen []SpendableOutput
+	tries := 0
+	var search func(i, sum int) bool
+	search = func(i, sum int) bool {
+		if sum == target {
+			return true
+		}
+		if i == len(sorted) || sum > target || sum+remaining[i] < target || tries >= bnbMaxTries {
+			return false
+		}
+		tries++
+
+		// Include the output
+		chosen = append(chosen, sorted[i])
+		if search(i+1, sum+sorted[i].Output.Value) {
+			return true
+		}
+		chosen = chosen[:len(chosen)-1]
+
+		// Exclude it and the outputs of the same value
+		next := i + 1
+		for next < len(sorted) && sorted[next].Output.Value == sorted[i].Output.Value {
+			next++
+		}
+		return search(next, sum)
+	}
+
+	if target > 0 && search(0, 0) {
+		return chosen
+	}
+	return selectFirst(sorted, target)
+}
+
+// sortedByValue returns the outputs sorted by value, keeping the order of
+// the outputs of the same value
+// Parameters:
+//   - candidates: The outputs, left as they are
+//   - descending: Whether the largest come first
+func sortedByValue(candidates []SpendableOutput, descending bool) []SpendableOutput {
+	sorted := slices.Clone(candidates)
+	slices.SortStableFunc(sorted, func(a, b SpendableOutput) int {
+		if descending {
+			return cmp.Compare(b.Output.Value, a.Output.Value)
+		}
+		return cmp.Compare(a.Output.Value, b.Output.Value)
+	})
+
+	return sorted
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// testCandidates returns spendable outputs with the given values, output i
+// having Vout i
+func testCandidates(values ...int) []SpendableOutput {
+	candidates := make([]SpendableOutput, len(values))
+	for i, value := range values {
+		candidates[i] = SpendableOutput{Txid: []byte{byte(i)}, Vout: i, Output: TXOutput{Value: value, ScriptPubKey: "alice"}}
+	}
+
+	return candidates
+}
+
+// selectedVouts returns the Vout of each selected output, in order
+func selectedVouts(selected []SpendableOutput) []int {
+	if selected == nil {
+		return nil
+	}
+
+	vouts := make([]int, len(selected))
+	for i, s := range selected {
+		vouts[i] = s.Vout
+	}
+
+	return vouts
+}
+
+func TestCoinSelection(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		values   []int
+		target   int
+		want     []int // Vouts of the selected outputs, nil if none
+	}{
+		{"first in order", "first", []int{5, 3, 8, 2}, 7, []int{0, 1}},
+		{"first exact", "first", []int{5, 3, 8, 2}, 5, []int{0}},
+		{"first all", "first", []int{5, 3, 8, 2}, 18, []int{0, 1, 2, 3}},
+		{"first short", "first", []int{5, 3, 8, 2}, 19, nil},
+		{"largest", "largest", []int{5, 3, 8, 2}, 10, []int{2, 0}},
+		{"largest single", "largest", []int{5, 3, 8, 2}, 8, []int{2}},
+		{"largest ties keep order", "largest", []int{4, 6, 4, 6}, 12, []int{1, 3}},
+		{"largest short", "largest", []int{5, 3}, 9, nil},
+		{"smallest", "smallest", []int{5, 3, 8, 2}, 4, []int{3, 1}},
+		{"smallest ties keep order", "smallest", []int{4, 2, 4, 2}, 5, []int{1, 3, 0}},
+		{"smallest short", "smallest", []int{5, 3}, 9, nil},
+		{"bnb exact match", "bnb", []int{5, 3, 8, 2}, 10, []int{2, 3}},
+		{"bnb exact match skipping the largest", "bnb", []int{9, 4, 3, 2}, 5, []int{2, 3}},
+		{"bnb exact match of every output", "bnb", []int{5, 3, 8, 2}, 18, []int{2, 0, 1, 3}},
+		{"bnb falls back to largest", "bnb", []int{5, 3, 8}, 7, []int{2}},
+		{"bnb falls back to several largest", "bnb", []int{4, 6, 10}, 15, []int{2, 1}},
+		{"bnb short", "bnb", []int{5, 3}, 9, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selector, err := lookupCoinSelector(tt.strategy)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			candidates := testCandidates(tt.values...)
+			got := selectedVouts(selector(candidates, tt.target))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("%s selected %v for %d of %v, want %v", tt.strategy, got, tt.target, tt.values, tt.want)
+			}
+
+			// The same outputs give the same selection, and stay in order
+			again := selectedVouts(selector(candidates, tt.target))
+			if !slices.Equal(again, got) {
+				t.Errorf("%s selected %v, then %v", tt.strategy, got, again)
+			}
+			if !slices.Equal(selectedVouts(candidates), selectedVouts(testCandidates(tt.values...))) {
+				t.Errorf("%s reordered the candidates", tt.strategy)
+			}
+		})
+	}
+}
+
+func TestLookupCoinSelector(t *testing.T) {
+	for _, name := range append(coinSelectionNames(), "") {
+		_, err := lookupCoinSelector(name)
+		if err != nil {
+			t.Errorf("lookupCoinSelector(%q): %v", name, err)
+		}
+	}
+
+	_, err := lookupCoinSelector("random")
+	if err == nil {
+		t.Error("lookupCoinSelector accepted an unknown strategy")
+	}
+}
@@ -0,0 +1,1421 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// The commands are grouped by what they work on: wallet for the local wallet,
+// chain for the blockchain database, tx for building, signing and sending
+// transactions and node for the long running node and API servers. Every
+// command and group has --help, the global flags can be given anywhere on the
+// command line, and the commands keep working under their names from before
+// the groups, such as "go-blockchain getbalance", as hidden top-level
+// commands. Flags take one dash like before, -address, or two, --address.
+
+// nodeClientFlags are the flags of the commands that can hand their
+// transaction to a node
+type nodeClientFlags struct {
+	node   *string // Address of the node, empty for the local mempool
+	tls    *bool   // Connect to the node with TLS
+	tlsPin *string // PEM file with the node's trusted certificate
+}
+
+// addNodeClientFlags defines the flags of the commands that can hand their
+// transaction to a node
+// Parameters:
+//   - flags: The flags of the command
+//   - usage: Usage of the -node flag
+func addNodeClientFlags(flags *pflag.FlagSet, usage string) *nodeClientFlags {
+	return &nodeClientFlags{
+		node:   flags.String("node", "", usage),
+		tls:    flags.Bool("tls", false, "Connect to the node with TLS"),
+		tlsPin: flags.String("tlspin", "", "PEM file with the node's trusted certificate"),
+	}
+}
+
+// options returns the node given by the parsed flags
+func (f *nodeClientFlags) options() nodeClientOptions {
+	return nodeClientOptions{*f.node, *f.tls || *f.tlsPin != "", *f.tlsPin}
+}
+
+// exitUsage prints the usage of a command given invalid flags and exits
+func exitUsage(cmd *cobra.Command) {
+	cmd.Usage()
+	os.Exit(1)
+}
+
+// longFlagArgs rewrites single-dash long flags such as -address to the
+// double-dash form the flag parser expects, leaving negative numbers, the
+// one-letter -h and everything after "--" as they are
+// Parameters:
+//   - args: The command line arguments
+func longFlagArgs(args []string) []string {
+	result := make([]string, 0, len(args))
+
+	for i, arg := range args {
+		if arg == "--" {
+			return append(result, args[i:]...)
+		}
+		if len(arg) > 2 && arg[0] == '-' && arg[1] != '-' {
+			if _, err := strconv.ParseFloat(arg, 64); err != nil {
+				arg = "-" + arg
+			}
+		}
+		result = append(result, arg)
+	}
+
+	return result
+}
+
+// Run is the entry point for the CLI application. It parses the command line
+// and executes the command it names, see rootCommand.
+func (cli *CLI) Run() {
+	root := cli.rootCommand()
+	root.SetArgs(longFlagArgs(os.Args[1:]))
+
+	err := root.Execute()
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// rootCommand builds the command tree. The global flags select the network
+// and the data directory, with -datadir by default BLOCKCHAIN_DATA_DIR or a
+// directory of the user's configuration directory, limit the mempool with
+// -mempoolmaxtxs, -mempoolmaxsize, -mempoolexpiry, -minrelayfee and
+// -dustrelayfee, add -checkpoints, limit the goroutines mining blocks with
+// -miningworkers, size the caches with -utxocachesize and -blockcache and
+// the goroutines validating blocks with -validationworkers (see
+// resources.go), -ephemeral keeps the blockchain in memory instead of its
+// database file and -json prints the results as JSON. Flags left out are
+// taken from their BC_ environment variables, see env.go. The groups are:
+// - wallet: Balances, payments, locked outputs and paper wallets
+// - chain: Creating, mining, inspecting and maintaining the blockchain
+// - tx: Offline signing, raw and partially signed transactions, NFTs and contracts
+// - node: Network nodes, miners and the HTTP and gRPC APIs
+func (cli *CLI) rootCommand() *cobra.Command {
+	root := &cobra.Command{
+		Use:   "go-blockchain",
+		Short: "A proof of work blockchain with a wallet, a peer-to-peer network and APIs",
+		Long: "A proof of work blockchain with a wallet, a peer-to-peer network and APIs.\n\n" +
+			"Every flag can also be set with an environment variable named after it, such as BC_NETWORK for --network " +
+			"or BC_LOCKED_UNTIL for --locked-until. A flag given on the command line takes precedence over its variable.",
+	}
+
+	flags := root.PersistentFlags()
+	network := flags.String("network", activeNetwork.Name, "Network to use: mainnet, testnet or regtest")
+	globalDataDir := flags.String("datadir", dataDir, "Directory of the blockchain, wallet and peer files, by default $"+dataDirEnv+" or the user's one")
+	maxTxs := flags.Int("mempoolmaxtxs", mempoolMaxTxs, "Most transactions the mempool holds")
+	maxSize := flags.Int("mempoolmaxsize", mempoolMaxSize, "Most bytes of transactions the mempool holds, by default less with under 640 MB of memory")
+	expiry := flags.Duration("mempoolexpiry", mempoolExpiry, "How long a transaction may wait in the mempool to be mined")
+	relayFee := flags.Int("minrelayfee", minRelayFee, "Lowest fee rate the mempool accepts, in coins per 1000 bytes")
+	dustFee := flags.Int("dustrelayfee", dustRelayFee, "Fee rate outputs worth less than spending them are dust at, in coins per 1000 bytes")
+	checkpoints := flags.String("checkpoints", "", "Comma-separated HEIGHT:HASH blocks to add to the network's checkpoints")
+	workers := flags.Int("miningworkers", miningWorkers, "Goroutines mining blocks, by default one per CPU")
+	utxoCacheBytes := flags.Int("utxocachesize", utxoCacheSize, "Most bytes of decoded UTXO set entries cached, 0 for none, by default derived from the memory")
+	blockCacheSize := flags.Int("blockcache", blockCacheEntries, "Most decoded blocks cached, 0 for none, by default derived from the memory")
+	checkWorkers := flags.Int("validationworkers", validationWorkers, "Goroutines checking the transactions of a block, by default one per CPU and 128 MB of memory")
+	inMemory := flags.Bool("ephemeral", false, "Keep the blockchain in memory, without a database file, for tests and demos")
+	flags.BoolVar(&jsonOutput, "json", false, "Print the results as JSON for scripts")
+	logLevel := flags.String("loglevel", "info", "Lowest level logged: debug, info, warn or error")
+	logFormat := flags.String("logformat", logFormatText, "Format of the log on stderr: text or json")
+
+	root.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		// The completion request applies the globals of the command line it
+		// completes instead, see completionChain
+		if isCompletionRequest(cmd) {
+			return
+		}
+		applyEnv(cmd)
+
+		err := setupLogging(*logLevel, *logFormat)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		if *maxTxs < 1 || *maxSize < 1 {
+			fmt.Println("-mempoolmaxtxs and -mempoolmaxsize must be positive")
+			os.Exit(1)
+		}
+		mempoolMaxTxs = *maxTxs
+		mempoolMaxSize = *maxSize
+
+		if *expiry <= 0 {
+			fmt.Println("-mempoolexpiry must be positive")
+			os.Exit(1)
+		}
+		mempoolExpiry = *expiry
+
+		if *relayFee < 0 || *dustFee < 0 {
+			fmt.Println("-minrelayfee and -dustrelayfee can't be negative")
+			os.Exit(1)
+		}
+		minRelayFee = *relayFee
+		dustRelayFee = *dustFee
+
+		if *workers < 1 {
+			fmt.Println("-miningworkers must be positive")
+			os.Exit(1)
+		}
+		miningWorkers = *workers
+
+		if *utxoCacheBytes < 0 || *blockCacheSize < 0 {
+			fmt.Println("-utxocachesize and -blockcache can't be negative")
+			os.Exit(1)
+		}
+		setCacheLimits(*utxoCacheBytes, *blockCacheSize)
+		if *checkWorkers < 1 {
+			fmt.Println("-validationworkers must be positive")
+			os.Exit(1)
+		}
+		validationWorkers = *checkWorkers
+		ephemeral = *inMemory
+
+		dataDir = *globalDataDir
+		err = selectNetwork(*network)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		if *checkpoints != "" {
+			extra, err := parseCheckpoints(*checkpoints)
+			if err == nil {
+				err = addCheckpoints(extra)
+			}
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	groups := []struct {
+		name     string
+		aliases  []string
+		short    string
+		commands []func() *cobra.Command
+	}{
+		{"wallet", []string{"w"}, "Check balances and pay from the local wallet", []func() *cobra.Command{
+			cli.getBalanceCommand, cli.sendCommand, cli.bumpFeeCommand, cli.listUnspentCommand, cli.historyCommand,
+			cli.lockUnspentCommand, cli.listLockUnspentCommand, cli.paperWalletCommand,
+			cli.dumpSeedCommand, cli.importSeedCommand,
+		}},
+		{"chain", []string{"blockchain"}, "Create, mine, inspect and maintain the blockchain", []func() *cobra.Command{
+			cli.createBlockchainCommand, cli.mineCommand, cli.printChainCommand, cli.getChainInfoCommand,
+			cli.getBlockchainInfoCommand, cli.getBlockCommand, cli.getChainTipsCommand, cli.getBlockStatsCommand, cli.getMempoolInfoCommand,
+			cli.getDeploymentInfoCommand, cli.getMiningInfoCommand, cli.getMerkleProofCommand,
+			cli.verifyMerkleProofCommand, cli.invalidateBlockCommand, cli.reconsiderBlockCommand,
+			cli.reindexUTXOCommand, cli.checkBalancesCommand, cli.setArchiveDepthCommand,
+			cli.setPruneDepthCommand, cli.backupCommand, cli.restoreCommand, cli.exportChainCommand,
+			cli.importChainCommand, cli.benchCommand,
+		}},
+		{"tx", []string{"transaction"}, "Build, sign and send transactions, NFTs and contract calls", []func() *cobra.Command{
+			cli.getTransactionCommand, cli.createUnsignedTxCommand, cli.signTxCommand, cli.broadcastTxCommand,
+			cli.createRawTxCommand, cli.signRawTxCommand, cli.sendRawTxCommand, cli.psbtCommand,
+			cli.nftCommand, cli.contractCommand,
+		}},
+		{"node", []string{"n"}, "Run network nodes, miners and the HTTP and gRPC APIs", []func() *cobra.Command{
+			cli.startNodeCommand, cli.startMinerCommand, cli.serveCommand, cli.watchCommand, cli.chainTestCommand,
+		}},
+	}
+
+	for _, group := range groups {
+		groupCmd := &cobra.Command{
+			Use:     group.name,
+			Aliases: group.aliases,
+			Short:   group.short,
+		}
+		for _, newCommand := range group.commands {
+			groupCmd.AddCommand(newCommand())
+
+			// The commands were top-level before the groups
+			legacy := newCommand()
+			legacy.Hidden = true
+			root.AddCommand(legacy)
+		}
+		root.AddCommand(groupCmd)
+	}
+
+	root.AddCommand(cli.completionCommand())
+	registerCompletions(root)
+
+	return root
+}
+
+// getBalanceCommand builds the getbalance command
+func (cli *CLI) getBalanceCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "getbalance",
+		Aliases: []string{"balance"},
+		Short:   "Get the balance of an address and its change addresses, or of every address of the wallet",
+		Args:    cobra.NoArgs,
+	}
+	address := cmd.Flags().String("address", "", "The address to get balance for")
+	all := cmd.Flags().Bool("all", false, "Get the balance of every address of the wallet and their total")
+	cmd.MarkFlagsOneRequired("address", "all")
+	cmd.MarkFlagsMutuallyExclusive("address", "all")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		if *all {
+			cli.getWalletBalance()
+			return
+		}
+		if *address == "" {
+			exitUsage(cmd)
+		}
+		cli.getBalance(*address)
+	}
+
+	return cmd
+}
+
+// sendCommand builds the send command
+func (cli *CLI) sendCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "send",
+		Short: "Send coins to an address, through a node if given, or else the local mempool",
+		Long: "Send AMOUNT coins from FROM to TO, paying FEE coins to the miner, attaching up to 80 bytes of TEXT, " +
+			"locked until height or time N, which TO can only spend from HEIGHT on, and spending the outputs the " +
+			"coin selection strategy selects, through node HOST:PORT if given, or else through the local mempool.",
+		Args: cobra.NoArgs,
+	}
+	flags := cmd.Flags()
+	from := flags.String("from", "", "Source wallet address")
+	to := flags.String("to", "", "Destination wallet address")
+	amount := flags.Int("amount", 0, "Amount to send")
+	fee := flags.Int("fee", 0, "Fee paid to the miner")
+	text := flags.String("data", "", "Text to attach in an unspendable data-carrier output")
+	lockTime := flags.Int64("locktime", 0, "Height, or Unix time from 500000000 on, before which the transaction can't be mined")
+	lockedUntil := flags.Int("locked-until", 0, "Height before which the recipient can't spend the payment")
+	coinSelect := flags.String("coinselect", defaultCoinSelection, "Coin selection strategy: first, largest, smallest or bnb")
+	node := addNodeClientFlags(flags, "Node to send the transaction to instead of the local mempool")
+	dryRun := flags.Bool("dry-run", false, "Build, sign and check the transaction and print it, without sending it")
+	cmd.MarkFlagRequired("from")
+	cmd.MarkFlagRequired("to")
+	cmd.MarkFlagRequired("amount")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		if *amount <= 0 || *fee < 0 || *lockTime < 0 || *lockedUntil < 0 {
+			exitUsage(cmd)
+		}
+
+		var data []byte
+		if *text != "" {
+			data = []byte(*text)
+		}
+		if len(data) > maxDataCarrierSize {
+			fmt.Printf("-data can carry at most %d bytes, not %d\n", maxDataCarrierSize, len(data))
+			os.Exit(1)
+		}
+
+		if _, err := lookupCoinSelector(*coinSelect); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		cli.send(*from, *to, *amount, SendOptions{*fee, data, *lockTime, *lockedUntil, *coinSelect}, node.options(), *dryRun)
+	}
+
+	return cmd
+}
+
+// bumpFeeCommand builds the bumpfee command
+func (cli *CLI) bumpFeeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "bumpfee",
+		Short: "Replace a pending transaction of the wallet with one paying a higher fee",
+		Long: "Replace pending transaction TXID of the local mempool with one making the same payments and paying " +
+			"FEE coins to the miner, twice its fee by default, taken from the change.",
+		Args: cobra.NoArgs,
+	}
+	txID := cmd.Flags().String("tx", "", "ID of the pending transaction")
+	fee := cmd.Flags().Int("fee", 0, "New fee paid to the miner, twice the old one by default")
+	cmd.MarkFlagRequired("tx")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		if *fee < 0 {
+			exitUsage(cmd)
+		}
+		cli.bumpFee(*txID, *fee)
+	}
+
+	return cmd
+}
+
+// lockUnspentCommand builds the lockunspent command
+func (cli *CLI) lockUnspentCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "lockunspent",
+		Aliases: []string{"lock"},
+		Short:   "Exclude an output from coin selection, or include it again with -unlock",
+		Args:    cobra.NoArgs,
+	}
+	flags := cmd.Flags()
+	txID := flags.String("txid", "", "ID of the transaction containing the output")
+	vout := flags.Int("vout", -1, "Index of the output in the transaction")
+	unlock := flags.Bool("unlock", false, "Unlock the output instead of locking it")
+	cmd.MarkFlagRequired("txid")
+	cmd.MarkFlagRequired("vout")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		if *vout < 0 {
+			exitUsage(cmd)
+		}
+		cli.lockUnspent(*txID, *vout, *unlock)
+	}
+
+	return cmd
+}
+
+// listLockUnspentCommand builds the listlockunspent command
+func (cli *CLI) listLockUnspentCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "listlockunspent",
+		Aliases: []string{"listlocked"},
+		Short:   "List the outputs excluded from coin selection",
+		Args:    cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cli.listLockUnspent()
+		},
+	}
+}
+
+// listUnspentCommand builds the listunspent command
+func (cli *CLI) listUnspentCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "listunspent",
+		Aliases: []string{"unspent", "utxos"},
+		Short:   "List the unspent outputs of an address and its change addresses, or of every address of the wallet",
+		Args:    cobra.NoArgs,
+	}
+	address := cmd.Flags().String("address", "", "The address to list the outputs of")
+	all := cmd.Flags().Bool("all", false, "List the outputs of every address of the wallet")
+	cmd.MarkFlagsOneRequired("address", "all")
+	cmd.MarkFlagsMutuallyExclusive("address", "all")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		if !*all && *address == "" {
+			exitUsage(cmd)
+		}
+		cli.listUnspent(*address, *all)
+	}
+
+	return cmd
+}
+
+// historyCommand builds the history command
+func (cli *CLI) historyCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "history",
+		Aliases: []string{"statement"},
+		Short:   "List the transactions of an address and its change addresses with the amounts they moved",
+		Args:    cobra.NoArgs,
+	}
+	address := cmd.Flags().String("address", "", "The address to list the transactions of")
+	cmd.MarkFlagRequired("address")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		cli.history(*address)
+	}
+
+	return cmd
+}
+
+// paperWalletCommand builds the paperwallet command
+func (cli *CLI) paperWalletCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "paperwallet",
+		Aliases: []string{"paper"},
+		Short:   "Print an address and its change addresses as QR codes",
+		Args:    cobra.NoArgs,
+	}
+	address := cmd.Flags().String("address", "", "The address to export")
+	pngFile := cmd.Flags().String("png", "", "PNG file to save the address QR code to")
+	cmd.MarkFlagRequired("address")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		cli.paperWallet(*address, *pngFile)
+	}
+
+	return cmd
+}
+
+// dumpSeedCommand builds the dumpseed command
+func (cli *CLI) dumpSeedCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "dumpseed",
+		Short: "Print the secret seed the wallet derives change addresses from",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cli.dumpSeed()
+		},
+	}
+}
+
+// importSeedCommand builds the importseed command
+func (cli *CLI) importSeedCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "importseed",
+		Short: "Derive change addresses from the seed of another wallet, printed by dumpseed",
+		Args:  cobra.NoArgs,
+	}
+	seed := cmd.Flags().String("seed", "", "The seed in hex")
+	cmd.MarkFlagRequired("seed")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		cli.importSeed(*seed)
+	}
+
+	return cmd
+}
+
+// createBlockchainCommand builds the createblockchain command
+func (cli *CLI) createBlockchainCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "createblockchain",
+		Aliases: []string{"create"},
+		Short:   "Create a blockchain and send the genesis block reward to an address",
+		Args:    cobra.NoArgs,
+	}
+	address := cmd.Flags().String("address", "", "The address to send genesis block reward to")
+	params := cmd.Flags().String("params", "", "JSON file with the chain parameters, by default the network's")
+	cmd.MarkFlagRequired("address")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		cli.createBlockchain(*address, *params)
+	}
+
+	return cmd
+}
+
+// mineCommand builds the mine command
+func (cli *CLI) mineCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "mine",
+		Short: "Mine the mempool into a new block paying the reward to an address",
+		Args:  cobra.NoArgs,
+	}
+	address := cmd.Flags().String("address", "", "The address to pay the block reward to")
+	cmd.MarkFlagRequired("address")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		cli.mine(*address)
+	}
+
+	return cmd
+}
+
+// printChainCommand builds the printchain command
+func (cli *CLI) printChainCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "printchain",
+		Aliases: []string{"print"},
+		Short:   "Print all the blocks of the blockchain",
+		Args:    cobra.NoArgs,
+	}
+	verbose := cmd.Flags().Bool("verbose", false, "Also print the time of the blocks and their transactions with the inputs and outputs decoded")
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		cli.printChain(*verbose)
+	}
+
+	return cmd
+}
+
+// getChainInfoCommand builds the getchaininfo command
+func (cli *CLI) getChainInfoCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "getchaininfo",
+		Aliases: []string{"info"},
+		Short:   "Print the chain fingerprint, height and best block",
+		Args:    cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cli.getChainInfo()
+		},
+	}
+}
+
+// getBlockchainInfoCommand builds the getblockchaininfo command
+func (cli *CLI) getBlockchainInfoCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "getblockchaininfo",
+		Aliases: []string{"status"},
+		Short:   "Print the height, work and difficulty of the chain, its UTXO set and supply, pruning and database size",
+		Args:    cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cli.getBlockchainInfo()
+		},
+	}
+}
+
+// getBlockCommand builds the getblock command
+func (cli *CLI) getBlockCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "getblock",
+		Aliases: []string{"block"},
+		Short:   "Print the block at a height of the active chain, or the block with a hash",
+		Args:    cobra.NoArgs,
+	}
+	height := cmd.Flags().Int("height", -1, "Height of the block in the active chain")
+	hash := cmd.Flags().String("hash", "", "Hash of the block")
+	cmd.MarkFlagsOneRequired("height", "hash")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		if *height < 0 && *hash == "" {
+			exitUsage(cmd)
+		}
+		cli.getBlock(*height, *hash)
+	}
+
+	return cmd
+}
+
+// getChainTipsCommand builds the getchaintips command
+func (cli *CLI) getChainTipsCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "getchaintips",
+		Aliases: []string{"tips"},
+		Short:   "List the active tip and the tips of all side branches",
+		Args:    cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cli.getChainTips()
+		},
+	}
+}
+
+// getBlockStatsCommand builds the getblockstats command
+func (cli *CLI) getBlockStatsCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "getblockstats",
+		Aliases: []string{"blockstats"},
+		Short:   "Print fee, size and input/output statistics of a block",
+		Args:    cobra.NoArgs,
+	}
+	height := cmd.Flags().Int("height", -1, "Height of the block")
+	cmd.MarkFlagRequired("height")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		if *height < 0 {
+			exitUsage(cmd)
+		}
+		cli.getBlockStats(*height)
+	}
+
+	return cmd
+}
+
+// getMempoolInfoCommand builds the getmempoolinfo command
+func (cli *CLI) getMempoolInfoCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "getmempoolinfo",
+		Aliases: []string{"mempool"},
+		Short:   "Print the size, fees and limits of the mempool",
+		Args:    cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cli.getMempoolInfo()
+		},
+	}
+}
+
+// getDeploymentInfoCommand builds the getdeploymentinfo command
+func (cli *CLI) getDeploymentInfoCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "getdeploymentinfo",
+		Aliases: []string{"deployments"},
+		Short:   "Print the state of the rule changes activated with version bits",
+		Args:    cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cli.getDeploymentInfo()
+		},
+	}
+}
+
+// getMiningInfoCommand builds the getmininginfo command
+func (cli *CLI) getMiningInfoCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "getmininginfo",
+		Aliases: []string{"mininginfo"},
+		Short:   "Print the difficulty and target of the next block, the network hash rate and recent solve times",
+		Args:    cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cli.getMiningInfo()
+		},
+	}
+}
+
+// getMerkleProofCommand builds the getmerkleproof command
+func (cli *CLI) getMerkleProofCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "getmerkleproof",
+		Aliases: []string{"proof"},
+		Short:   "Save the proof that a transaction is included in its block to a file",
+		Args:    cobra.NoArgs,
+	}
+	txID := cmd.Flags().String("txid", "", "ID of the transaction")
+	out := cmd.Flags().String("out", "", "File to save the proof to")
+	cmd.MarkFlagRequired("txid")
+	cmd.MarkFlagRequired("out")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		cli.getMerkleProof(*txID, *out)
+	}
+
+	return cmd
+}
+
+// verifyMerkleProofCommand builds the verifymerkleproof command
+func (cli *CLI) verifyMerkleProofCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "verifymerkleproof",
+		Aliases: []string{"verifyproof"},
+		Short:   "Check a Merkle proof file against its Merkle root",
+		Args:    cobra.NoArgs,
+	}
+	in := cmd.Flags().String("in", "", "File with the proof")
+	cmd.MarkFlagRequired("in")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		cli.verifyMerkleProof(*in)
+	}
+
+	return cmd
+}
+
+// invalidateBlockCommand builds the invalidateblock command
+func (cli *CLI) invalidateBlockCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "invalidateblock",
+		Aliases: []string{"invalidate"},
+		Short:   "Mark a block and its descendants invalid, rewinding the chain if needed",
+		Args:    cobra.NoArgs,
+	}
+	hash := cmd.Flags().String("hash", "", "Hash of the block to invalidate")
+	cmd.MarkFlagRequired("hash")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		cli.invalidateBlock(*hash)
+	}
+
+	return cmd
+}
+
+// reconsiderBlockCommand builds the reconsiderblock command
+func (cli *CLI) reconsiderBlockCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "reconsiderblock",
+		Aliases: []string{"reconsider"},
+		Short:   "Remove the invalid mark from a block and its ancestors",
+		Args:    cobra.NoArgs,
+	}
+	hash := cmd.Flags().String("hash", "", "Hash of the block to reconsider")
+	cmd.MarkFlagRequired("hash")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		cli.reconsiderBlock(*hash)
+	}
+
+	return cmd
+}
+
+// reindexUTXOCommand builds the reindexutxo command
+func (cli *CLI) reindexUTXOCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "reindexutxo",
+		Aliases: []string{"reindex"},
+		Short:   "Rebuild the UTXO set from the blockchain",
+		Args:    cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cli.reindexUTXO()
+		},
+	}
+}
+
+// checkBalancesCommand builds the checkbalances command
+func (cli *CLI) checkBalancesCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "checkbalances",
+		Short: "Compare the balance cache with the UTXO set and report drift",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cli.checkBalances()
+		},
+	}
+}
+
+// setArchiveDepthCommand builds the setarchivedepth command
+func (cli *CLI) setArchiveDepthCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "setarchivedepth",
+		Aliases: []string{"archive"},
+		Short:   "Compress blocks more than a depth below the tip, 0 turns compression off",
+		Args:    cobra.NoArgs,
+	}
+	depth := cmd.Flags().Int("depth", -1, "Number of blocks below the tip kept uncompressed, 0 to turn compression off")
+	cmd.MarkFlagRequired("depth")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		if *depth < 0 {
+			exitUsage(cmd)
+		}
+		cli.setArchiveDepth(*depth)
+	}
+
+	return cmd
+}
+
+// setPruneDepthCommand builds the setprunedepth command
+func (cli *CLI) setPruneDepthCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "setprunedepth",
+		Aliases: []string{"prune"},
+		Short:   fmt.Sprintf("Discard the transactions of blocks more than a depth of at least %d below the tip, 0 stops pruning", minPruneDepth),
+		Args:    cobra.NoArgs,
+	}
+	depth := cmd.Flags().Int("depth", -1, "Number of blocks below the tip whose transactions are kept, 0 to stop pruning")
+	cmd.MarkFlagRequired("depth")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		if *depth < 0 {
+			exitUsage(cmd)
+		}
+		if *depth > 0 && *depth < minPruneDepth {
+			fmt.Printf("-depth must be at least %d, the deepest reorganization a pruned node can follow.\n", minPruneDepth)
+			os.Exit(1)
+		}
+		cli.setPruneDepth(*depth)
+	}
+
+	return cmd
+}
+
+// backupCommand builds the backup command
+func (cli *CLI) backupCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Save a consistent snapshot of the database, from the running node's HTTP API if given",
+		Args:  cobra.NoArgs,
+	}
+	out := cmd.Flags().String("out", "", "File to save the snapshot to")
+	httpAddr := cmd.Flags().String("http", "", "Address of the HTTP API of the node using the database, for example localhost:8080")
+	cmd.MarkFlagRequired("out")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		cli.backup(*out, *httpAddr)
+	}
+
+	return cmd
+}
+
+// restoreCommand builds the restore command
+func (cli *CLI) restoreCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "restore",
+		Short: "Replace the database with a snapshot after checking its tip, while no node uses the database",
+		Args:  cobra.NoArgs,
+	}
+	in := cmd.Flags().String("in", "", "Snapshot file saved by backup")
+	cmd.MarkFlagRequired("in")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		cli.restore(*in)
+	}
+
+	return cmd
+}
+
+// exportChainCommand builds the exportchain command
+func (cli *CLI) exportChainCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "exportchain",
+		Aliases: []string{"export"},
+		Short:   "Save the blocks of the active chain to a file",
+		Args:    cobra.NoArgs,
+	}
+	out := cmd.Flags().String("out", "", "File to save the blocks to")
+	cmd.MarkFlagRequired("out")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		cli.exportChain(*out)
+	}
+
+	return cmd
+}
+
+// importChainCommand builds the importchain command
+func (cli *CLI) importChainCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "importchain",
+		Aliases: []string{"import"},
+		Short:   "Validate and add the blocks saved by exportchain, creating the chain from them if there's none",
+		Args:    cobra.NoArgs,
+	}
+	in := cmd.Flags().String("in", "", "File of blocks saved by exportchain")
+	cmd.MarkFlagRequired("in")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		cli.importChain(*in)
+	}
+
+	return cmd
+}
+
+// benchCommand builds the bench command with its benchmarks
+func (cli *CLI) benchCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "bench",
+		Short: "Run benchmarks",
+	}
+
+	mine := &cobra.Command{
+		Use:   "mine",
+		Short: "Mine throwaway blocks for a duration and report the hash rate and block interval",
+		Args:  cobra.NoArgs,
+	}
+	bits := mine.Flags().Int("bits", 0, "Leading zero bits the block hashes need, by default the network's initial difficulty")
+	duration := mine.Flags().Duration("duration", 30*time.Second, "How long to mine")
+	mine.Run = func(cmd *cobra.Command, args []string) {
+		// The network is only known once the global flags are parsed
+		if !cmd.Flags().Changed("bits") {
+			*bits = targetBits
+		}
+		if *bits < 1 || *bits > 255 || *duration <= 0 {
+			exitUsage(cmd)
+		}
+		cli.benchMine(*bits, *duration)
+	}
+	cmd.AddCommand(mine)
+
+	return cmd
+}
+
+// getTransactionCommand builds the gettransaction command
+func (cli *CLI) getTransactionCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "gettransaction",
+		Aliases: []string{"show"},
+		Short:   "Print a transaction with its containing block and confirmations",
+		Args:    cobra.NoArgs,
+	}
+	txID := cmd.Flags().String("txid", "", "ID of the transaction")
+	cmd.MarkFlagRequired("txid")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		cli.getTransaction(*txID)
+	}
+
+	return cmd
+}
+
+// createUnsignedTxCommand builds the createunsignedtx command
+func (cli *CLI) createUnsignedTxCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "createunsignedtx",
+		Aliases: []string{"createunsigned"},
+		Short:   "Save an unsigned transaction to a file for offline signing",
+		Args:    cobra.NoArgs,
+	}
+	flags := cmd.Flags()
+	from := flags.String("from", "", "Source wallet address")
+	to := flags.String("to", "", "Destination wallet address")
+	amount := flags.Int("amount", 0, "Amount to send")
+	fee := flags.Int("fee", 0, "Fee paid to the miner")
+	text := flags.String("data", "", "Text to attach in an unspendable data-carrier output")
+	lockTime := flags.Int64("locktime", 0, "Height, or Unix time from 500000000 on, before which the transaction can't be mined")
+	lockedUntil := flags.Int("locked-until", 0, "Height before which the recipient can't spend the payment")
+	coinSelect := flags.String("coinselect", defaultCoinSelection, "Coin selection strategy: first, largest, smallest or bnb")
+	out := flags.String("out", "", "File to save the unsigned transaction to")
+	cmd.MarkFlagRequired("from")
+	cmd.MarkFlagRequired("to")
+	cmd.MarkFlagRequired("amount")
+	cmd.MarkFlagRequired("out")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		if *amount <= 0 || *fee < 0 || *lockTime < 0 || *lockedUntil < 0 {
+			exitUsage(cmd)
+		}
+
+		var data []byte
+		if *text != "" {
+			data = []byte(*text)
+		}
+		if len(data) > maxDataCarrierSize {
+			fmt.Printf("-data can carry at most %d bytes, not %d\n", maxDataCarrierSize, len(data))
+			os.Exit(1)
+		}
+
+		if _, err := lookupCoinSelector(*coinSelect); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		cli.createUnsignedTx(*from, *to, *amount, SendOptions{*fee, data, *lockTime, *lockedUntil, *coinSelect}, *out)
+	}
+
+	return cmd
+}
+
+// signTxCommand builds the signtx command
+func (cli *CLI) signTxCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "signtx",
+		Aliases: []string{"sign"},
+		Short:   "Sign a transaction file with the local wallet, on the offline machine",
+		Args:    cobra.NoArgs,
+	}
+	in := cmd.Flags().String("in", "", "File with the unsigned transaction")
+	out := cmd.Flags().String("out", "", "File to save the signed transaction to")
+	cmd.MarkFlagRequired("in")
+	cmd.MarkFlagRequired("out")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		cli.signTx(*in, *out)
+	}
+
+	return cmd
+}
+
+// broadcastTxCommand builds the broadcasttx command
+func (cli *CLI) broadcastTxCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "broadcasttx",
+		Aliases: []string{"broadcast"},
+		Short:   "Verify a signed transaction file and add it to the blockchain, or send it to a node",
+		Args:    cobra.NoArgs,
+	}
+	in := cmd.Flags().String("in", "", "File with the signed transaction")
+	node := addNodeClientFlags(cmd.Flags(), "Node to send the transaction to instead of mining it locally")
+	cmd.MarkFlagRequired("in")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		cli.broadcastTx(*in, node.options())
+	}
+
+	return cmd
+}
+
+// createRawTxCommand builds the createrawtransaction command
+func (cli *CLI) createRawTxCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "createrawtransaction",
+		Aliases: []string{"createraw"},
+		Short:   "Print an unsigned hex transaction spending the given outputs and paying the given amounts",
+		Args:    cobra.NoArgs,
+	}
+	flags := cmd.Flags()
+	inputList := flags.String("inputs", "", "Comma-separated TXID:VOUT outputs to spend")
+	outputList := flags.String("outputs", "", "Comma-separated ADDRESS:AMOUNT outputs to create")
+	text := flags.String("data", "", "Text to attach in an unspendable data-carrier output")
+	lockTime := flags.Int64("locktime", 0, "Height, or Unix time from 500000000 on, before which the transaction can't be mined")
+	cmd.MarkFlagRequired("inputs")
+	cmd.MarkFlagsOneRequired("outputs", "data")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		if *inputList == "" || (*outputList == "" && *text == "") || *lockTime < 0 {
+			exitUsage(cmd)
+		}
+		inputs, err := parseOutpoints(*inputList)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		outputs, err := parsePayments(*outputList)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if *text != "" {
+			if len(*text) > maxDataCarrierSize {
+				fmt.Printf("-data can carry at most %d bytes, not %d\n", maxDataCarrierSize, len(*text))
+				os.Exit(1)
+			}
+			outputs = append(outputs, NewDataOutput([]byte(*text)))
+		}
+
+		cli.createRawTransaction(inputs, outputs, *lockTime)
+	}
+
+	return cmd
+}
+
+// signRawTxCommand builds the signrawtransaction command
+func (cli *CLI) signRawTxCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "signrawtransaction",
+		Aliases: []string{"signraw"},
+		Short:   "Sign the inputs of a hex transaction spending outputs of an address or its change addresses",
+		Args:    cobra.NoArgs,
+	}
+	data := cmd.Flags().String("hex", "", "Hex encoded transaction to sign")
+	from := cmd.Flags().String("from", "", "Address whose outputs to unlock")
+	cmd.MarkFlagRequired("hex")
+	cmd.MarkFlagRequired("from")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		cli.signRawTransaction(*data, *from)
+	}
+
+	return cmd
+}
+
+// sendRawTxCommand builds the sendrawtransaction command
+func (cli *CLI) sendRawTxCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "sendrawtransaction",
+		Aliases: []string{"sendraw"},
+		Short:   "Validate a signed hex transaction and add it to the mempool, or send it to a node",
+		Args:    cobra.NoArgs,
+	}
+	data := cmd.Flags().String("hex", "", "Hex encoded signed transaction")
+	node := addNodeClientFlags(cmd.Flags(), "Node to send the transaction to instead of the local mempool")
+	cmd.MarkFlagRequired("hex")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		cli.sendRawTransaction(*data, node.options())
+	}
+
+	return cmd
+}
+
+// psbtCommand builds the psbt command with its subcommands
+func (cli *CLI) psbtCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "psbt",
+		Short: "Sign transactions spending the outputs of several owners",
+	}
+
+	create := &cobra.Command{
+		Use:   "create",
+		Short: "Save an unsigned hex transaction with the outputs it spends to a file, for its owners to sign",
+		Args:  cobra.NoArgs,
+	}
+	createHex := create.Flags().String("hex", "", "Hex unsigned transaction, from createrawtransaction")
+	createOut := create.Flags().String("out", "", "File to save the partially signed transaction to")
+	create.MarkFlagRequired("hex")
+	create.MarkFlagRequired("out")
+	create.Run = func(cmd *cobra.Command, args []string) {
+		cli.psbtCreate(*createHex, *createOut)
+	}
+
+	sign := &cobra.Command{
+		Use:   "sign",
+		Short: "Sign the inputs of a partially signed transaction spending outputs of an address or its change addresses",
+		Args:  cobra.NoArgs,
+	}
+	signIn := sign.Flags().String("in", "", "File with the partially signed transaction")
+	signFrom := sign.Flags().String("from", "", "Address whose outputs to unlock")
+	signOut := sign.Flags().String("out", "", "File to save the transaction to, by default the input file")
+	sign.MarkFlagRequired("in")
+	sign.MarkFlagRequired("from")
+	sign.Run = func(cmd *cobra.Command, args []string) {
+		if *signOut == "" {
+			*signOut = *signIn
+		}
+		cli.psbtSign(*signIn, *signFrom, *signOut)
+	}
+
+	combine := &cobra.Command{
+		Use:   "combine",
+		Short: "Merge the signatures of copies of a partially signed transaction",
+		Args:  cobra.NoArgs,
+	}
+	combineIn := combine.Flags().String("in", "", "Comma-separated files with copies of the partially signed transaction")
+	combineOut := combine.Flags().String("out", "", "File to save the combined transaction to")
+	combine.MarkFlagRequired("in")
+	combine.MarkFlagRequired("out")
+	combine.Run = func(cmd *cobra.Command, args []string) {
+		inFiles := splitList(*combineIn)
+		if len(inFiles) == 0 {
+			exitUsage(cmd)
+		}
+		cli.psbtCombine(inFiles, *combineOut)
+	}
+
+	finalize := &cobra.Command{
+		Use:   "finalize",
+		Short: "Print a fully signed partially signed transaction as a hex transaction for sendrawtransaction",
+		Args:  cobra.NoArgs,
+	}
+	finalizeIn := finalize.Flags().String("in", "", "File with the fully signed partially signed transaction")
+	finalize.MarkFlagRequired("in")
+	finalize.Run = func(cmd *cobra.Command, args []string) {
+		cli.psbtFinalize(*finalizeIn)
+	}
+
+	cmd.AddCommand(create, sign, combine, finalize)
+	return cmd
+}
+
+// nftCommand builds the nft command with its subcommands
+func (cli *CLI) nftCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "nft",
+		Short: "Mint and transfer unique tokens carried by outputs",
+	}
+
+	mint := &cobra.Command{
+		Use:   "mint",
+		Short: "Mint a unique NFT holding up to 80 bytes of hex data to an address",
+		Args:  cobra.NoArgs,
+	}
+	mintAddress := mint.Flags().String("address", "", "Address minting and receiving the NFT")
+	mintData := mint.Flags().String("data", "", "Hex content of the NFT, such as the hash of a document")
+	mintFee := mint.Flags().Int("fee", 0, "Fee paid to the miner")
+	mintNode := addNodeClientFlags(mint.Flags(), "Node to send the transaction to instead of the local mempool")
+	mint.MarkFlagRequired("address")
+	mint.MarkFlagRequired("data")
+	mint.Run = func(cmd *cobra.Command, args []string) {
+		data, err := hex.DecodeString(*mintData)
+		if len(data) == 0 || err != nil || *mintFee < 0 {
+			exitUsage(cmd)
+		}
+		if len(data) > maxDataCarrierSize {
+			fmt.Printf("-data can carry at most %d bytes, not %d\n", maxDataCarrierSize, len(data))
+			os.Exit(1)
+		}
+		cli.nftMint(*mintAddress, data, SendOptions{Fee: *mintFee}, mintNode.options())
+	}
+
+	transfer := &cobra.Command{
+		Use:   "transfer",
+		Short: "Pass an NFT on to another address",
+		Args:  cobra.NoArgs,
+	}
+	transferID := transfer.Flags().String("id", "", "Hex ID of the NFT")
+	transferFrom := transfer.Flags().String("from", "", "Address owning the NFT")
+	transferTo := transfer.Flags().String("to", "", "Recipient's address")
+	transferFee := transfer.Flags().Int("fee", 0, "Fee paid to the miner")
+	transferNode := addNodeClientFlags(transfer.Flags(), "Node to send the transaction to instead of the local mempool")
+	transfer.MarkFlagRequired("id")
+	transfer.MarkFlagRequired("from")
+	transfer.MarkFlagRequired("to")
+	transfer.Run = func(cmd *cobra.Command, args []string) {
+		id, err := hex.DecodeString(*transferID)
+		if len(id) == 0 || err != nil || *transferFee < 0 {
+			exitUsage(cmd)
+		}
+		cli.nftTransfer(id, *transferFrom, *transferTo, SendOptions{Fee: *transferFee}, transferNode.options())
+	}
+
+	owner := &cobra.Command{
+		Use:   "owner",
+		Short: "Print the owner and content of an NFT and the transactions that carried it",
+		Args:  cobra.NoArgs,
+	}
+	ownerID := owner.Flags().String("id", "", "Hex ID of the NFT")
+	owner.MarkFlagRequired("id")
+	owner.Run = func(cmd *cobra.Command, args []string) {
+		id, err := hex.DecodeString(*ownerID)
+		if len(id) == 0 || err != nil {
+			exitUsage(cmd)
+		}
+		cli.nftOwner(id)
+	}
+
+	cmd.AddCommand(mint, transfer, owner)
+	return cmd
+}
+
+// contractCommand builds the contract command with its subcommands
+func (cli *CLI) contractCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "contract",
+		Short: "Deploy and call experimental contracts, on chains created with contracts enabled",
+	}
+
+	deploy := &cobra.Command{
+		Use:   "deploy",
+		Short: "Deploy a contract paid for by an address",
+		Args:  cobra.NoArgs,
+	}
+	deployFrom := deploy.Flags().String("from", "", "Address paying the fee")
+	deployCode := deploy.Flags().String("code", "", "Hex bytecode of the contract")
+	deployFee := deploy.Flags().Int("fee", 0, "Fee paid to the miner")
+	deployNode := addNodeClientFlags(deploy.Flags(), "Node to send the transaction to instead of the local mempool")
+	deploy.MarkFlagRequired("from")
+	deploy.MarkFlagRequired("code")
+	deploy.Run = func(cmd *cobra.Command, args []string) {
+		code, err := hex.DecodeString(*deployCode)
+		if len(code) == 0 || err != nil || *deployFee < 0 {
+			exitUsage(cmd)
+		}
+		if size := len(contractDeployData(code)); size > maxDataCarrierSize {
+			fmt.Printf("-code can be at most %d bytes, not %d\n", maxDataCarrierSize-len(contractDeployMagic), len(code))
+			os.Exit(1)
+		}
+		cli.contractDeploy(*deployFrom, code, SendOptions{Fee: *deployFee}, deployNode.options())
+	}
+
+	call := &cobra.Command{
+		Use:   "call",
+		Short: "Call a contract with integer arguments, paid for by an address",
+		Args:  cobra.NoArgs,
+	}
+	callFrom := call.Flags().String("from", "", "Address paying the fee")
+	callID := call.Flags().String("id", "", "Hex ID of the contract")
+	callArgs := call.Flags().String("args", "", "Comma-separated integer arguments")
+	callFee := call.Flags().Int("fee", 0, "Fee paid to the miner")
+	callNode := addNodeClientFlags(call.Flags(), "Node to send the transaction to instead of the local mempool")
+	call.MarkFlagRequired("from")
+	call.MarkFlagRequired("id")
+	call.Run = func(cmd *cobra.Command, args []string) {
+		if *callFee < 0 {
+			exitUsage(cmd)
+		}
+		id, err := decodeContractID(*callID)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		values, err := parseContractArgs(*callArgs)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		cli.contractCall(*callFrom, ContractCall{id, values}, SendOptions{Fee: *callFee}, callNode.options())
+	}
+
+	get := &cobra.Command{
+		Use:   "get",
+		Short: "Print the value stored under a key by a contract",
+		Args:  cobra.NoArgs,
+	}
+	getID := get.Flags().String("id", "", "Hex ID of the contract")
+	getKey := get.Flags().Int64("key", 0, "Storage key")
+	get.MarkFlagRequired("id")
+	get.Run = func(cmd *cobra.Command, args []string) {
+		id, err := decodeContractID(*getID)
+		if err != nil {
+			exitUsage(cmd)
+		}
+		cli.contractGet(id, *getKey)
+	}
+
+	cmd.AddCommand(deploy, call, get)
+	return cmd
+}
+
+// watchCommand builds the watch command
+func (cli *CLI) watchCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "watch",
+		Aliases: []string{"tail"},
+		Short:   "Print each block connected to the chain of a running node as it arrives",
+		Long: "Print the height, hash, number of transactions and reward address of each block connected to the " +
+			"chain of a running node as it arrives, from the WebSocket feed of its HTTP API, only the blocks " +
+			"touching ADDRESS or its change addresses if given.",
+		Args: cobra.NoArgs,
+	}
+	api := cmd.Flags().String("api", "localhost:8080", "HOST:PORT of the HTTP API of the node, or the ws:// URL of its feed")
+	address := cmd.Flags().String("address", "", "Only print the blocks with transactions spending from or paying to this address")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		cli.watch(*api, *address)
+	}
+
+	return cmd
+}
+
+// chainTestCommand builds the chaintest command
+func (cli *CLI) chainTestCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "chaintest",
+		Short: "Test real nodes end to end over JSON-RPC, started on regtest or running ones",
+		Long: "Start two regtest nodes of this binary in temporary data directories and drive them over JSON-RPC " +
+			"through creating the chain, mining, sending, restarting and reorganizing, checking the state they agree " +
+			"on after each step. With -rpc, test running nodes instead: check they agree on the chain, send a coin " +
+			"FROM TO through the first one and mine a block to MINE if given.",
+		Args: cobra.NoArgs,
+	}
+	rpc := cmd.Flags().String("rpc", "", "Comma separated JSON-RPC URLs of running nodes to test instead, like http://localhost:8080/")
+	from := cmd.Flags().String("from", "", "With -rpc, the address to send a coin from through the first node")
+	to := cmd.Flags().String("to", "", "With -rpc, the address receiving the coin, by default the sender")
+	mine := cmd.Flags().String("mine", "", "With -rpc, the address to mine a block to through the first node")
+	timeout := cmd.Flags().Duration("timeout", time.Minute, "How long to wait for the nodes to reach each state")
+	keep := cmd.Flags().Bool("keep", false, "Keep the data directories and logs of the started nodes")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		if *timeout <= 0 {
+			exitUsage(cmd)
+		}
+		cli.chainTest(ChainTestOptions{splitList(*rpc), *from, *to, *mine, *timeout, *keep})
+	}
+
+	return cmd
+}
+
+// startNodeCommand builds the startnode command
+func (cli *CLI) startNodeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "startnode",
+		Aliases: []string{"start"},
+		Short:   "Run a node exchanging blocks and transactions with its peers",
+		Args:    cobra.NoArgs,
+	}
+	flags := addNodeFlags(cmd.Flags())
+	role := cmd.Flags().String("role", roleFull, "Role of the node: full validates and relays, miner also mines pending transactions, wallet ignores the transactions of peers")
+	rewardAddress := cmd.Flags().String("rewardaddress", "", "Address the block rewards are paid to, required for miners")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		config := cli.nodeConfig(cmd, flags)
+		config.Role = *role
+		config.RewardAddress = *rewardAddress
+		cli.startNode(config)
+	}
+
+	return cmd
+}
+
+// startMinerCommand builds the startminer command
+func (cli *CLI) startMinerCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "startminer",
+		Aliases: []string{"miner"},
+		Short:   "Run a mining node that keeps mining the pending transactions into blocks",
+		Args:    cobra.NoArgs,
+	}
+	flags := addNodeFlags(cmd.Flags())
+	address := cmd.Flags().String("address", "", "The address to pay the block rewards to")
+	cmd.MarkFlagRequired("address")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		config := cli.nodeConfig(cmd, flags)
+		config.Role = roleMiner
+		config.RewardAddress = *address
+		cli.startNode(config)
+	}
+
+	return cmd
+}
+
+// serveCommand builds the serve command
+func (cli *CLI) serveCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "serve",
+		Aliases: []string{"api"},
+		Short:   "Serve the blockchain over an HTTP and/or gRPC API",
+		Args:    cobra.NoArgs,
+	}
+	httpAddr := cmd.Flags().String("http", "", "Address to serve the HTTP API on, for example :8080")
+	grpcAddr := cmd.Flags().String("grpc", "", "Address to serve the gRPC API on, for example :9090")
+	webhooks := cmd.Flags().String("webhooks", "", "JSON file with the webhooks to notify")
+	node := addNodeClientFlags(cmd.Flags(), "Node to send posted transactions to instead of mining them locally")
+	cmd.Flags().Lookup("tls").Usage = "Serve the APIs with TLS, and connect to the node with TLS"
+	cmd.MarkFlagsOneRequired("http", "grpc")
+
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		if *httpAddr == "" && *grpcAddr == "" {
+			exitUsage(cmd)
+		}
+		cli.serve(*httpAddr, *grpcAddr, cli.loadWebhooks(*webhooks), node.options())
+	}
+
+	return cmd
+}
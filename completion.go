@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// completionBlocks is how many blocks below the tip the hashes completed for
+// -hash go back, besides the chain tips
+const completionBlocks = 20
+
+// The completion command prints a completion script for bash, zsh or fish,
+// generated from the command tree, so the shell completes the commands and
+// their flags. The scripts call the program back to complete flag values:
+// addresses for -address, -from, -to and -rewardaddress, the owners of the
+// wallet first and then the addresses holding coins, and block hashes for
+// -hash, the chain tips and the last completionBlocks blocks of the active
+// chain. These read the chain of the network and data directory given on the
+// command line being completed, and complete nothing while a node holds the
+// database open.
+
+// addressFlags are the flags whose values are completed with addresses
+var addressFlags = map[string]bool{"address": true, "from": true, "to": true, "rewardaddress": true}
+
+// completionCommand builds the completion command
+func (cli *CLI) completionCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "completion bash|zsh|fish",
+		Short: "Print the shell completion script for bash, zsh or fish",
+		Long: "Print the shell completion script for bash, zsh or fish, completing the commands, their flags, " +
+			"addresses and block hashes. For example:\n\n" +
+			"  source <(go-blockchain completion bash)\n" +
+			"  go-blockchain completion zsh > \"${fpath[1]}/_go-blockchain\"\n" +
+			"  go-blockchain completion fish > ~/.config/fish/completions/go-blockchain.fish",
+		ValidArgs: []string{"bash", "zsh", "fish"},
+		Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+		Run: func(cmd *cobra.Command, args []string) {
+			var err error
+			switch args[0] {
+			case "bash":
+				err = cmd.Root().GenBashCompletionV2(os.Stdout, true)
+			case "zsh":
+				err = cmd.Root().GenZshCompletion(os.Stdout)
+			case "fish":
+				err = cmd.Root().GenFishCompletion(os.Stdout, true)
+			}
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+	}
+}
+
+// registerCompletions sets the completion of the flag values of every command
+// in a command tree
+// Parameters:
+//   - cmd: The root of the tree
+func registerCompletions(cmd *cobra.Command) {
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		switch {
+		case addressFlags[f.Name]:
+			cmd.RegisterFlagCompletionFunc(f.Name, completeAddresses)
+		case f.Name == "hash":
+			cmd.RegisterFlagCompletionFunc(f.Name, completeBlockHashes)
+		case f.Name == "coinselect":
+			cmd.RegisterFlagCompletionFunc(f.Name, cobra.FixedCompletions(coinSelectionNames(), cobra.ShellCompDirectiveNoFileComp))
+		case f.Name == "role":
+			cmd.RegisterFlagCompletionFunc(f.Name, cobra.FixedCompletions([]string{roleFull, roleMiner, roleWallet}, cobra.ShellCompDirectiveNoFileComp))
+		}
+	})
+	cmd.PersistentFlags().VisitAll(func(f *pflag.Flag) {
+		switch f.Name {
+		case "network":
+			var names []string
+			for _, n := range networks {
+				names = append(names, n.Name)
+			}
+			cmd.RegisterFlagCompletionFunc(f.Name, cobra.FixedCompletions(names, cobra.ShellCompDirectiveNoFileComp))
+		case "loglevel":
+			cmd.RegisterFlagCompletionFunc(f.Name, cobra.FixedCompletions([]string{"debug", "info", "warn", "error"}, cobra.ShellCompDirectiveNoFileComp))
+		case "logformat":
+			cmd.RegisterFlagCompletionFunc(f.Name, cobra.FixedCompletions([]string{logFormatText, logFormatJSON}, cobra.ShellCompDirectiveNoFileComp))
+		}
+	})
+
+	for _, child := range cmd.Commands() {
+		registerCompletions(child)
+	}
+}
+
+// isCompletionRequest checks whether a command is the hidden one the
+// completion scripts call, which completes the command line of another
+func isCompletionRequest(cmd *cobra.Command) bool {
+	return cmd.Name() == cobra.ShellCompRequestCmd || cmd.Name() == cobra.ShellCompNoDescRequestCmd
+}
+
+// completionChain opens the chain of the command line being completed
+// Parameters:
+//   - cmd: The command whose flag is completed, with the flags given so far parsed
+//
+// Returns:
+//   - *Blockchain: The chain, nil if there's none or a node holds it open
+func completionChain(cmd *cobra.Command) *Blockchain {
+	// The global flags and the environment apply to the completed command
+	// line, not to the completion request
+	cmd.Root().PersistentPreRun(cmd, nil)
+
+	if !dbExists() || (!ephemeral && boltFileInUse(dbFile)) {
+		return nil
+	}
+
+	return NewBlockchain("")
+}
+
+// completeAddresses completes an address: the owners of the wallet, then the
+// other addresses holding coins, with their balances
+func completeAddresses(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	var completions []string
+	listed := make(map[string]bool)
+	add := func(address, description string) {
+		if !listed[address] && strings.HasPrefix(address, toComplete) {
+			completions = append(completions, address+"\t"+description)
+		}
+		listed[address] = true
+	}
+
+	bc := completionChain(cmd)
+
+	wallet := NewWallet()
+	for _, owner := range wallet.Owners() {
+		add(owner, "wallet")
+		for _, change := range wallet.ChangeAddresses[owner] {
+			listed[change] = true
+		}
+	}
+
+	if bc != nil {
+		defer bc.db.Close()
+
+		err := bc.db.View(func(tx StoreTx) error {
+			return tx.Bucket([]byte(balancesBucket)).ForEach(func(k, v []byte) error {
+				add(string(k), fmt.Sprintf("balance %d", decodeBalance(v)))
+				return nil
+			})
+		})
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveError
+		}
+	}
+
+	return completions, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeBlockHashes completes a block hash: the chain tips, then the last
+// completionBlocks blocks of the active chain
+func completeBlockHashes(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	bc := completionChain(cmd)
+	if bc == nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	defer bc.db.Close()
+
+	var completions []string
+	listed := make(map[string]bool)
+	add := func(hash, description string) {
+		if !listed[hash] && strings.HasPrefix(hash, toComplete) {
+			completions = append(completions, hash+"\t"+description)
+		}
+		listed[hash] = true
+	}
+
+	for _, tip := range bc.GetChainTips() {
+		add(tip.Hash, fmt.Sprintf("%s tip at height %d", tip.Status, tip.Height))
+	}
+
+	best := bc.GetBestHeight()
+	for height := best; height >= 0 && height > best-completionBlocks; height-- {
+		hash, err := bc.GetBlockHash(height)
+		if err != nil {
+			break
+		}
+		add(hex.EncodeToString(hash), fmt.Sprintf("height %d", height))
+	}
+
+	return completions, cobra.ShellCompDirectiveNoFileComp
+}
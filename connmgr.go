@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// defaultNodePort is the port of the nodes found through DNS seeds, which only
+// resolve to IP addresses, and of nodes started without -port. Set per
+// network by selectNetwork
+var defaultNodePort = 3000
+
+// defaultMaxOutbound is the number of connections to discovered nodes a node
+// keeps open when no limit is configured
+const defaultMaxOutbound = 8
+
+// connManagerInterval is how often the connection manager opens connections to
+// discovered nodes when below the outbound limit
+const connManagerInterval = 5 * time.Second
+
+// candidateRetryInterval is how long the connection manager waits before
+// trying an address again
+const candidateRetryInterval = time.Minute
+
+// Besides the configured peers, which it always stays connected to, a node
+// discovers others through seeds: static host:port addresses and DNS names
+// resolving to the IP addresses of nodes. The connection manager keeps up to
+// MaxOutbound connections open to the discovered addresses, replacing the ones
+// that drop.
+
+// resolveDNSSeeds looks up the configured DNS seeds
+// Returns:
+//   - []string: Addresses (host:port) of the nodes found, on the default port
+func (s *Server) resolveDNSSeeds() []string {
+	var addrs []string
+
+	for _, seed := range s.config.DNSSeeds {
+		hosts, err := net.LookupHost(seed)
+		if err != nil {
+			slog.Warn("Can't resolve DNS seed", "seed", seed, "err", err)
+			continue
+		}
+
+		slog.Info("DNS seed resolved", "seed", seed, "addresses", len(hosts))
+		for _, host := range hosts {
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(defaultNodePort)))
+		}
+	}
+
+	return addrs
+}
+
+// addCandidates hands discovered addresses to the connection manager. The
+// configured peers and this node's own address are ignored.
+// Parameters:
+//   - addrs: Addresses (host:port) of nodes
+func (s *Server) addCandidates(addrs []string) {
+	s.addrsMu.Lock()
+	defer s.addrsMu.Unlock()
+
+	for _, addr := range addrs {
+		if _, ok := s.candidates[addr]; ok || slices.Contains(s.config.Peers, addr) || s.isOwnAddress(addr) {
+			continue
+		}
+		s.candidates[addr] = time.Time{}
+	}
+}
+
+// isOwnAddress checks whether an address points to this node: it has the
+// listening port and a loopback, unspecified or local interface IP
+func (s *Server) isOwnAddress(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port != strconv.Itoa(s.config.Port) {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			return false
+		}
+		ip = ips[0]
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range ifaceAddrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// manageConnections periodically opens connections to discovered addresses
+// until MaxOutbound of them are connected. Addresses tried recently are skipped,
+// and known peers that have been reliable are tried first.
+func (s *Server) manageConnections() {
+	for {
+		s.addrsMu.Lock()
+		var addrs []string
+		for addr, lastTry := range s.candidates {
+			if !s.outbound[addr] && time.Since(lastTry) >= candidateRetryInterval {
+				addrs = append(addrs, addr)
+			}
+		}
+		sort.SliceStable(addrs, func(i, j int) bool {
+			return s.knownPeers.Score(addrs[i]) > s.knownPeers.Score(addrs[j])
+		})
+
+		for _, addr := range addrs {
+			if len(s.outbound) >= s.config.MaxOutbound {
+				break
+			}
+
+			s.candidates[addr] = time.Now()
+			s.outbound[addr] = true
+			go s.connectOutbound(addr)
+		}
+		s.addrsMu.Unlock()
+
+		time.Sleep(connManagerInterval)
+	}
+}
+
+// connectOutbound serves a connection to a discovered address until it drops,
+// freeing its outbound slot afterwards
+func (s *Server) connectOutbound(addr string) {
+	defer func() {
+		s.addrsMu.Lock()
+		delete(s.outbound, addr)
+		s.addrsMu.Unlock()
+	}()
+
+	conn, err := dialNode(addr, s.clientTLS)
+	if err != nil {
+		slog.Warn("Can't connect to peer", "peer", addr, "err", err)
+		s.knownPeers.RecordFailure(addr)
+		return
+	}
+
+	s.handlePeer(conn, addr, true)
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// Contracts are an experimental subsystem, only run on chains created with
+// "contracts": true in their chain parameters (see params.go). A transaction
+// deploys a contract with a data-carrier output (see datacarrier.go) carrying
+// contractDeployMagic and the bytecode of the contract VM (see contractvm.go),
+// and later transactions call it with data-carrier outputs carrying
+// contractCallMagic, the contract ID and up to maxContractArgs arguments.
+// Nodes run the calls as blocks are connected, in the order of the block, and
+// keep the storage of every contract in contractStorageBucket. To other chains,
+// and to validation, these are ordinary data-carrier outputs: a call that
+// fails is reverted but its transaction stays valid, like in Ethereum, so the
+// VM never decides whether a block is valid. What connecting a block changed
+// is recorded in contractUndoBucket, so the block can be disconnected again.
+
+// Buckets of the contract subsystem
+const (
+	contractsBucket       = "contracts"       // Contract ID -> bytecode
+	contractStorageBucket = "contractstorage" // Contract ID + 8-byte key -> 8-byte value
+	contractUndoBucket    = "contractundo"    // Block hash -> contractUndo of the block
+)
+
+// Magic bytes starting the data of contract deploys and calls
+var (
+	contractDeployMagic = []byte("CTD")
+	contractCallMagic   = []byte("CTC")
+)
+
+// contractIDSize is the size of a contract ID, a SHA-256 hash
+const contractIDSize = 32
+
+// maxContractArgs is the most int64 arguments fitting in a call next to the
+// contract ID
+const maxContractArgs = (maxDataCarrierSize - 3 - contractIDSize) / 8
+
+// contractsEnabled is whether the chain runs contracts, a chain parameter
+var contractsEnabled = false
+
+// ContractCall is a call of a contract
+type ContractCall struct {
+	ID   []byte  // ID of the contract
+	Args []int64 // Arguments of the call
+}
+
+// contractUndo is what connecting a block changed in the contract buckets
+type contractUndo struct {
+	Deployed [][]byte          // IDs of the contracts it deployed
+	Storage  map[string][]byte // Storage key -> its value before the block, empty if it had none
+}
+
+// contractID returns the ID of the contract deployed by an output: the
+// SHA-256 of its outpoint
+func contractID(txID []byte, vout int) []byte {
+	data := append([]byte("contract"), txID...)
+	data = binary.BigEndian.AppendUint64(data, uint64(int64(vout)))
+
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+// contractDeployData returns the data of an output deploying bytecode
+func contractDeployData(code []byte) []byte {
+	return append(bytes.Clone(contractDeployMagic), code...)
+}
+
+// contractCallData returns the data of an output calling a contract
+func contractCallData(call ContractCall) []byte {
+	data := append(bytes.Clone(contractCallMagic), call.ID...)
+	for _, arg := range call.Args {
+		data = binary.BigEndian.AppendUint64(data, uint64(arg))
+	}
+
+	return data
+}
+
+// parseContractCall decodes the data of an output calling a contract
+// Returns:
+//   - ContractCall: The call
+//   - bool: false if the data isn't a call
+func parseContractCall(data []byte) (ContractCall, bool) {
+	rest, ok := bytes.CutPrefix(data, contractCallMagic)
+	if !ok || len(rest) < contractIDSize || (len(rest)-contractIDSize)%8 != 0 {
+		return ContractCall{}, false
+	}
+
+	call := ContractCall{ID: rest[:contractIDSize]}
+	for args := rest[contractIDSize:]; len(args) > 0; args = args[8:] {
+		call.Args = append(call.Args, int64(binary.BigEndian.Uint64(args)))
+	}
+
+	return call, true
+}
+
+// contractStorageKey returns the key of a storage value of a contract
+func contractStorageKey(id []byte, key int64) []byte {
+	return binary.BigEndian.AppendUint64(bytes.Clone(id), uint64(key))
+}
+
+// contractStorageLoader returns the function reading the storage of a
+// contract for runContract
+func contractStorageLoader(storage StoreBucket, id []byte) func(int64) int64 {
+	return func(key int64) int64 {
+		if storage == nil {
+			return 0
+		}
+		v := storage.Get(contractStorageKey(id, key))
+		if v == nil {
+			return 0
+		}
+		return int64(binary.BigEndian.Uint64(v))
+	}
+}
+
+// NewContractTransaction creates a transaction deploying or calling a
+// contract, paid for by an address
+// Parameters:
+//   - from: The address paying the fee
+//   - data: The data of the deploy or call, see contractDeployData and contractCallData
+//   - options: The fee and coin selection
+//   - UTXOSet: The UTXO set to find spendable outputs in
+//   - wallet: The wallet tracking the address's change addresses
+func NewContractTransaction(from string, data []byte, options SendOptions, UTXOSet *UTXOSet, wallet *Wallet) *Transaction {
+	// A transaction needs an input, so a coin is selected even without a fee
+	inputs, acc := selectFunds(from, max(options.Fee, 1), options.CoinSelection, UTXOSet, wallet)
+
+	outputs := []TXOutput{NewDataOutput(data)}
+	outputs = append(outputs, changeOutputs(from, acc-options.Fee, wallet)...)
+
+	tx := Transaction{nil, inputs, outputs, options.LockTime}
+	tx.SetID()
+
+	return &tx
+}
+
+// connectContracts deploys the contracts of a block being connected and runs
+// its calls, saving what it changed for disconnectContracts
+// Parameters:
+//   - tx: The database transaction connecting the block
+//   - block: The block
+func connectContracts(tx StoreTx, block *Block) error {
+	if !contractsEnabled {
+		return nil
+	}
+
+	contracts, err := tx.CreateBucketIfNotExists([]byte(contractsBucket))
+	if err != nil {
+		return err
+	}
+	storage, err := tx.CreateBucketIfNotExists([]byte(contractStorageBucket))
+	if err != nil {
+		return err
+	}
+
+	undo := contractUndo{Storage: make(map[string][]byte)}
+	for _, transaction := range block.Transactions {
+		if transaction.IsCoinbase() {
+			continue
+		}
+
+		for outIdx, out := range transaction.Vout {
+			if !out.IsDataCarrier() {
+				continue
+			}
+			data := out.CarriedData()
+
+			if code, ok := bytes.CutPrefix(data, contractDeployMagic); ok && len(code) > 0 {
+				id := contractID(transaction.ID, outIdx)
+				err = contracts.Put(id, code)
+				if err != nil {
+					return err
+				}
+				undo.Deployed = append(undo.Deployed, id)
+				continue
+			}
+
+			call, ok := parseContractCall(data)
+			if !ok {
+				continue
+			}
+			code := bytes.Clone(contracts.Get(call.ID))
+			if code == nil {
+				continue
+			}
+
+			// Failed calls are reverted, their writes dropped
+			result, err := runContract(code, call.Args, block.Height, contractStorageLoader(storage, call.ID))
+			if err != nil {
+				continue
+			}
+
+			for key, v := range result.Writes {
+				k := contractStorageKey(call.ID, key)
+				if _, ok := undo.Storage[string(k)]; !ok {
+					undo.Storage[string(k)] = bytes.Clone(storage.Get(k))
+				}
+
+				// Like missing keys, keys set to 0 take no space
+				if v == 0 {
+					err = storage.Delete(k)
+				} else {
+					err = storage.Put(k, binary.BigEndian.AppendUint64(nil, uint64(v)))
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	b, err := tx.CreateBucketIfNotExists([]byte(contractUndoBucket))
+	if err != nil {
+		return err
+	}
+
+	var buff bytes.Buffer
+	err = gob.NewEncoder(&buff).Encode(undo)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(block.Hash, buff.Bytes())
+}
+
+// disconnectContracts reverts what connectContracts did for the tip of the
+// active chain. Blocks connected while contracts weren't run changed nothing.
+// Parameters:
+//   - tx: The database transaction
+//   - block: The tip of the active chain
+func disconnectContracts(tx StoreTx, block *Block) error {
+	b := tx.Bucket([]byte(contractUndoBucket))
+	if b == nil || b.Get(block.Hash) == nil {
+		return nil
+	}
+
+	var undo contractUndo
+	err := gob.NewDecoder(bytes.NewReader(b.Get(block.Hash))).Decode(&undo)
+	if err != nil {
+		return err
+	}
+
+	storage := tx.Bucket([]byte(contractStorageBucket))
+	for k, v := range undo.Storage {
+		if len(v) == 0 {
+			err = storage.Delete([]byte(k))
+		} else {
+			err = storage.Put([]byte(k), v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	contracts := tx.Bucket([]byte(contractsBucket))
+	for _, id := range undo.Deployed {
+		err = contracts.Delete(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.Delete(block.Hash)
+}
+
+// reindexContracts rebuilds the contract buckets by connecting the contracts
+// of every block of the active chain again, from the genesis block on
+func (bc *Blockchain) reindexContracts() {
+	if !contractsEnabled {
+		return
+	}
+
+	err := bc.db.Update(func(tx StoreTx) error {
+		for _, bucket := range []string{contractsBucket, contractStorageBucket, contractUndoBucket} {
+			err := tx.DeleteBucket([]byte(bucket))
+			if err != nil && err != errBucketNotFound {
+				return err
+			}
+		}
+
+		// Walk back from the tip, then connect the blocks in chain order
+		var chain []*Block
+		for hash := bc.tip; len(hash) > 0; {
+			block := getBlock(tx, hash)
+			chain = append(chain, block)
+			hash = block.PrevBlockHash
+		}
+
+		for i := len(chain) - 1; i >= 0; i-- {
+			err := connectContracts(tx, chain[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// errContractsDisabled is returned for contract operations on chains that
+// don't run contracts
+var errContractsDisabled = errors.New("contracts aren't enabled on this chain, create it with \"contracts\": true in its -params")
+
+// GetContract looks up the bytecode of a contract
+// Parameters:
+//   - id: ID of the contract
+func (bc *Blockchain) GetContract(id []byte) ([]byte, error) {
+	if !contractsEnabled {
+		return nil, errContractsDisabled
+	}
+
+	var code []byte
+	err := bc.db.View(func(tx StoreTx) error {
+		if b := tx.Bucket([]byte(contractsBucket)); b != nil {
+			code = bytes.Clone(b.Get(id))
+		}
+		if code == nil {
+			return fmt.Errorf("contract %x not found", id)
+		}
+		return nil
+	})
+
+	return code, err
+}
+
+// GetContractStorage reads a storage value of a contract
+// Parameters:
+//   - id: ID of the contract
+//   - key: The storage key
+func (bc *Blockchain) GetContractStorage(id []byte, key int64) (int64, error) {
+	_, err := bc.GetContract(id)
+	if err != nil {
+		return 0, err
+	}
+
+	var v int64
+	err = bc.db.View(func(tx StoreTx) error {
+		v = contractStorageLoader(tx.Bucket([]byte(contractStorageBucket)), id)(key)
+		return nil
+	})
+
+	return v, err
+}
+
+// SimulateContractCall runs a call against the storage at the tip of the
+// active chain, as if the next block included it, without keeping its writes
+// Parameters:
+//   - call: The call
+func (bc *Blockchain) SimulateContractCall(call ContractCall) (ContractResult, error) {
+	code, err := bc.GetContract(call.ID)
+	if err != nil {
+		return ContractResult{}, err
+	}
+
+	var result ContractResult
+	height := bc.GetBestHeight() + 1
+	err = bc.db.View(func(tx StoreTx) error {
+		var err error
+		result, err = runContract(code, call.Args, height, contractStorageLoader(tx.Bucket([]byte(contractStorageBucket)), call.ID))
+		return err
+	})
+
+	return result, err
+}
+
+// decodeContractID parses the hex ID of a contract
+func decodeContractID(value string) ([]byte, error) {
+	id, err := hex.DecodeString(value)
+	if err != nil || len(id) != contractIDSize {
+		return nil, fmt.Errorf("invalid contract ID %q, expected %d bytes of hex", value, contractIDSize)
+	}
+
+	return id, nil
+}
+
+// parseContractArgs parses the comma separated int64 arguments of a call
+func parseContractArgs(value string) ([]int64, error) {
+	var args []int64
+	for _, item := range splitList(value) {
+		arg, err := strconv.ParseInt(item, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid argument %q", item)
+		}
+		args = append(args, arg)
+	}
+	if len(args) > maxContractArgs {
+		return nil, fmt.Errorf("a call takes at most %d arguments, not %d", maxContractArgs, len(args))
+	}
+
+	return args, nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The contract VM is a tiny deterministic stack machine running the bytecode
+// of contracts, see contracts.go. Its values are int64s, arithmetic wraps
+// around, and a contract's storage maps int64 keys to int64 values, missing
+// keys reading as 0. Every opcode costs gas and a call stops once it used
+// contractGasLimit, so no call runs forever. Execution ends at STOP or the end
+// of the code, and any failure, such as running out of gas, a stack underflow
+// or a division by zero, reverts the call: none of its writes are kept.
+//
+// Opcodes:
+//   - 0x00 STOP: End the call
+//   - 0x01 PUSH1 b: Push the next byte of the code
+//   - 0x02 PUSH8 n: Push the next 8 bytes of the code, a big-endian int64
+//   - 0x10 ADD, 0x11 SUB, 0x12 MUL, 0x13 DIV, 0x14 MOD: Pop b and a, push a op b
+//   - 0x20 LT, 0x21 GT, 0x22 EQ: Pop b and a, push 1 if a op b, else 0
+//   - 0x23 ISZERO: Pop a, push 1 if it's 0, else 0
+//   - 0x30 POP, 0x31 DUP, 0x32 SWAP: Drop, copy or swap the top values
+//   - 0x40 JUMP: Pop an offset of the code and continue there
+//   - 0x41 JUMPI: Pop a condition and an offset, jump if the condition isn't 0
+//   - 0x50 SLOAD: Pop a key, push its stored value
+//   - 0x51 SSTORE: Pop a value and a key, store the value under the key
+//   - 0x60 ARG: Pop an index, push that argument of the call, 0 if there's none
+//   - 0x61 ARGC: Push the number of arguments of the call
+//   - 0x70 HEIGHT: Push the height of the block including the call
+//   - 0xff FAIL: Revert the call
+
+// contractGasLimit is the most gas a call can use
+const contractGasLimit = 10000
+
+// maxContractStack is the most values the stack of a call can hold
+const maxContractStack = 64
+
+// Opcodes of the contract VM
+const (
+	opStop   = 0x00
+	opPush1  = 0x01
+	opPush8  = 0x02
+	opAdd    = 0x10
+	opSub    = 0x11
+	opMul    = 0x12
+	opDiv    = 0x13
+	opMod    = 0x14
+	opLt     = 0x20
+	opGt     = 0x21
+	opEq     = 0x22
+	opIsZero = 0x23
+	opPop    = 0x30
+	opDup    = 0x31
+	opSwap   = 0x32
+	opJump   = 0x40
+	opJumpI  = 0x41
+	opSLoad  = 0x50
+	opSStore = 0x51
+	opArg    = 0x60
+	opArgC   = 0x61
+	opHeight = 0x70
+	opFail   = 0xff
+)
+
+// contractOpGas is the gas each opcode costs, storage being the most
+// expensive as every node keeps it
+var contractOpGas = map[byte]int{
+	opStop: 0, opPush1: 1, opPush8: 1,
+	opAdd: 1, opSub: 1, opMul: 2, opDiv: 2, opMod: 2,
+	opLt: 1, opGt: 1, opEq: 1, opIsZero: 1,
+	opPop: 1, opDup: 1, opSwap: 1,
+	opJump: 2, opJumpI: 2,
+	opSLoad: 20, opSStore: 100,
+	opArg: 1, opArgC: 1, opHeight: 1,
+	opFail: 0,
+}
+
+// Errors of failed calls
+var (
+	errOutOfGas       = errors.New("out of gas") // The call used more than contractGasLimit
+	errStackUnderflow = errors.New("stack underflow")
+)
+
+// ContractResult is the outcome of a successful call
+type ContractResult struct {
+	Writes  map[int64]int64 // Storage values the call wrote, by key
+	GasUsed int             // Gas the call used
+}
+
+// runContract executes the bytecode of a contract. Storage is only read
+// through load, the writes are returned for the caller to keep.
+// Parameters:
+//   - code: The bytecode
+//   - args: The arguments of the call
+//   - height: Height of the block including the call
+//   - load: Returns the stored value of a key, 0 if it has none
+//
+// Returns:
+//   - ContractResult: The writes and gas of the call
+//   - error: Why the call failed, its writes being reverted
+func runContract(code []byte, args []int64, height int, load func(key int64) int64) (ContractResult, error) {
+	result := ContractResult{Writes: make(map[int64]int64)}
+	var stack []int64
+
+	pop := func() (int64, error) {
+		if len(stack) == 0 {
+			return 0, errStackUnderflow
+		}
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v, nil
+	}
+	push := func(v int64) error {
+		if len(stack) == maxContractStack {
+			return errors.New("stack overflow")
+		}
+		stack = append(stack, v)
+		return nil
+	}
+
+	for pc := 0; pc < len(code); {
+		at, op := pc, code[pc]
+		gas, ok := contractOpGas[op]
+		if !ok {
+			return result, fmt.Errorf("unknown opcode 0x%02x at %d", op, at)
+		}
+		result.GasUsed += gas
+		if result.GasUsed > contractGasLimit {
+			return result, errOutOfGas
+		}
+		pc++
+
+		var err error
+		switch op {
+		case opStop:
+			return result, nil
+		case opPush1:
+			if pc >= len(code) {
+				err = errors.New("PUSH1 past the end of the code")
+				break
+			}
+			err = push(int64(code[pc]))
+			pc++
+		case opPush8:
+			if pc+8 > len(code) {
+				err = errors.New("PUSH8 past the end of the code")
+				break
+			}
+			err = push(int64(binary.BigEndian.Uint64(code[pc:])))
+			pc += 8
+		case opAdd, opSub, opMul, opDiv, opMod, opLt, opGt, opEq:
+			var a, b int64
+			b, err = pop()
+			if err == nil {
+				a, err = pop()
+			}
+			if err != nil {
+				break
+			}
+			var v int64
+			v, err = binaryContractOp(op, a, b)
+			if err == nil {
+				err = push(v)
+			}
+		case opIsZero:
+			var a int64
+			a, err = pop()
+			if err == nil {
+				err = push(boolValue(a == 0))
+			}
+		case opPop:
+			_, err = pop()
+		case opDup:
+			if len(stack) == 0 {
+				err = errStackUnderflow
+				break
+			}
+			err = push(stack[len(stack)-1])
+		case opSwap:
+			if len(stack) < 2 {
+				err = errStackUnderflow
+				break
+			}
+			stack[len(stack)-1], stack[len(stack)-2] = stack[len(stack)-2], stack[len(stack)-1]
+		case opJump, opJumpI:
+			cond := int64(1)
+			if op == opJumpI {
+				cond, err = pop()
+			}
+			var dest int64
+			if err == nil {
+				dest, err = pop()
+			}
+			if err != nil {
+				break
+			}
+			if cond != 0 {
+				if dest < 0 || dest >= int64(len(code)) {
+					err = fmt.Errorf("jump to %d, outside of the code", dest)
+					break
+				}
+				pc = int(dest)
+			}
+		case opSLoad:
+			var key int64
+			key, err = pop()
+			if err != nil {
+				break
+			}
+			v, written := result.Writes[key]
+			if !written {
+				v = load(key)
+			}
+			err = push(v)
+		case opSStore:
+			var key, v int64
+			v, err = pop()
+			if err == nil {
+				key, err = pop()
+			}
+			if err == nil {
+				result.Writes[key] = v
+			}
+		case opArg:
+			var i int64
+			i, err = pop()
+			if err != nil {
+				break
+			}
+			v := int64(0)
+			if i >= 0 && i < int64(len(args)) {
+				v = args[i]
+			}
+			err = push(v)
+		case opArgC:
+			err = push(int64(len(args)))
+		case opHeight:
+			err = push(int64(height))
+		case opFail:
+			err = errors.New("FAIL")
+		}
+		if err != nil {
+			return result, fmt.Errorf("%w at %d", err, at)
+		}
+	}
+
+	return result, nil
+}
+
+// binaryContractOp applies an arithmetic or comparison opcode to two values
+func binaryContractOp(op byte, a, b int64) (int64, error) {
+	switch op {
+	case opAdd:
+		return a + b, nil
+	case opSub:
+		return a - b, nil
+	case opMul:
+		return a * b, nil
+	case opDiv, opMod:
+		if b == 0 {
+			return 0, errors.New("division by zero")
+		}
+		if op == opDiv {
+			return a / b, nil
+		}
+		return a % b, nil
+	case opLt:
+		return boolValue(a < b), nil
+	case opGt:
+		return boolValue(a > b), nil
+	default:
+		return boolValue(a == b), nil
+	}
+}
+
+// boolValue converts a condition to the 1 or 0 the VM pushes
+func boolValue(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Data-carrier outputs hold arbitrary data instead of paying an address, like
+// Bitcoin's OP_RETURN outputs, for timestamping documents or attaching
+// metadata to a payment. Their ScriptPubKey is dataCarrierPrefix followed by
+// the data in hex, which no ScriptSig can unlock, so they are provably
+// unspendable: they carry no value and never enter the UTXO set, the address
+// index or the balances.
+
+// dataCarrierPrefix starts the ScriptPubKey of a data-carrier output
+const dataCarrierPrefix = "OP_RETURN "
+
+// maxDataCarrierSize is the most bytes of data an output can carry, Bitcoin's
+// standard limit
+const maxDataCarrierSize = 80
+
+// NewDataOutput creates an output carrying data
+// Parameters:
+//   - data: The data, at most maxDataCarrierSize bytes
+func NewDataOutput(data []byte) TXOutput {
+	return TXOutput{0, dataCarrierPrefix + hex.EncodeToString(data), nil, 0}
+}
+
+// IsDataCarrier checks whether the output carries data rather than paying an
+// address
+func (out TXOutput) IsDataCarrier() bool {
+	return strings.HasPrefix(out.ScriptPubKey, dataCarrierPrefix)
+}
+
+// CarriedData returns the data of a data-carrier output, nil if it isn't
+// valid hex
+func (out TXOutput) CarriedData() []byte {
+	data, err := hex.DecodeString(strings.TrimPrefix(out.ScriptPubKey, dataCarrierPrefix))
+	if err != nil {
+		return nil
+	}
+
+	return data
+}
+
+// checkDataCarrier validates a data-carrier output: it carries no value and
+// at most maxDataCarrierSize bytes of hex data
+func checkDataCarrier(out TXOutput) error {
+	if out.Value != 0 {
+		return fmt.Errorf("data-carrier output has value %d, it must be 0", out.Value)
+	}
+
+	encoded := strings.TrimPrefix(out.ScriptPubKey, dataCarrierPrefix)
+	if _, err := hex.DecodeString(encoded); err != nil {
+		return fmt.Errorf("data-carrier output has invalid data: %w", err)
+	}
+	if size := len(encoded) / 2; size > maxDataCarrierSize {
+		return fmt.Errorf("data-carrier output has %d bytes of data, more than the limit of %d", size, maxDataCarrierSize)
+	}
+
+	return nil
+}
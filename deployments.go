@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Soft forks are deployed like Bitcoin's BIP 9 version bits: every deployment
+// is assigned a bit of the block version, miners whose software enforces the
+// new rule set the bit, and the rule applies once enough blocks of a window
+// signaled. Windows are counted from the genesis block, and the state of a
+// deployment only changes at the first block of a window:
+//
+//	defined -> started -> locked in -> active
+//	              \-> failed
+//
+// A deployment is defined until its start height, started until a window
+// has deploymentThreshold signaling blocks, and then locked in for one more
+// window before it's active. A started deployment that reaches its timeout
+// height fails. Heights are used instead of BIP 9's median times, so the
+// state of a block only depends on its ancestors.
+
+// Versions of blocks signaling with version bits start with the bits 001, so
+// 29 bits are left for deployments, as in Bitcoin. Blocks mined before
+// versions existed have version 0 and signal nothing.
+const (
+	versionBitsTopBits int32 = 0x20000000
+	versionBitsTopMask int32 = -0x20000000 // 0xe0000000
+)
+
+// Windows of the deployments
+const (
+	deploymentWindow    = 20 // Blocks whose signals are counted together
+	deploymentThreshold = 19 // Signaling blocks of a window locking a deployment in, 95%
+)
+
+// deploymentNoTimeout is the timeout height of deployments that never fail
+const deploymentNoTimeout = -1
+
+// DeploymentState is the state of a deployment for a block
+type DeploymentState string
+
+// States of a deployment
+const (
+	deploymentDefined  DeploymentState = "defined"   // Before its start height
+	deploymentStarted  DeploymentState = "started"   // Miners signal with its bit
+	deploymentLockedIn DeploymentState = "locked_in" // Enough blocks signaled, active from the next window
+	deploymentActive   DeploymentState = "active"    // Its rule is enforced
+	deploymentFailed   DeploymentState = "failed"    // It timed out before locking in
+)
+
+// Deployment is a rule change activated with version bits
+type Deployment struct {
+	Name          string // Name shown by getdeploymentinfo
+	Bit           uint   // Version bit signaling it, 0 to 28
+	StartHeight   int    // Height from which miners signal, the window containing it is the first started one
+	TimeoutHeight int    // Height at which it fails if it isn't locked in, deploymentNoTimeout to never fail
+
+	// Check enforces the rule once the deployment is active, nil for
+	// deployments testing the signaling only
+	Check func(block *Block) error
+}
+
+// deployments are the deployments of the active network, set by selectNetwork.
+// Mainnet's are listed here; there are none yet.
+var deployments []Deployment
+
+// testDummyDeployment exercises the signaling on testnet and regtest, like
+// Bitcoin's testdummy. It changes no rule.
+var testDummyDeployment = Deployment{
+	Name:          "testdummy",
+	Bit:           28,
+	StartHeight:   0,
+	TimeoutHeight: deploymentNoTimeout,
+}
+
+// deploymentStates caches the state of deployments for the windows starting
+// after the block with a given hash, keyed by deployment name and hash. The
+// state only depends on the block's ancestors, so entries never get stale.
+var deploymentStates = struct {
+	sync.Mutex
+	m map[string]DeploymentState
+}{m: make(map[string]DeploymentState)}
+
+// signals reports whether a block's version signals for a deployment
+func (d Deployment) signals(block *Block) bool {
+	return block.Version&versionBitsTopMask == versionBitsTopBits && block.Version&(1<<d.Bit) != 0
+}
+
+// timedOut reports whether a deployment failed by the given height
+func (d Deployment) timedOut(height int) bool {
+	return d.TimeoutHeight != deploymentNoTimeout && height >= d.TimeoutHeight
+}
+
+// deploymentState returns the state of a deployment for the block following
+// a parent block
+// Parameters:
+//   - tx: The database transaction
+//   - d: The deployment
+//   - parent: The block the next block extends
+func deploymentState(tx StoreTx, d Deployment, parent *Block) (DeploymentState, error) {
+	height := parent.Height + 1
+	windowStart := height - height%deploymentWindow
+	if windowStart == 0 {
+		return deploymentDefined, nil
+	}
+
+	// The state is decided at the last block of the previous window
+	last := parent
+	blocks := tx.Bucket([]byte(blocksBucket))
+	for last.Height > windowStart-1 {
+		data := blocks.Get(last.PrevBlockHash)
+		if data == nil {
+			return "", fmt.Errorf("block %x not found", last.PrevBlockHash)
+		}
+		last = DeserializeBlock(data)
+	}
+
+	return windowState(tx, d, last)
+}
+
+// windowState returns the state of a deployment for the window after a block
+// Parameters:
+//   - tx: The database transaction
+//   - d: The deployment
+//   - last: The last block of a window
+func windowState(tx StoreTx, d Deployment, last *Block) (DeploymentState, error) {
+	key := d.Name + ":" + hex.EncodeToString(last.Hash)
+	deploymentStates.Lock()
+	state, ok := deploymentStates.m[key]
+	deploymentStates.Unlock()
+	if ok {
+		return state, nil
+	}
+
+	// Count the signals of the window, walking back to the last block of the
+	// window before
+	signaled := 0
+	first := last
+	blocks := tx.Bucket([]byte(blocksBucket))
+	for i := 0; i < deploymentWindow; i++ {
+		if d.signals(first) {
+			signaled++
+		}
+		if len(first.PrevBlockHash) == 0 {
+			first = nil
+			break
+		}
+		data := blocks.Get(first.PrevBlockHash)
+		if data == nil {
+			return "", fmt.Errorf("block %x not found", first.PrevBlockHash)
+		}
+		first = DeserializeBlock(data)
+	}
+
+	state = deploymentDefined
+	if first != nil {
+		var err error
+		state, err = windowState(tx, d, first)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	next := last.Height + 1
+	switch state {
+	case deploymentDefined:
+		if d.timedOut(next) {
+			state = deploymentFailed
+		} else if next >= d.StartHeight {
+			state = deploymentStarted
+		}
+	case deploymentStarted:
+		// The window before was started, so its signals count
+		if signaled >= deploymentThreshold {
+			state = deploymentLockedIn
+		} else if d.timedOut(next) {
+			state = deploymentFailed
+		}
+	case deploymentLockedIn:
+		state = deploymentActive
+	}
+
+	deploymentStates.Lock()
+	deploymentStates.m[key] = state
+	deploymentStates.Unlock()
+
+	return state, nil
+}
+
+// blockVersion returns the version of a block mined on top of a parent,
+// signaling for the deployments that are started or locked in
+// Parameters:
+//   - tx: The database transaction
+//   - parent: The block the new block extends
+func blockVersion(tx StoreTx, parent *Block) (int32, error) {
+	version := versionBitsTopBits
+
+	for _, d := range deployments {
+		state, err := deploymentState(tx, d, parent)
+		if err != nil {
+			return 0, err
+		}
+		if state == deploymentStarted || state == deploymentLockedIn {
+			version |= 1 << d.Bit
+		}
+	}
+
+	return version, nil
+}
+
+// checkDeployments enforces the rules of the deployments active for a block
+// Parameters:
+//   - tx: The database transaction
+//   - block: The block to check
+//   - parent: The block it extends
+func checkDeployments(tx StoreTx, block, parent *Block) error {
+	for _, d := range deployments {
+		if d.Check == nil {
+			continue
+		}
+
+		state, err := deploymentState(tx, d, parent)
+		if err != nil {
+			return err
+		}
+		if state != deploymentActive {
+			continue
+		}
+
+		err = d.Check(block)
+		if err != nil {
+			return fmt.Errorf("block %x breaks the rule of deployment %s: %w", block.Hash, d.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// DeploymentInfo is the state of a deployment for the next block of the
+// active chain, in the JSON format of getdeploymentinfo
+type DeploymentInfo struct {
+	Name          string          `json:"name"`           // Name of the deployment
+	Bit           uint            `json:"bit"`            // Version bit signaling it
+	StartHeight   int             `json:"start_height"`   // Height from which miners signal
+	TimeoutHeight int             `json:"timeout_height"` // Height at which it fails if it isn't locked in, -1 for never
+	Status        DeploymentState `json:"status"`         // State for the next block
+	Since         int             `json:"since"`          // Height of the first block with this state
+	Period        int             `json:"period"`         // Blocks of a window
+	Threshold     int             `json:"threshold"`      // Signaling blocks of a window locking it in
+	Elapsed       int             `json:"elapsed"`        // Blocks of the current window so far
+	Count         int             `json:"count"`          // Blocks of the current window so far signaling for it
+	Possible      bool            `json:"possible"`       // Whether the current window can still lock it in
+}
+
+// DeploymentInfo returns the state of every deployment for the next block of
+// the active chain
+func (bc *Blockchain) DeploymentInfo() []DeploymentInfo {
+	infos := []DeploymentInfo{}
+
+	err := bc.db.View(func(tx StoreTx) error {
+		blocks := tx.Bucket([]byte(blocksBucket))
+		heights := tx.Bucket([]byte(heightsBucket))
+		tip := DeserializeBlock(blocks.Get(bc.tip))
+
+		height := tip.Height + 1
+		windowStart := height - height%deploymentWindow
+
+		// windowStateAt returns the state of the active chain's window
+		// starting at a height
+		windowStateAt := func(d Deployment, start int) (DeploymentState, error) {
+			if start == 0 {
+				return deploymentDefined, nil
+			}
+			return windowState(tx, d, DeserializeBlock(blocks.Get(heights.Get(heightKey(start-1)))))
+		}
+
+		for _, d := range deployments {
+			state, err := deploymentState(tx, d, tip)
+			if err != nil {
+				return err
+			}
+
+			since := windowStart
+			for since > 0 {
+				earlier, err := windowStateAt(d, since-deploymentWindow)
+				if err != nil {
+					return err
+				}
+				if earlier != state {
+					break
+				}
+				since -= deploymentWindow
+			}
+
+			info := DeploymentInfo{
+				Name:          d.Name,
+				Bit:           d.Bit,
+				StartHeight:   d.StartHeight,
+				TimeoutHeight: d.TimeoutHeight,
+				Status:        state,
+				Since:         since,
+				Period:        deploymentWindow,
+				Threshold:     deploymentThreshold,
+			}
+
+			for block := tip; block.Height >= windowStart; {
+				info.Elapsed++
+				if d.signals(block) {
+					info.Count++
+				}
+				if len(block.PrevBlockHash) == 0 {
+					break
+				}
+				block = DeserializeBlock(blocks.Get(block.PrevBlockHash))
+			}
+			info.Possible = state == deploymentStarted && info.Count+deploymentWindow-info.Elapsed >= deploymentThreshold
+
+			infos = append(infos, info)
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return infos
+}
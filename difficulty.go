@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+)
+
+// Difficulty retargeting, set per network by selectNetwork. Like Bitcoin,
+// the target is recalculated every retargetInterval blocks from the time
+// the last interval took, so blocks keep coming every targetSpacing
+// seconds however fast the miners' hardware gets.
+var (
+	retargetInterval       = 10 // Blocks between difficulty adjustments, 0 to never adjust
+	targetSpacing    int64 = 60 // Seconds a block should take to mine
+)
+
+// retargetClamp bounds how much a single adjustment may change the target:
+// the elapsed time counts as at least a quarter and at most four times the
+// target timespan
+const retargetClamp = 4
+
+// Blocks carry their proof-of-work target in Bitcoin's compact form, a
+// 32-bit number where the high byte is the length of the target in bytes
+// and the low 3 bytes its most significant bytes. Bit 23 is the sign, and
+// targets are never negative.
+
+// compactToBig decodes a compact target
+func compactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	exponent := uint(compact >> 24)
+
+	var n *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		n = big.NewInt(int64(mantissa))
+	} else {
+		n = big.NewInt(int64(mantissa))
+		n.Lsh(n, 8*(exponent-3))
+	}
+
+	if compact&0x00800000 != 0 {
+		n.Neg(n)
+	}
+
+	return n
+}
+
+// bigToCompact encodes a target in compact form, keeping its 3 most
+// significant bytes
+func bigToCompact(n *big.Int) uint32 {
+	if n.Sign() == 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(n.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(n.Uint64()) << (8 * (3 - exponent))
+	} else {
+		mantissa = uint32(new(big.Int).Rsh(n, 8*(exponent-3)).Uint64())
+	}
+
+	// The mantissa is unsigned, move a set sign bit to the next byte
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	compact := uint32(exponent<<24) | mantissa
+	if n.Sign() < 0 {
+		compact |= 0x00800000
+	}
+
+	return compact
+}
+
+// powLimit returns the easiest target, of the network's initial difficulty
+// targetBits
+func powLimit() *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(256-targetBits))
+}
+
+// hardestTarget returns the hardest target, rounded to compact form: the one
+// needing maxNonce tries on average. Mining used to give up after maxNonce
+// nonces, and the bound stays so the difficulty of existing chains doesn't
+// change.
+func hardestTarget() *big.Int {
+	target := new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(int64(maxNonce)))
+	return compactToBig(bigToCompact(target))
+}
+
+// Target returns the proof-of-work target of the block: its hash must be
+// below it. Blocks mined before blocks carried their target have Bits 0,
+// they all used the target of the network's initial difficulty.
+func (b *Block) Target() *big.Int {
+	if b.Bits == 0 {
+		return powLimit()
+	}
+
+	return compactToBig(b.Bits)
+}
+
+// Difficulty returns how many times harder the block's target is to meet
+// than the easiest target, 1 for a block of the initial difficulty
+func (b *Block) Difficulty() float64 {
+	return targetDifficulty(b.Target())
+}
+
+// targetDifficulty returns how many times harder a target is to meet than
+// the easiest target
+func targetDifficulty(target *big.Int) float64 {
+	difficulty, _ := new(big.Rat).SetFrac(powLimit(), target).Float64()
+	return difficulty
+}
+
+// nextTarget computes the target required of the block following a given
+// block, on the branch of that block. It changes only at heights that are
+// multiples of retargetInterval, scaled by the time the last
+// retargetInterval blocks took over the target timespan, and stays between
+// hardestTarget and powLimit.
+// Parameters:
+//   - tx: The database transaction
+//   - parent: The block the new block extends
+//
+// Returns:
+//   - uint32: The target of the new block, in compact form
+func nextTarget(tx StoreTx, parent *Block) (uint32, error) {
+	target := parent.Target()
+	height := parent.Height + 1
+	if retargetInterval <= 0 || height%retargetInterval != 0 {
+		return bigToCompact(target), nil
+	}
+
+	// Walk back to the first block of the interval
+	first := parent
+	blocks := tx.Bucket([]byte(blocksBucket))
+	for first.Height > height-retargetInterval {
+		data := blocks.Get(first.PrevBlockHash)
+		if data == nil {
+			return 0, fmt.Errorf("block %x of the retarget interval not found", first.PrevBlockHash)
+		}
+		first = DeserializeBlock(data)
+	}
+
+	timespan := int64(retargetInterval) * targetSpacing
+	elapsed := parent.Timestamp - first.Timestamp
+	elapsed = max(elapsed, timespan/retargetClamp)
+	elapsed = min(elapsed, timespan*retargetClamp)
+
+	target = new(big.Int).Mul(target, big.NewInt(elapsed))
+	target.Div(target, big.NewInt(timespan))
+
+	if limit := powLimit(); target.Cmp(limit) > 0 {
+		target = limit
+	}
+	if hardest := hardestTarget(); target.Cmp(hardest) < 0 {
+		target = hardest
+	}
+
+	return bigToCompact(target), nil
+}
+
+// NextTarget returns the target required of the next block on the active
+// chain, in compact form
+func (bc *Blockchain) NextTarget() uint32 {
+	var bits uint32
+
+	err := bc.db.View(func(tx StoreTx) error {
+		tip := DeserializeBlock(tx.Bucket([]byte(blocksBucket)).Get(bc.tip))
+
+		var err error
+		bits, err = nextTarget(tx, tip)
+		return err
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return bits
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+)
+
+// An output is dust when it's worth less than the fee of spending it, like in
+// Bitcoin: a transaction spending only that output into one like it, paying
+// dustRelayFee, would spend more than its value. Such outputs would stay in
+// the UTXO set forever, so the mempool rejects transactions creating them and
+// the wallet leaves dust change to the miner instead. Data-carrier outputs
+// carry no value and are never dust, see datacarrier.go.
+
+// dustRelayFee is the fee rate dust is measured at, in coins per 1000 bytes,
+// set with -dustrelayfee. Coins can't be split, so at the default rate any
+// output of a coin is worth spending, and higher rates make small outputs
+// dust.
+var dustRelayFee = 1
+
+// dustThreshold returns the smallest value an output can have without being
+// dust: the fee, rounded up, of a transaction spending only that output into
+// an output like it
+// Parameters:
+//   - out: The output
+func dustThreshold(out TXOutput) int {
+	spend := Transaction{
+		ID:   make([]byte, 32),
+		Vin:  []TXInput{{make([]byte, 32), 0, out.ScriptPubKey}},
+		Vout: []TXOutput{out},
+	}
+	size := len(spend.Serialize())
+
+	return (dustRelayFee*size + 999) / 1000
+}
+
+// IsDust checks whether an output is worth less than spending it costs
+func (out TXOutput) IsDust() bool {
+	return !out.IsDataCarrier() && out.Value < dustThreshold(out)
+}
+
+// checkDust rejects a transaction creating dust outputs, before it's accepted
+// in the mempool
+func checkDust(transaction *Transaction) error {
+	for i, out := range transaction.Vout {
+		if out.IsDust() {
+			return fmt.Errorf("transaction %x output %d of %d is dust, less than the %d it costs to spend", transaction.ID, i, out.Value, dustThreshold(out))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// envPrefix prefixes the environment variables setting flags
+const envPrefix = "BC_"
+
+// Every flag can be set with an environment variable as well, named after
+// the flag with envPrefix, in upper case and with underscores for dashes:
+// BC_NETWORK for -network, BC_DATADIR for -datadir, BC_ADDRESS for -address
+// or BC_LOCKED_UNTIL for -locked-until. This configures nodes in containers
+// and scripts without building command lines. The variable of a flag applies
+// to every command having the flag, so BC_ADDRESS gives the address of
+// getbalance, mine and startminer alike. The precedence, highest first, is:
+// 1. The flag on the command line
+// 2. Its BC_ environment variable
+// 3. For -datadir, the older BLOCKCHAIN_DATA_DIR variable
+// 4. The default of the flag
+
+// envName returns the environment variable setting a flag
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// applyEnv sets the flags of a command left off the command line from their
+// environment variables, exiting if a variable isn't a valid value of its flag
+// Parameters:
+//   - cmd: The command being run, with its flags parsed
+func applyEnv(cmd *cobra.Command) {
+	flags := cmd.Flags()
+
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Changed || f.Name == "help" {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+
+		// Set marks the flag as given, so required flags can come from the
+		// environment too
+		err := flags.Set(f.Name, value)
+		if err != nil {
+			fmt.Printf("%s: %v\n", envName(f.Name), err)
+			os.Exit(1)
+		}
+	})
+}
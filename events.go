@@ -0,0 +1,106 @@
+package main
+
+import "sync"
+
+// eventBufferSize is how many events a subscriber may fall behind before it
+// is dropped
+const eventBufferSize = 64
+
+// Event types
+const (
+	eventBlockConnected = "block.connected" // A block was added on top of the active chain
+	eventTxAccepted     = "tx.accepted"     // A transaction was accepted to be mined
+	eventTxConfirmed    = "tx.confirmed"    // A transaction was included in a connected block
+	eventTxExpired      = "tx.expired"      // A transaction waited too long to be mined and left the mempool
+)
+
+// Event is something that happened to the chain, pushed to API subscribers
+type Event struct {
+	Type  string       // One of the event constants
+	Block *Block       // The block, for block events and tx.confirmed
+	Tx    *Transaction // The transaction, for transaction events
+}
+
+// confirmedEvents returns the tx.confirmed events of a block.connected event.
+// They are derived by the subscribers that want them rather than published,
+// so a block with many transactions doesn't overflow the other subscribers.
+func confirmedEvents(ev Event) []Event {
+	if ev.Type != eventBlockConnected {
+		return nil
+	}
+
+	var events []Event
+	for _, tx := range ev.Block.Transactions {
+		events = append(events, Event{Type: eventTxConfirmed, Block: ev.Block, Tx: tx})
+	}
+
+	return events
+}
+
+// involves tells whether a transaction spends from or pays to an address
+func (tx *Transaction) involves(address string) bool {
+	for _, in := range tx.Vin {
+		if !tx.IsCoinbase() && in.CanUnlockOutputWith(address) {
+			return true
+		}
+	}
+	for _, out := range tx.Vout {
+		if out.CanBeUnlockedWith(address) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// eventFeed hands events to subscribers. Each subscriber gets a buffered
+// channel; one that falls behind by more than eventBufferSize events has its
+// channel closed instead of stalling the chain, and has to subscribe again.
+type eventFeed struct {
+	mu   sync.Mutex
+	subs map[chan Event]bool
+}
+
+// newEventFeed creates a feed without subscribers
+func newEventFeed() *eventFeed {
+	return &eventFeed{subs: make(map[chan Event]bool)}
+}
+
+// subscribe registers a new subscriber
+// Returns:
+//   - chan Event: Channel receiving the events, closed if the subscriber falls behind
+func (f *eventFeed) subscribe() chan Event {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ch := make(chan Event, eventBufferSize)
+	f.subs[ch] = true
+
+	return ch
+}
+
+// unsubscribe removes a subscriber and closes its channel
+func (f *eventFeed) unsubscribe(ch chan Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.subs[ch] {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+// publish sends an event to every subscriber without blocking
+func (f *eventFeed) publish(ev Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for ch := range f.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+}
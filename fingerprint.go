@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+// metaBucket holds metadata about the chain stored in the database
+const metaBucket = "meta"
+
+// Keys of the meta bucket
+const (
+	metaFingerprintKey   = "fingerprint"   // The chain fingerprint
+	metaGenesisKey       = "genesis"       // Hash of the genesis block
+	metaNetworkKey       = "network"       // Name of the network the chain was created on, see network.go
+	metaArchiveDepthKey  = "archivedepth"  // Blocks below the tip kept uncompressed, see archive.go
+	metaParamsKey        = "params"        // The chain parameters as JSON, see params.go
+	metaPruneDepthKey    = "prunedepth"    // Blocks below the tip kept whole, see prune.go
+	metaPrunedHeightKey  = "prunedheight"  // Height of the last pruned block, see prune.go
+	metaChainStateTipKey = "chainstatetip" // Hash of the block the chain state was built up to, see recovery.go
+)
+
+// chainFingerprint derives a short identifier of a chain from its genesis block
+// and the consensus parameters it's run with. Two databases with the same
+// fingerprint belong to the same chain, and a database opened by a node with
+// different parameters gets a different fingerprint.
+// Parameters:
+//   - genesisHash: Hash of the genesis block
+//
+// Returns:
+//   - string: The fingerprint as 8 hex characters
+func chainFingerprint(genesisHash []byte) string {
+	data := bytes.Join(
+		[][]byte{
+			genesisHash,
+			IntToHex(int64(targetBits)),
+			IntToHex(int64(subsidy)),
+			[]byte(genesisCoinbaseData),
+		},
+		[]byte{},
+	)
+	hash := sha256.Sum256(data)
+
+	return hex.EncodeToString(hash[:4])
+}
+
+// storeFingerprint records the genesis hash and fingerprint of a new chain
+// Parameters:
+//   - tx: The database transaction creating the chain
+//   - genesisHash: Hash of the genesis block
+func storeFingerprint(tx StoreTx, genesisHash []byte) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+	if err != nil {
+		return err
+	}
+
+	err = b.Put([]byte(metaGenesisKey), genesisHash)
+	if err != nil {
+		return err
+	}
+
+	err = b.Put([]byte(metaNetworkKey), []byte(activeNetwork.Name))
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte(metaFingerprintKey), []byte(chainFingerprint(genesisHash)))
+}
+
+// Fingerprint returns the fingerprint stored for the chain
+func (bc *Blockchain) Fingerprint() string {
+	var fingerprint string
+
+	err := bc.db.View(func(tx StoreTx) error {
+		fingerprint = string(tx.Bucket([]byte(metaBucket)).Get([]byte(metaFingerprintKey)))
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return fingerprint
+}
+
+// storedNetwork returns the name of the network a database belongs to. Chains
+// created before it was recorded are recognized by the coinbase message of
+// their genesis block, which differs between networks.
+// Parameters:
+//   - db: The database of the chain
+//
+// Returns:
+//   - string: The network, empty if it can't be told
+func storedNetwork(db Store) string {
+	var network string
+
+	err := db.View(func(tx StoreTx) error {
+		b := tx.Bucket([]byte(metaBucket))
+		if b == nil {
+			return nil
+		}
+
+		network = string(b.Get([]byte(metaNetworkKey)))
+		data := b.Get([]byte(metaParamsKey))
+		if network != "" || data == nil {
+			return nil
+		}
+
+		var params ChainParams
+		err := json.Unmarshal(data, &params)
+		if err != nil {
+			return err
+		}
+		for _, n := range networks {
+			if n.GenesisData == params.CoinbaseMessage {
+				network = n.Name
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return network
+}
+
+// checkNetwork makes sure a database belongs to the active network. It runs
+// before the parameters stored with the chain are applied, since the
+// fingerprint is derived from those and always matches them.
+// Parameters:
+//   - db: The database of the chain
+func checkNetwork(db Store) error {
+	network := storedNetwork(db)
+	if network != "" && network != activeNetwork.Name {
+		return fmt.Errorf("%s belongs to the %s network, but this node runs %s, select it with -network %s", dbFile, network, activeNetwork.Name, network)
+	}
+
+	return nil
+}
+
+// checkFingerprint makes sure the database belongs to the chain this node is
+// configured for, by comparing the stored fingerprint with the one derived
+// from the stored genesis block and the current parameters. Databases created
+// before fingerprints existed get one recorded. The process exits on a mismatch
+// rather than risking mixing up data of different chains.
+func (bc *Blockchain) checkFingerprint() {
+	var stored, genesisHash []byte
+
+	err := bc.db.View(func(tx StoreTx) error {
+		if b := tx.Bucket([]byte(metaBucket)); b != nil {
+			stored = bytes.Clone(b.Get([]byte(metaFingerprintKey)))
+			genesisHash = bytes.Clone(b.Get([]byte(metaGenesisKey)))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if stored == nil {
+		// Find the genesis block by walking back from the tip
+		bci := bc.Iterator()
+		for {
+			block := bci.Next()
+			if len(block.PrevBlockHash) == 0 {
+				genesisHash = block.Hash
+				break
+			}
+		}
+
+		err = bc.db.Update(func(tx StoreTx) error {
+			return storeFingerprint(tx, genesisHash)
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+		return
+	}
+
+	if expected := chainFingerprint(genesisHash); string(stored) != expected {
+		fmt.Printf("%s belongs to chain %s, but this node runs chain %s.\n", dbFile, stored, expected)
+		os.Exit(1)
+	}
+}
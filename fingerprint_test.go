@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// testNetwork returns the network with the given name
+func testNetwork(t *testing.T, name string) Network {
+	for _, n := range networks {
+		if n.Name == name {
+			return n
+		}
+	}
+
+	t.Fatalf("no network %s", name)
+	return Network{}
+}
+
+func TestCheckNetwork(t *testing.T) {
+	defer func(n Network) { activeNetwork = n }(activeNetwork)
+	regtest := testNetwork(t, "regtest")
+
+	// A chain created on regtest, and one created before the network was
+	// recorded with the regtest genesis coinbase message
+	created := newMemoryStore()
+	legacy := newMemoryStore()
+	activeNetwork = regtest
+	err := created.Update(func(tx StoreTx) error {
+		return storeFingerprint(tx, []byte("genesis"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = legacy.Update(func(tx StoreTx) error {
+		b, err := tx.CreateBucket([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(ChainParams{CoinbaseMessage: regtest.GenesisData})
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(metaParamsKey), data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, db := range []Store{created, legacy} {
+		activeNetwork = regtest
+		if err := checkNetwork(db); err != nil {
+			t.Errorf("regtest chain refused on regtest: %v", err)
+		}
+
+		activeNetwork = testNetwork(t, "mainnet")
+		if err := checkNetwork(db); err == nil {
+			t.Error("regtest chain opened on mainnet")
+		}
+	}
+
+	// Nothing tells the network of a chain without parameters
+	if err := checkNetwork(newMemoryStore()); err != nil {
+		t.Errorf("chain of unknown network refused: %v", err)
+	}
+}
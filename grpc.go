@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// The gRPC API implements the Node service of node.proto. Like the network
+// payloads its messages are encoded with protowire instead of generated code,
+// through a codec replacing the default protobuf codec of the server, so
+// clients generating stubs from node.proto speak the same format.
+
+// grpcMessage is a request or response message of node.proto
+type grpcMessage interface {
+	marshalProto() []byte
+	unmarshalProto(data []byte) error
+}
+
+// grpcCodec encodes the messages of node.proto, and the Block and Transaction
+// messages shared with the network protocol
+type grpcCodec struct{}
+
+// Name returns the content subtype of the codec, the one of protobuf
+func (grpcCodec) Name() string {
+	return "proto"
+}
+
+// Marshal encodes a message
+func (grpcCodec) Marshal(v any) ([]byte, error) {
+	switch m := v.(type) {
+	case grpcMessage:
+		return m.marshalProto(), nil
+	case *Block, *Transaction:
+		return encodePayload(v), nil
+	}
+
+	return nil, fmt.Errorf("no wire format for %T", v)
+}
+
+// Unmarshal decodes a message
+func (grpcCodec) Unmarshal(data []byte, v any) error {
+	if m, ok := v.(grpcMessage); ok {
+		return m.unmarshalProto(data)
+	}
+
+	return decodePayload(data, v)
+}
+
+// emptyMessage is a message without fields: GetBlockCountRequest and
+// SubscribeBlocksRequest
+type emptyMessage struct{}
+
+func (*emptyMessage) marshalProto() []byte { return nil }
+
+func (*emptyMessage) unmarshalProto(data []byte) error {
+	_, err := parseProtoFields(data)
+	return err
+}
+
+// getBlockCountResponse is a GetBlockCountResponse message
+type getBlockCountResponse struct {
+	Height  int
+	TipHash []byte
+}
+
+func (m *getBlockCountResponse) marshalProto() []byte {
+	b := appendVarintField(nil, 1, uint64(m.Height))
+	return appendBytesField(b, 2, m.TipHash)
+}
+
+func (m *getBlockCountResponse) unmarshalProto(data []byte) error {
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		var v uint64
+		switch f.num {
+		case 1:
+			v, err = f.varint()
+			m.Height = int(int64(v))
+		case 2:
+			m.TipHash, err = f.bytes()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getBlockRequest is a GetBlockRequest message
+type getBlockRequest struct {
+	Hash   []byte
+	Height int
+}
+
+func (m *getBlockRequest) marshalProto() []byte {
+	var b []byte
+	if len(m.Hash) > 0 {
+		b = appendBytesField(b, 1, m.Hash)
+	}
+	return appendVarintField(b, 2, uint64(m.Height))
+}
+
+func (m *getBlockRequest) unmarshalProto(data []byte) error {
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		var v uint64
+		switch f.num {
+		case 1:
+			m.Hash, err = f.bytes()
+		case 2:
+			v, err = f.varint()
+			m.Height = int(int64(v))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bytesMessage is a message with a single bytes field 1: GetTransactionRequest
+// and SendTransactionResponse
+type bytesMessage struct {
+	Value []byte
+}
+
+func (m *bytesMessage) marshalProto() []byte {
+	if len(m.Value) == 0 {
+		return nil
+	}
+	return appendBytesField(nil, 1, m.Value)
+}
+
+func (m *bytesMessage) unmarshalProto(data []byte) error {
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		if f.num == 1 {
+			m.Value, err = f.bytes()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// getTransactionResponse is a GetTransactionResponse message
+type getTransactionResponse struct {
+	Transaction   *Transaction
+	BlockHash     []byte
+	Confirmations int
+}
+
+func (m *getTransactionResponse) marshalProto() []byte {
+	b := appendBytesField(nil, 1, marshalTransaction(m.Transaction))
+	b = appendBytesField(b, 2, m.BlockHash)
+	return appendVarintField(b, 3, uint64(m.Confirmations))
+}
+
+func (m *getTransactionResponse) unmarshalProto(data []byte) error {
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		var v uint64
+		var tx []byte
+		switch f.num {
+		case 1:
+			tx, err = f.bytes()
+			if err == nil {
+				m.Transaction = &Transaction{}
+				err = unmarshalTransaction(tx, m.Transaction)
+			}
+		case 2:
+			m.BlockHash, err = f.bytes()
+		case 3:
+			v, err = f.varint()
+			m.Confirmations = int(int64(v))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getBalanceRequest is a GetBalanceRequest message
+type getBalanceRequest struct {
+	Address string
+}
+
+func (m *getBalanceRequest) marshalProto() []byte {
+	return appendStringField(nil, 1, m.Address)
+}
+
+func (m *getBalanceRequest) unmarshalProto(data []byte) error {
+	var s bytesMessage
+	err := s.unmarshalProto(data)
+	m.Address = string(s.Value)
+	return err
+}
+
+// getBalanceResponse is a GetBalanceResponse message
+type getBalanceResponse struct {
+	Balance int
+}
+
+func (m *getBalanceResponse) marshalProto() []byte {
+	return appendVarintField(nil, 1, uint64(m.Balance))
+}
+
+func (m *getBalanceResponse) unmarshalProto(data []byte) error {
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		if f.num == 1 {
+			var v uint64
+			v, err = f.varint()
+			if err != nil {
+				return err
+			}
+			m.Balance = int(int64(v))
+		}
+	}
+
+	return nil
+}
+
+// grpcNode implements the Node service on top of an API server
+type grpcNode struct {
+	api *APIServer
+}
+
+// toGRPCError converts an error of the API to a gRPC status
+func toGRPCError(err error) error {
+	if errors.Is(err, errNoChain) {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		switch apiErr.status {
+		case http.StatusNotFound:
+			return status.Error(codes.NotFound, err.Error())
+		case http.StatusBadRequest:
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
+
+// getBlockCount implements Node.GetBlockCount
+func (n *grpcNode) getBlockCount(_ any) (any, error) {
+	return n.api.withChain(func(bc *Blockchain) (any, error) {
+		return &getBlockCountResponse{bc.GetBestHeight(), bc.tip}, nil
+	})
+}
+
+// getBlock implements Node.GetBlock
+func (n *grpcNode) getBlock(req any) (any, error) {
+	r := req.(*getBlockRequest)
+
+	return n.api.withChain(func(bc *Blockchain) (any, error) {
+		hash := r.Hash
+		if len(hash) == 0 {
+			var err error
+			hash, err = bc.GetBlockHash(r.Height)
+			if err != nil {
+				return nil, notFound(err)
+			}
+		}
+
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			return nil, notFound(err)
+		}
+
+		return block, nil
+	})
+}
+
+// getTransaction implements Node.GetTransaction
+func (n *grpcNode) getTransaction(req any) (any, error) {
+	id := req.(*bytesMessage).Value
+
+	return n.api.withChain(func(bc *Blockchain) (any, error) {
+		block, err := bc.TransactionBlock(id)
+		if err != nil {
+			return nil, notFound(err)
+		}
+
+		tx, err := bc.FindTransaction(id)
+		if err != nil {
+			return nil, err
+		}
+
+		confirmations, err := bc.Confirmations(block)
+		if err != nil {
+			return nil, err
+		}
+
+		return &getTransactionResponse{&tx, block.Hash, confirmations}, nil
+	})
+}
+
+// getBalance implements Node.GetBalance
+func (n *grpcNode) getBalance(req any) (any, error) {
+	address := req.(*getBalanceRequest).Address
+
+	return n.api.withChain(func(bc *Blockchain) (any, error) {
+		return &getBalanceResponse{UTXOSet{bc}.GetBalance(address)}, nil
+	})
+}
+
+// sendTransaction implements Node.SendTransaction
+func (n *grpcNode) sendTransaction(req any) (any, error) {
+	tx := req.(*Transaction)
+
+	_, err := n.api.withChain(func(bc *Blockchain) (any, error) {
+		err := UTXOSet{bc}.VerifyTransaction(tx)
+		if err != nil {
+			return nil, badRequest(err)
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = n.api.submit(tx)
+	if err != nil {
+		return nil, badRequest(err)
+	}
+
+	return &bytesMessage{tx.ID}, nil
+}
+
+// subscribeBlocks implements Node.SubscribeBlocks, streaming every block
+// connected to the active chain until the client goes away
+func (n *grpcNode) subscribeBlocks(stream grpc.ServerStream) error {
+	err := stream.RecvMsg(&emptyMessage{})
+	if err != nil {
+		return err
+	}
+
+	events := n.api.events.subscribe()
+	defer n.api.events.unsubscribe(events)
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case ev, ok := <-events:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "subscriber fell behind, subscribe again")
+			}
+			if ev.Type != eventBlockConnected {
+				continue
+			}
+
+			err = stream.SendMsg(ev.Block)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// grpcUnary describes a unary method of the Node service
+// Parameters:
+//   - name: Name of the method
+//   - newReq: Returns an empty request message to decode into
+//   - call: Runs the method
+func grpcUnary(name string, newReq func() any, call func(n *grpcNode, req any) (any, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			req := newReq()
+			err := dec(req)
+			if err != nil {
+				return nil, err
+			}
+
+			handler := func(_ context.Context, req any) (any, error) {
+				resp, err := call(srv.(*grpcNode), req)
+				if err != nil {
+					return nil, toGRPCError(err)
+				}
+				return resp, nil
+			}
+			if interceptor == nil {
+				return handler(ctx, req)
+			}
+
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/goblockchain.Node/" + name}, handler)
+		},
+	}
+}
+
+// nodeServiceDesc describes the Node service of node.proto
+var nodeServiceDesc = grpc.ServiceDesc{
+	ServiceName: "goblockchain.Node",
+	// Handlers are looked up in the descriptor, so any implementation type is accepted
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		grpcUnary("GetBlockCount", func() any { return &emptyMessage{} }, (*grpcNode).getBlockCount),
+		grpcUnary("GetBlock", func() any { return &getBlockRequest{} }, (*grpcNode).getBlock),
+		grpcUnary("GetTransaction", func() any { return &bytesMessage{} }, (*grpcNode).getTransaction),
+		grpcUnary("GetBalance", func() any { return &getBalanceRequest{} }, (*grpcNode).getBalance),
+		grpcUnary("SendTransaction", func() any { return &Transaction{} }, (*grpcNode).sendTransaction),
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SubscribeBlocks",
+			ServerStreams: true,
+			Handler: func(srv any, stream grpc.ServerStream) error {
+				return srv.(*grpcNode).subscribeBlocks(stream)
+			},
+		},
+	},
+	Metadata: "node.proto",
+}
+
+// ServeGRPC serves the gRPC API until the listener fails
+// Parameters:
+//   - addr: Address to listen on, for example ":9090"
+//   - config: TLS configuration to encrypt connections with, see serverTLSConfig, nil for none
+func (a *APIServer) ServeGRPC(addr string, config *tls.Config) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	options := []grpc.ServerOption{grpc.ForceServerCodec(grpcCodec{})}
+	if config != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(config)))
+	}
+	server := grpc.NewServer(options...)
+	server.RegisterService(&nodeServiceDesc, &grpcNode{a})
+
+	slog.Info("gRPC API listening", "addr", addr, "tls", config != nil)
+	return server.Serve(ln)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+)
+
+// heightsBucket is the bucket mapping the heights of the active chain to block hashes
+const heightsBucket = "heights"
+
+// heightKey encodes a height as a big-endian key, so keys sort by height
+func heightKey(height int) []byte {
+	return IntToHex(int64(height))
+}
+
+// GetBestHeight returns the height of the tip of the active chain
+func (bc *Blockchain) GetBestHeight() int {
+	var lastBlock *Block
+
+	err := bc.db.View(func(tx StoreTx) error {
+		lastBlock = DeserializeBlock(tx.Bucket([]byte(blocksBucket)).Get(bc.tip))
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return lastBlock.Height
+}
+
+// GetBlockHash returns the hash of the block of the active chain at a height
+// Parameters:
+//   - height: Height of the block, the genesis block has height 0
+//
+// Returns:
+//   - []byte: Hash of the block
+func (bc *Blockchain) GetBlockHash(height int) ([]byte, error) {
+	var hash []byte
+
+	err := bc.db.View(func(tx StoreTx) error {
+		hash = bytes.Clone(tx.Bucket([]byte(heightsBucket)).Get(heightKey(height)))
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if hash == nil {
+		return nil, fmt.Errorf("block height %d out of range, chain height is %d", height, bc.GetBestHeight())
+	}
+
+	return hash, nil
+}
+
+// GetBlock returns a stored block by its hash. The block doesn't have to be
+// part of the active chain.
+// Parameters:
+//   - hash: Hash of the block
+//
+// Returns:
+//   - *Block: The block
+func (bc *Blockchain) GetBlock(hash []byte) (*Block, error) {
+	var block *Block
+
+	err := bc.db.View(func(tx StoreTx) error {
+		block = getBlock(tx, hash)
+		if block == nil {
+			return fmt.Errorf("block %x not found", hash)
+		}
+
+		return nil
+	})
+
+	return block, err
+}
+
+// GetBlockHeader returns the header of a stored block, without reading its
+// transactions, see blockstore.go
+// Parameters:
+//   - hash: Hash of the block
+//
+// Returns:
+//   - *Block: The header
+func (bc *Blockchain) GetBlockHeader(hash []byte) (*Block, error) {
+	var header *Block
+
+	err := bc.db.View(func(tx StoreTx) error {
+		encodedHeader := tx.Bucket([]byte(blocksBucket)).Get(hash)
+		if encodedHeader == nil {
+			return fmt.Errorf("block %x not found", hash)
+		}
+		header = DeserializeBlock(encodedHeader)
+
+		return nil
+	})
+
+	return header, err
+}
+
+// IsInActiveChain checks whether a block is part of the active chain
+func (bc *Blockchain) IsInActiveChain(block *Block) bool {
+	hash, err := bc.GetBlockHash(block.Height)
+	return err == nil && bytes.Equal(hash, block.Hash)
+}
+
+// updateHeightIndex records the height of a block added to the active chain
+// Parameters:
+//   - tx: The database transaction storing the block
+//   - block: The block being added to the chain
+func updateHeightIndex(tx StoreTx, block *Block) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(heightsBucket))
+	if err != nil {
+		return err
+	}
+
+	return b.Put(heightKey(block.Height), block.Hash)
+}
+
+// reindexHeights rebuilds the height index from the active chain.
+// Blocks stored before blocks had a height field get their height set.
+func (bc *Blockchain) reindexHeights() {
+	err := bc.db.Update(func(tx StoreTx) error {
+		err := tx.DeleteBucket([]byte(heightsBucket))
+		if err != nil && err != errBucketNotFound {
+			return err
+		}
+
+		// Collect the active chain from the tip back to genesis
+		var chain []*Block
+		blocks := tx.Bucket([]byte(blocksBucket))
+		for hash := bc.tip; len(hash) > 0; {
+			block := DeserializeBlock(blocks.Get(hash))
+			chain = append(chain, block)
+			hash = block.PrevBlockHash
+		}
+
+		for i, block := range chain {
+			height := len(chain) - 1 - i
+
+			if block.Height != height {
+				block.Height = height
+				err = blocks.Put(block.Hash, block.Serialize())
+				if err != nil {
+					return err
+				}
+			}
+
+			err = updateHeightIndex(tx, block)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
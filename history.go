@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/hex"
+	"log"
+)
+
+// The history of an address is every transaction of the active chain paying
+// it or spending its outputs, oldest first, like a bank statement. The
+// address index only holds unspent outputs, so the history walks the blocks
+// of the active chain up from the genesis block, remembering the outputs paid
+// to the address so the inputs spending them have a value. It needs the
+// transactions of every block and refuses to run on pruned chains.
+
+// History directions of a transaction, see HistoryEntry.Direction
+const (
+	historyMined    = "mined"    // A coinbase paying the address
+	historyReceived = "received" // Pays the address without spending its outputs
+	historySent     = "sent"     // Spends its outputs, leaving it with less
+	historySelf     = "self"     // Spends its outputs, paying it at least as much back
+)
+
+// HistoryEntry is a transaction in the history of an address
+type HistoryEntry struct {
+	Txid      []byte // ID of the transaction
+	Height    int    // Height of its block
+	Timestamp int64  // Unix timestamp of its block
+	Received  int    // Value of its outputs paying the address
+	Sent      int    // Value of the outputs of the address it spends
+	Coinbase  bool   // Whether it's a coinbase transaction
+}
+
+// Net returns the amount the transaction added to the balance, negative if it
+// took away from it
+func (e HistoryEntry) Net() int {
+	return e.Received - e.Sent
+}
+
+// Direction returns which way the transaction moved coins, one of the
+// history directions
+func (e HistoryEntry) Direction() string {
+	switch {
+	case e.Coinbase:
+		return historyMined
+	case e.Sent == 0:
+		return historyReceived
+	case e.Net() < 0:
+		return historySent
+	}
+
+	return historySelf
+}
+
+// AddressHistory returns the transactions of the active chain touching any of
+// a set of addresses, oldest first
+// Parameters:
+//   - addresses: The addresses, such as an owner and its change addresses
+//
+// Returns:
+//   - []HistoryEntry: The transactions with the amounts they moved
+//   - error: If blocks were pruned
+func (bc *Blockchain) AddressHistory(addresses []string) ([]HistoryEntry, error) {
+	err := bc.checkUnpruned("The address history")
+	if err != nil {
+		return nil, err
+	}
+
+	owned := make(map[string]bool)
+	for _, address := range addresses {
+		owned[address] = true
+	}
+
+	// Values of the outputs paid to the addresses, by outpoint
+	outputs := make(map[string]int)
+
+	var history []HistoryEntry
+	for height := 0; height <= bc.GetBestHeight(); height++ {
+		hash, err := bc.GetBlockHash(height)
+		if err != nil {
+			log.Panic(err)
+		}
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		for _, tx := range block.Transactions {
+			entry := HistoryEntry{Txid: tx.ID, Height: block.Height, Timestamp: block.Timestamp, Coinbase: tx.IsCoinbase()}
+			touched := false
+
+			if !tx.IsCoinbase() {
+				for _, in := range tx.Vin {
+					outpoint := outpointKey(hex.EncodeToString(in.Txid), in.Vout)
+					if value, ok := outputs[outpoint]; ok {
+						entry.Sent += value
+						touched = true
+						delete(outputs, outpoint)
+					}
+				}
+			}
+			for i, out := range tx.Vout {
+				if owned[out.ScriptPubKey] {
+					entry.Received += out.Value
+					touched = true
+					outputs[outpointKey(hex.EncodeToString(tx.ID), i)] = out.Value
+				}
+			}
+
+			if touched {
+				history = append(history, entry)
+			}
+		}
+	}
+
+	return history, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// importBatchSize is the most blocks connected in one database transaction
+// by ImportBlocks
+const importBatchSize = 250
+
+// Connecting a block with AddBlock takes a database transaction of its own,
+// and committing it, which syncs the file, is what importing thousands of
+// blocks mostly costs. ImportBlocks connects the blocks extending the tip in
+// batches of importBatchSize per transaction instead, used by importchain
+// and by nodes downloading a long chain from a peer (see queueSyncBlock). A
+// batch is written atomically like a single block: if one of its blocks is
+// invalid, nothing of the batch was written, and its blocks are added again
+// one at a time so the ones before the invalid block are kept.
+
+// errNotExtendingTip stops a batch at a block not extending the tip, which
+// AddBlock adds instead
+var errNotExtendingTip = errors.New("block doesn't extend the tip")
+
+// ImportBlocks adds blocks to the chain in order, connecting the ones
+// extending the tip importBatchSize per database transaction
+// Parameters:
+//   - blocks: The blocks, each one's parent stored or before it
+//
+// Returns:
+//   - int: How many of the blocks were added or already stored, the block
+//     after them failed when the error isn't nil
+//   - error: Why that block couldn't be added
+func (bc *Blockchain) ImportBlocks(blocks []*Block) (int, error) {
+	done := 0
+
+	for done < len(blocks) {
+		batch := blocks[done:min(done+importBatchSize, len(blocks))]
+
+		n, err := bc.connectBatch(batch)
+		if err == nil {
+			done += n
+			continue
+		}
+
+		// Find the block that failed, keeping the ones before it
+		n = 0
+		for _, block := range batch {
+			_, err = bc.AddBlock(block)
+			if err != nil {
+				return done + n, err
+			}
+			n++
+		}
+		done += n
+	}
+
+	return done, nil
+}
+
+// connectBatch stores and connects blocks extending the tip, and the ones
+// before them already stored, in one database transaction
+// Parameters:
+//   - batch: The blocks
+//
+// Returns:
+//   - int: Number of blocks of the batch, all added or already stored
+//   - error: The error of the first block that couldn't, nothing was written then
+func (bc *Blockchain) connectBatch(batch []*Block) (int, error) {
+	tip := bc.tip
+
+	err := bc.db.Update(func(tx StoreTx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		tip = bytes.Clone(b.Get([]byte("l")))
+
+		for _, block := range batch {
+			if b.Get(block.Hash) != nil {
+				continue
+			}
+			if !bytes.Equal(block.PrevBlockHash, tip) {
+				return errNotExtendingTip
+			}
+
+			err := checkBlockHeader(block)
+			if err != nil {
+				return err
+			}
+			err = checkCheckpoints(tx, block)
+			if err != nil {
+				return err
+			}
+
+			err = validateBlock(tx, block, DeserializeBlock(b.Get(tip)))
+			if err != nil {
+				return err
+			}
+
+			err = putBlock(tx, block)
+			if err != nil {
+				return err
+			}
+			err = storeChainWork(tx, block)
+			if err != nil {
+				return err
+			}
+			err = connectBlock(tx, block)
+			if err != nil {
+				return err
+			}
+			tip = block.Hash
+		}
+
+		return b.Put([]byte("l"), tip)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	bc.tip = tip
+	return len(batch), nil
+}
+
+// exportChain writes the blocks of the active chain from the genesis block to
+// the tip as a stream of GOB encoded blocks, the file importChain reads
+// Parameters:
+//   - bc: The blockchain
+//   - w: Where to write the blocks
+//
+// Returns:
+//   - int: Number of blocks written
+func exportChain(bc *Blockchain, w io.Writer) (int, error) {
+	err := bc.checkUnpruned("Exporting the chain")
+	if err != nil {
+		return 0, err
+	}
+
+	encoder := gob.NewEncoder(w)
+	tipHeight := bc.GetBestHeight()
+	for height := 0; height <= tipHeight; height++ {
+		hash, err := bc.GetBlockHash(height)
+		if err != nil {
+			return height, err
+		}
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			return height, err
+		}
+
+		err = encoder.Encode(block)
+		if err != nil {
+			return height, err
+		}
+	}
+
+	return tipHeight + 1, nil
+}
+
+// importChain adds the blocks of a file written by exportChain to the chain,
+// creating the chain from the first block of the file if there's none
+// Parameters:
+//   - path: The file
+//   - progress: Told how far the import got, may be nil. The blocks of the
+//     file are estimated from the bytes read so far.
+//
+// Returns:
+//   - int: Number of blocks read from the file
+//   - int: Height of the chain afterwards
+func importChain(path string, progress ProgressReporter) (int, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	counter := &countingReader{r: f}
+
+	var bc *Blockchain
+	if dbExists() {
+		bc = NewBlockchain("")
+	}
+	defer func() {
+		if bc != nil {
+			bc.db.Close()
+		}
+	}()
+
+	tracker := newProgressTracker(progress, "Importing blocks", 0, 0)
+	height := func() int {
+		if bc == nil {
+			return 0
+		}
+		return bc.GetBestHeight()
+	}
+
+	decoder := gob.NewDecoder(counter)
+	read := 0
+	for {
+		var batch []*Block
+		for len(batch) < importBatchSize {
+			var block Block
+			err = decoder.Decode(&block)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return read, height(), fmt.Errorf("%s: block %d: %w", path, read+len(batch), err)
+			}
+			batch = append(batch, &block)
+		}
+		if len(batch) == 0 {
+			tracker.update(read, read)
+			return read, height(), nil
+		}
+
+		if bc == nil {
+			genesis := batch[0]
+			if len(genesis.PrevBlockHash) != 0 {
+				return read, 0, fmt.Errorf("%s doesn't start with a genesis block", path)
+			}
+			err = checkBlockHeader(genesis)
+			if err != nil {
+				return read, 0, err
+			}
+			bc = InitBlockchain(genesis)
+		}
+		if first := batch[0]; read == 0 && len(first.PrevBlockHash) == 0 && !bc.hasBlock(first.Hash) {
+			return read, height(), fmt.Errorf("%s starts with genesis block %x of another chain", path, first.Hash)
+		}
+
+		n, err := bc.ImportBlocks(batch)
+		if err != nil {
+			return read + n, height(), fmt.Errorf("block %x: %w", batch[n].Hash, err)
+		}
+		read += n
+		if counter.n > 0 {
+			tracker.update(read, max(int(int64(read)*info.Size()/counter.n), read+1))
+		}
+	}
+}
+
+// countingReader counts the bytes read from a reader
+type countingReader struct {
+	r io.Reader
+	n int64 // Bytes read so far
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+)
+
+// A transaction with a lock time can't be mined before it, like Bitcoin's
+// nLockTime: the lock time is the height of the first block that may include
+// it, or, from lockTimeThreshold on, a Unix time the median time past of the
+// block's parent must have reached. Median times only move forward, unlike the
+// timestamps of single blocks (Bitcoin's BIP 113). A lock time of 0 doesn't
+// lock the transaction.
+
+// lockTimeThreshold is where lock times stop being heights and become Unix
+// times, November 1985 as in Bitcoin
+const lockTimeThreshold = 500000000
+
+// IsFinal checks whether a transaction can be included in a block
+// Parameters:
+//   - height: Height of the block
+//   - mtp: Median time past of the block's parent, see medianTimePast
+func (tx Transaction) IsFinal(height int, mtp int64) bool {
+	switch {
+	case tx.LockTime == 0:
+		return true
+	case tx.LockTime < lockTimeThreshold:
+		return int64(height) >= tx.LockTime
+	default:
+		return mtp >= tx.LockTime
+	}
+}
+
+// describeLockTime formats a lock time for error messages
+func describeLockTime(lockTime int64) string {
+	if lockTime < lockTimeThreshold {
+		return fmt.Sprintf("height %d", lockTime)
+	}
+	return fmt.Sprintf("time %d", lockTime)
+}
+
+// checkLockTimes makes sure every transaction of a block is final at its
+// height and after its parent's median time past
+// Parameters:
+//   - tx: The database transaction
+//   - block: The block to check
+//   - parent: The block it extends
+func checkLockTimes(tx StoreTx, block, parent *Block) error {
+	mtp, err := medianTimePast(tx, parent)
+	if err != nil {
+		return err
+	}
+
+	for _, transaction := range block.Transactions {
+		if !transaction.IsFinal(block.Height, mtp) {
+			return fmt.Errorf("block %x includes transaction %x, locked until %s", block.Hash, transaction.ID, describeLockTime(transaction.LockTime))
+		}
+	}
+
+	return nil
+}
+
+// checkFinalForNextBlock makes sure a transaction can be included in the
+// next block of the active chain, before it's accepted in the mempool
+// Parameters:
+//   - tx: The database transaction
+//   - tip: The active tip
+//   - transaction: The transaction
+func checkFinalForNextBlock(tx StoreTx, tip *Block, transaction *Transaction) error {
+	mtp, err := medianTimePast(tx, tip)
+	if err != nil {
+		return err
+	}
+
+	if !transaction.IsFinal(tip.Height+1, mtp) {
+		return fmt.Errorf("transaction %x is locked until %s", transaction.ID, describeLockTime(transaction.LockTime))
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Nodes, miners and the commands log what they do with log/slog on stderr:
+// peers connecting, blocks and transactions accepted or rejected, database
+// updates, the progress of mining. Every entry has a level and its values as
+// attributes, such as peer=HOST:PORT or hash=HEX, in the format of -logformat:
+// text, one key=value line an entry, or json, one JSON object a line for log
+// collectors. -loglevel drops the entries below a level; the mining hash rate
+// and database updates are debug entries and stay out of the way by default.
+// The results of the commands still go to stdout, see output.go.
+
+// Log formats of -logformat
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// setupLogging makes slog log at a level in a format, log included
+// Parameters:
+//   - level: Lowest level logged: debug, info, warn or error
+//   - format: logFormatText or logFormatJSON
+//
+// Returns:
+//   - error: If the level or format is unknown
+func setupLogging(level, format string) error {
+	var lowest slog.Level
+	err := lowest.UnmarshalText([]byte(level))
+	if err != nil {
+		return fmt.Errorf("unknown log level %q, expected debug, info, warn or error", level)
+	}
+
+	options := &slog.HandlerOptions{Level: lowest}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case logFormatText:
+		handler = slog.NewTextHandler(os.Stderr, options)
+	case logFormatJSON:
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("unknown log format %q, expected %s or %s", format, logFormatText, logFormatJSON)
+	}
+
+	// The log package, and the message of log.Panic, go through it too, as
+	// errors: the commands only use it for internal errors
+	slog.SetDefault(slog.New(handler))
+	slog.SetLogLoggerLevel(slog.LevelError)
+
+	return nil
+}
+
+// hashAttr is a log attribute holding a hash or ID in hex
+func hashAttr(key string, hash []byte) slog.Attr {
+	return slog.String(key, hex.EncodeToString(hash))
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"sync"
+)
+
+// memoryStore is a Store kept in memory, for demos run with -ephemeral and
+// for tests, so generating a chain needs no disk I/O and leaves no files
+// behind. Like BoltDB it runs one read-write transaction at a time next to
+// any number of read-only ones. An Update writes straight to the buckets and
+// records how to undo each write, undoing them all if it fails.
+type memoryStore struct {
+	mu      sync.RWMutex
+	buckets map[string]*memoryBucket
+}
+
+// memoryBucket is a bucket of a memoryStore, its keys kept sorted for cursors
+type memoryBucket struct {
+	keys   []string          // The keys, sorted
+	values map[string][]byte // Key -> value
+}
+
+// errTxNotWritable is returned for writes in a read-only transaction
+var errTxNotWritable = errors.New("transaction not writable")
+
+// newMemoryStore creates an empty memoryStore
+func newMemoryStore() *memoryStore {
+	return &memoryStore{buckets: make(map[string]*memoryBucket)}
+}
+
+func (s *memoryStore) View(fn func(tx StoreTx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return fn(&memoryTx{store: s})
+}
+
+func (s *memoryStore) Update(fn func(tx StoreTx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &memoryTx{store: s, writable: true}
+	defer func() {
+		// Like bolt, a panicking fn leaves the store as it was
+		if r := recover(); r != nil {
+			tx.rollback()
+			panic(r)
+		}
+	}()
+
+	err := fn(tx)
+	if err != nil {
+		tx.rollback()
+	}
+
+	return err
+}
+
+// Backup writes the store as a BoltDB file, so a chain kept in memory is
+// saved and restored like any other
+func (s *memoryStore) Backup(w io.Writer) error {
+	f, err := os.CreateTemp("", "memory-store-*.db")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	file, err := openBoltStore(f.Name())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = s.View(func(tx StoreTx) error {
+		return file.Update(func(fileTx StoreTx) error {
+			for name := range s.buckets {
+				b, err := fileTx.CreateBucket([]byte(name))
+				if err != nil {
+					return err
+				}
+
+				err = tx.Bucket([]byte(name)).ForEach(b.Put)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return file.Backup(w)
+}
+
+// Close keeps the data, which lives as long as the process
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// memoryTx is a StoreTx of a memoryStore
+type memoryTx struct {
+	store    *memoryStore
+	writable bool
+	undo     []func() // Reverts the writes of the transaction, in order
+}
+
+// rollback reverts the writes of the transaction, the last first
+func (t *memoryTx) rollback() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		t.undo[i]()
+	}
+	t.undo = nil
+}
+
+func (t *memoryTx) Bucket(name []byte) StoreBucket {
+	b, ok := t.store.buckets[string(name)]
+	if !ok {
+		return nil
+	}
+
+	return memoryBucketTx{b, t}
+}
+
+func (t *memoryTx) CreateBucket(name []byte) (StoreBucket, error) {
+	if !t.writable {
+		return nil, errTxNotWritable
+	}
+	if _, ok := t.store.buckets[string(name)]; ok {
+		return nil, errBucketExists
+	}
+
+	b := &memoryBucket{values: make(map[string][]byte)}
+	t.store.buckets[string(name)] = b
+	t.undo = append(t.undo, func() { delete(t.store.buckets, string(name)) })
+
+	return memoryBucketTx{b, t}, nil
+}
+
+func (t *memoryTx) CreateBucketIfNotExists(name []byte) (StoreBucket, error) {
+	if b := t.Bucket(name); b != nil {
+		return b, nil
+	}
+
+	return t.CreateBucket(name)
+}
+
+func (t *memoryTx) DeleteBucket(name []byte) error {
+	if !t.writable {
+		return errTxNotWritable
+	}
+	b, ok := t.store.buckets[string(name)]
+	if !ok {
+		return errBucketNotFound
+	}
+
+	delete(t.store.buckets, string(name))
+	t.undo = append(t.undo, func() { t.store.buckets[string(name)] = b })
+
+	return nil
+}
+
+// memoryBucketTx is a memoryBucket accessed in a transaction
+type memoryBucketTx struct {
+	b  *memoryBucket
+	tx *memoryTx
+}
+
+func (b memoryBucketTx) Get(key []byte) []byte {
+	return b.b.values[string(key)]
+}
+
+func (b memoryBucketTx) Put(key, value []byte) error {
+	if !b.tx.writable {
+		return errTxNotWritable
+	}
+
+	k := string(key)
+	old, existed := b.b.values[k]
+	if !existed {
+		i, _ := slices.BinarySearch(b.b.keys, k)
+		b.b.keys = slices.Insert(b.b.keys, i, k)
+	}
+	// Callers may reuse the value's buffer
+	b.b.values[k] = bytes.Clone(value)
+
+	b.tx.undo = append(b.tx.undo, func() { b.b.restore(k, old, existed) })
+	return nil
+}
+
+func (b memoryBucketTx) Delete(key []byte) error {
+	if !b.tx.writable {
+		return errTxNotWritable
+	}
+
+	k := string(key)
+	old, existed := b.b.values[k]
+	if !existed {
+		return nil
+	}
+	b.b.restore(k, nil, false)
+
+	b.tx.undo = append(b.tx.undo, func() { b.b.restore(k, old, true) })
+	return nil
+}
+
+func (b memoryBucketTx) Cursor() StoreCursor {
+	return &memoryCursor{b: b.b}
+}
+
+func (b memoryBucketTx) ForEach(fn func(k, v []byte) error) error {
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		err := fn(k, v)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b memoryBucketTx) KeyCount() int {
+	return len(b.b.keys)
+}
+
+// restore sets a key to a value, or removes it if it shouldn't exist
+func (b *memoryBucket) restore(k string, value []byte, exists bool) {
+	i, found := slices.BinarySearch(b.keys, k)
+	switch {
+	case exists && !found:
+		b.keys = slices.Insert(b.keys, i, k)
+	case !exists && found:
+		b.keys = slices.Delete(b.keys, i, i+1)
+	}
+
+	if exists {
+		b.values[k] = value
+	} else {
+		delete(b.values, k)
+	}
+}
+
+// memoryCursor is a StoreCursor of a memoryBucket. It remembers its key
+// rather than a position, so writes while iterating don't make it skip keys.
+type memoryCursor struct {
+	b   *memoryBucket
+	key string
+	ok  bool // Whether it's on a key
+}
+
+func (c *memoryCursor) First() ([]byte, []byte) {
+	return c.at(0)
+}
+
+func (c *memoryCursor) Next() ([]byte, []byte) {
+	if !c.ok {
+		return nil, nil
+	}
+
+	i, found := slices.BinarySearch(c.b.keys, c.key)
+	if found {
+		i++
+	}
+	return c.at(i)
+}
+
+func (c *memoryCursor) Seek(seek []byte) ([]byte, []byte) {
+	i, _ := slices.BinarySearch(c.b.keys, string(seek))
+	return c.at(i)
+}
+
+// at moves the cursor to the i-th key
+func (c *memoryCursor) at(i int) ([]byte, []byte) {
+	if i >= len(c.b.keys) {
+		c.ok = false
+		return nil, nil
+	}
+
+	c.key, c.ok = c.b.keys[i], true
+	return []byte(c.key), c.b.values[c.key]
+}
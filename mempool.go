@@ -0,0 +1,643 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Buckets of the mempool
+const (
+	mempoolBucket      = "mempool"      // Transaction ID -> mempoolEntry
+	mempoolSpentBucket = "mempoolspent" // Outpoint (see outpointKey) -> ID of the pool transaction spending it
+)
+
+// Limits of the mempool, set with -mempoolmaxtxs, -mempoolmaxsize, -minrelayfee
+// and -mempoolexpiry
+var (
+	mempoolMaxTxs  = 10000                          // Most transactions the pool holds
+	mempoolMaxSize = min(10000000, systemMemory/64) // Most bytes of serialized transactions the pool holds, less with under 640 MB of memory
+	minRelayFee    = 0                              // Lowest fee rate the pool accepts, in coins per 1000 bytes
+	mempoolExpiry  = 72 * time.Hour                 // How long a transaction may wait to be mined before it's evicted
+)
+
+// mempoolExpiryInterval is how often a node evicts expired transactions
+const mempoolExpiryInterval = time.Minute
+
+// errKnownTransaction is returned when adding a transaction that is already
+// in the mempool or in the active chain
+var errKnownTransaction = errors.New("transaction already known")
+
+// Mempool holds the transactions that were validated but not mined yet,
+// persisted in the database next to the chain. Pool transactions never
+// spend the same output twice: a new transaction spending an output a pool
+// transaction spends replaces it if it pays a high enough fee, see rbf.go.
+// Coin selection skips the outputs pool transactions spend. Connecting a block removes the transactions it includes and the
+// ones it conflicts with, and transactions left unmined for mempoolExpiry
+// expire.
+type Mempool struct {
+	Blockchain *Blockchain // The blockchain the pool transactions spend from
+}
+
+// mempoolEntry is a transaction of the mempool
+type mempoolEntry struct {
+	Tx    *Transaction // The transaction
+	Added int64        // When the transaction was added, in Unix nanoseconds
+}
+
+// mempoolResident is a pool transaction with its fee and size
+type mempoolResident struct {
+	id    []byte // ID of the transaction
+	fee   int    // Fee it pays, see transactionFee
+	size  int    // Serialized size
+	added int64  // When it was added, in Unix nanoseconds
+}
+
+// MempoolInfo describes the state of the mempool, named after the fields of
+// bitcoind's getmempoolinfo call. There's no segregated witness data on this
+// chain, so virtual sizes are the serialized sizes. Fee rates are expressed in
+// coins per 1000 bytes of serialized transaction.
+type MempoolInfo struct {
+	Size          int `json:"size"`          // Number of transactions
+	Bytes         int `json:"bytes"`         // Total size of the transactions
+	TotalFee      int `json:"total_fee"`     // Sum of the fees of the transactions
+	MaxTxs        int `json:"maxtxs"`        // Most transactions the pool holds
+	MaxMempool    int `json:"maxmempool"`    // Most bytes of transactions the pool holds
+	MempoolMinFee int `json:"mempoolminfee"` // New transactions must pay a higher fee rate when the pool is full, 0 while it isn't
+	MinRelayTxFee int `json:"minrelaytxfee"` // Lowest fee rate the pool accepts, see minRelayFee
+}
+
+// Add validates a transaction against the UTXO set and the other pool
+// transactions, and adds it to the pool. It must pay at least the minimum
+// relay fee rate, minRelayFee, and create no dust. When the pool is full, the
+// transactions with the lowest fee rates are evicted to make room, and a
+// transaction whose fee rate doesn't beat theirs is rejected. It replaces the
+// pool transactions spending the same outputs if it pays enough more than
+// them, see checkReplacement, and is rejected otherwise.
+// Parameters:
+//   - transaction: The signed transaction
+//
+// Returns:
+//   - error: errKnownTransaction if it's already in the pool or the chain, or why it's invalid
+func (m Mempool) Add(transaction *Transaction) error {
+	if m.Has(transaction.ID) {
+		return errKnownTransaction
+	}
+	if _, err := m.Blockchain.TransactionBlock(transaction.ID); err == nil {
+		return errKnownTransaction
+	}
+
+	err := UTXOSet{m.Blockchain}.VerifyTransaction(transaction)
+	if err != nil {
+		return err
+	}
+	err = checkDust(transaction)
+	if err != nil {
+		return err
+	}
+
+	txID := hex.EncodeToString(transaction.ID)
+	entry := mempoolEntry{transaction, time.Now().UnixNano()}
+
+	return m.Blockchain.db.Update(func(tx StoreTx) error {
+		pool, err := tx.CreateBucketIfNotExists([]byte(mempoolBucket))
+		if err != nil {
+			return err
+		}
+		spent, err := tx.CreateBucketIfNotExists([]byte(mempoolSpentBucket))
+		if err != nil {
+			return err
+		}
+
+		err = checkRelayFee(tx, transaction)
+		if err != nil {
+			return err
+		}
+
+		// Pool transactions spending the same outputs are replaced, see rbf.go
+		conflicts := mempoolConflicts(spent, transaction)
+		err = checkReplacement(tx, transaction, conflicts)
+		if err != nil {
+			return fmt.Errorf("transaction %s spends outputs already spent by pending transactions: %w", txID, err)
+		}
+		for _, id := range conflicts {
+			err = removeFromMempool(tx, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		evicted, err := makeRoom(tx, transaction)
+		if err != nil {
+			return err
+		}
+		for _, id := range evicted {
+			err = removeFromMempool(tx, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, in := range transaction.Vin {
+			outpoint := outpointKey(hex.EncodeToString(in.Txid), in.Vout)
+			err = spent.Put([]byte(outpoint), transaction.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		return pool.Put(transaction.ID, entry.serialize())
+	})
+}
+
+// Has checks whether a transaction is in the pool
+func (m Mempool) Has(id []byte) bool {
+	found := false
+
+	err := m.Blockchain.db.View(func(tx StoreTx) error {
+		if pool := tx.Bucket([]byte(mempoolBucket)); pool != nil {
+			found = pool.Get(id) != nil
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return found
+}
+
+// Get returns a pool transaction
+// Parameters:
+//   - id: ID of the transaction
+//
+// Returns:
+//   - *Transaction: The transaction, nil if it isn't in the pool
+func (m Mempool) Get(id []byte) *Transaction {
+	var transaction *Transaction
+
+	err := m.Blockchain.db.View(func(tx StoreTx) error {
+		pool := tx.Bucket([]byte(mempoolBucket))
+		if pool == nil {
+			return nil
+		}
+		if data := pool.Get(id); data != nil {
+			transaction = deserializeMempoolEntry(data).Tx
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return transaction
+}
+
+// Fee returns the fee of a transaction spending outputs of the UTXO set, like
+// pool transactions do, see transactionFee
+func (m Mempool) Fee(transaction *Transaction) int {
+	fee := 0
+
+	err := m.Blockchain.db.View(func(tx StoreTx) error {
+		fee = transactionFee(chainStateLookup(tx, nil), transaction)
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return fee
+}
+
+// Transactions returns the pool transactions, oldest first
+func (m Mempool) Transactions() []*Transaction {
+	var entries []mempoolEntry
+
+	err := m.Blockchain.db.View(func(tx StoreTx) error {
+		pool := tx.Bucket([]byte(mempoolBucket))
+		if pool == nil {
+			return nil
+		}
+
+		return pool.ForEach(func(_, v []byte) error {
+			entries = append(entries, deserializeMempoolEntry(v))
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Added < entries[j].Added
+	})
+
+	var txs []*Transaction
+	for _, entry := range entries {
+		txs = append(txs, entry.Tx)
+	}
+
+	return txs
+}
+
+// SelectForBlock picks the pool transactions to mine into the next block.
+// Transactions are taken by fee rate, the highest first and the oldest among
+// equal rates, and packed greedily: one that doesn't fit in the space left
+// is skipped for smaller ones behind it.
+// Parameters:
+//   - reserved: Bytes of the block already taken by its header and coinbase, see blockOverhead
+//
+// Returns:
+//   - []*Transaction: The transactions to mine, keeping the block within maxBlockSize bytes
+func (m Mempool) SelectForBlock(reserved int) []*Transaction {
+	type candidate struct {
+		tx        *Transaction
+		fee       int
+		size      int // Serialized size, which the fee rate is relative to
+		blockSize int // Bytes taken in the block, see blockSpace
+	}
+
+	var candidates []candidate
+	err := m.Blockchain.db.View(func(tx StoreTx) error {
+		lookup := chainStateLookup(tx, nil)
+
+		transactions := m.Transactions()
+		blockSizes := blockSpace(transactions)
+		for i, transaction := range transactions {
+			candidates = append(candidates, candidate{transaction, transactionFee(lookup, transaction), len(transaction.Serialize()), blockSizes[i]})
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// Compare fee/size rates by cross-multiplying, the transactions are oldest first
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].fee*candidates[j].size > candidates[j].fee*candidates[i].size
+	})
+
+	var selected []*Transaction
+	size := reserved
+	for _, c := range candidates {
+		if size+c.blockSize > maxBlockSize {
+			continue
+		}
+
+		selected = append(selected, c.tx)
+		size += c.blockSize
+	}
+
+	return selected
+}
+
+// AssembleBlock returns the transactions of the next block: the pool
+// transactions picked by SelectForBlock, after a coinbase paying the block
+// subsidy plus their fees to an address
+// Parameters:
+//   - address: The address the reward is paid to
+func (m Mempool) AssembleBlock(address string) []*Transaction {
+	height := m.Blockchain.GetBestHeight() + 1
+	reward := NewRewardTX(address, height)
+	selected := m.SelectForBlock(blockOverhead(reward, address))
+
+	fees := 0
+	err := m.Blockchain.db.View(func(tx StoreTx) error {
+		lookup := chainStateLookup(tx, nil)
+		for _, transaction := range selected {
+			fees += transactionFee(lookup, transaction)
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if fees > 0 {
+		reward = NewCoinbaseTX(address, reward.Vin[0].ScriptSig, blockSubsidy(height)+fees)
+	}
+
+	return append([]*Transaction{reward}, selected...)
+}
+
+// transactionFee returns the fee of a transaction, the value of the outputs
+// it spends minus the value of its outputs. Pool transactions only spend
+// outputs of the UTXO set, see Add; transactions of a block may also spend
+// outputs of earlier ones, which lookup must find.
+// Parameters:
+//   - lookup: Returns the unspent output at an outpoint, see chainStateLookup
+//   - transaction: The transaction
+func transactionFee(lookup func(string, []byte, int) (TXOutput, bool), transaction *Transaction) int {
+	fee := 0
+	for _, in := range transaction.Vin {
+		prevOut, _ := lookup(outpointKey(hex.EncodeToString(in.Txid), in.Vout), in.Txid, in.Vout)
+		fee += prevOut.Value
+	}
+	for _, out := range transaction.Vout {
+		fee -= out.Value
+	}
+
+	return fee
+}
+
+// belowFeeRate checks whether a fee pays less than a fee rate
+// Parameters:
+//   - fee: The fee of a transaction
+//   - size: Its serialized size
+//   - rate: The fee rate, in coins per 1000 bytes
+func belowFeeRate(fee, size, rate int) bool {
+	return fee*1000 < rate*size
+}
+
+// checkRelayFee rejects a transaction paying a fee rate below minRelayFee
+// Parameters:
+//   - tx: The database transaction adding the new transaction
+//   - transaction: The new transaction
+func checkRelayFee(tx StoreTx, transaction *Transaction) error {
+	fee := transactionFee(chainStateLookup(tx, nil), transaction)
+	size := len(transaction.Serialize())
+	if belowFeeRate(fee, size, minRelayFee) {
+		return fmt.Errorf("transaction %x pays a fee of %d for %d bytes, below the minimum relay fee rate of %d coins per 1000 bytes", transaction.ID, fee, size, minRelayFee)
+	}
+
+	return nil
+}
+
+// makeRoom finds the pool transactions to evict so that a new transaction
+// fits within mempoolMaxTxs and mempoolMaxSize. The lowest fee rates go
+// first, the newest first among equal rates, and only transactions paying a
+// lower fee rate than the new one may be evicted. Pool transactions never
+// spend each other's outputs, so evicting one leaves no descendants behind.
+// Parameters:
+//   - tx: The database transaction adding the new transaction
+//   - transaction: The new transaction
+//
+// Returns:
+//   - [][]byte: IDs of the transactions to evict
+//   - error: Why the new transaction can't fit
+func makeRoom(tx StoreTx, transaction *Transaction) ([][]byte, error) {
+	fee := transactionFee(chainStateLookup(tx, nil), transaction)
+	size := len(transaction.Serialize())
+	if size > mempoolMaxSize {
+		return nil, fmt.Errorf("transaction %x has %d bytes, more than the mempool limit of %d", transaction.ID, size, mempoolMaxSize)
+	}
+
+	residents, err := mempoolResidents(tx)
+	if err != nil {
+		return nil, err
+	}
+	count, total := len(residents)+1, size
+	for _, r := range residents {
+		total += r.size
+	}
+
+	var evicted [][]byte
+	for _, r := range residents {
+		if count <= mempoolMaxTxs && total <= mempoolMaxSize {
+			break
+		}
+		if r.fee*size >= fee*r.size {
+			return nil, fmt.Errorf("mempool is full: transaction %x pays a fee rate of %d coins per 1000 bytes, not above the mempool minimum fee rate of %d", transaction.ID, fee*1000/size, r.fee*1000/r.size)
+		}
+
+		evicted = append(evicted, r.id)
+		count--
+		total -= r.size
+	}
+
+	return evicted, nil
+}
+
+// mempoolResidents lists the pool transactions, the lowest fee rate first
+// and the newest first among equal rates, the order they're evicted in
+// Parameters:
+//   - tx: The database transaction
+func mempoolResidents(tx StoreTx) ([]mempoolResident, error) {
+	pool := tx.Bucket([]byte(mempoolBucket))
+	if pool == nil {
+		return nil, nil
+	}
+
+	lookup := chainStateLookup(tx, nil)
+	var residents []mempoolResident
+	err := pool.ForEach(func(k, v []byte) error {
+		entry := deserializeMempoolEntry(v)
+		residents = append(residents, mempoolResident{bytes.Clone(k), transactionFee(lookup, entry.Tx), len(entry.Tx.Serialize()), entry.Added})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Compare fee/size rates by cross-multiplying
+	sort.Slice(residents, func(i, j int) bool {
+		a, b := residents[i], residents[j]
+		if a.fee*b.size != b.fee*a.size {
+			return a.fee*b.size < b.fee*a.size
+		}
+		return a.added > b.added
+	})
+
+	return residents, nil
+}
+
+// Info describes the state of the pool
+// Returns:
+//   - MempoolInfo: Size, fees and limits of the pool
+func (m Mempool) Info() MempoolInfo {
+	info := MempoolInfo{MaxTxs: mempoolMaxTxs, MaxMempool: mempoolMaxSize, MinRelayTxFee: minRelayFee}
+
+	err := m.Blockchain.db.View(func(tx StoreTx) error {
+		residents, err := mempoolResidents(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range residents {
+			info.Size++
+			info.Bytes += r.size
+			info.TotalFee += r.fee
+		}
+		if len(residents) > 0 && (info.Size >= info.MaxTxs || info.Bytes >= info.MaxMempool) {
+			info.MempoolMinFee = residents[0].fee * 1000 / residents[0].size
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return info
+}
+
+// DropInvalid removes the pool transactions that are no longer valid, after
+// the active chain switched to another branch
+// Returns:
+//   - map[string]error: Hex ID -> why the dropped transaction is invalid
+func (m Mempool) DropInvalid() map[string]error {
+	dropped := make(map[string]error)
+
+	for _, transaction := range m.Transactions() {
+		err := UTXOSet{m.Blockchain}.VerifyTransaction(transaction)
+		if err == nil {
+			continue
+		}
+
+		dropped[hex.EncodeToString(transaction.ID)] = err
+		err = m.Blockchain.db.Update(func(tx StoreTx) error {
+			return removeFromMempool(tx, transaction.ID)
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	return dropped
+}
+
+// Expire evicts the pool transactions that waited longer than mempoolExpiry
+// to be mined, so the outputs they spend can be spent again
+// Returns:
+//   - []*Transaction: The evicted transactions, oldest first
+func (m Mempool) Expire() []*Transaction {
+	cutoff := time.Now().Add(-mempoolExpiry).UnixNano()
+
+	var expired []mempoolEntry
+	err := m.Blockchain.db.View(func(tx StoreTx) error {
+		pool := tx.Bucket([]byte(mempoolBucket))
+		if pool == nil {
+			return nil
+		}
+
+		return pool.ForEach(func(_, v []byte) error {
+			entry := deserializeMempoolEntry(v)
+			if entry.Added < cutoff {
+				expired = append(expired, entry)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+
+	err = m.Blockchain.db.Update(func(tx StoreTx) error {
+		for _, entry := range expired {
+			err := removeFromMempool(tx, entry.Tx.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	sort.SliceStable(expired, func(i, j int) bool {
+		return expired[i].Added < expired[j].Added
+	})
+
+	var txs []*Transaction
+	for _, entry := range expired {
+		txs = append(txs, entry.Tx)
+	}
+
+	return txs
+}
+
+// removeFromMempool removes a transaction and the outputs it spends from the pool
+// Parameters:
+//   - tx: The database transaction
+//   - id: ID of the pool transaction, which may be missing
+func removeFromMempool(tx StoreTx, id []byte) error {
+	pool := tx.Bucket([]byte(mempoolBucket))
+	if pool == nil {
+		return nil
+	}
+	data := pool.Get(id)
+	if data == nil {
+		return nil
+	}
+
+	spent := tx.Bucket([]byte(mempoolSpentBucket))
+	for _, in := range deserializeMempoolEntry(data).Tx.Vin {
+		err := spent.Delete([]byte(outpointKey(hex.EncodeToString(in.Txid), in.Vout)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return pool.Delete(id)
+}
+
+// updateMempool removes the transactions of a new block from the pool, and
+// the pool transactions spending an output the block spends
+// Parameters:
+//   - tx: The database transaction storing the block
+//   - block: The block being added to the chain
+func updateMempool(tx StoreTx, block *Block) error {
+	spent := tx.Bucket([]byte(mempoolSpentBucket))
+	if spent == nil {
+		return nil
+	}
+
+	for _, transaction := range block.Transactions {
+		err := removeFromMempool(tx, transaction.ID)
+		if err != nil {
+			return err
+		}
+		if transaction.IsCoinbase() {
+			continue
+		}
+
+		for _, in := range transaction.Vin {
+			conflicting := spent.Get([]byte(outpointKey(hex.EncodeToString(in.Txid), in.Vout)))
+			if conflicting == nil {
+				continue
+			}
+
+			err = removeFromMempool(tx, bytes.Clone(conflicting))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// serialize encodes a mempool entry using GOB encoding
+func (e mempoolEntry) serialize() []byte {
+	var buff bytes.Buffer
+
+	err := gob.NewEncoder(&buff).Encode(e)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+// deserializeMempoolEntry decodes a mempool entry
+func deserializeMempoolEntry(data []byte) mempoolEntry {
+	var entry mempoolEntry
+
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entry)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return entry
+}
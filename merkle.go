@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// The transactions of a block are committed to by a Merkle tree. The leaves are
+// the SHA-256 hashes of the transaction IDs, and every parent is the hash of its
+// two children concatenated. When a level has an odd number of nodes, the last
+// one is paired with itself. A block with a single transaction has the hash of
+// its ID as the root.
+
+// MerkleProof is the branch of a Merkle tree linking a transaction to the root
+type MerkleProof struct {
+	Hashes [][]byte // Sibling hashes from the leaf level up to just below the root
+	Right  []bool   // Whether each sibling is the right child of the pair
+}
+
+// hashMerklePair hashes two sibling nodes into their parent
+func hashMerklePair(left, right []byte) []byte {
+	hash := sha256.Sum256(append(bytes.Clone(left), right...))
+	return hash[:]
+}
+
+// merkleLeaves hashes transaction IDs into the leaves of a Merkle tree
+func merkleLeaves(txIDs [][]byte) [][]byte {
+	var leaves [][]byte
+	for _, id := range txIDs {
+		hash := sha256.Sum256(id)
+		leaves = append(leaves, hash[:])
+	}
+
+	return leaves
+}
+
+// nextMerkleLevel hashes the nodes of a level of the tree pairwise into the
+// level above it
+func nextMerkleLevel(level [][]byte) [][]byte {
+	var next [][]byte
+	for i := 0; i < len(level); i += 2 {
+		right := level[i]
+		if i+1 < len(level) {
+			right = level[i+1]
+		}
+		next = append(next, hashMerklePair(level[i], right))
+	}
+
+	return next
+}
+
+// MerkleRoot computes the root of the Merkle tree of a list of transaction IDs
+// Parameters:
+//   - txIDs: IDs of the transactions, in block order
+//
+// Returns:
+//   - []byte: The Merkle root, the hash of no data for an empty list
+func MerkleRoot(txIDs [][]byte) []byte {
+	if len(txIDs) == 0 {
+		hash := sha256.Sum256(nil)
+		return hash[:]
+	}
+
+	level := merkleLeaves(txIDs)
+	for len(level) > 1 {
+		level = nextMerkleLevel(level)
+	}
+
+	return level[0]
+}
+
+// MerkleProof builds the proof that a transaction is included in the block
+// Parameters:
+//   - txID: ID of the transaction
+//
+// Returns:
+//   - *MerkleProof: The branch from the transaction to the block's Merkle root
+func (b *Block) MerkleProof(txID []byte) (*MerkleProof, error) {
+	var txIDs [][]byte
+	index := -1
+	for i, tx := range b.Transactions {
+		if bytes.Equal(tx.ID, txID) {
+			index = i
+		}
+		txIDs = append(txIDs, tx.ID)
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("transaction %x is not in block %x", txID, b.Hash)
+	}
+
+	proof := MerkleProof{}
+	level := merkleLeaves(txIDs)
+	for len(level) > 1 {
+		sibling := index ^ 1
+		if sibling >= len(level) {
+			// The last node of an odd level is paired with itself
+			sibling = index
+		}
+		proof.Hashes = append(proof.Hashes, level[sibling])
+		proof.Right = append(proof.Right, index%2 == 0)
+
+		level = nextMerkleLevel(level)
+		index /= 2
+	}
+
+	return &proof, nil
+}
+
+// VerifyMerkleProof checks that a proof links a transaction to a Merkle root.
+// It needs nothing but the root, so a client only has to trust the block header.
+// Parameters:
+//   - root: Merkle root of the block
+//   - txID: ID of the transaction
+//   - proof: The proof to check
+//
+// Returns:
+//   - bool: true if the transaction is included under the root
+func VerifyMerkleProof(root, txID []byte, proof *MerkleProof) bool {
+	if len(proof.Hashes) != len(proof.Right) {
+		return false
+	}
+
+	hash := merkleLeaves([][]byte{txID})[0]
+	for i, sibling := range proof.Hashes {
+		if proof.Right[i] {
+			hash = hashMerklePair(hash, sibling)
+		} else {
+			hash = hashMerklePair(sibling, hash)
+		}
+	}
+
+	return bytes.Equal(hash, root)
+}
+
+// TxOutProof is a Merkle proof in a portable JSON format, together with the
+// block and transaction it is for, so it can be passed to another machine
+type TxOutProof struct {
+	BlockHash  string   `json:"blockhash"`  // Hex hash of the block containing the transaction
+	MerkleRoot string   `json:"merkleroot"` // Hex Merkle root of the block
+	Txid       string   `json:"txid"`       // Hex ID of the transaction
+	Hashes     []string `json:"hashes"`     // Hex sibling hashes, see MerkleProof
+	Right      []bool   `json:"right"`      // Sibling positions, see MerkleProof
+}
+
+// NewTxOutProof builds the portable proof that a transaction of the active
+// chain is included in its block
+// Parameters:
+//   - bc: The blockchain to look up the transaction in
+//   - txID: ID of the transaction
+//
+// Returns:
+//   - *TxOutProof: The proof
+func NewTxOutProof(bc *Blockchain, txID []byte) (*TxOutProof, error) {
+	block, err := bc.TransactionBlock(txID)
+	if err != nil {
+		return nil, err
+	}
+	if block.IsPruned() {
+		return nil, fmt.Errorf("block %x: %w", block.Hash, errPrunedData)
+	}
+
+	proof, err := block.MerkleProof(txID)
+	if err != nil {
+		return nil, err
+	}
+
+	p := TxOutProof{
+		BlockHash:  hex.EncodeToString(block.Hash),
+		MerkleRoot: hex.EncodeToString(block.HashTransactions()),
+		Txid:       hex.EncodeToString(txID),
+		Hashes:     []string{},
+		Right:      proof.Right,
+	}
+	for _, hash := range proof.Hashes {
+		p.Hashes = append(p.Hashes, hex.EncodeToString(hash))
+	}
+	if p.Right == nil {
+		p.Right = []bool{}
+	}
+
+	return &p, nil
+}
+
+// ReadTxOutProof reads a portable proof from a JSON file
+// Parameters:
+//   - filename: The file to read
+func ReadTxOutProof(filename string) (*TxOutProof, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var p TxOutProof
+	err = json.Unmarshal(content, &p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proof file %s: %w", filename, err)
+	}
+
+	return &p, nil
+}
+
+// WriteToFile writes the proof to a file as indented JSON
+// Parameters:
+//   - filename: The file to write
+func (p *TxOutProof) WriteToFile(filename string) error {
+	content, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filename, append(content, '\n'), 0644)
+}
+
+// Verify checks that the proof links its transaction to its Merkle root
+func (p *TxOutProof) Verify() error {
+	root, err := hex.DecodeString(p.MerkleRoot)
+	if err != nil {
+		return fmt.Errorf("invalid merkle root: %w", err)
+	}
+	txID, err := hex.DecodeString(p.Txid)
+	if err != nil {
+		return fmt.Errorf("invalid transaction ID: %w", err)
+	}
+
+	proof := MerkleProof{Right: p.Right}
+	for _, h := range p.Hashes {
+		hash, err := hex.DecodeString(h)
+		if err != nil {
+			return fmt.Errorf("invalid proof hash: %w", err)
+		}
+		proof.Hashes = append(proof.Hashes, hash)
+	}
+
+	if !VerifyMerkleProof(root, txID, &proof) {
+		return errors.New("proof doesn't match the merkle root")
+	}
+
+	return nil
+}
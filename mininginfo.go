@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// miningInfoBlocks is the number of recent blocks getmininginfo lists the
+// solve times of and estimates the network hash rate over
+const miningInfoBlocks = 10
+
+// hashRateStats counts the hashes tried by the proof of work of this
+// process, so a node can report how fast it mines
+type hashRateStats struct {
+	sync.Mutex
+	hashes  uint64        // Hashes tried by the current or last run
+	elapsed time.Duration // Time the current or last run took so far
+	mining  bool          // Whether a run is in progress
+}
+
+// hashRate are the hash rate statistics of ProofOfWork.Run
+var hashRate hashRateStats
+
+// start records that a run started. The last run's rate is kept until the
+// new run reports its first hashes.
+func (h *hashRateStats) start() {
+	h.Lock()
+	defer h.Unlock()
+
+	h.mining = true
+}
+
+// update records the hashes a run tried so far
+func (h *hashRateStats) update(hashes uint64, elapsed time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.hashes, h.elapsed = hashes, elapsed
+}
+
+// stop records the hashes a run tried once it's over
+func (h *hashRateStats) stop(hashes uint64, elapsed time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.hashes, h.elapsed, h.mining = hashes, elapsed, false
+}
+
+// last returns the hashes tried by the current or last run and the time it
+// took so far
+func (h *hashRateStats) last() (uint64, time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.hashes, h.elapsed
+}
+
+// rate returns the hashes per second of the current or last run, 0 before
+// the first one, and whether a run is in progress
+func (h *hashRateStats) rate() (float64, bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.elapsed <= 0 {
+		return 0, h.mining
+	}
+	return float64(h.hashes) / h.elapsed.Seconds(), h.mining
+}
+
+// formatHashRate formats hashes per second with a unit prefix, like "1.50 MH/s"
+func formatHashRate(rate float64) string {
+	units := []string{"H/s", "kH/s", "MH/s", "GH/s", "TH/s"}
+
+	i := 0
+	for rate >= 1000 && i < len(units)-1 {
+		rate /= 1000
+		i++
+	}
+
+	return fmt.Sprintf("%.2f %s", rate, units[i])
+}
+
+// SolveTime is the time a block of the active chain took to be mined: the
+// difference between its timestamp and its parent's
+type SolveTime struct {
+	Height  int    `json:"height"`  // Height of the block
+	Hash    string `json:"hash"`    // Hex hash of the block
+	Seconds int64  `json:"seconds"` // Seconds since its parent, negative if the miners' clocks disagree
+}
+
+// MiningInfo is the state of mining on the active chain, in the JSON format
+// of getmininginfo, named after the fields of bitcoind's
+type MiningInfo struct {
+	Blocks        int         `json:"blocks"`        // Height of the active tip
+	Difficulty    float64     `json:"difficulty"`    // Difficulty of the next block
+	Bits          string      `json:"bits"`          // Hex target of the next block in compact form
+	Target        string      `json:"target"`        // Hex target of the next block
+	NetworkHashPS float64     `json:"networkhashps"` // Hashes per second spent on the recent blocks, estimated from their work and timestamps
+	HashesPerSec  float64     `json:"hashespersec"`  // Hash rate of this process's current or last proof of work, 0 if it hasn't mined
+	Mining        bool        `json:"mining"`        // Whether this process is mining a block
+	PooledTx      int         `json:"pooledtx"`      // Transactions in the mempool
+	SolveTimes    []SolveTime `json:"solvetimes"`    // Solve times of the last miningInfoBlocks blocks, newest first
+}
+
+// MiningInfo returns the difficulty and target of the next block, the solve
+// times of the last miningInfoBlocks blocks of the active chain with the
+// network hash rate they imply, and the hash rate of this process
+func (bc *Blockchain) MiningInfo() MiningInfo {
+	bits := bc.NextTarget()
+	info := MiningInfo{
+		Blocks:     bc.GetBestHeight(),
+		Difficulty: targetDifficulty(compactToBig(bits)),
+		Bits:       fmt.Sprintf("%08x", bits),
+		Target:     fmt.Sprintf("%064x", compactToBig(bits)),
+		PooledTx:   len(Mempool{bc}.Transactions()),
+		SolveTimes: []SolveTime{},
+	}
+	info.HashesPerSec, info.Mining = hashRate.rate()
+
+	err := bc.db.View(func(tx StoreTx) error {
+		blocks := tx.Bucket([]byte(blocksBucket))
+
+		work := new(big.Int)
+		block := DeserializeBlock(blocks.Get(bc.tip))
+		newest := block.Timestamp
+		for len(info.SolveTimes) < miningInfoBlocks && len(block.PrevBlockHash) > 0 {
+			parent := DeserializeBlock(blocks.Get(block.PrevBlockHash))
+			info.SolveTimes = append(info.SolveTimes, SolveTime{
+				Height:  block.Height,
+				Hash:    hex.EncodeToString(block.Hash),
+				Seconds: block.Timestamp - parent.Timestamp,
+			})
+			work.Add(work, blockWork(block))
+			block = parent
+		}
+
+		if span := newest - block.Timestamp; span > 0 {
+			info.NetworkHashPS, _ = new(big.Rat).SetFrac(work, big.NewInt(span)).Float64()
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return info
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Network holds the parameters that keep a network apart from the others.
+// Its chains get a different fingerprint, its nodes use different network
+// magic and so refuse to peer with the nodes of other networks, and its
+// files live in a directory of their own.
+type Network struct {
+	Name         string  // Name given to -network
+	Magic        [4]byte // Starts every message, see wire.go
+	DefaultPort  int     // Port nodes listen on and DNS seeds are dialed on
+	DataDir      string  // Directory of the network's files, relative to the data directory
+	GenesisData  string  // Coinbase data of the genesis block
+	TargetBits   int     // Initial and easiest proof-of-work difficulty
+	MaxBlockSize int     // Largest serialized size of a block, in bytes
+
+	RetargetInterval int   // Blocks between difficulty adjustments, 0 to never adjust
+	TargetSpacing    int64 // Seconds a block should take to mine
+
+	Checkpoints []Checkpoint // Known blocks of the network's chain, lowest first
+	Deployments []Deployment // Rule changes activated with version bits, see deployments.go
+}
+
+// networks lists the networks a node can run on. Mainnet uses the defaults
+// declared next to the code using them, and keeps its files in the data
+// directory itself, by default the per-user one of defaultDataDir, while the
+// other networks get a directory of their own in it. Testnet is a throwaway
+// network, and regtest mines nearly instantly for local experiments, never
+// adjusting its difficulty.
+var networks = []Network{
+	{
+		Name:         "mainnet",
+		Magic:        networkMagic,
+		DefaultPort:  defaultNodePort,
+		GenesisData:  genesisCoinbaseData,
+		TargetBits:   targetBits,
+		MaxBlockSize: maxBlockSize,
+
+		RetargetInterval: retargetInterval,
+		TargetSpacing:    targetSpacing,
+
+		Checkpoints: checkpoints,
+		Deployments: deployments,
+	},
+	{
+		Name:         "testnet",
+		Magic:        [4]byte{0x0b, 0x11, 0x09, 0x07},
+		DefaultPort:  13000,
+		DataDir:      "testnet",
+		GenesisData:  "Go-Blockchain testnet genesis block",
+		TargetBits:   targetBits,
+		MaxBlockSize: maxBlockSize,
+
+		RetargetInterval: retargetInterval,
+		TargetSpacing:    targetSpacing,
+
+		Deployments: []Deployment{testDummyDeployment},
+	},
+	{
+		Name:         "regtest",
+		Magic:        [4]byte{0xfa, 0xbf, 0xb5, 0xdb},
+		DefaultPort:  23000,
+		DataDir:      "regtest",
+		GenesisData:  "Go-Blockchain regtest genesis block",
+		TargetBits:   4,
+		MaxBlockSize: maxBlockSize,
+
+		Deployments: []Deployment{testDummyDeployment},
+	},
+}
+
+// dataDirEnv is the environment variable giving the data directory when
+// -datadir isn't given
+const dataDirEnv = "BLOCKCHAIN_DATA_DIR"
+
+// dataDir is the directory holding the files of the program: the database,
+// with the mempool, the wallet, the known peers and the TLS files. It's set
+// with -datadir, and networks other than mainnet use a directory in it.
+var dataDir = defaultDataDir()
+
+// defaultDataDir returns the data directory used without -datadir: the one
+// of BLOCKCHAIN_DATA_DIR, or else go-blockchain in the user's configuration
+// directory, like ~/.config/go-blockchain on Linux, so every run of the
+// program uses the same chain whatever its working directory
+func defaultDataDir() string {
+	if dir := os.Getenv(dataDirEnv); dir != "" {
+		return dir
+	}
+
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(base, "go-blockchain")
+}
+
+// activeNetwork is the network selected with -network
+var activeNetwork = networks[0]
+
+// selectNetwork switches the program to a network, before any of its files
+// are opened
+// Parameters:
+//   - name: Name of the network
+func selectNetwork(name string) error {
+	var names []string
+	for _, n := range networks {
+		names = append(names, n.Name)
+		if n.Name != name {
+			continue
+		}
+
+		dir := filepath.Join(dataDir, n.DataDir)
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			return err
+		}
+		for _, file := range []*string{&dbFile, &walletFile, &peersFile, &tlsCertFile, &tlsKeyFile} {
+			*file = filepath.Join(dir, *file)
+		}
+
+		activeNetwork = n
+		networkMagic = n.Magic
+		defaultNodePort = n.DefaultPort
+		genesisCoinbaseData = n.GenesisData
+		targetBits = n.TargetBits
+		maxBlockSize = n.MaxBlockSize
+		retargetInterval = n.RetargetInterval
+		targetSpacing = n.TargetSpacing
+		checkpoints = n.Checkpoints
+		deployments = n.Deployments
+		return nil
+	}
+
+	return fmt.Errorf("unknown network %q, expected %s", name, strings.Join(names, ", "))
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+)
+
+// NFTs are unique, indivisible tokens carried by outputs, like Bitcoin's
+// colored coins: the NFT field of an output holds the ID of the token it
+// carries, and a transaction spending that output must pass the token on to
+// exactly one of its own outputs, so a token can't be duplicated, split or
+// lost along the way. A token is minted by a transaction spending the
+// outpoint its ID is derived from, see mintNFTID; outpoints are spent once,
+// so no two mints give the same ID. Its content, such as the hash of a
+// document or an artwork, is the data of the mint transaction's data-carrier
+// output (see datacarrier.go), and following the outputs that carried the
+// token back leads to that mint, see NFTLineage. The output carrying a token
+// also holds coins, nftValue when minted, which coin selection never spends.
+
+// nftValue is the value of the output carrying a newly minted token
+const nftValue = 1
+
+// NFTTransfer is a transaction of the lineage of a token
+type NFTTransfer struct {
+	Txid  []byte // ID of the transaction
+	Vout  int    // Index of its output carrying the token
+	Owner string // Address of that output
+}
+
+// carriesNFTs checks whether an output of the transaction carries a token
+func (tx Transaction) carriesNFTs() bool {
+	for _, out := range tx.Vout {
+		if len(out.NFT) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mintNFTID returns the ID of the token a transaction can mint: the SHA-256
+// of the outpoint its first input spends
+func mintNFTID(tx *Transaction) []byte {
+	data := append([]byte("nft"), tx.Vin[0].Txid...)
+	data = binary.BigEndian.AppendUint64(data, uint64(int64(tx.Vin[0].Vout)))
+
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+// checkNFTs makes sure a transaction passes each token of the outputs it
+// spends to exactly one of its outputs, and that an output carrying a token
+// none of them carries mints it
+// Parameters:
+//   - transaction: The transaction
+//   - carried: Hex IDs of the tokens of the outputs it spends
+func checkNFTs(transaction *Transaction, carried map[string]bool) error {
+	minted := hex.EncodeToString(mintNFTID(transaction))
+	passed := make(map[string]bool)
+
+	for i, out := range transaction.Vout {
+		if len(out.NFT) == 0 {
+			continue
+		}
+		id := hex.EncodeToString(out.NFT)
+
+		switch {
+		case out.IsDataCarrier():
+			return fmt.Errorf("transaction %x data-carrier output %d can't carry NFT %s", transaction.ID, i, id)
+		case passed[id]:
+			return fmt.Errorf("transaction %x duplicates NFT %s in output %d", transaction.ID, id, i)
+		case !carried[id] && id != minted:
+			return fmt.Errorf("transaction %x output %d carries NFT %s, which it neither spends nor mints", transaction.ID, i, id)
+		}
+		passed[id] = true
+	}
+
+	for id := range carried {
+		if !passed[id] {
+			return fmt.Errorf("transaction %x spends NFT %s without passing it to an output", transaction.ID, id)
+		}
+	}
+
+	return nil
+}
+
+// NewNFTMintTransaction creates a transaction minting a token to an address,
+// which pays nftValue and the fee
+// Parameters:
+//   - address: The address minting and receiving the token
+//   - data: The content of the token, at most maxDataCarrierSize bytes
+//   - options: The fee and coin selection
+//   - UTXOSet: The UTXO set to find spendable outputs in
+//   - wallet: The wallet tracking the address's change addresses
+func NewNFTMintTransaction(address string, data []byte, options SendOptions, UTXOSet *UTXOSet, wallet *Wallet) *Transaction {
+	needed := nftValue + options.Fee
+	inputs, acc := selectFunds(address, needed, options.CoinSelection, UTXOSet, wallet)
+
+	tx := Transaction{nil, inputs, nil, options.LockTime}
+	tx.Vout = append(tx.Vout, TXOutput{nftValue, address, mintNFTID(&tx), 0}, NewDataOutput(data))
+	tx.Vout = append(tx.Vout, changeOutputs(address, acc-needed, wallet)...)
+	tx.SetID()
+
+	return &tx
+}
+
+// NewNFTTransferTransaction creates a transaction passing a token of an
+// address or of its change addresses on to another address, with the coins
+// of the output carrying it. Other outputs pay the fee.
+// Parameters:
+//   - id: ID of the token
+//   - from: Sender's address
+//   - to: Recipient's address
+//   - options: The fee and coin selection
+//   - UTXOSet: The UTXO set to find the token and spendable outputs in
+//   - wallet: The wallet tracking the sender's change addresses
+func NewNFTTransferTransaction(id []byte, from, to string, options SendOptions, UTXOSet *UTXOSet, wallet *Wallet) (*Transaction, error) {
+	token, ok := UTXOSet.FindNFT(id)
+	if !ok {
+		return nil, fmt.Errorf("NFT %x not found", id)
+	}
+	if !wallet.IsOwnAddress(from, token.Output.ScriptPubKey) {
+		return nil, fmt.Errorf("NFT %x belongs to %s, not to %s", id, token.Output.ScriptPubKey, from)
+	}
+
+	inputs, acc := selectFunds(from, options.Fee, options.CoinSelection, UTXOSet, wallet)
+	inputs = append([]TXInput{{token.Txid, token.Vout, token.Output.ScriptPubKey}}, inputs...)
+
+	outputs := []TXOutput{{token.Output.Value, to, id, 0}}
+	outputs = append(outputs, changeOutputs(from, acc-options.Fee, wallet)...)
+
+	tx := Transaction{nil, inputs, outputs, options.LockTime}
+	tx.SetID()
+
+	return &tx, nil
+}
+
+// FindNFT looks up the unspent output carrying a token. There's no index of
+// the tokens, so it scans the UTXO set.
+// Parameters:
+//   - id: ID of the token
+//
+// Returns:
+//   - SpendableOutput: The output carrying it
+//   - bool: false if no unspent output carries it
+func (u UTXOSet) FindNFT(id []byte) (SpendableOutput, bool) {
+	var found SpendableOutput
+	ok := false
+
+	err := u.Blockchain.db.View(func(tx StoreTx) error {
+		c := tx.Bucket([]byte(utxoBucket)).Cursor()
+		for k, v := c.First(); k != nil && !ok; k, v = c.Next() {
+			for outIdx, out := range DeserializeOutputs(v).Outputs {
+				if bytes.Equal(out.NFT, id) {
+					found = SpendableOutput{bytes.Clone(k), outIdx, out}
+					ok = true
+					break
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return found, ok
+}
+
+// NFTLineage follows a token back from the output carrying it to its mint
+// Parameters:
+//   - id: ID of the token
+//
+// Returns:
+//   - []NFTTransfer: The transactions that carried it, the latest first and the mint last
+//   - []byte: Its content, the data of the mint transaction, nil if it has none
+//   - error: If no unspent output carries it
+func (bc *Blockchain) NFTLineage(id []byte) ([]NFTTransfer, []byte, error) {
+	token, ok := UTXOSet{bc}.FindNFT(id)
+	if !ok {
+		return nil, nil, fmt.Errorf("NFT %x not found", id)
+	}
+
+	var lineage []NFTTransfer
+	txID, vout, owner := token.Txid, token.Vout, token.Output.ScriptPubKey
+	for {
+		lineage = append(lineage, NFTTransfer{txID, vout, owner})
+
+		tx, err := bc.FindTransaction(txID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// The input spending the previous output carrying it, none in the mint
+		var prev *NFTTransfer
+		for _, in := range tx.Vin {
+			if tx.IsCoinbase() {
+				break
+			}
+			parent, err := bc.FindTransaction(in.Txid)
+			if err != nil {
+				return nil, nil, err
+			}
+			if out := parent.Vout[in.Vout]; bytes.Equal(out.NFT, id) {
+				prev = &NFTTransfer{in.Txid, in.Vout, out.ScriptPubKey}
+				break
+			}
+		}
+
+		if prev == nil {
+			for _, out := range tx.Vout {
+				if out.IsDataCarrier() {
+					return lineage, out.CarriedData(), nil
+				}
+			}
+			return lineage, nil, nil
+		}
+		txID, vout, owner = prev.Txid, prev.Vout, prev.Owner
+	}
+}
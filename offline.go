@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// PortableTransaction is a transaction in a portable JSON format, used to move
+// a transaction between an online node and an offline (air-gapped) signing machine.
+// Besides the transaction itself it carries the previous output each input spends,
+// so the offline machine can check what it signs without access to the blockchain.
+// The workflow is:
+// 1. createunsignedtx on the online node builds the transaction
+// 2. signtx on the offline machine signs its inputs using the wallet
+// 3. broadcasttx on the online node verifies it and adds it to the blockchain
+type PortableTransaction struct {
+	From     string           `json:"from"`               // The sender, whose wallet signs the inputs
+	Inputs   []PortableInput  `json:"inputs"`             // Inputs with the outputs they spend
+	Outputs  []PortableOutput `json:"outputs"`            // New outputs
+	LockTime int64            `json:"locktime,omitempty"` // Height or Unix time before which it can't be mined, see locktime.go
+}
+
+// PortableInput is a transaction input together with the output it spends
+type PortableInput struct {
+	Txid        string `json:"txid"`                 // Hex ID of the transaction containing the spent output
+	Vout        int    `json:"vout"`                 // Index of the spent output
+	PrevValue   int    `json:"prev_value"`           // Value of the spent output
+	PrevAddress string `json:"prev_address"`         // Address owning the spent output
+	ScriptSig   string `json:"script_sig,omitempty"` // Unlocking data, empty until signed
+}
+
+// PortableOutput is a transaction output
+type PortableOutput struct {
+	Value      int    `json:"value"`                 // The amount of coins
+	Address    string `json:"address,omitempty"`     // The recipient address, empty for a data-carrier output
+	Change     bool   `json:"change,omitempty"`      // Whether the output pays change back to the sender
+	Data       string `json:"data,omitempty"`        // Hex data of a data-carrier output, see datacarrier.go
+	NFT        string `json:"nft,omitempty"`         // Hex ID of the NFT the output carries, see nft.go
+	LockHeight int    `json:"lock_height,omitempty"` // Height of the first block that may spend it, see timelock.go
+}
+
+// newPortableOutput converts a transaction output into a portable output
+// Parameters:
+//   - out: The output
+//   - change: Whether it pays change back to the sender
+func newPortableOutput(out TXOutput, change bool) PortableOutput {
+	portable := PortableOutput{
+		Value:      out.Value,
+		Address:    out.ScriptPubKey,
+		Change:     change,
+		NFT:        hex.EncodeToString(out.NFT),
+		LockHeight: out.LockHeight,
+	}
+	if out.IsDataCarrier() {
+		portable.Address = ""
+		portable.Data = strings.TrimPrefix(out.ScriptPubKey, dataCarrierPrefix)
+	}
+
+	return portable
+}
+
+// output converts the portable output back into a transaction output
+func (out PortableOutput) output() (TXOutput, error) {
+	nft, err := hex.DecodeString(out.NFT)
+	if err != nil {
+		return TXOutput{}, fmt.Errorf("output to %s has an invalid NFT: %w", out.Address, err)
+	}
+	if len(nft) == 0 {
+		nft = nil
+	}
+
+	if out.Data != "" {
+		data, err := hex.DecodeString(out.Data)
+		if err != nil {
+			return TXOutput{}, fmt.Errorf("data-carrier output has invalid data: %w", err)
+		}
+		return NewDataOutput(data), nil
+	}
+
+	return TXOutput{out.Value, out.Address, nft, out.LockHeight}, nil
+}
+
+// NewUnsignedTransaction creates an unsigned portable transaction sending coins
+// between addresses. Coins are selected the same way as for a regular send.
+// Parameters:
+//   - from: Sender's address
+//   - to: Recipient's address
+//   - amount: Amount to send
+//   - options: The fee and lock time, see SendOptions
+//   - UTXOSet: The UTXO set to find spendable outputs in
+//   - wallet: The wallet tracking the sender's change addresses
+//
+// Returns:
+//   - *PortableTransaction: The unsigned transaction
+func NewUnsignedTransaction(from, to string, amount int, options SendOptions, UTXOSet *UTXOSet, wallet *Wallet) *PortableTransaction {
+	tx := NewUTXOTransaction(from, to, amount, options, UTXOSet, wallet)
+	ptx := PortableTransaction{From: from, LockTime: tx.LockTime}
+
+	// Inputs are created unlocked by the address owning the spent output,
+	// which tells us where to look up the output being spent
+	for _, in := range tx.Vin {
+		prevOut, ok := UTXOSet.FindUnspentOutput(in.ScriptSig, in.Txid, in.Vout)
+		if !ok {
+			log.Panicf("ERROR: Output %x:%d not found", in.Txid, in.Vout)
+		}
+
+		ptx.Inputs = append(ptx.Inputs, PortableInput{
+			Txid:        hex.EncodeToString(in.Txid),
+			Vout:        in.Vout,
+			PrevValue:   prevOut.Value,
+			PrevAddress: prevOut.ScriptPubKey,
+		})
+	}
+
+	changeAddresses := wallet.ChangeAddresses[from]
+	for _, out := range tx.Vout {
+		isChange := len(changeAddresses) > 0 && out.ScriptPubKey == changeAddresses[len(changeAddresses)-1]
+		ptx.Outputs = append(ptx.Outputs, newPortableOutput(out, isChange))
+	}
+
+	return &ptx
+}
+
+// ReadPortableTransaction reads a portable transaction from a file
+// Parameters:
+//   - filename: The file to read
+//
+// Returns:
+//   - *PortableTransaction: The transaction read from the file
+func ReadPortableTransaction(filename string) (*PortableTransaction, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var ptx PortableTransaction
+	err = json.Unmarshal(content, &ptx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transaction file %s: %w", filename, err)
+	}
+
+	return &ptx, ptx.checkBalanced()
+}
+
+// WriteToFile writes the portable transaction to a file as indented JSON
+// Parameters:
+//   - filename: The file to write
+func (ptx *PortableTransaction) WriteToFile(filename string) error {
+	content, err := json.MarshalIndent(ptx, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filename, append(content, '\n'), 0644)
+}
+
+// Sign signs every input of the transaction using the wallet. This is done on
+// the offline machine, so before signing it validates the transaction using only
+// the data in the file: every spent output and every change output must belong
+// to the sender, and inputs and outputs must balance.
+// Parameters:
+//   - wallet: The wallet of the sender
+func (ptx *PortableTransaction) Sign(wallet *Wallet) error {
+	err := ptx.checkBalanced()
+	if err != nil {
+		return err
+	}
+
+	for i, in := range ptx.Inputs {
+		if !wallet.IsOwnAddress(ptx.From, in.PrevAddress) {
+			return fmt.Errorf("input %d spends an output of %s which doesn't belong to %s", i, in.PrevAddress, ptx.From)
+		}
+	}
+
+	for i, out := range ptx.Outputs {
+		if out.Change && !wallet.IsOwnAddress(ptx.From, out.Address) {
+			return fmt.Errorf("change output %d pays to %s which doesn't belong to %s, import the seed of the wallet that created the transaction with importseed", i, out.Address, ptx.From)
+		}
+	}
+
+	// Unlock each spent output with the address that owns it
+	for i := range ptx.Inputs {
+		ptx.Inputs[i].ScriptSig = ptx.Inputs[i].PrevAddress
+	}
+
+	return nil
+}
+
+// Verify checks a signed transaction against the UTXO set before it's broadcast:
+// every input must be signed and spend an existing unspent output matching the
+// output described in the file.
+// Parameters:
+//   - UTXOSet: The UTXO set to verify the spent outputs against
+func (ptx *PortableTransaction) Verify(UTXOSet *UTXOSet) error {
+	err := ptx.checkBalanced()
+	if err != nil {
+		return err
+	}
+
+	spent := make(map[string]bool)
+	for i, in := range ptx.Inputs {
+		if in.ScriptSig == "" {
+			return fmt.Errorf("input %d is not signed", i)
+		}
+
+		outpoint := fmt.Sprintf("%s:%d", in.Txid, in.Vout)
+		if spent[outpoint] {
+			return fmt.Errorf("input %d spends output %s twice", i, outpoint)
+		}
+		spent[outpoint] = true
+
+		txID, err := hex.DecodeString(in.Txid)
+		if err != nil {
+			return fmt.Errorf("input %d has an invalid txid: %w", i, err)
+		}
+
+		prevOut, ok := UTXOSet.FindUnspentOutput(in.ScriptSig, txID, in.Vout)
+		if !ok {
+			return fmt.Errorf("input %d spends output %s which is spent, missing or can't be unlocked", i, outpoint)
+		}
+		if prevOut.Value != in.PrevValue || prevOut.ScriptPubKey != in.PrevAddress {
+			return fmt.Errorf("input %d doesn't match the output %s it spends", i, outpoint)
+		}
+	}
+
+	return nil
+}
+
+// Transaction converts a signed portable transaction into a blockchain transaction
+// Returns:
+//   - *Transaction: The transaction with its ID set
+func (ptx *PortableTransaction) Transaction() (*Transaction, error) {
+	var inputs []TXInput
+	var outputs []TXOutput
+
+	for i, in := range ptx.Inputs {
+		if in.ScriptSig == "" {
+			return nil, fmt.Errorf("input %d is not signed", i)
+		}
+
+		txID, err := hex.DecodeString(in.Txid)
+		if err != nil {
+			return nil, fmt.Errorf("input %d has an invalid txid: %w", i, err)
+		}
+		inputs = append(inputs, TXInput{txID, in.Vout, in.ScriptSig})
+	}
+
+	for _, out := range ptx.Outputs {
+		output, err := out.output()
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, output)
+	}
+
+	tx := Transaction{nil, inputs, outputs, ptx.LockTime}
+	tx.SetID()
+
+	return &tx, nil
+}
+
+// checkBalanced checks the transaction is well formed: it has inputs and outputs,
+// every output pays a positive value except valid data-carrier outputs, and the
+// spent value covers the value of the new outputs, the rest being the fee
+func (ptx *PortableTransaction) checkBalanced() error {
+	if len(ptx.Inputs) == 0 || len(ptx.Outputs) == 0 {
+		return errors.New("transaction must have inputs and outputs")
+	}
+
+	in, out := 0, 0
+	for _, input := range ptx.Inputs {
+		in += input.PrevValue
+	}
+	for _, output := range ptx.Outputs {
+		if output.Data != "" {
+			out, err := output.output()
+			if err != nil {
+				return err
+			}
+			if err := checkDataCarrier(out); err != nil {
+				return err
+			}
+			if output.Value != 0 || output.Address != "" || output.NFT != "" || output.LockHeight != 0 {
+				return errors.New("data-carrier output can't have a value, an address, an NFT or a lock height")
+			}
+			continue
+		}
+		if output.Value <= 0 {
+			return fmt.Errorf("output to %s has invalid value %d", output.Address, output.Value)
+		}
+		out += output.Value
+	}
+
+	if in < out {
+		return fmt.Errorf("outputs (%d) spend more than the inputs (%d)", out, in)
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+)
+
+func TestPortableTransactionRoundTrip(t *testing.T) {
+	funding := NewCoinbaseTX("alice", "funding", 10)
+	tx := Transaction{
+		Vin: []TXInput{{funding.ID, 0, "alice"}},
+		Vout: []TXOutput{
+			{Value: 6, ScriptPubKey: "bob", LockHeight: 120},
+			NewDataOutput([]byte("invoice 42")),
+			{Value: 3, ScriptPubKey: "alice"},
+		},
+		LockTime: 100,
+	}
+	tx.SetID()
+
+	ptx := PortableTransaction{From: "alice", LockTime: tx.LockTime}
+	ptx.Inputs = []PortableInput{{Txid: hex.EncodeToString(funding.ID), Vout: 0, PrevValue: 10, PrevAddress: "alice"}}
+	for _, out := range tx.Vout {
+		ptx.Outputs = append(ptx.Outputs, newPortableOutput(out, false))
+	}
+
+	// Through the JSON of the transaction files, and signed
+	content, err := json.Marshal(ptx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var read PortableTransaction
+	err = json.Unmarshal(content, &read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = read.Sign(NewWallet())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := read.Transaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.ID, tx.ID) {
+		t.Errorf("transaction %x came back as %x:\n%v\nwant\n%v", tx.ID, got.ID, got, &tx)
+	}
+}
+
+func TestPortableTransactionInvalidData(t *testing.T) {
+	ptx := PortableTransaction{
+		From:    "alice",
+		Inputs:  []PortableInput{{Txid: "00", PrevValue: 10, PrevAddress: "alice"}},
+		Outputs: []PortableOutput{{Value: 5, Data: "00"}},
+	}
+
+	if err := ptx.checkBalanced(); err == nil {
+		t.Error("data-carrier output with a value accepted")
+	}
+}
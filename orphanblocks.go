@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"log/slog"
+	"time"
+)
+
+// Limits of the orphan block pool
+const (
+	maxOrphanBlocks   = 100              // Most orphan blocks a node holds, the oldest is evicted for a new one
+	orphanBlockExpiry = 20 * time.Minute // How long an orphan block waits for its parent
+)
+
+// orphanBlock is a block received from a peer before its parent. Blocks can
+// arrive out of order from different peers, or when a peer announces a new
+// block of a branch we haven't downloaded yet. The missing ancestors are
+// requested, and the orphan is added once its parent is.
+type orphanBlock struct {
+	block *Block    // The block
+	from  *peer     // The peer it came from, not announced to again
+	added time.Time // When it arrived
+}
+
+// holdOrphanBlock keeps a block whose parent isn't stored in the orphan block
+// pool. The caller must hold s.mu.
+// Parameters:
+//   - block: The block
+//   - from: The peer it came from
+func (s *Server) holdOrphanBlock(block *Block, from *peer) {
+	hash := hex.EncodeToString(block.Hash)
+	if _, ok := s.orphanBlocks[hash]; ok {
+		return
+	}
+
+	s.expireOrphanBlocks()
+	if len(s.orphanBlocks) >= maxOrphanBlocks {
+		oldest := ""
+		for id, o := range s.orphanBlocks {
+			if oldest == "" || o.added.Before(s.orphanBlocks[oldest].added) {
+				oldest = id
+			}
+		}
+		slog.Warn("Orphan block pool is full, evicting the oldest", "hash", oldest)
+		delete(s.orphanBlocks, oldest)
+	}
+
+	s.orphanBlocks[hash] = orphanBlock{block, from, time.Now()}
+	slog.Info("Holding orphan block until its parent arrives", "hash", hash, "height", block.Height, "peer", from.addr, hashAttr("parent", block.PrevBlockHash))
+}
+
+// expireOrphanBlocks drops the orphan blocks that waited too long for their
+// parent. The caller must hold s.mu.
+func (s *Server) expireOrphanBlocks() {
+	for id, o := range s.orphanBlocks {
+		if time.Since(o.added) > orphanBlockExpiry {
+			slog.Info("Orphan block expired", "hash", id)
+			delete(s.orphanBlocks, id)
+		}
+	}
+}
+
+// connectOrphanBlocks adds the orphan blocks descending from a block that was
+// just added, parents before their children. The caller must hold s.mu.
+// Parameters:
+//   - hash: Hash of the added block
+func (s *Server) connectOrphanBlocks(hash []byte) {
+	parents := [][]byte{hash}
+
+	for len(parents) > 0 {
+		parent := parents[0]
+		parents = parents[1:]
+
+		for id, o := range s.orphanBlocks {
+			if !bytes.Equal(o.block.PrevBlockHash, parent) {
+				continue
+			}
+			delete(s.orphanBlocks, id)
+
+			err := s.addBlock(o.block, o.from)
+			if err != nil {
+				slog.Warn("Dropped orphan block", "hash", id, "err", err)
+				continue
+			}
+			parents = append(parents, o.block.Hash)
+		}
+	}
+}
+
+// rejectOrphanBlocks drops the orphan blocks descending from an invalid
+// block, and marks them rejected too. The caller must hold s.mu.
+// Parameters:
+//   - hash: Hash of the invalid block
+func (s *Server) rejectOrphanBlocks(hash []byte) {
+	for id, o := range s.orphanBlocks {
+		if !bytes.Equal(o.block.PrevBlockHash, hash) {
+			continue
+		}
+
+		slog.Warn("Dropped orphan block descending from an invalid block", "hash", id, hashAttr("invalid", hash))
+		delete(s.orphanBlocks, id)
+		s.rejected[id] = true
+		s.rejectOrphanBlocks(o.block.Hash)
+	}
+}
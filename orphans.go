@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Limits of the orphan pool
+const (
+	maxOrphans   = 100              // Most orphan transactions a node holds, the oldest is evicted for a new one
+	orphanExpiry = 20 * time.Minute // How long an orphan waits for its parents
+)
+
+// orphan is a transaction received from a peer that spends outputs of
+// transactions not in the chain yet. Peers relay transactions in any order,
+// so a transaction may arrive before its parent, and pool transactions only
+// spend confirmed outputs, so a child of a pool transaction waits too.
+type orphan struct {
+	tx    *Transaction // The transaction
+	from  *peer        // The peer it came from, not relayed to again
+	added time.Time    // When it arrived
+}
+
+// missingParents lists the transactions a transaction spends outputs of
+// that aren't in the active chain. The caller must hold s.mu.
+// Returns:
+//   - []string: Hex IDs of the missing transactions
+func (s *Server) missingParents(tx *Transaction) []string {
+	var missing []string
+	seen := make(map[string]bool)
+
+	for _, in := range tx.Vin {
+		parentID := hex.EncodeToString(in.Txid)
+		if seen[parentID] {
+			continue
+		}
+		seen[parentID] = true
+
+		if _, err := s.bc.TransactionBlock(in.Txid); err != nil {
+			missing = append(missing, parentID)
+		}
+	}
+
+	return missing
+}
+
+// holdOrphan keeps a transaction from a peer in the orphan pool if it spends
+// outputs of missing transactions, to try it again once they're mined. The
+// caller must hold s.mu.
+// Parameters:
+//   - tx: The transaction the mempool rejected
+//   - from: The peer it came from
+//
+// Returns:
+//   - bool: Whether the transaction is an orphan
+func (s *Server) holdOrphan(tx *Transaction, from *peer) bool {
+	missing := s.missingParents(tx)
+	if len(missing) == 0 {
+		return false
+	}
+
+	txID := hex.EncodeToString(tx.ID)
+	if _, ok := s.orphans[txID]; ok {
+		return true
+	}
+
+	s.expireOrphans()
+	if len(s.orphans) >= maxOrphans {
+		oldest := ""
+		for id, o := range s.orphans {
+			if oldest == "" || o.added.Before(s.orphans[oldest].added) {
+				oldest = id
+			}
+		}
+		slog.Warn("Orphan pool is full, evicting the oldest transaction", "txid", oldest)
+		delete(s.orphans, oldest)
+	}
+
+	s.orphans[txID] = orphan{tx, from, time.Now()}
+	slog.Info("Holding orphan transaction until its parents are mined", "txid", txID, "peer", from.addr, "parents", strings.Join(missing, ","))
+	return true
+}
+
+// expireOrphans drops the orphans that waited too long for their parents.
+// The caller must hold s.mu.
+func (s *Server) expireOrphans() {
+	for id, o := range s.orphans {
+		if time.Since(o.added) > orphanExpiry {
+			slog.Info("Orphan transaction expired", "txid", id)
+			delete(s.orphans, id)
+		}
+	}
+}
+
+// processOrphans tries the orphans whose parents are all in the active chain
+// again, after blocks were connected. The caller must hold s.mu.
+func (s *Server) processOrphans() {
+	s.expireOrphans()
+
+	var ready []string
+	for id, o := range s.orphans {
+		if len(s.missingParents(o.tx)) == 0 {
+			ready = append(ready, id)
+		}
+	}
+
+	for _, id := range ready {
+		// Accepting an orphan can mine a block and process the orphans again
+		o, ok := s.orphans[id]
+		if !ok {
+			continue
+		}
+		delete(s.orphans, id)
+
+		err := s.addTransaction(o.tx, o.from)
+		if err != nil {
+			slog.Warn("Dropped orphan transaction", "txid", id, "err", err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// Commands print their results as text for people, or with the global -json
+// flag as a single JSON document on stdout for scripts. The field names are
+// lowercase like the ones of the API, and blocks and transactions have the
+// format of the API (see BlockInfo and TransactionInfo), so scripts can
+// switch between the two. Notes printed along the way, such as the mining
+// progress, expired mempool transactions or the progress of an import, go to
+// stderr with -json so stdout stays parseable. Commands printing results as
+// they come, like watch, print one compact JSON document a line instead.
+// Failures still print their error as text and exit with status 1.
+
+// jsonOutput is set by the -json flag
+var jsonOutput bool
+
+// printJSON prints the result of a command as indented JSON
+func printJSON(v any) {
+	output, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Println(string(output))
+}
+
+// printJSONLine prints one of the results of a command printing them as they
+// come, as JSON on a single line
+func printJSONLine(v any) {
+	output, err := json.Marshal(v)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Println(string(output))
+}
+
+// noteOutput returns where notes printed along a command's result go: stdout,
+// or stderr with -json
+func noteOutput() io.Writer {
+	if jsonOutput {
+		return os.Stderr
+	}
+
+	return os.Stdout
+}
+
+// printNote prints a note that isn't the result of the command, see noteOutput
+func printNote(format string, a ...any) {
+	fmt.Fprintf(noteOutput(), format, a...)
+}
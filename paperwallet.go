@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// paperWalletQRSize is the width and height in pixels of the PNG QR code
+const paperWalletQRSize = 512
+
+// PaperWallet is a printable export of an address and its change addresses,
+// meant for keeping a cold-storage record of where the funds are held, with
+// the wallet seed the change addresses are derived from.
+type PaperWallet struct {
+	Address         string   // The address being exported
+	ChangeAddresses []string // Change addresses the wallet derived for the address
+	Seed            string   // Hex seed of the wallet, see Wallet.SetSeed
+}
+
+// NewPaperWallet creates a paper wallet for an address using the change
+// addresses the wallet has derived for it.
+// Parameters:
+//   - address: The address to export
+//   - wallet: The wallet tracking the address's change addresses
+//
+// Returns:
+//   - *PaperWallet: The paper wallet for the address
+func NewPaperWallet(address string, wallet *Wallet) *PaperWallet {
+	return &PaperWallet{address, wallet.ChangeAddresses[address], hex.EncodeToString(wallet.Seed)}
+}
+
+// String renders the paper wallet as printable text. Every address is shown
+// both in plain text and as a QR code drawn with block characters.
+func (pw *PaperWallet) String() string {
+	var lines []string
+
+	lines = append(lines, "==== Paper wallet ====")
+	lines = append(lines, renderAddressQR("Address", pw.Address))
+
+	for i, address := range pw.ChangeAddresses {
+		lines = append(lines, renderAddressQR(fmt.Sprintf("Change address %d", i), address))
+	}
+
+	// Outputs on this chain are locked by address only, so there are no
+	// private keys, but the seed tells the wallet's change addresses apart
+	lines = append(lines, renderAddressQR("Wallet seed", pw.Seed))
+	lines = append(lines, "Note: addresses on this chain have no private keys. The wallet seed derives its change addresses, restore it with importseed and keep it secret.")
+
+	return strings.Join(lines, "\n")
+}
+
+// WritePNG writes the QR code of the main address to a PNG file.
+// Parameters:
+//   - filename: The PNG file to write
+func (pw *PaperWallet) WritePNG(filename string) error {
+	return qrcode.WriteFile(pw.Address, qrcode.Medium, paperWalletQRSize, filename)
+}
+
+// renderAddressQR renders a titled address and its QR code as text
+func renderAddressQR(title, address string) string {
+	code, err := qrcode.New(address, qrcode.Medium)
+	if err != nil {
+		return fmt.Sprintf("%s: %s\n(QR code unavailable: %s)\n", title, address, err)
+	}
+
+	return fmt.Sprintf("%s: %s\n%s", title, address, code.ToSmallString(false))
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+// halvingInterval is the number of blocks after which the subsidy halves, like
+// Bitcoin's 210,000. 0 never halves it.
+var halvingInterval = 0
+
+// addressVersion is prefixed to the change addresses the wallet derives, like
+// the version byte of Bitcoin addresses telling mainnet and testnet ones
+// apart. 0 derives them without a prefix, as before it existed.
+var addressVersion byte = 0
+
+// minMaxBlockSize is the smallest block size limit a chain can have, leaving
+// room for the coinbase and a few transactions
+const minMaxBlockSize = 1000
+
+// ChainParams are the consensus parameters of a chain. They default to the
+// ones of the active network, a chain created with createblockchain -params
+// gets its own from a JSON file. They are stored with the chain, so every
+// node opening its database enforces the parameters it was created with.
+type ChainParams struct {
+	TargetBits       int    `json:"target_bits"`       // Initial and easiest proof-of-work difficulty
+	TargetSpacing    int64  `json:"target_spacing"`    // Seconds a block should take to mine
+	RetargetInterval int    `json:"retarget_interval"` // Blocks between difficulty adjustments, 0 to never adjust
+	Subsidy          int    `json:"subsidy"`           // Reward of the first blocks
+	HalvingInterval  int    `json:"halving_interval"`  // Blocks after which the subsidy halves, 0 to never halve it
+	MaxBlockSize     int    `json:"max_block_size"`    // Largest serialized size of a block, in bytes
+	CoinbaseMessage  string `json:"coinbase_message"`  // Coinbase data of the genesis block
+	AddressVersion   byte   `json:"address_version"`   // Prefix of derived change addresses, 0 for none
+	PowAlgorithm     string `json:"pow_algorithm"`     // Hash function of the proof of work, see powhash.go
+	Contracts        bool   `json:"contracts"`         // Whether nodes run contracts, experimental, see contracts.go
+}
+
+// currentParams returns the parameters the node currently runs with
+func currentParams() ChainParams {
+	return ChainParams{
+		TargetBits:       targetBits,
+		TargetSpacing:    targetSpacing,
+		RetargetInterval: retargetInterval,
+		Subsidy:          subsidy,
+		HalvingInterval:  halvingInterval,
+		MaxBlockSize:     maxBlockSize,
+		CoinbaseMessage:  genesisCoinbaseData,
+		AddressVersion:   addressVersion,
+		PowAlgorithm:     powHasher.Name(),
+		Contracts:        contractsEnabled,
+	}
+}
+
+// apply makes the node run with the parameters
+func (p ChainParams) apply() {
+	targetBits = p.TargetBits
+	targetSpacing = p.TargetSpacing
+	retargetInterval = p.RetargetInterval
+	subsidy = p.Subsidy
+	halvingInterval = p.HalvingInterval
+	maxBlockSize = p.MaxBlockSize
+	genesisCoinbaseData = p.CoinbaseMessage
+	addressVersion = p.AddressVersion
+	contractsEnabled = p.Contracts
+	if h, err := lookupHasher(p.PowAlgorithm); err == nil {
+		powHasher = h
+	}
+}
+
+// validate checks that a chain can run with the parameters
+func (p ChainParams) validate() error {
+	switch {
+	case p.TargetBits < 1 || p.TargetBits > 255:
+		return fmt.Errorf("target_bits must be between 1 and 255, not %d", p.TargetBits)
+	case p.TargetSpacing < 1:
+		return fmt.Errorf("target_spacing must be at least 1 second, not %d", p.TargetSpacing)
+	case p.RetargetInterval < 0:
+		return fmt.Errorf("retarget_interval can't be negative")
+	case !validMoney(p.Subsidy):
+		return fmt.Errorf("subsidy must be between 0 and %d", maxMoney)
+	case p.HalvingInterval < 0:
+		return fmt.Errorf("halving_interval can't be negative")
+	case p.MaxBlockSize < minMaxBlockSize:
+		return fmt.Errorf("max_block_size must be at least %d bytes, not %d", minMaxBlockSize, p.MaxBlockSize)
+	}
+
+	_, err := lookupHasher(p.PowAlgorithm)
+	if err != nil {
+		return fmt.Errorf("pow_algorithm: %w", err)
+	}
+
+	return nil
+}
+
+// loadChainParams reads chain parameters from a JSON file. Parameters missing
+// from the file keep the values of the active network.
+// Parameters:
+//   - path: Path of the JSON file
+//
+// Returns:
+//   - ChainParams: The parameters
+//   - error: If the file can't be read or the parameters are invalid
+func loadChainParams(path string) (ChainParams, error) {
+	params := currentParams()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return params, err
+	}
+
+	err = json.Unmarshal(data, &params)
+	if err != nil {
+		return params, fmt.Errorf("%s: %w", path, err)
+	}
+
+	err = params.validate()
+	if err != nil {
+		return params, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return params, nil
+}
+
+// storeParams records the parameters a new chain is created with
+// Parameters:
+//   - tx: The database transaction creating the chain
+func storeParams(tx StoreTx) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(currentParams())
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte(metaParamsKey), data)
+}
+
+// applyStoredParams makes the node run with the parameters stored with the
+// chain. Databases created before parameters were stored keep running with
+// the ones of the active network.
+// Parameters:
+//   - db: The database of the chain
+func applyStoredParams(db Store) {
+	err := db.View(func(tx StoreTx) error {
+		b := tx.Bucket([]byte(metaBucket))
+		if b == nil {
+			return nil
+		}
+
+		data := b.Get([]byte(metaParamsKey))
+		if data == nil {
+			return nil
+		}
+
+		// Parameters added later keep the values of the active network
+		params := currentParams()
+		err := json.Unmarshal(data, &params)
+		if err != nil {
+			return err
+		}
+		params.apply()
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// blockSubsidy returns the reward of a block: the subsidy, halved every
+// halvingInterval blocks
+// Parameters:
+//   - height: Height of the block
+func blockSubsidy(height int) int {
+	if halvingInterval == 0 {
+		return subsidy
+	}
+
+	halvings := height / halvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+
+	return subsidy >> halvings
+}
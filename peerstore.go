@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"log"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// peersFile is the file where a node stores the addresses of the peers it has
+// connected to, moved by selectNetwork
+var peersFile = "peers.dat"
+
+// maxPeerAge is how long a peer that can't be reached any more is remembered
+const maxPeerAge = 30 * 24 * time.Hour
+
+// KnownPeer is an address a node has connected to, with statistics about how
+// reliable it has been
+type KnownPeer struct {
+	Addr        string    // Address (host:port) of the node
+	LastSeen    time.Time // Last time a handshake with the node completed
+	LastAttempt time.Time // Last time a connection to the node was attempted
+	Successes   int       // Number of completed handshakes
+	Failures    int       // Number of failed connection attempts since the last success
+}
+
+// score ranks known peers, higher is more likely to be reachable
+func (k *KnownPeer) score() int {
+	return k.Successes - 2*k.Failures
+}
+
+// PeerStore remembers the peers a node has connected to in the peers file, so
+// a restarted node can reconnect to the network without any configuration
+type PeerStore struct {
+	mu    sync.Mutex            // Guards Peers
+	Peers map[string]*KnownPeer // Address -> peer
+}
+
+// LoadPeerStore reads the peers file, dropping peers that haven't been seen for
+// maxPeerAge. An empty store is returned if there is no file yet.
+// Returns:
+//   - *PeerStore: The loaded (or empty) peer store
+func LoadPeerStore() *PeerStore {
+	store := PeerStore{Peers: make(map[string]*KnownPeer)}
+
+	content, err := os.ReadFile(peersFile)
+	if os.IsNotExist(err) {
+		return &store
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var peers []*KnownPeer
+	err = gob.NewDecoder(bytes.NewReader(content)).Decode(&peers)
+	if err != nil {
+		slog.Warn("Ignoring invalid peers file", "file", peersFile, "err", err)
+		return &store
+	}
+
+	for _, k := range peers {
+		if time.Since(k.LastSeen) < maxPeerAge {
+			store.Peers[k.Addr] = k
+		}
+	}
+
+	return &store
+}
+
+// Addresses returns the known addresses, most reliable first
+func (ps *PeerStore) Addresses() []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	var peers []*KnownPeer
+	for _, k := range ps.Peers {
+		peers = append(peers, k)
+	}
+	sortKnownPeers(peers)
+
+	var addrs []string
+	for _, k := range peers {
+		addrs = append(addrs, k.Addr)
+	}
+
+	return addrs
+}
+
+// Score returns the score of an address, 0 for unknown addresses
+func (ps *PeerStore) Score(addr string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	k, ok := ps.Peers[addr]
+	if !ok {
+		return 0
+	}
+
+	return k.score()
+}
+
+// RecordSuccess records a completed handshake with a node and saves the store
+// Parameters:
+//   - addr: Address (host:port) the node was connected to at
+func (ps *PeerStore) RecordSuccess(addr string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	k, ok := ps.Peers[addr]
+	if !ok {
+		k = &KnownPeer{Addr: addr}
+		ps.Peers[addr] = k
+	}
+
+	k.LastSeen = time.Now()
+	k.LastAttempt = k.LastSeen
+	k.Successes++
+	k.Failures = 0
+
+	ps.save()
+}
+
+// RecordFailure records a failed connection attempt to a node and saves the
+// store. Only nodes connected to before are remembered.
+// Parameters:
+//   - addr: Address (host:port) of the node
+func (ps *PeerStore) RecordFailure(addr string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	k, ok := ps.Peers[addr]
+	if !ok {
+		return
+	}
+
+	k.LastAttempt = time.Now()
+	k.Failures++
+
+	ps.save()
+}
+
+// save writes the store to the peers file. The caller holds ps.mu.
+func (ps *PeerStore) save() {
+	var peers []*KnownPeer
+	for _, k := range ps.Peers {
+		peers = append(peers, k)
+	}
+	sortKnownPeers(peers)
+
+	var content bytes.Buffer
+	err := gob.NewEncoder(&content).Encode(peers)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = os.WriteFile(peersFile, content.Bytes(), 0644)
+	if err != nil {
+		slog.Warn("Can't save peers file", "file", peersFile, "err", err)
+	}
+}
+
+// sortKnownPeers orders peers by score, then by when they were last seen
+func sortKnownPeers(peers []*KnownPeer) {
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].score() != peers[j].score() {
+			return peers[i].score() > peers[j].score()
+		}
+		return peers[i].LastSeen.After(peers[j].LastSeen)
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+)
+
+// The proof of work hashes the header data of a block with the hash function
+// of the chain, SHA-256 unless the chain was created with another one in its
+// pow_algorithm parameter. The genesis block records the algorithm, so nodes
+// joining the chain hash the same way as its creator; blocks using SHA-256
+// record nothing, as blocks did before the algorithm could be chosen. Other
+// functions such as scrypt or BLAKE3, or accelerated implementations, can be
+// added to hashers; they need dependencies this module doesn't have yet.
+
+// defaultPowAlgorithm is the proof-of-work algorithm of chains that don't
+// choose one
+const defaultPowAlgorithm = "sha256"
+
+// Hasher is a hash function of the proof of work. It's used by the mining
+// goroutines at once, so it must be safe for concurrent use.
+type Hasher interface {
+	// Name returns the name of the algorithm, as in the chain parameters
+	Name() string
+	// Hash returns the hash of the header data of a block
+	Hash(data []byte) [32]byte
+}
+
+// hashFunc is a Hasher built from a plain hash function
+type hashFunc struct {
+	name string
+	hash func(data []byte) [32]byte
+}
+
+func (h hashFunc) Name() string              { return h.name }
+func (h hashFunc) Hash(data []byte) [32]byte { return h.hash(data) }
+
+// hashers are the proof-of-work algorithms a chain can use, by name
+var hashers = map[string]Hasher{
+	"sha256": hashFunc{"sha256", sha256.Sum256},
+	"sha256d": hashFunc{"sha256d", func(data []byte) [32]byte {
+		first := sha256.Sum256(data)
+		return sha256.Sum256(first[:])
+	}},
+	"sha512_256": hashFunc{"sha512_256", sha512.Sum512_256},
+}
+
+// powHasher is the proof-of-work algorithm of the chain, set from its
+// parameters
+var powHasher = hashers[defaultPowAlgorithm]
+
+// lookupHasher returns the proof-of-work algorithm with a name, an empty one
+// being SHA-256
+// Parameters:
+//   - name: Name of the algorithm
+//
+// Returns:
+//   - Hasher: The algorithm
+//   - error: If there is none with that name
+func lookupHasher(name string) (Hasher, error) {
+	if name == "" {
+		name = defaultPowAlgorithm
+	}
+
+	h, ok := hashers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown proof-of-work algorithm %q", name)
+	}
+
+	return h, nil
+}
+
+// blockHasher returns the proof-of-work algorithm of a block. The genesis
+// block is hashed with the algorithm it records, so a node can check it
+// before knowing the chain, and every other block with the chain's.
+// Parameters:
+//   - block: The block
+func blockHasher(block *Block) Hasher {
+	if block.Height != 0 {
+		return powHasher
+	}
+
+	h, err := lookupHasher(block.PowAlgorithm)
+	if err != nil {
+		// Rejected by checkBlockHeader, hash it like the chain does meanwhile
+		return powHasher
+	}
+
+	return h
+}
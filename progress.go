@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// progressInterval is how often long operations report their progress
+const progressInterval = time.Second
+
+// Operations going over every block of the chain, like rebuilding the UTXO
+// set or the transaction index, importing a chain file or a node's initial
+// sync, can take minutes on a long chain. They report how far they got to a
+// ProgressReporter every progressInterval and once done: the blocks done out
+// of the total, the blocks per second and the time left at that rate. The
+// commands render it on stderr, see cliProgress, on a single line rewritten
+// in place on a terminal, and nodes and the chain state rebuilt on their own
+// log it, see logProgress. Operations given no reporter report nothing.
+
+// Progress is how far a long operation over the blocks of the chain got
+type Progress struct {
+	Operation string        // What's being done, such as "Rebuilding the UTXO set"
+	Done      int           // Blocks done so far
+	Total     int           // Blocks to do in all, possibly estimated, 0 if unknown
+	Rate      float64       // Blocks done per second
+	ETA       time.Duration // Time left at the current rate, 0 once done or if unknown
+}
+
+// Percent returns the part of the blocks done, 0 if the total is unknown
+func (p Progress) Percent() float64 {
+	if p.Total <= 0 {
+		return 0
+	}
+
+	return min(100*float64(p.Done)/float64(p.Total), 100)
+}
+
+// Complete checks whether every block is done
+func (p Progress) Complete() bool {
+	return p.Total > 0 && p.Done >= p.Total
+}
+
+// String describes the progress on one line
+func (p Progress) String() string {
+	if p.Total <= 0 {
+		return fmt.Sprintf("%s: %d blocks, %.0f blocks/s", p.Operation, p.Done, p.Rate)
+	}
+
+	line := fmt.Sprintf("%s: %.1f%%, %d of %d blocks, %.0f blocks/s", p.Operation, p.Percent(), p.Done, p.Total, p.Rate)
+	if p.ETA > 0 {
+		line += fmt.Sprintf(", %s left", p.ETA.Round(time.Second))
+	}
+
+	return line
+}
+
+// ProgressReporter is told how far long operations got
+type ProgressReporter interface {
+	// ReportProgress is called every progressInterval and once the
+	// operation is complete
+	ReportProgress(p Progress)
+}
+
+// progressTracker measures the rate of an operation and reports its progress
+// at most every progressInterval, and once complete
+type progressTracker struct {
+	reporter  ProgressReporter
+	progress  Progress
+	started   time.Time // When the tracker was created
+	startDone int       // Blocks done when the tracker was created
+	reported  time.Time // When the progress was last reported
+}
+
+// newProgressTracker starts tracking an operation
+// Parameters:
+//   - reporter: Told the progress, nil to report nothing
+//   - operation: What's being done
+//   - done: Blocks done already, such as the height a sync starts from
+//   - total: Blocks to do in all, 0 if unknown
+//
+// Returns:
+//   - *progressTracker: The tracker, nil without a reporter
+func newProgressTracker(reporter ProgressReporter, operation string, done, total int) *progressTracker {
+	if reporter == nil {
+		return nil
+	}
+
+	now := time.Now()
+	return &progressTracker{
+		reporter:  reporter,
+		progress:  Progress{Operation: operation, Done: done, Total: total},
+		started:   now,
+		startDone: done,
+		reported:  now,
+	}
+}
+
+// update records the blocks done so far, then reports them if
+// progressInterval passed since the last report or the operation is complete
+// Parameters:
+//   - done: Blocks done so far
+//   - total: Blocks to do in all, which may be revised as the operation goes
+func (t *progressTracker) update(done, total int) {
+	if t == nil {
+		return
+	}
+
+	t.progress.Done, t.progress.Total = done, total
+	now := time.Now()
+	if !t.progress.Complete() && now.Sub(t.reported) < progressInterval {
+		return
+	}
+	t.reported = now
+
+	t.progress.Rate = float64(done-t.startDone) / now.Sub(t.started).Seconds()
+	t.progress.ETA = 0
+	if left := total - done; left > 0 && t.progress.Rate > 0 {
+		t.progress.ETA = time.Duration(float64(left) / t.progress.Rate * float64(time.Second))
+	}
+
+	t.reporter.ReportProgress(t.progress)
+}
+
+// cliProgress renders the progress of the operation of a command on
+// noteOutput: on a terminal as a single line rewritten in place, otherwise
+// as a line every report, so pipelines and log files get whole lines
+type cliProgress struct{}
+
+func (cliProgress) ReportProgress(p Progress) {
+	w := noteOutput()
+	if !isTerminal(w) {
+		fmt.Fprintln(w, p)
+		return
+	}
+
+	fmt.Fprintf(w, "\r\033[K%s", p)
+	if p.Complete() {
+		fmt.Fprintln(w)
+	}
+}
+
+// logProgress logs the progress of operations nobody waits on at a terminal,
+// like a node's initial sync
+type logProgress struct{}
+
+func (logProgress) ReportProgress(p Progress) {
+	slog.Info(p.Operation, "done", p.Done, "total", p.Total, "percent", fmt.Sprintf("%.1f", p.Percent()),
+		"rate", fmt.Sprintf("%.0f", p.Rate), "eta", p.ETA.Round(time.Second))
+}
+
+// isTerminal checks whether a writer is a terminal
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -2,24 +2,36 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"fmt"
+	"context"
+	"encoding/hex"
+	"errors"
+	"log/slog"
 	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Global variables defining the proof-of-work parameters
 var (
 	// maxNonce defines the maximum value the nonce can take.
-	// If a solution isn't found after maxNonce iterations,
-	// the mining process stops.
+	// If a solution isn't found after maxNonce iterations, the
+	// miner changes the block and starts over, see Block.Mine.
 	maxNonce = 10000000
+
+	// miningWorkers is the number of goroutines grinding nonces, one per
+	// CPU unless limited with -miningworkers
+	miningWorkers = runtime.NumCPU()
 )
 
-// targetBits defines the difficulty of mining. The higher this number,
-// the easier it is to mine a block. The lower the number, the harder it becomes.
-// In Bitcoin, this value is adjusted every 2016 blocks to maintain a consistent
-// block generation time of about 10 minutes.
-const targetBits = 12
+// targetBits defines the initial difficulty of mining, the difficulty of the
+// genesis block and the easiest one allowed: hashes must start with
+// targetBits zero bits. The higher this number, the harder it is to mine a
+// block. As in Bitcoin, the target is then adjusted every retargetInterval
+// blocks and carried by each block (see difficulty.go). Set per network by
+// selectNetwork.
+var targetBits = 12
 
 // ProofOfWork represents a proof-of-work system similar to the one used in Bitcoin.
 // It ensures that a significant amount of computational work has been invested in
@@ -27,84 +39,177 @@ const targetBits = 12
 type ProofOfWork struct {
 	block  *Block   // The block to mine
 	target *big.Int // The target threshold that the hash must be less than
+	hasher Hasher   // The hash function, see blockHasher
+	quiet  bool     // Mine without logging the progress, for benchmarks
 }
 
 // NewProofOfWork builds and returns a ProofOfWork instance for a given block.
-// It calculates the target value based on the targetBits difficulty.
-// The target is calculated as: target = 1 << (256 - targetBits)
+// The target is the one the block carries, see Block.Target.
 // This means the hash of the block must be below this target to be valid.
+// The hash function is the chain's, see powhash.go.
 func NewProofOfWork(b *Block) *ProofOfWork {
-	// Create a new big integer with value 1
-	target := big.NewInt(1)
-
-	// Left shift by (256 - targetBits) positions
-	// 256 is used because SHA-256 hash is 256 bits long
-	// For example, if targetBits = 12, we shift by 244 positions
-	// This creates our target threshold
-	target.Lsh(target, uint(256-targetBits))
-
-	pow := &ProofOfWork{b, target}
+	pow := &ProofOfWork{block: b, target: b.Target(), hasher: blockHasher(b)}
 
 	return pow
 }
 
 // prepareData combines the block data with the nonce to create
 // the data that will be hashed. This implements the core mining algorithm:
-// hash(prevHash + transactions + timestamp + targetBits + nonce)
+// hash(prevHash + transactions + timestamp + target + nonce)
 // Parameters:
 //   - nonce: The current nonce value being tested
 //
 // Returns:
 //   - []byte: The combined data ready for hashing
 func (pow *ProofOfWork) prepareData(nonce int) []byte {
+	// Blocks without a target hashed the initial difficulty instead
+	bits := int64(pow.block.Bits)
+	if bits == 0 {
+		bits = int64(targetBits)
+	}
+
 	data := bytes.Join(
 		[][]byte{
 			pow.block.PrevBlockHash,       // Previous block's hash
 			pow.block.HashTransactions(),  // Hash of all transactions in the block
 			IntToHex(pow.block.Timestamp), // Block timestamp
-			IntToHex(int64(targetBits)),   // Mining difficulty
+			IntToHex(bits),                // Compact target
 			IntToHex(int64(nonce)),        // Current nonce value
 		},
 		[]byte{}, // Separator (empty in this case)
 	)
 
+	// Blocks mined before versions existed didn't hash one
+	if pow.block.Version != 0 {
+		data = append(data, IntToHex(int64(pow.block.Version))...)
+	}
+
+	// The genesis block of a chain not using SHA-256 commits to its algorithm
+	if pow.block.PowAlgorithm != "" {
+		data = append(data, pow.block.PowAlgorithm...)
+	}
+
 	return data
 }
 
+// errMiningCancelled is returned by Run when its context is cancelled before
+// a valid hash is found, for example because a better block arrived
+var errMiningCancelled = errors.New("mining cancelled")
+
+// errNoncesExhausted is returned by Run when no nonce up to maxNonce gives a
+// hash below the target
+var errNoncesExhausted = errors.New("no nonce gives a valid hash")
+
+// hashCountBatch is how many hashes a mining goroutine tries before adding
+// them to the shared count, so the goroutines don't contend for it
+const hashCountBatch = 4096
+
+// hashRateInterval is how often Run updates the hash rate readout
+const hashRateInterval = time.Second
+
 // Run performs the actual proof-of-work computation.
 // It continuously hashes the block data with different nonce values
-// until it finds a hash that's less than the target.
+// until it finds a hash that's less than the target. The nonces are split
+// between miningWorkers goroutines, worker i trying i, i+n, i+2n and so on,
+// and the first one finding a valid hash stops the others. The hashes tried
+// are counted into hashRate, and the hash rate is printed every
+// hashRateInterval while mining.
+// Parameters:
+//   - ctx: Stops the mining when it's cancelled
+//
 // Returns:
 //   - int: The nonce that produced a valid hash
 //   - []byte: The valid hash that was found
-func (pow *ProofOfWork) Run() (int, []byte) {
-	var hashInt big.Int // Used to store the hash as a big integer for comparison
-	var hash [32]byte   // Stores the current hash value
-	nonce := 0          // Starting nonce value
-
-	fmt.Printf("Mining a new block")
-	for nonce < maxNonce {
-		// Prepare the data with the current nonce
-		data := pow.prepareData(nonce)
-
-		// Calculate the SHA-256 hash
-		hash = sha256.Sum256(data)
-		fmt.Printf("\r%x", hash) // Display mining progress
-
-		// Convert hash to big integer for comparison with target
-		hashInt.SetBytes(hash[:])
-
-		// Compare hash with target
-		// If hash < target, we've found a valid nonce
-		if hashInt.Cmp(pow.target) == -1 {
-			break
-		} else {
-			nonce++ // Try next nonce value
+//   - error: errMiningCancelled if ctx was cancelled first, errNoncesExhausted
+//     if every nonce failed
+func (pow *ProofOfWork) Run(ctx context.Context) (int, []byte, error) {
+	workers := max(miningWorkers, 1)
+
+	var stop atomic.Bool // Set when a valid hash is found or ctx is cancelled
+	var once sync.Once   // Records the first solution only
+	var wg sync.WaitGroup
+	solved := false
+	var nonce int
+	var hash [32]byte
+	var hashes atomic.Uint64 // Hashes tried so far, counted in batches
+
+	// Workers poll the flag, which is cheaper than checking ctx for every nonce
+	defer context.AfterFunc(ctx, func() { stop.Store(true) })()
+
+	started := time.Now()
+	hashRate.start()
+	defer func() { hashRate.stop(hashes.Load(), time.Since(started)) }()
+
+	pow.debug("Mining a new block", "height", pow.block.Height, "workers", workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(start int) {
+			defer wg.Done()
+
+			var hashInt big.Int // Used to store the hash as a big integer for comparison
+			counted := 0        // Hashes tried that aren't in hashes yet
+			defer func() { hashes.Add(uint64(counted)) }()
+			for n := start; n < maxNonce && !stop.Load(); n += workers {
+				// Calculate the hash of the data with this nonce
+				h := pow.hasher.Hash(pow.prepareData(n))
+				counted++
+				if counted == hashCountBatch {
+					hashes.Add(hashCountBatch)
+					counted = 0
+				}
+
+				// Compare hash with target
+				// If hash < target, we've found a valid nonce
+				hashInt.SetBytes(h[:])
+				if hashInt.Cmp(pow.target) == -1 {
+					once.Do(func() {
+						solved, nonce, hash = true, n, h
+						stop.Store(true)
+					})
+					return
+				}
+			}
+		}(w)
+	}
+
+	// Log the hash rate until the workers are done
+	done := make(chan struct{})
+	printed := make(chan struct{})
+	go func() {
+		defer close(printed)
+		ticker := time.NewTicker(hashRateInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				count, elapsed := hashes.Load(), time.Since(started)
+				hashRate.update(count, elapsed)
+				pow.debug("Mining a new block", "height", pow.block.Height, "hashrate", formatHashRate(float64(count)/elapsed.Seconds()))
+			}
+		}
+	}()
+	wg.Wait()
+	close(done)
+	<-printed
+
+	if !solved {
+		if ctx.Err() != nil {
+			return 0, nil, errMiningCancelled
 		}
+		return 0, nil, errNoncesExhausted
 	}
-	fmt.Print("\n\n")
+	pow.debug("Found the proof of work", "height", pow.block.Height, "hash", hex.EncodeToString(hash[:]), "nonce", nonce)
 
-	return nonce, hash[:]
+	return nonce, hash[:], nil
+}
+
+// debug logs the progress of Run unless the proof of work is quiet
+func (pow *ProofOfWork) debug(msg string, args ...any) {
+	if !pow.quiet {
+		slog.Debug(msg, args...)
+	}
 }
 
 // Validate verifies whether a block's proof-of-work is valid.
@@ -117,7 +222,7 @@ func (pow *ProofOfWork) Validate() bool {
 
 	// Recreate the hash using the block's stored nonce
 	data := pow.prepareData(pow.block.Nonce)
-	hash := sha256.Sum256(data)
+	hash := pow.hasher.Hash(data)
 	hashInt.SetBytes(hash[:])
 
 	// Check if hash is less than target
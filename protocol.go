@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Message payloads are protobuf encoded following protocol.proto, so clients
+// written in other languages can speak the protocol by generating code from
+// it. The messages are small and fixed, so they are encoded directly with
+// protowire instead of through generated code.
+
+// protoField is a field read from an encoded protobuf message
+type protoField struct {
+	num   protowire.Number
+	typ   protowire.Type
+	value uint64 // Value of a varint field
+	data  []byte // Value of a length-delimited field
+}
+
+// varint returns the value of a varint field
+func (f protoField) varint() (uint64, error) {
+	if f.typ != protowire.VarintType {
+		return 0, fmt.Errorf("field %d is not a varint", f.num)
+	}
+	return f.value, nil
+}
+
+// bytes returns a copy of the value of a length-delimited field
+func (f protoField) bytes() ([]byte, error) {
+	if f.typ != protowire.BytesType {
+		return nil, fmt.Errorf("field %d is not length-delimited", f.num)
+	}
+	return bytes.Clone(f.data), nil
+}
+
+// parseProtoFields splits an encoded protobuf message into its fields.
+// Fields of other wire types are skipped, so messages with fields added by
+// newer nodes can still be read.
+func parseProtoFields(data []byte) ([]protoField, error) {
+	var fields []protoField
+
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		f := protoField{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.value, n = protowire.ConsumeVarint(data)
+		case protowire.BytesType:
+			f.data, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		fields = append(fields, f)
+	}
+
+	return fields, nil
+}
+
+// appendVarintField appends a varint field, omitted when zero like proto3 does
+func appendVarintField(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// appendBytesField appends a length-delimited field
+func appendBytesField(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// appendStringField appends a string field, omitted when empty like proto3 does
+func appendStringField(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	return appendBytesField(b, num, []byte(v))
+}
+
+// marshalTransaction encodes a Transaction message
+func marshalTransaction(tx *Transaction) []byte {
+	var b []byte
+	if len(tx.ID) > 0 {
+		b = appendBytesField(b, 1, tx.ID)
+	}
+
+	for _, in := range tx.Vin {
+		var m []byte
+		if len(in.Txid) > 0 {
+			m = appendBytesField(m, 1, in.Txid)
+		}
+		m = appendVarintField(m, 2, uint64(in.Vout))
+		m = appendStringField(m, 3, in.ScriptSig)
+		b = appendBytesField(b, 2, m)
+	}
+
+	for _, out := range tx.Vout {
+		var m []byte
+		m = appendVarintField(m, 1, uint64(out.Value))
+		m = appendStringField(m, 2, out.ScriptPubKey)
+		if len(out.NFT) > 0 {
+			m = appendBytesField(m, 3, out.NFT)
+		}
+		if out.LockHeight != 0 {
+			m = appendVarintField(m, 4, uint64(out.LockHeight))
+		}
+		b = appendBytesField(b, 3, m)
+	}
+	b = appendVarintField(b, 4, uint64(tx.LockTime))
+
+	return b
+}
+
+// unmarshalTransaction decodes a Transaction message
+func unmarshalTransaction(data []byte, tx *Transaction) error {
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			tx.ID, err = f.bytes()
+		case 2:
+			var m []byte
+			m, err = f.bytes()
+			if err == nil {
+				var in TXInput
+				err = unmarshalTxInput(m, &in)
+				tx.Vin = append(tx.Vin, in)
+			}
+		case 3:
+			var m []byte
+			m, err = f.bytes()
+			if err == nil {
+				var out TXOutput
+				err = unmarshalTxOutput(m, &out)
+				tx.Vout = append(tx.Vout, out)
+			}
+		case 4:
+			var v uint64
+			v, err = f.varint()
+			tx.LockTime = int64(v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unmarshalTxInput decodes a TxInput message
+func unmarshalTxInput(data []byte, in *TXInput) error {
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		var v uint64
+		var s []byte
+		switch f.num {
+		case 1:
+			in.Txid, err = f.bytes()
+		case 2:
+			v, err = f.varint()
+			in.Vout = int(int64(v))
+		case 3:
+			s, err = f.bytes()
+			in.ScriptSig = string(s)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unmarshalTxOutput decodes a TxOutput message
+func unmarshalTxOutput(data []byte, out *TXOutput) error {
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		var v uint64
+		var s []byte
+		switch f.num {
+		case 1:
+			v, err = f.varint()
+			out.Value = int(int64(v))
+		case 2:
+			s, err = f.bytes()
+			out.ScriptPubKey = string(s)
+		case 3:
+			out.NFT, err = f.bytes()
+		case 4:
+			v, err = f.varint()
+			out.LockHeight = int(int64(v))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// marshalBlock encodes a Block message
+func marshalBlock(block *Block) []byte {
+	var b []byte
+	b = appendVarintField(b, 1, uint64(block.Timestamp))
+	for _, tx := range block.Transactions {
+		b = appendBytesField(b, 2, marshalTransaction(tx))
+	}
+	if len(block.PrevBlockHash) > 0 {
+		b = appendBytesField(b, 3, block.PrevBlockHash)
+	}
+	if len(block.Hash) > 0 {
+		b = appendBytesField(b, 4, block.Hash)
+	}
+	b = appendVarintField(b, 5, uint64(block.Nonce))
+	b = appendVarintField(b, 6, uint64(block.Height))
+	if block.Bits != 0 {
+		b = appendVarintField(b, 7, uint64(block.Bits))
+	}
+	if block.Version != 0 {
+		b = appendVarintField(b, 8, uint64(block.Version))
+	}
+	b = appendStringField(b, 9, block.PowAlgorithm)
+
+	return b
+}
+
+// unmarshalBlock decodes a Block message
+func unmarshalBlock(data []byte, block *Block) error {
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		var v uint64
+		switch f.num {
+		case 1:
+			v, err = f.varint()
+			block.Timestamp = int64(v)
+		case 2:
+			var m []byte
+			m, err = f.bytes()
+			if err == nil {
+				tx := &Transaction{}
+				err = unmarshalTransaction(m, tx)
+				block.Transactions = append(block.Transactions, tx)
+			}
+		case 3:
+			block.PrevBlockHash, err = f.bytes()
+		case 4:
+			block.Hash, err = f.bytes()
+		case 5:
+			v, err = f.varint()
+			block.Nonce = int(int64(v))
+		case 6:
+			v, err = f.varint()
+			block.Height = int(int64(v))
+		case 7:
+			v, err = f.varint()
+			block.Bits = uint32(v)
+		case 8:
+			v, err = f.varint()
+			block.Version = int32(v)
+		case 9:
+			var s []byte
+			s, err = f.bytes()
+			block.PowAlgorithm = string(s)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// marshalMerkleBlock encodes a MerkleBlock message
+func marshalMerkleBlock(mb merkleBlock) []byte {
+	var b []byte
+	b = appendBytesField(b, 1, marshalBlock(mb.Header))
+	b = appendBytesField(b, 2, mb.MerkleRoot)
+	for _, match := range mb.Matches {
+		var m []byte
+		m = appendBytesField(m, 1, marshalTransaction(match.Tx))
+		var right uint64
+		for i, hash := range match.Proof.Hashes {
+			m = appendBytesField(m, 2, hash)
+			if match.Proof.Right[i] {
+				right |= 1 << i
+			}
+		}
+		m = appendVarintField(m, 3, right)
+		b = appendBytesField(b, 3, m)
+	}
+
+	return b
+}
+
+// unmarshalMerkleBlock decodes a MerkleBlock message
+func unmarshalMerkleBlock(data []byte, mb *merkleBlock) error {
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		var m []byte
+		switch f.num {
+		case 1:
+			m, err = f.bytes()
+			if err == nil {
+				mb.Header = &Block{}
+				err = unmarshalBlock(m, mb.Header)
+			}
+		case 2:
+			mb.MerkleRoot, err = f.bytes()
+		case 3:
+			m, err = f.bytes()
+			if err == nil {
+				var match filteredTx
+				match, err = unmarshalFilteredTx(m)
+				mb.Matches = append(mb.Matches, match)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if mb.Header == nil {
+		return fmt.Errorf("merkle block without a header")
+	}
+
+	return nil
+}
+
+// unmarshalFilteredTx decodes a FilteredTransaction message
+func unmarshalFilteredTx(data []byte) (filteredTx, error) {
+	var match filteredTx
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return match, err
+	}
+
+	var right uint64
+	for _, f := range fields {
+		var m []byte
+		switch f.num {
+		case 1:
+			m, err = f.bytes()
+			if err == nil {
+				match.Tx = &Transaction{}
+				err = unmarshalTransaction(m, match.Tx)
+			}
+		case 2:
+			m, err = f.bytes()
+			match.Proof.Hashes = append(match.Proof.Hashes, m)
+		case 3:
+			right, err = f.varint()
+		}
+		if err != nil {
+			return match, err
+		}
+	}
+	if match.Tx == nil {
+		return match, fmt.Errorf("filtered transaction without a transaction")
+	}
+	if len(match.Proof.Hashes) > 64 {
+		return match, fmt.Errorf("merkle proof of %d hashes is too long", len(match.Proof.Hashes))
+	}
+
+	match.Proof.Right = make([]bool, len(match.Proof.Hashes))
+	for i := range match.Proof.Right {
+		match.Proof.Right[i] = right&(1<<i) != 0
+	}
+
+	return match, nil
+}
+
+// marshalHashList encodes a message made of a single repeated bytes field,
+// GetBlocks or Inventory
+func marshalHashList(hashes [][]byte) []byte {
+	var b []byte
+	for _, hash := range hashes {
+		b = appendBytesField(b, 1, hash)
+	}
+
+	return b
+}
+
+// unmarshalHashList decodes a GetBlocks or Inventory message
+func unmarshalHashList(data []byte) ([][]byte, error) {
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes [][]byte
+	for _, f := range fields {
+		if f.num != 1 {
+			continue
+		}
+
+		hash, err := f.bytes()
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, nil
+}
+
+// encodePayload encodes a message payload
+// Parameters:
+//   - v: The payload, one of the payload types of protocol.proto
+func encodePayload(v any) []byte {
+	var b []byte
+
+	switch p := v.(type) {
+	case version:
+		b = appendVarintField(b, 1, uint64(p.Version))
+		b = appendVarintField(b, 2, p.Services)
+		b = appendVarintField(b, 3, uint64(p.BestHeight))
+		if len(p.ChainWork) > 0 {
+			b = appendBytesField(b, 4, p.ChainWork)
+		}
+		if p.Fingerprint != "" {
+			b = appendStringField(b, 5, p.Fingerprint)
+		}
+		b = appendVarintField(b, 6, uint64(p.MinRelayFee))
+	case getBlocks:
+		b = marshalHashList(p.Locator)
+	case inventory:
+		b = marshalHashList(p.Items)
+	case reject:
+		if len(p.Txid) > 0 {
+			b = appendBytesField(b, 1, p.Txid)
+		}
+		b = appendStringField(b, 2, p.Reason)
+	case BloomFilter:
+		b = appendBytesField(b, 1, p.Filter)
+		b = appendVarintField(b, 2, uint64(p.HashFuncs))
+		b = appendVarintField(b, 3, uint64(p.Tweak))
+	case filterAdd:
+		b = appendBytesField(b, 1, p.Data)
+	case merkleBlock:
+		b = marshalMerkleBlock(p)
+	case *Transaction:
+		b = marshalTransaction(p)
+	case *Block:
+		b = marshalBlock(p)
+	default:
+		log.Panicf("no wire format for %T", v)
+	}
+
+	return b
+}
+
+// decodePayload decodes a message payload. Unlike the decoding of stored data
+// this returns an error, since peers can send anything.
+// Parameters:
+//   - data: The encoded payload
+//   - v: Pointer to the payload to fill, one of the payload types of protocol.proto
+func decodePayload(data []byte, v any) error {
+	switch p := v.(type) {
+	case *version:
+		fields, err := parseProtoFields(data)
+		if err != nil {
+			return err
+		}
+		for _, f := range fields {
+			var n uint64
+			var s []byte
+			switch f.num {
+			case 1:
+				n, err = f.varint()
+				p.Version = int(int64(n))
+			case 2:
+				p.Services, err = f.varint()
+			case 3:
+				n, err = f.varint()
+				p.BestHeight = int(int64(n))
+			case 4:
+				p.ChainWork, err = f.bytes()
+			case 5:
+				s, err = f.bytes()
+				p.Fingerprint = string(s)
+			case 6:
+				n, err = f.varint()
+				p.MinRelayFee = int(min(n, maxMoney))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case *getBlocks:
+		var err error
+		p.Locator, err = unmarshalHashList(data)
+		return err
+	case *inventory:
+		var err error
+		p.Items, err = unmarshalHashList(data)
+		return err
+	case *reject:
+		fields, err := parseProtoFields(data)
+		if err != nil {
+			return err
+		}
+		for _, f := range fields {
+			var s []byte
+			switch f.num {
+			case 1:
+				p.Txid, err = f.bytes()
+			case 2:
+				s, err = f.bytes()
+				p.Reason = string(s)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case *BloomFilter:
+		fields, err := parseProtoFields(data)
+		if err != nil {
+			return err
+		}
+		for _, f := range fields {
+			var n uint64
+			switch f.num {
+			case 1:
+				p.Filter, err = f.bytes()
+			case 2:
+				n, err = f.varint()
+				p.HashFuncs = int(min(n, maxBloomHashFuncs+1))
+			case 3:
+				n, err = f.varint()
+				p.Tweak = uint32(n)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case *filterAdd:
+		fields, err := parseProtoFields(data)
+		if err != nil {
+			return err
+		}
+		for _, f := range fields {
+			if f.num == 1 {
+				p.Data, err = f.bytes()
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case *merkleBlock:
+		return unmarshalMerkleBlock(data, p)
+	case *Transaction:
+		return unmarshalTransaction(data, p)
+	case *Block:
+		return unmarshalBlock(data, p)
+	default:
+		return fmt.Errorf("no wire format for %T", v)
+	}
+}
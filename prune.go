@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// Pruning discards the transactions of old blocks to save disk space. Once a
+// block of the active chain is more than the prune depth below the tip, the
+// UTXO set and indexes built when connecting it are all that's needed of it,
+// so its body is deleted and only its header is kept, see blockstore.go. Its
+// undo data is dropped as well, so the chain can no longer be rewound to below
+// the pruned height and blocks forking off there are refused. Pruning can't be undone, and whatever needs the
+// transactions of a pruned block, like rebuilding the UTXO set, looking up an
+// old transaction or serving the block to peers, fails with errPrunedData. The
+// depth is stored in the database, a depth of 0 stops pruning further blocks.
+
+// minPruneDepth is the fewest blocks below the tip kept whole, which is the
+// deepest reorganization a pruned node can follow
+const minPruneDepth = 100
+
+// errPrunedData is returned for operations needing pruned transactions
+var errPrunedData = errors.New("transactions pruned")
+
+// IsPruned checks whether a block is only its header, because its
+// transactions were pruned or it was read from blocksBucket without them
+func (b *Block) IsPruned() bool {
+	return len(b.Transactions) == 0 && b.MerkleRoot != nil
+}
+
+// readPruneDepth returns the prune depth stored in the meta bucket, 0 if unset
+func readPruneDepth(tx StoreTx) int {
+	b := tx.Bucket([]byte(metaBucket))
+	if b == nil {
+		return 0
+	}
+
+	data := b.Get([]byte(metaPruneDepthKey))
+	if data == nil {
+		return 0
+	}
+
+	return int(HexToInt(data))
+}
+
+// readPrunedHeight returns the height of the last pruned block of the active
+// chain, -1 if no block was pruned
+func readPrunedHeight(tx StoreTx) int {
+	b := tx.Bucket([]byte(metaBucket))
+	if b == nil {
+		return -1
+	}
+
+	data := b.Get([]byte(metaPrunedHeightKey))
+	if data == nil {
+		return -1
+	}
+
+	return int(HexToInt(data))
+}
+
+// PruneDepth returns the number of blocks below the tip kept whole, 0 if
+// pruning is off
+func (bc *Blockchain) PruneDepth() int {
+	depth := 0
+
+	err := bc.db.View(func(tx StoreTx) error {
+		depth = readPruneDepth(tx)
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return depth
+}
+
+// PrunedHeight returns the height up to which blocks were pruned, -1 if none
+// were
+func (bc *Blockchain) PrunedHeight() int {
+	height := -1
+
+	err := bc.db.View(func(tx StoreTx) error {
+		height = readPrunedHeight(tx)
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return height
+}
+
+// checkUnpruned fails if blocks were pruned, for operations needing the
+// transactions of every block
+// Parameters:
+//   - operation: What needs the transactions, for the error
+func (bc *Blockchain) checkUnpruned(operation string) error {
+	height := bc.PrunedHeight()
+	if height < 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%s needs the transactions of every block, but blocks up to height %d were pruned", operation, height)
+}
+
+// SetPruneDepth changes the prune depth and prunes the blocks of the active
+// chain more than depth below the tip right away
+// Parameters:
+//   - depth: Number of blocks below the tip to keep whole, at least
+//     minPruneDepth, or 0 to stop pruning
+//
+// Returns:
+//   - int: Height up to which blocks are pruned, -1 if none are
+func (bc *Blockchain) SetPruneDepth(depth int) int {
+	pruned := -1
+
+	err := bc.db.Update(func(tx StoreTx) error {
+		err := tx.Bucket([]byte(metaBucket)).Put([]byte(metaPruneDepthKey), IntToHex(int64(depth)))
+		if err != nil {
+			return err
+		}
+
+		pruned = readPrunedHeight(tx)
+		if depth == 0 {
+			return nil
+		}
+
+		tipHeight := DeserializeBlock(tx.Bucket([]byte(blocksBucket)).Get(bc.tip)).Height
+		for height := pruned + 1; height < tipHeight-depth; height++ {
+			err = pruneBlock(tx, height)
+			if err != nil {
+				return err
+			}
+			pruned = height
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return pruned
+}
+
+// pruneBlocks prunes the block of the active chain that a new block has
+// pushed beyond the prune depth
+// Parameters:
+//   - tx: The database transaction storing the block
+//   - block: The block being added to the chain
+func pruneBlocks(tx StoreTx, block *Block) error {
+	depth := readPruneDepth(tx)
+	if depth == 0 || block.Height <= depth {
+		return nil
+	}
+
+	// Blocks pruned before the depth was raised stay pruned
+	height := block.Height - depth - 1
+	if height <= readPrunedHeight(tx) {
+		return nil
+	}
+
+	return pruneBlock(tx, height)
+}
+
+// pruneBlock discards the transactions and undo data of a block of the
+// active chain, keeping its header
+// Parameters:
+//   - tx: The database transaction
+//   - height: Height of the block
+func pruneBlock(tx StoreTx, height int) error {
+	hash := bytes.Clone(tx.Bucket([]byte(heightsBucket)).Get(heightKey(height)))
+	if hash == nil {
+		return fmt.Errorf("no block at height %d", height)
+	}
+
+	for _, bucket := range []string{bodiesBucket, undoBucket, contractUndoBucket} {
+		if b := tx.Bucket([]byte(bucket)); b != nil {
+			err := b.Delete(hash)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Bucket([]byte(metaBucket)).Put([]byte(metaPrunedHeightKey), IntToHex(int64(height)))
+}
+
+// checkPrunedFork rejects a block forking off the active chain at or below
+// the pruned height, since the chain can't be rewound there
+// Parameters:
+//   - tx: The database transaction
+//   - block: The block
+func checkPrunedFork(tx StoreTx, block *Block) error {
+	pruned := readPrunedHeight(tx)
+	if block.Height > pruned || bytes.Equal(tx.Bucket([]byte(heightsBucket)).Get(heightKey(block.Height)), block.Hash) {
+		return nil
+	}
+
+	return fmt.Errorf("block %x at height %d forks off below the pruned height %d", block.Hash, block.Height, pruned)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// A partially signed transaction, like Bitcoin's PSBT (BIP 174), is an
+// unsigned raw transaction (see rawtx.go) saved with the outputs its inputs
+// spend and the ScriptSigs collected so far. The owners of the spent outputs
+// can check what they're paying and sign without the blockchain, each on a
+// copy of the file, so a transaction paid from several wallets is signed
+// asynchronously:
+// 1. psbt create looks up the outputs an unsigned raw transaction spends
+// 2. psbt sign unlocks the inputs of one owner, on any copy of the file
+// 3. psbt combine merges copies signed separately
+// 4. psbt finalize turns a fully signed file into a raw transaction for sendrawtransaction
+// Outputs are locked by one address, there are no multisig scripts, so each
+// input has a single signer and a spend needing several signatures is one
+// spending outputs of several owners.
+
+// PSBT is a partially signed transaction, saved as JSON
+type PSBT struct {
+	Tx     string      `json:"tx"`     // Hex unsigned raw transaction
+	Inputs []PSBTInput `json:"inputs"` // The outputs spent and the signatures, one per input of Tx
+}
+
+// PSBTInput is the output an input of a partially signed transaction spends,
+// and its signature once there is one
+type PSBTInput struct {
+	PrevValue   int    `json:"prev_value"`           // Value of the spent output
+	PrevAddress string `json:"prev_address"`         // Address owning the spent output
+	ScriptSig   string `json:"script_sig,omitempty"` // Unlocking data, empty until signed
+}
+
+// NewPSBT creates a partially signed transaction from an unsigned raw
+// transaction, looking up the outputs it spends
+// Parameters:
+//   - tx: The unsigned transaction
+//   - UTXOSet: The UTXO set to look up the spent outputs in
+func NewPSBT(tx *Transaction, UTXOSet *UTXOSet) (*PSBT, error) {
+	psbt := PSBT{Tx: EncodeRawTransaction(tx)}
+
+	for i, in := range tx.Vin {
+		if in.ScriptSig != "" {
+			return nil, fmt.Errorf("input %d is already signed", i)
+		}
+
+		prevOut, ok := UTXOSet.FindOutput(in.Txid, in.Vout)
+		if !ok {
+			return nil, fmt.Errorf("input %d spends output %x:%d which is spent or missing", i, in.Txid, in.Vout)
+		}
+		psbt.Inputs = append(psbt.Inputs, PSBTInput{prevOut.Value, prevOut.ScriptPubKey, ""})
+	}
+
+	return &psbt, psbt.checkBalanced()
+}
+
+// ReadPSBT reads a partially signed transaction from a file
+// Parameters:
+//   - filename: The file to read
+func ReadPSBT(filename string) (*PSBT, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var psbt PSBT
+	err = json.Unmarshal(content, &psbt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid partially signed transaction file %s: %w", filename, err)
+	}
+
+	return &psbt, psbt.checkBalanced()
+}
+
+// WriteToFile writes the partially signed transaction to a file as indented JSON
+// Parameters:
+//   - filename: The file to write
+func (psbt *PSBT) WriteToFile(filename string) error {
+	content, err := json.MarshalIndent(psbt, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filename, append(content, '\n'), 0644)
+}
+
+// Sign unlocks the inputs spending outputs of an address or of its change
+// addresses, using only the data in the file
+// Parameters:
+//   - from: The address whose outputs the wallet unlocks
+//   - wallet: The wallet tracking the change addresses of from
+//
+// Returns:
+//   - int: Number of inputs it signed
+func (psbt *PSBT) Sign(from string, wallet *Wallet) int {
+	signed := 0
+	for i, in := range psbt.Inputs {
+		if in.ScriptSig == "" && wallet.IsOwnAddress(from, in.PrevAddress) {
+			// Unlock the spent output with the address that owns it
+			psbt.Inputs[i].ScriptSig = in.PrevAddress
+			signed++
+		}
+	}
+
+	return signed
+}
+
+// Unsigned returns the number of inputs still waiting for a signature
+func (psbt *PSBT) Unsigned() int {
+	unsigned := 0
+	for _, in := range psbt.Inputs {
+		if in.ScriptSig == "" {
+			unsigned++
+		}
+	}
+
+	return unsigned
+}
+
+// CombinePSBTs merges the signatures of copies of a partially signed
+// transaction
+// Parameters:
+//   - psbts: The copies, all of the same transaction
+//
+// Returns:
+//   - *PSBT: The transaction with the signatures of every copy
+//   - error: If the copies are of different transactions or sign an input differently
+func CombinePSBTs(psbts []*PSBT) (*PSBT, error) {
+	if len(psbts) == 0 {
+		return nil, errors.New("nothing to combine")
+	}
+
+	combined := PSBT{psbts[0].Tx, append([]PSBTInput(nil), psbts[0].Inputs...)}
+	for n, psbt := range psbts[1:] {
+		if psbt.Tx != combined.Tx || len(psbt.Inputs) != len(combined.Inputs) {
+			return nil, fmt.Errorf("copy %d is of a different transaction", n+2)
+		}
+
+		for i, in := range psbt.Inputs {
+			merged := &combined.Inputs[i]
+			if in.PrevValue != merged.PrevValue || in.PrevAddress != merged.PrevAddress {
+				return nil, fmt.Errorf("copy %d describes the output input %d spends differently", n+2, i)
+			}
+
+			switch {
+			case in.ScriptSig == "":
+			case merged.ScriptSig == "":
+				merged.ScriptSig = in.ScriptSig
+			case in.ScriptSig != merged.ScriptSig:
+				return nil, fmt.Errorf("copy %d signs input %d differently", n+2, i)
+			}
+		}
+	}
+
+	return &combined, nil
+}
+
+// Finalize builds the signed transaction once every input is signed
+// Returns:
+//   - *Transaction: The transaction with its ID set
+func (psbt *PSBT) Finalize() (*Transaction, error) {
+	if unsigned := psbt.Unsigned(); unsigned > 0 {
+		return nil, fmt.Errorf("%d inputs are still unsigned", unsigned)
+	}
+
+	tx, err := psbt.transaction()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, in := range psbt.Inputs {
+		tx.Vin[i].ScriptSig = in.ScriptSig
+	}
+	tx.SetID()
+
+	return tx, nil
+}
+
+// transaction decodes the unsigned transaction and checks it has an input
+// for each spent output of the file
+func (psbt *PSBT) transaction() (*Transaction, error) {
+	tx, err := DecodeRawTransaction(psbt.Tx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tx.Vin) != len(psbt.Inputs) {
+		return nil, fmt.Errorf("transaction has %d inputs but %d spent outputs are described", len(tx.Vin), len(psbt.Inputs))
+	}
+	for i, in := range tx.Vin {
+		if in.ScriptSig != "" {
+			return nil, fmt.Errorf("input %d of the unsigned transaction is signed", i)
+		}
+	}
+
+	return tx, nil
+}
+
+// checkBalanced checks the transaction is well formed and the spent outputs
+// cover the value of the new outputs, the rest being the fee, so signers
+// know what they're paying
+func (psbt *PSBT) checkBalanced() error {
+	tx, err := psbt.transaction()
+	if err != nil {
+		return err
+	}
+
+	in, out := 0, 0
+	for _, input := range psbt.Inputs {
+		in += input.PrevValue
+	}
+	for _, output := range tx.Vout {
+		out += output.Value
+	}
+
+	if in < out {
+		return fmt.Errorf("outputs (%d) spend more than the inputs (%d)", out, in)
+	}
+
+	return nil
+}
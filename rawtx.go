@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Raw transactions are transactions encoded in hex as the Transaction message
+// of protocol.proto, like Bitcoin's, for scripts and external tools choosing
+// the outputs to spend themselves instead of leaving it to coin selection.
+// The workflow is:
+// 1. createrawtransaction builds an unsigned transaction from explicit inputs and outputs
+// 2. signrawtransaction unlocks the inputs spending outputs of the wallet
+// 3. sendrawtransaction validates it and adds it to the mempool or hands it to a node
+// Unsigned inputs have an empty ScriptSig. The ID changes as inputs are
+// signed, so it's recomputed whenever a raw transaction is decoded, and tools
+// building one can leave it out.
+
+// NewRawTransaction creates an unsigned transaction spending and creating
+// the given outputs
+// Parameters:
+//   - inputs: The outputs to spend, their ScriptSig is ignored
+//   - outputs: The new outputs
+//   - lockTime: Height or Unix time before which it can't be mined, see locktime.go
+//
+// Returns:
+//   - *Transaction: The transaction with its ID set
+func NewRawTransaction(inputs []TXInput, outputs []TXOutput, lockTime int64) (*Transaction, error) {
+	if len(inputs) == 0 || len(outputs) == 0 {
+		return nil, errors.New("transaction must have inputs and outputs")
+	}
+
+	spent := make(map[string]bool)
+	var vin []TXInput
+	for i, in := range inputs {
+		outpoint := outpointKey(hex.EncodeToString(in.Txid), in.Vout)
+		if spent[outpoint] {
+			return nil, fmt.Errorf("input %d spends output %s twice", i, outpoint)
+		}
+		spent[outpoint] = true
+		vin = append(vin, TXInput{in.Txid, in.Vout, ""})
+	}
+
+	for i, out := range outputs {
+		if out.IsDataCarrier() {
+			err := checkDataCarrier(out)
+			if err != nil {
+				return nil, fmt.Errorf("output %d: %w", i, err)
+			}
+		} else if out.Value <= 0 {
+			return nil, fmt.Errorf("output %d to %s has invalid value %d", i, out.ScriptPubKey, out.Value)
+		}
+	}
+
+	tx := Transaction{nil, vin, outputs, lockTime}
+	tx.SetID()
+
+	return &tx, nil
+}
+
+// EncodeRawTransaction encodes a transaction in hex
+func EncodeRawTransaction(tx *Transaction) string {
+	return hex.EncodeToString(marshalTransaction(tx))
+}
+
+// DecodeRawTransaction decodes a transaction encoded in hex and sets its ID
+// Parameters:
+//   - data: The hex encoded transaction
+func DecodeRawTransaction(data string) (*Transaction, error) {
+	encoded, err := hex.DecodeString(data)
+	if err != nil {
+		return nil, errors.New("transaction data isn't hex")
+	}
+
+	var tx Transaction
+	err = unmarshalTransaction(encoded, &tx)
+	if err != nil {
+		return nil, fmt.Errorf("transaction decode failed: %w", err)
+	}
+	if len(tx.Vin) == 0 || len(tx.Vout) == 0 {
+		return nil, errors.New("transaction must have inputs and outputs")
+	}
+
+	tx.SetID()
+	return &tx, nil
+}
+
+// SignRawTransaction unlocks the unsigned inputs of a raw transaction
+// spending outputs of an address or of its change addresses. Inputs spending
+// outputs of other addresses are left for their owners to sign, so
+// transactions paid for by several wallets are signed by each in turn.
+// Parameters:
+//   - tx: The transaction, whose ID is updated
+//   - from: The address whose outputs the wallet unlocks
+//   - UTXOSet: The UTXO set to look up the spent outputs in
+//   - wallet: The wallet tracking the change addresses of from
+//
+// Returns:
+//   - bool: Whether every input is now signed
+//   - error: If an input spends an output that's spent or missing
+func SignRawTransaction(tx *Transaction, from string, UTXOSet *UTXOSet, wallet *Wallet) (bool, error) {
+	complete := true
+
+	for i, in := range tx.Vin {
+		if in.ScriptSig != "" {
+			continue
+		}
+
+		prevOut, ok := UTXOSet.FindOutput(in.Txid, in.Vout)
+		if !ok {
+			return false, fmt.Errorf("input %d spends output %x:%d which is spent or missing", i, in.Txid, in.Vout)
+		}
+		if !wallet.IsOwnAddress(from, prevOut.ScriptPubKey) {
+			complete = false
+			continue
+		}
+
+		// Unlock the spent output with the address that owns it
+		tx.Vin[i].ScriptSig = prevOut.ScriptPubKey
+	}
+
+	tx.SetID()
+	return complete, nil
+}
+
+// parseOutpoints parses the comma separated TXID:VOUT outputs a raw
+// transaction spends
+func parseOutpoints(value string) ([]TXInput, error) {
+	var inputs []TXInput
+	for _, item := range splitList(value) {
+		txIDHex, voutStr, ok := strings.Cut(item, ":")
+		txID, err := hex.DecodeString(txIDHex)
+		if !ok || err != nil || len(txID) == 0 {
+			return nil, fmt.Errorf("invalid input %q, expected TXID:VOUT", item)
+		}
+		vout, err := strconv.Atoi(voutStr)
+		if err != nil || vout < 0 {
+			return nil, fmt.Errorf("invalid output index in input %q", item)
+		}
+
+		inputs = append(inputs, TXInput{txID, vout, ""})
+	}
+
+	return inputs, nil
+}
+
+// parsePayments parses the comma separated ADDRESS:AMOUNT outputs of a raw
+// transaction. Addresses are any string, so the amount follows the last colon.
+func parsePayments(value string) ([]TXOutput, error) {
+	var outputs []TXOutput
+	for _, item := range splitList(value) {
+		i := strings.LastIndex(item, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid output %q, expected ADDRESS:AMOUNT", item)
+		}
+		amount, err := strconv.Atoi(item[i+1:])
+		if err != nil || amount <= 0 {
+			return nil, fmt.Errorf("invalid amount in output %q", item)
+		}
+
+		outputs = append(outputs, TXOutput{amount, item[:i], nil, 0})
+	}
+
+	return outputs, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"slices"
+)
+
+// A new transaction spending an output that a pool transaction already spends
+// replaces it, like Bitcoin Core's full replace-by-fee: transactions don't
+// signal whether they may be replaced, any pool transaction can be. A
+// replacement must pay a higher fee rate than each transaction it replaces,
+// and more fee than all of them together, so that replacing transactions
+// back and forth costs the sender and relaying them isn't free. Pool
+// transactions never spend each other's outputs, so the replaced transactions
+// leave no descendants behind. bumpfee builds such a replacement for a wallet
+// transaction stuck with too low a fee.
+
+// maxReplacements is the most pool transactions one transaction may replace,
+// like BIP 125
+const maxReplacements = 100
+
+// mempoolConflicts returns the pool transactions spending an output a new
+// transaction spends
+// Parameters:
+//   - spent: The mempoolspent bucket
+//   - transaction: The new transaction
+//
+// Returns:
+//   - [][]byte: IDs of the pool transactions, each once
+func mempoolConflicts(spent StoreBucket, transaction *Transaction) [][]byte {
+	var conflicts [][]byte
+	seen := make(map[string]bool)
+	for _, in := range transaction.Vin {
+		other := spent.Get([]byte(outpointKey(hex.EncodeToString(in.Txid), in.Vout)))
+		if other == nil || seen[string(other)] {
+			continue
+		}
+
+		seen[string(other)] = true
+		conflicts = append(conflicts, append([]byte(nil), other...))
+	}
+
+	return conflicts
+}
+
+// replacementFee returns the least fee a replacement must pay: the fees of
+// the transactions it replaces plus its own size at the minimum relay fee
+// rate, and at least a coin more
+// Parameters:
+//   - replacedFees: Sum of the fees of the transactions it replaces
+//   - size: Serialized size of the replacement
+func replacementFee(replacedFees, size int) int {
+	return replacedFees + max(1, (minRelayFee*size+999)/1000)
+}
+
+// checkReplacement checks that a new transaction pays enough to replace the
+// pool transactions it conflicts with: a higher fee rate than each of them,
+// and at least replacementFee
+// Parameters:
+//   - tx: The database transaction adding the new transaction
+//   - transaction: The new transaction
+//   - conflicts: IDs of the pool transactions it replaces, see mempoolConflicts
+func checkReplacement(tx StoreTx, transaction *Transaction, conflicts [][]byte) error {
+	if len(conflicts) == 0 {
+		return nil
+	}
+	if len(conflicts) > maxReplacements {
+		return fmt.Errorf("it would replace %d transactions, more than %d", len(conflicts), maxReplacements)
+	}
+
+	lookup := chainStateLookup(tx, nil)
+	fee := transactionFee(lookup, transaction)
+	size := len(transaction.Serialize())
+
+	pool := tx.Bucket([]byte(mempoolBucket))
+	replacedFees := 0
+	for _, id := range conflicts {
+		replaced := deserializeMempoolEntry(pool.Get(id)).Tx
+		replacedFee := transactionFee(lookup, replaced)
+		replacedSize := len(replaced.Serialize())
+		// Compare fee/size rates by cross-multiplying
+		if fee*replacedSize <= replacedFee*size {
+			return fmt.Errorf("its fee of %d for %d bytes doesn't pay a higher fee rate than the fee of %d for %d bytes of %x", fee, size, replacedFee, replacedSize, id)
+		}
+		replacedFees += replacedFee
+	}
+
+	if least := replacementFee(replacedFees, size); fee < least {
+		return fmt.Errorf("its fee of %d doesn't pay for replacing them, it must be at least %d", fee, least)
+	}
+
+	return nil
+}
+
+// NewFeeBumpTransaction rebuilds a pending transaction of the wallet with a
+// higher fee, to replace it in the mempool. The payments stay the same, and
+// the extra fee comes out of the change, with more outputs of the sender
+// selected when the change can't cover it. Change left as dust goes to the
+// miner, like in NewUTXOTransaction.
+// Parameters:
+//   - original: The pending transaction
+//   - fee: The new fee, 0 for twice the old fee or replacementFee if it's higher
+//   - UTXOSet: The UTXO set the original spends from
+//   - wallet: The wallet of the sender
+//
+// Returns:
+//   - *Transaction: The signed replacement
+//   - error: Why the transaction can't be bumped
+func NewFeeBumpTransaction(original *Transaction, fee int, UTXOSet *UTXOSet, wallet *Wallet) (*Transaction, error) {
+	from := ""
+	for _, owner := range wallet.Owners() {
+		owns := true
+		for _, in := range original.Vin {
+			owns = owns && wallet.IsOwnAddress(owner, in.ScriptSig)
+		}
+		if owns {
+			from = owner
+			break
+		}
+	}
+	if from == "" || len(original.Vin) == 0 {
+		return nil, fmt.Errorf("transaction %x doesn't spend outputs of one address of the wallet", original.ID)
+	}
+
+	oldFee := 0
+	for _, in := range original.Vin {
+		prevOut, ok := UTXOSet.FindOutput(in.Txid, in.Vout)
+		if !ok {
+			return nil, fmt.Errorf("transaction %x spends output %x:%d, which is no longer unspent", original.ID, in.Txid, in.Vout)
+		}
+		oldFee += prevOut.Value
+	}
+	change := -1
+	for i, out := range original.Vout {
+		oldFee -= out.Value
+		if change < 0 && out.NFT == nil && out.LockHeight == 0 && out.ScriptPubKey != from && wallet.IsOwnAddress(from, out.ScriptPubKey) {
+			change = i
+		}
+	}
+
+	least := replacementFee(oldFee, len(original.Serialize()))
+	if fee == 0 {
+		fee = max(2*oldFee, least)
+	}
+	if fee < least {
+		return nil, fmt.Errorf("a fee of %d doesn't pay for replacing transaction %x, whose fee is %d: it must be at least %d", fee, original.ID, oldFee, least)
+	}
+
+	inputs := append([]TXInput(nil), original.Vin...)
+	var outputs []TXOutput
+	for i, out := range original.Vout {
+		if i != change {
+			outputs = append(outputs, out)
+		}
+	}
+
+	if change < 0 {
+		added, acc := selectFunds(from, fee-oldFee, "", UTXOSet, wallet)
+		inputs = append(inputs, added...)
+		outputs = append(outputs, changeOutputs(from, acc-(fee-oldFee), wallet)...)
+	} else {
+		changeOut := original.Vout[change]
+		changeOut.Value -= fee - oldFee
+		if changeOut.Value < 0 {
+			added, acc := selectFunds(from, -changeOut.Value, "", UTXOSet, wallet)
+			inputs = append(inputs, added...)
+			changeOut.Value += acc
+		}
+		if changeOut.Value > 0 && !changeOut.IsDust() {
+			// Keep the change where it was, at the same address
+			outputs = slices.Insert(outputs, change, changeOut)
+		}
+	}
+
+	tx := Transaction{nil, inputs, outputs, original.LockTime}
+	tx.SetID()
+
+	return &tx, nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+)
+
+// The chain state is updated in the same database transaction as the tip, so
+// the two only disagree once the database file is damaged, by a failing disk
+// or a file copied while it was written. NewBlockchain checks the tip when a
+// chain is opened, see checkTip: its block must decode, its proof of work must
+// be valid and the chain state must be the one of the tip, as recorded under
+// metaChainStateTipKey. Otherwise the chain is recovered at the last block of
+// the height index passing the checks: the damaged blocks above it are
+// deleted, the chain state is rolled back to it with the undo data, or rebuilt
+// from the blocks if that fails, and the node carries on from there, getting
+// the rest of the chain from its peers again.
+
+// storeChainStateTip records the block the chain state was built up to
+// Parameters:
+//   - tx: The database transaction updating the chain state
+//   - hash: Hash of the block
+func storeChainStateTip(tx StoreTx, hash []byte) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte(metaChainStateTipKey), hash)
+}
+
+// readChainStateTip returns the block the chain state was built up to, nil for
+// databases created before it was recorded
+func readChainStateTip(tx StoreTx) []byte {
+	b := tx.Bucket([]byte(metaBucket))
+	if b == nil {
+		return nil
+	}
+
+	return b.Get([]byte(metaChainStateTipKey))
+}
+
+// readBlock reads a stored block like getBlock, failing instead of panicking
+// if it's missing, doesn't decode, has invalid proof of work or transactions
+// not matching its header
+// Parameters:
+//   - tx: The database transaction
+//   - hash: Hash of the block
+func readBlock(tx StoreTx, hash []byte) (*Block, error) {
+	data := tx.Bucket([]byte(blocksBucket)).Get(hash)
+	if data == nil {
+		return nil, fmt.Errorf("block %x not found", hash)
+	}
+
+	block, err := decodeBlock(data)
+	if err != nil {
+		return nil, fmt.Errorf("block %x doesn't decode: %w", hash, err)
+	}
+	if !bytes.Equal(block.Hash, hash) || !NewProofOfWork(block).Validate() {
+		return nil, fmt.Errorf("block %x has invalid proof of work", hash)
+	}
+
+	// Pruned blocks have no body
+	body := tx.Bucket([]byte(bodiesBucket)).Get(hash)
+	if body == nil {
+		return block, nil
+	}
+
+	transactions, err := decodeBody(body)
+	if err != nil {
+		return nil, fmt.Errorf("transactions of block %x don't decode: %w", hash, err)
+	}
+	root := block.MerkleRoot
+	block.Transactions = transactions
+	block.MerkleRoot = nil
+	if !bytes.Equal(block.HashTransactions(), root) {
+		return nil, fmt.Errorf("transactions of block %x don't match its header", hash)
+	}
+
+	return block, nil
+}
+
+// checkTip makes sure the tip and the chain state are intact, recovering the
+// chain if they aren't
+// Parameters:
+//   - hasChainState: Whether the chain state exists, databases without one
+//     only get their tip checked before it's built
+func (bc *Blockchain) checkTip(hasChainState bool) {
+	recorded := true
+	err := bc.db.View(func(tx StoreTx) error {
+		_, err := readBlock(tx, bc.tip)
+		if err != nil {
+			return err
+		}
+
+		state := readChainStateTip(tx)
+		recorded = state != nil
+		if hasChainState && recorded && !bytes.Equal(state, bc.tip) {
+			return fmt.Errorf("the chain state is at block %x, not at the tip %x", state, bc.tip)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("The blockchain is damaged", "err", err)
+		bc.recoverChain()
+		return
+	}
+
+	// Databases created before the block of the chain state was recorded
+	// start recording it now
+	if hasChainState && !recorded {
+		err = bc.db.Update(func(tx StoreTx) error {
+			return storeChainStateTip(tx, bc.tip)
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+}
+
+// recoverChain makes the last intact block of the height index the tip,
+// deleting the damaged blocks above it and rolling the chain state back to it
+func (bc *Blockchain) recoverChain() {
+	var good *Block
+	var damaged [][]byte
+
+	err := bc.db.View(func(tx StoreTx) error {
+		var hashes [][]byte
+		err := tx.Bucket([]byte(heightsBucket)).ForEach(func(k, v []byte) error {
+			hashes = append(hashes, bytes.Clone(v))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if _, err := readBlock(tx, bc.tip); err != nil {
+			damaged = append(damaged, bytes.Clone(bc.tip))
+		}
+		for i := len(hashes) - 1; i >= 0 && good == nil; i-- {
+			block, err := readBlock(tx, hashes[i])
+			if err == nil {
+				good = block
+			} else {
+				damaged = append(damaged, hashes[i])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	if good == nil {
+		fmt.Printf("No intact block found in %s, restore a backup with restore.\n", dbFile)
+		os.Exit(1)
+	}
+
+	err = bc.db.Update(func(tx StoreTx) error {
+		blocks := tx.Bucket([]byte(blocksBucket))
+
+		// Disconnect the blocks the chain state is built on, down to the intact one
+		state := bytes.Clone(readChainStateTip(tx))
+		if state == nil {
+			return errors.New("the block of the chain state isn't recorded")
+		}
+		for !bytes.Equal(state, good.Hash) {
+			block, err := readBlock(tx, state)
+			if err != nil {
+				return err
+			}
+			if block.Height <= good.Height {
+				return fmt.Errorf("the chain state is at block %x, on another branch", state)
+			}
+
+			err = disconnectBlock(tx, block)
+			if err != nil {
+				return err
+			}
+			state = block.PrevBlockHash
+		}
+
+		err := deleteBlocks(tx, damaged, good.Hash)
+		if err != nil {
+			return err
+		}
+
+		return blocks.Put([]byte("l"), good.Hash)
+	})
+	if err == nil {
+		bc.tip = good.Hash
+		slog.Info("Recovered the blockchain", hashAttr("hash", good.Hash), "height", good.Height)
+		return
+	}
+
+	// The undo data can't roll the chain state back, so it's built again
+	slog.Warn("Rolling the chain state back failed", "err", err)
+	err = bc.checkUnpruned("Rebuilding the chain state")
+	if err != nil {
+		fmt.Printf("%v, restore a backup with restore.\n", err)
+		os.Exit(1)
+	}
+
+	err = bc.db.Update(func(tx StoreTx) error {
+		err := deleteBlocks(tx, damaged, good.Hash)
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket([]byte(blocksBucket)).Put([]byte("l"), good.Hash)
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	bc.tip = good.Hash
+
+	bc.reindexChainState()
+	slog.Info("Rebuilt the chain state", hashAttr("hash", good.Hash), "height", good.Height)
+}
+
+// deleteBlocks removes damaged blocks with their bodies and chain work, so
+// they're downloaded again. The intact block they were found above is kept.
+// Parameters:
+//   - tx: The database transaction
+//   - hashes: Hashes of the damaged blocks
+//   - keep: Hash of the intact block
+func deleteBlocks(tx StoreTx, hashes [][]byte, keep []byte) error {
+	for _, hash := range hashes {
+		if bytes.Equal(hash, keep) {
+			continue
+		}
+
+		for _, bucket := range []string{blocksBucket, bodiesBucket, chainWorkBucket} {
+			if b := tx.Bucket([]byte(bucket)); b != nil {
+				err := b.Delete(hash)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"slices"
+)
+
+// undoBucket maps the hash of every connected block to the outputs it spent,
+// keyed by outpoint, so the block can be disconnected again in a
+// reorganization. The UTXO set doesn't keep spent outputs, and without them
+// the block's inputs couldn't be restored.
+const undoBucket = "undo"
+
+// errNoUndoData is returned when disconnecting a block connected before undo
+// data was stored
+var errNoUndoData = errors.New("no undo data")
+
+// storeUndoData records the outputs spent by a block being connected
+// Parameters:
+//   - tx: The database transaction connecting the block
+//   - block: The block
+//   - spent: The outputs spent by the block, see findSpentOutputs
+func storeUndoData(tx StoreTx, block *Block, spent map[string]TXOutput) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(undoBucket))
+	if err != nil {
+		return err
+	}
+
+	var buff bytes.Buffer
+	err = gob.NewEncoder(&buff).Encode(spent)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(block.Hash, buff.Bytes())
+}
+
+// readUndoData reads the outputs spent by a connected block
+func readUndoData(tx StoreTx, block *Block) (map[string]TXOutput, error) {
+	var data []byte
+	if b := tx.Bucket([]byte(undoBucket)); b != nil {
+		data = b.Get(block.Hash)
+	}
+	if data == nil {
+		return nil, fmt.Errorf("block %x: %w", block.Hash, errNoUndoData)
+	}
+
+	var spent map[string]TXOutput
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&spent)
+	if err != nil {
+		return nil, err
+	}
+
+	return spent, nil
+}
+
+// disconnectBlock reverts what connectBlock did for the tip of the active
+// chain: its height and transactions are unindexed, the outputs it created
+// are removed from the UTXO set, address index and balance cache, the
+// outputs it spent are restored to them and its contract calls are reverted.
+// The block itself stays stored.
+// Parameters:
+//   - tx: The database transaction
+//   - block: The tip of the active chain
+func disconnectBlock(tx StoreTx, block *Block) error {
+	spent, err := readUndoData(tx, block)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket([]byte(heightsBucket)).Delete(heightKey(block.Height))
+	if err != nil {
+		return err
+	}
+
+	txIndex := tx.Bucket([]byte(txIndexBucket))
+	utxos := tx.Bucket([]byte(utxoBucket))
+	addresses := tx.Bucket([]byte(addressIndexBucket))
+	balances := tx.Bucket([]byte(balancesBucket))
+
+	// Outputs created and spent within the block were never in the UTXO set
+	created := make(map[string]bool)
+	for _, transaction := range block.Transactions {
+		created[hex.EncodeToString(transaction.ID)] = true
+	}
+
+	for _, transaction := range block.Transactions {
+		err = txIndex.Delete(transaction.ID)
+		if err != nil {
+			return err
+		}
+
+		err = utxos.Delete(transaction.ID)
+		if err != nil {
+			return err
+		}
+
+		for outIdx, out := range transaction.Vout {
+			err = addresses.Delete(addressIndexKey(out.ScriptPubKey, transaction.ID, outIdx))
+			if err != nil {
+				return err
+			}
+
+			err = addBalance(balances, out.ScriptPubKey, -out.Value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, transaction := range block.Transactions {
+		if transaction.IsCoinbase() {
+			continue
+		}
+
+		for _, vin := range transaction.Vin {
+			if created[hex.EncodeToString(vin.Txid)] {
+				continue
+			}
+			out, ok := spent[outpointKey(hex.EncodeToString(vin.Txid), vin.Vout)]
+			if !ok {
+				continue
+			}
+
+			outs := TXOutputs{make(map[int]TXOutput)}
+			if data := utxos.Get(vin.Txid); data != nil {
+				outs = DeserializeOutputs(data)
+			}
+			outs.Outputs[vin.Vout] = out
+
+			err = utxos.Put(vin.Txid, outs.Serialize())
+			if err != nil {
+				return err
+			}
+
+			err = addresses.Put(addressIndexKey(out.ScriptPubKey, vin.Txid, vin.Vout), serializeOutput(out))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, out := range spent {
+		err = addBalance(balances, out.ScriptPubKey, out.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = disconnectContracts(tx, block)
+	if err != nil {
+		return err
+	}
+
+	err = storeChainStateTip(tx, block.PrevBlockHash)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket([]byte(undoBucket)).Delete(block.Hash)
+}
+
+// reorganize switches the active chain to the branch ending with a given tip.
+// The blocks of the active chain past the fork point are disconnected, and
+// the blocks of the new branch validated and connected, all in one database
+// transaction: if a block of the new branch is invalid, the active chain is
+// left untouched. The transactions of the disconnected blocks go back to the
+// mempool, unless the new branch contains them too.
+// Active chains connected before undo data was stored can't be disconnected
+// block by block. Rewinding them to an earlier block of the active chain
+// rebuilds the chain state for it instead, but a new branch is refused, since
+// a rebuild wouldn't validate its blocks.
+// Parameters:
+//   - tree: The block tree
+//   - best: Hash of the new tip
+//
+// Returns:
+//   - []byte: Hash of the invalid block if the new branch has one
+func (bc *Blockchain) reorganize(tree *blockTree, best string) ([]byte, error) {
+	// The fork point is the last block of the new branch on the active chain
+	fork := best
+	var connect []string
+	for ; !tree.active[fork]; fork = tree.parents[fork] {
+		connect = append(connect, fork)
+	}
+	slices.Reverse(connect)
+
+	var disconnect []string
+	for hash := tree.activeID; hash != fork; hash = tree.parents[hash] {
+		disconnect = append(disconnect, hash)
+	}
+
+	bestHash, err := hex.DecodeString(best)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var disconnected []*Block
+	var bad []byte
+	err = bc.db.Update(func(tx StoreTx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		disconnected = nil
+
+		for _, id := range disconnect {
+			key, err := hex.DecodeString(id)
+			if err != nil {
+				return err
+			}
+			block := getBlock(tx, key)
+			// The branch forks off below the pruned height, see prune.go
+			if block.IsPruned() {
+				bad, err = hex.DecodeString(connect[0])
+				if err != nil {
+					return err
+				}
+				return fmt.Errorf("it forks off below pruned block %x", block.Hash)
+			}
+
+			err = disconnectBlock(tx, block)
+			if err != nil {
+				return err
+			}
+			disconnected = append(disconnected, block)
+		}
+
+		key, err := hex.DecodeString(fork)
+		if err != nil {
+			return err
+		}
+		parent := DeserializeBlock(b.Get(key))
+
+		for _, id := range connect {
+			key, err := hex.DecodeString(id)
+			if err != nil {
+				return err
+			}
+			block := getBlock(tx, key)
+
+			err = validateBlock(tx, block, parent)
+			if err != nil {
+				bad = block.Hash
+				return err
+			}
+
+			err = connectBlock(tx, block)
+			if err != nil {
+				return err
+			}
+			parent = block
+		}
+
+		return b.Put([]byte("l"), bestHash)
+	})
+	if errors.Is(err, errNoUndoData) {
+		if len(connect) > 0 {
+			bad, err := hex.DecodeString(connect[0])
+			if err != nil {
+				log.Panic(err)
+			}
+			return bad, fmt.Errorf("it forks off below blocks that can't be disconnected: %w", errNoUndoData)
+		}
+
+		slog.Warn("Rebuilding the chain state for the new tip", "tip", best, "err", err)
+		bc.rebuildForTip(bestHash)
+		return nil, nil
+	}
+	if err != nil {
+		return bad, err
+	}
+	bc.tip = bestHash
+
+	slog.Info("Reorganized the chain", "from", tree.activeID, "to", best, "fork", fork, "disconnected", len(disconnect), "connected", len(connect))
+
+	// Return the disconnected transactions oldest first, so parents go before their children
+	mempool := Mempool{bc}
+	for i := len(disconnected) - 1; i >= 0; i-- {
+		for _, transaction := range disconnected[i].Transactions {
+			if transaction.IsCoinbase() {
+				continue
+			}
+
+			err = mempool.Add(transaction)
+			if err != nil && !errors.Is(err, errKnownTransaction) {
+				slog.Warn("Dropped transaction of disconnected block", hashAttr("txid", transaction.ID), hashAttr("block", disconnected[i].Hash), "err", err)
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// rebuildForTip makes a block the active tip and rebuilds the chain state
+// from scratch
+func (bc *Blockchain) rebuildForTip(hash []byte) {
+	err := bc.db.Update(func(tx StoreTx) error {
+		return tx.Bucket([]byte(blocksBucket)).Put([]byte("l"), hash)
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	bc.tip = hash
+
+	bc.reindexChainState()
+}
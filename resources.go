@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The memory and CPU a node uses are bounded by -utxocachesize,
+// -blockcache, -mempoolmaxsize and -validationworkers. Their defaults are
+// derived from the memory of the machine, or of its container when that's
+// lower, so a node fits a small VPS or a classroom laptop as well as a
+// server: the caches and the mempool together take at most about a tenth of
+// it. The caches only hold decoded copies of what the database stores, so
+// they can be shrunk or turned off with 0 without changing any result.
+
+// defaultMemory is the memory assumed when the system doesn't tell, as on
+// systems without /proc
+const defaultMemory = 1 << 30
+
+// blockCacheEntrySize is the memory a decoded block is assumed to take, for
+// the default of -blockcache: a full block of 1 MB decodes to a few MB
+const blockCacheEntrySize = 4 << 20
+
+// systemMemory is the memory of the machine or of its container, in bytes
+var systemMemory = detectMemory()
+
+// Limits of the caches, set with -utxocachesize, -blockcache and
+// -validationworkers. The mempool limits are in mempool.go.
+var (
+	utxoCacheSize     = min(max(systemMemory/32, 4<<20), 512<<20)             // Most bytes of decoded UTXO set entries cached
+	blockCacheEntries = min(max(systemMemory/32/blockCacheEntrySize, 4), 256) // Most decoded blocks cached
+	validationWorkers = max(min(runtime.NumCPU(), systemMemory/(128<<20)), 1) // Goroutines checking the transactions of a block
+	utxoCache         = newLRUCache(utxoCacheSize)                            // Decoded entries of the UTXO set, see cachedOutputs
+	blockCache        = newLRUCache(blockCacheEntries)                        // Decoded transactions of blocks, see cachedTransactions
+)
+
+// detectMemory returns the memory of the machine, from /proc/meminfo, or the
+// memory limit of its cgroup if that's lower, defaultMemory if neither can
+// be read
+func detectMemory() int {
+	memory := 0
+
+	file, err := os.Open("/proc/meminfo")
+	if err == nil {
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 3 && fields[0] == "MemTotal:" && fields[2] == "kB" {
+				kb, err := strconv.Atoi(fields[1])
+				if err == nil {
+					memory = kb << 10
+				}
+				break
+			}
+		}
+	}
+
+	// cgroup v2, then v1, whose unlimited value is a huge number
+	for _, path := range []string{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes"} {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err == nil && limit > 0 && (memory == 0 || limit < memory) {
+			memory = limit
+		}
+		break
+	}
+
+	if memory == 0 {
+		return defaultMemory
+	}
+	return memory
+}
+
+// setCacheLimits replaces the caches with empty ones of new capacities,
+// before the blockchain is opened
+// Parameters:
+//   - utxoBytes: Most bytes of UTXO set entries cached, 0 for no cache
+//   - blocks: Most blocks cached, 0 for no cache
+func setCacheLimits(utxoBytes, blocks int) {
+	utxoCacheSize, blockCacheEntries = utxoBytes, blocks
+	utxoCache = newLRUCache(utxoBytes)
+	blockCache = newLRUCache(blocks)
+}
+
+// lruCache caches values by key, evicting the least recently used ones once
+// their costs add up to more than its capacity. It's safe for concurrent use.
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int                      // Most cost held, nothing is cached at 0
+	cost     int                      // Cost of the entries held
+	order    *list.List               // The entries, most recently used first
+	entries  map[string]*list.Element // Key -> element of order holding its *lruEntry
+}
+
+// lruEntry is a value of an lruCache
+type lruEntry struct {
+	key   string
+	value any
+	cost  int
+}
+
+// newLRUCache creates an empty cache
+// Parameters:
+//   - capacity: Most cost the cache holds, 0 to cache nothing
+func newLRUCache(capacity int) *lruCache {
+	return &lruCache{capacity: capacity, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// Get returns the value cached for a key, marking it as the most recently used
+func (c *lruCache) Get(key string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+
+	return element.Value.(*lruEntry).value, true
+}
+
+// Add caches a value, replacing the one cached for its key, and evicts the
+// least recently used values that no longer fit. A value costing more than
+// the capacity isn't cached.
+// Parameters:
+//   - key: The key
+//   - value: The value
+//   - cost: What the value takes from the capacity, like its size in bytes
+func (c *lruCache) Add(key string, value any, cost int) {
+	if cost > c.capacity {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.cost -= element.Value.(*lruEntry).cost
+		c.order.Remove(element)
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key, value, cost})
+	c.cost += cost
+
+	for c.cost > c.capacity {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*lruEntry)
+		c.order.Remove(oldest)
+		delete(c.entries, entry.key)
+		c.cost -= entry.cost
+	}
+}
+
+// cachedUTXOs is an entry of the UTXO set decoded once, along with the
+// encoded entry it was decoded from
+type cachedUTXOs struct {
+	data    []byte
+	outputs TXOutputs
+}
+
+// cachedOutputs decodes an entry of the UTXO set through utxoCache. The
+// cache is checked against the encoded entry read from the database, so it
+// never returns outputs that were spent or replaced since, whatever
+// transaction changed them. The outputs returned must not be modified.
+// Parameters:
+//   - txID: ID of the transaction whose unspent outputs the entry holds
+//   - data: The encoded entry, see TXOutputs.Serialize
+func cachedOutputs(txID, data []byte) TXOutputs {
+	key := string(txID)
+	if cached, ok := utxoCache.Get(key); ok && bytes.Equal(cached.(cachedUTXOs).data, data) {
+		return cached.(cachedUTXOs).outputs
+	}
+
+	outputs := DeserializeOutputs(data)
+	// Decoded outputs take about as much as their encoding, on top of it
+	utxoCache.Add(key, cachedUTXOs{bytes.Clone(data), outputs}, 2*len(data)+len(key))
+
+	return outputs
+}
+
+// cachedBody is the body of a block decoded once, with the size of the
+// stored body, which archiving changes
+type cachedBody struct {
+	size         int
+	transactions []*Transaction
+}
+
+// cachedTransactions decodes the body of a block through blockCache. The
+// transactions of a block never change, as its hash commits to them, but
+// archiving recompresses the body, which is then decoded again.
+// Parameters:
+//   - hash: Hash of the block
+//   - body: The stored body, see bodiesBucket
+func cachedTransactions(hash, body []byte) ([]*Transaction, error) {
+	key := string(hash)
+	if cached, ok := blockCache.Get(key); ok && cached.(cachedBody).size == len(body) {
+		return slices.Clone(cached.(cachedBody).transactions), nil
+	}
+
+	transactions, err := decodeBody(body)
+	if err != nil {
+		return nil, err
+	}
+	blockCache.Add(key, cachedBody{len(body), transactions}, 1)
+
+	return slices.Clone(transactions), nil
+}
+
+// checkTransactionIDs checks the IDs of transactions with checkTransactionID,
+// the hashing spread over validationWorkers goroutines
+// Parameters:
+//   - transactions: The transactions, such as those of a block
+//
+// Returns:
+//   - error: Why the first transaction with an invalid ID is invalid
+func checkTransactionIDs(transactions []*Transaction) error {
+	errs := make([]error, len(transactions))
+	workers := min(max(validationWorkers, 1), len(transactions))
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(start int) {
+			defer wg.Done()
+			for i := start; i < len(transactions); i += workers {
+				errs[i] = checkTransactionID(transactions[i])
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,717 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// JSON-RPC 2.0 error codes. The codes below -32000 are defined by the
+// specification, the others are the ones bitcoind uses for the same errors.
+const (
+	rpcParseError       = -32700 // The request isn't valid JSON
+	rpcInvalidRequest   = -32600 // The request isn't a valid request object
+	rpcMethodNotFound   = -32601 // Unknown method
+	rpcInvalidParams    = -32602 // Wrong number or type of parameters
+	rpcInternalError    = -32603 // The method failed
+	rpcInvalidParameter = -8     // A parameter has an invalid value
+	rpcNotFound         = -5     // No block or transaction with the given hash or ID
+	rpcVerifyRejected   = -26    // The transaction was rejected
+	rpcInWarmup         = -28    // The node has no chain yet
+)
+
+// rpcRequest is a JSON-RPC 2.0 request
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"` // Positional params, an array
+	ID      json.RawMessage `json:"id"`     // Absent for notifications, which get no response
+}
+
+// rpcResponse is a JSON-RPC 2.0 response
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// rpcError is the error of a failed JSON-RPC request
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// rpcMethod runs an RPC method against the chain, holding the API lock
+type rpcMethod func(bc *Blockchain, params []json.RawMessage) (any, error)
+
+// rpcMethods are the supported methods, named and shaped like the bitcoind
+// methods so existing tooling can be pointed at a node. sendtoaddress,
+// sendrawtransaction and submitblock relay what they get, so they're handled
+// separately.
+var rpcMethods = map[string]rpcMethod{
+	"getblockcount":        rpcGetBlockCount,
+	"getbestblockhash":     rpcGetBestBlockHash,
+	"getblockhash":         rpcGetBlockHash,
+	"getblock":             rpcGetBlock,
+	"getrawtransaction":    rpcGetRawTransaction,
+	"getbalance":           rpcGetBalance,
+	"getblockstats":        rpcGetBlockStats,
+	"getchaintips":         rpcGetChainTips,
+	"getrawmempool":        rpcGetRawMempool,
+	"getmempoolinfo":       rpcGetMempoolInfo,
+	"getblocktemplate":     rpcGetBlockTemplate,
+	"getmininginfo":        rpcGetMiningInfo,
+	"createrawtransaction": rpcCreateRawTransaction,
+	"signrawtransaction":   rpcSignRawTransaction,
+}
+
+// The RPC server answers POST requests to / with a single request object, or
+// a batch: an array of request objects answered with an array of responses.
+// Params are positional.
+
+// handleRPC answers a JSON-RPC request or batch
+func (a *APIServer) handleRPC(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, rpcResponse{JSONRPC: "2.0", Error: &rpcError{rpcParseError, err.Error()}, ID: json.RawMessage("null")})
+		return
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var batch []json.RawMessage
+		err = json.Unmarshal(body, &batch)
+		if err != nil {
+			writeJSON(w, http.StatusOK, rpcResponse{JSONRPC: "2.0", Error: &rpcError{rpcParseError, err.Error()}, ID: json.RawMessage("null")})
+			return
+		}
+		if len(batch) == 0 {
+			writeJSON(w, http.StatusOK, rpcResponse{JSONRPC: "2.0", Error: &rpcError{rpcInvalidRequest, "empty batch"}, ID: json.RawMessage("null")})
+			return
+		}
+
+		responses := []rpcResponse{}
+		for _, raw := range batch {
+			resp, ok := a.callRPC(raw)
+			if ok {
+				responses = append(responses, resp)
+			}
+		}
+
+		// A batch of notifications only gets no content back
+		if len(responses) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, http.StatusOK, responses)
+		return
+	}
+
+	resp, ok := a.callRPC(body)
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// callRPC decodes and runs a single request
+// Returns:
+//   - rpcResponse: The response
+//   - bool: false for a notification, which gets no response
+func (a *APIServer) callRPC(raw json.RawMessage) (rpcResponse, bool) {
+	resp := rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null")}
+
+	var req rpcRequest
+	err := json.Unmarshal(raw, &req)
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			resp.Error = &rpcError{rpcParseError, err.Error()}
+		} else {
+			resp.Error = &rpcError{rpcInvalidRequest, err.Error()}
+		}
+		return resp, true
+	}
+	if req.ID != nil {
+		resp.ID = req.ID
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		resp.Error = &rpcError{rpcInvalidRequest, `request must have "jsonrpc": "2.0" and a method`}
+		return resp, true
+	}
+
+	var params []json.RawMessage
+	if len(req.Params) > 0 && string(req.Params) != "null" {
+		err = json.Unmarshal(req.Params, &params)
+		if err != nil {
+			resp.Error = &rpcError{rpcInvalidParams, "params must be an array, named params are not supported"}
+			return resp, req.ID != nil
+		}
+	}
+
+	result, err := a.runRPC(req.Method, params)
+	if req.ID == nil {
+		return resp, false
+	}
+	if err == nil {
+		resp.Result, err = json.Marshal(result)
+	}
+	if err != nil {
+		resp.Error = toRPCError(err)
+		return resp, true
+	}
+
+	return resp, true
+}
+
+// runRPC runs a method. A method panicking, for example when a wallet has too
+// little funds for sendtoaddress, fails the request instead of the server.
+func (a *APIServer) runRPC(method string, params []json.RawMessage) (result any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &rpcError{rpcInternalError, fmt.Sprint(r)}
+		}
+	}()
+
+	switch method {
+	case "sendtoaddress":
+		return a.rpcSendToAddress(params)
+	case "bumpfee":
+		return a.rpcBumpFee(params)
+	case "sendrawtransaction":
+		return a.rpcSendRawTransaction(params)
+	case "submitblock":
+		return a.rpcSubmitBlock(params)
+	}
+
+	fn, ok := rpcMethods[method]
+	if !ok {
+		return nil, &rpcError{rpcMethodNotFound, fmt.Sprintf("method %q not found", method)}
+	}
+
+	return a.withChain(func(bc *Blockchain) (any, error) {
+		return fn(bc, params)
+	})
+}
+
+// toRPCError converts an error of a method to a JSON-RPC error
+func toRPCError(err error) *rpcError {
+	var rpcErr *rpcError
+	if errors.As(err, &rpcErr) {
+		return rpcErr
+	}
+	if errors.Is(err, errNoChain) {
+		return &rpcError{rpcInWarmup, err.Error()}
+	}
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		switch apiErr.status {
+		case http.StatusNotFound:
+			return &rpcError{rpcNotFound, err.Error()}
+		case http.StatusBadRequest:
+			return &rpcError{rpcInvalidParameter, err.Error()}
+		}
+	}
+
+	return &rpcError{rpcInternalError, err.Error()}
+}
+
+// parseParams decodes positional params into pointers, in order. Params
+// beyond the required count are optional.
+func parseParams(params []json.RawMessage, required int, dst ...any) error {
+	if len(params) < required || len(params) > len(dst) {
+		return &rpcError{rpcInvalidParams, fmt.Sprintf("expected %d to %d params, got %d", required, len(dst), len(params))}
+	}
+
+	for i, raw := range params {
+		err := json.Unmarshal(raw, dst[i])
+		if err != nil {
+			return &rpcError{rpcInvalidParams, fmt.Sprintf("param %d: %v", i+1, err)}
+		}
+	}
+
+	return nil
+}
+
+// parseHash decodes a hex block hash or transaction ID param
+func parseHash(s string) ([]byte, error) {
+	hash, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParameter, fmt.Sprintf("invalid hash %q", s)}
+	}
+
+	return hash, nil
+}
+
+// rpcGetBlockCount returns the height of the active tip: getblockcount
+func rpcGetBlockCount(bc *Blockchain, params []json.RawMessage) (any, error) {
+	err := parseParams(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return bc.GetBestHeight(), nil
+}
+
+// rpcGetRawMempool returns the IDs of the mempool transactions, oldest
+// first: getrawmempool
+func rpcGetRawMempool(bc *Blockchain, params []json.RawMessage) (any, error) {
+	err := parseParams(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, tx := range (Mempool{bc}).Transactions() {
+		ids = append(ids, hex.EncodeToString(tx.ID))
+	}
+
+	return ids, nil
+}
+
+// rpcGetMempoolInfo returns the size, fees and limits of the mempool:
+// getmempoolinfo
+func rpcGetMempoolInfo(bc *Blockchain, params []json.RawMessage) (any, error) {
+	err := parseParams(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return (Mempool{bc}).Info(), nil
+}
+
+// rpcGetMiningInfo returns the difficulty, the network hash rate, the hash
+// rate of the node and the recent solve times: getmininginfo
+func rpcGetMiningInfo(bc *Blockchain, params []json.RawMessage) (any, error) {
+	err := parseParams(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return bc.MiningInfo(), nil
+}
+
+// rpcGetBestBlockHash returns the hash of the active tip: getbestblockhash
+func rpcGetBestBlockHash(bc *Blockchain, params []json.RawMessage) (any, error) {
+	err := parseParams(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return hex.EncodeToString(bc.tip), nil
+}
+
+// rpcGetBlockHash returns the hash of the block at a height: getblockhash height
+func rpcGetBlockHash(bc *Blockchain, params []json.RawMessage) (any, error) {
+	var height int
+	err := parseParams(params, 1, &height)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := bc.GetBlockHash(height)
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParameter, err.Error()}
+	}
+
+	return hex.EncodeToString(hash), nil
+}
+
+// rpcGetBlock returns a block: getblock hash
+func rpcGetBlock(bc *Blockchain, params []json.RawMessage) (any, error) {
+	var hashHex string
+	err := parseParams(params, 1, &hashHex)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := parseHash(hashHex)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := bc.GetBlock(hash)
+	if err != nil {
+		return nil, &rpcError{rpcNotFound, err.Error()}
+	}
+
+	return NewBlockInfo(bc, block), nil
+}
+
+// rpcGetRawTransaction returns a transaction of the active chain with its
+// block: getrawtransaction txid
+func rpcGetRawTransaction(bc *Blockchain, params []json.RawMessage) (any, error) {
+	var txIDHex string
+	err := parseParams(params, 1, &txIDHex)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := parseHash(txIDHex)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := bc.TransactionBlock(id)
+	if err != nil {
+		return nil, &rpcError{rpcNotFound, err.Error()}
+	}
+
+	tx, err := bc.FindTransaction(id)
+	if err != nil {
+		return nil, err
+	}
+
+	info := NewTransactionInfo(&tx)
+	info.BlockHash = hex.EncodeToString(block.Hash)
+	info.Confirmations, err = bc.Confirmations(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// rpcGetBalance returns the balance of an address and its change addresses
+// known to the local wallet, like the getbalance command: getbalance address
+func rpcGetBalance(bc *Blockchain, params []json.RawMessage) (any, error) {
+	var address string
+	err := parseParams(params, 1, &address)
+	if err != nil {
+		return nil, err
+	}
+
+	balance := 0
+	for _, a := range NewWallet().Addresses(address) {
+		balance += UTXOSet{bc}.GetBalance(a)
+	}
+
+	return balance, nil
+}
+
+// rpcGetBlockStats returns the statistics of a block: getblockstats height
+func rpcGetBlockStats(bc *Blockchain, params []json.RawMessage) (any, error) {
+	var height int
+	err := parseParams(params, 1, &height)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := bc.GetBlockStats(height)
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParameter, err.Error()}
+	}
+
+	return stats, nil
+}
+
+// rpcGetChainTips returns the active tip and the side-branch tips: getchaintips
+func rpcGetChainTips(bc *Blockchain, params []json.RawMessage) (any, error) {
+	err := parseParams(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return bc.GetChainTips(), nil
+}
+
+// rpcGetBlockTemplate returns the next block for an external miner to mine,
+// with a coinbase paying the reward to an address: getblocktemplate address.
+// Unlike bitcoind, the template comes with its coinbase, so the address is
+// a required param.
+func rpcGetBlockTemplate(bc *Blockchain, params []json.RawMessage) (any, error) {
+	var address string
+	err := parseParams(params, 1, &address)
+	if err != nil {
+		return nil, err
+	}
+	if address == "" {
+		return nil, &rpcError{rpcInvalidParameter, "address must not be empty"}
+	}
+
+	return bc.GetBlockTemplate(address), nil
+}
+
+// rpcSendToAddress sends coins from an address of the local wallet:
+// sendtoaddress toaddress amount fromaddress [fee]. The wallet has no default
+// account, so unlike bitcoind the sender is a required third param, and the
+// fee is an amount rather than a rate.
+func (a *APIServer) rpcSendToAddress(params []json.RawMessage) (any, error) {
+	var to, from string
+	var amount, fee int
+	err := parseParams(params, 3, &to, &amount, &from, &fee)
+	if err != nil {
+		return nil, err
+	}
+	if amount <= 0 {
+		return nil, &rpcError{rpcInvalidParameter, "amount must be positive"}
+	}
+	if fee < 0 {
+		return nil, &rpcError{rpcInvalidParameter, "fee can't be negative"}
+	}
+
+	v, err := a.withChain(func(bc *Blockchain) (any, error) {
+		wallet := NewWallet()
+		tx := NewUTXOTransaction(from, to, amount, SendOptions{Fee: fee}, &UTXOSet{bc}, wallet)
+		// Persist the change address before the transaction is relayed so it's never lost
+		wallet.SaveToFile()
+
+		return tx, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return a.submitRPC(v.(*Transaction))
+}
+
+// rpcBumpFee replaces a pending transaction of the local wallet with one
+// paying a higher fee, see NewFeeBumpTransaction: bumpfee txid [fee]. Like
+// bitcoind's, it returns the txid of the replacement with its fee and the
+// original's, but the fee is an amount rather than a rate.
+func (a *APIServer) rpcBumpFee(params []json.RawMessage) (any, error) {
+	var txID string
+	var fee int
+	err := parseParams(params, 1, &txID, &fee)
+	if err != nil {
+		return nil, err
+	}
+	id, err := hex.DecodeString(txID)
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParameter, "txid isn't hex"}
+	}
+	if fee < 0 {
+		return nil, &rpcError{rpcInvalidParameter, "fee can't be negative"}
+	}
+
+	type bumpInfo struct {
+		Txid    string `json:"txid"`
+		OrigFee int    `json:"origfee"`
+		Fee     int    `json:"fee"`
+		tx      *Transaction
+	}
+	v, err := a.withChain(func(bc *Blockchain) (any, error) {
+		original := Mempool{bc}.Get(id)
+		if original == nil {
+			return nil, &rpcError{rpcNotFound, fmt.Sprintf("transaction %s isn't in the mempool", txID)}
+		}
+
+		wallet := NewWallet()
+		tx, err := NewFeeBumpTransaction(original, fee, &UTXOSet{bc}, wallet)
+		if err != nil {
+			return nil, &rpcError{rpcInvalidParameter, err.Error()}
+		}
+		// Persist the change address before the transaction is relayed so it's never lost
+		wallet.SaveToFile()
+
+		return bumpInfo{hex.EncodeToString(tx.ID), Mempool{bc}.Fee(original), Mempool{bc}.Fee(tx), tx}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	info := v.(bumpInfo)
+	_, err = a.submitRPC(info.tx)
+	if err != nil {
+		return nil, err
+	}
+
+	wallet := NewWallet()
+	wallet.AddReplacement(info.tx.ID, id)
+	wallet.SaveToFile()
+
+	return info, nil
+}
+
+// rpcSendRawTransaction verifies and relays a signed transaction:
+// sendrawtransaction tx, with tx a hex raw transaction like bitcoind's, or
+// an object in the JSON format written by signtx
+func (a *APIServer) rpcSendRawTransaction(params []json.RawMessage) (any, error) {
+	var data string
+	if len(params) == 1 && json.Unmarshal(params[0], &data) == nil {
+		tx, err := DecodeRawTransaction(data)
+		if err != nil {
+			return nil, &rpcError{rpcInvalidParameter, err.Error()}
+		}
+		return a.submitRPC(tx)
+	}
+
+	var ptx PortableTransaction
+	err := parseParams(params, 1, &ptx)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := a.withChain(func(bc *Blockchain) (any, error) {
+		err := ptx.Verify(&UTXOSet{bc})
+		if err != nil {
+			return nil, &rpcError{rpcVerifyRejected, err.Error()}
+		}
+
+		return ptx.Transaction()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return a.submitRPC(v.(*Transaction))
+}
+
+// submitRPC relays a transaction built by an RPC method
+func (a *APIServer) submitRPC(tx *Transaction) (any, error) {
+	err := a.submit(tx)
+	if err != nil {
+		return nil, &rpcError{rpcVerifyRejected, err.Error()}
+	}
+
+	return hex.EncodeToString(tx.ID), nil
+}
+
+// rpcSubmitBlock adds a block mined from a template to the chain and
+// announces it: submitblock hexdata, with the block encoded as the Block
+// message of protocol.proto. Like bitcoind, it returns null for an accepted
+// block and "duplicate" for a known one.
+func (a *APIServer) rpcSubmitBlock(params []json.RawMessage) (any, error) {
+	var data string
+	err := parseParams(params, 1, &data)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := hex.DecodeString(data)
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParameter, "block data isn't hex"}
+	}
+	var block Block
+	err = unmarshalBlock(encoded, &block)
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParameter, fmt.Sprintf("block decode failed: %v", err)}
+	}
+
+	err = a.block(&block)
+	if errors.Is(err, errDuplicateBlock) {
+		return err.Error(), nil
+	}
+	if errors.Is(err, errNoChain) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &rpcError{rpcVerifyRejected, err.Error()}
+	}
+
+	return nil, nil
+}
+
+// rpcInput is an output spent by createrawtransaction
+type rpcInput struct {
+	Txid string `json:"txid"`
+	Vout int    `json:"vout"`
+}
+
+// rpcCreateRawTransaction returns an unsigned hex raw transaction:
+// createrawtransaction inputs outputs [locktime], with inputs an array of
+// {"txid": TXID, "vout": N} and outputs an array of {"ADDRESS": AMOUNT}
+// payments or {"data": HEX} data carriers. bitcoind also takes the outputs
+// as a single object, whose order JSON doesn't keep, so only arrays are
+// supported.
+func rpcCreateRawTransaction(bc *Blockchain, params []json.RawMessage) (any, error) {
+	var ins []rpcInput
+	var outs []map[string]json.RawMessage
+	var lockTime int64
+	err := parseParams(params, 2, &ins, &outs, &lockTime)
+	if err != nil {
+		return nil, err
+	}
+
+	var inputs []TXInput
+	for _, in := range ins {
+		txID, err := parseHash(in.Txid)
+		if err != nil {
+			return nil, err
+		}
+		if in.Vout < 0 {
+			return nil, &rpcError{rpcInvalidParameter, fmt.Sprintf("invalid vout %d", in.Vout)}
+		}
+		inputs = append(inputs, TXInput{txID, in.Vout, ""})
+	}
+
+	var outputs []TXOutput
+	for i, out := range outs {
+		if len(out) != 1 {
+			return nil, &rpcError{rpcInvalidParameter, fmt.Sprintf("output %d must have a single address or data key", i)}
+		}
+		for key, raw := range out {
+			var err error
+			if key == "data" {
+				var dataHex string
+				var data []byte
+				err = json.Unmarshal(raw, &dataHex)
+				if err == nil {
+					data, err = hex.DecodeString(dataHex)
+				}
+				outputs = append(outputs, NewDataOutput(data))
+			} else {
+				var amount int
+				err = json.Unmarshal(raw, &amount)
+				outputs = append(outputs, TXOutput{amount, key, nil, 0})
+			}
+			if err != nil {
+				return nil, &rpcError{rpcInvalidParameter, fmt.Sprintf("output %d: %v", i, err)}
+			}
+		}
+	}
+	if lockTime < 0 {
+		return nil, &rpcError{rpcInvalidParameter, "locktime can't be negative"}
+	}
+
+	tx, err := NewRawTransaction(inputs, outputs, lockTime)
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParameter, err.Error()}
+	}
+
+	return EncodeRawTransaction(tx), nil
+}
+
+// rpcSignResult is the result of signrawtransaction
+type rpcSignResult struct {
+	Hex      string `json:"hex"`      // The transaction
+	Complete bool   `json:"complete"` // Whether every input is signed
+}
+
+// rpcSignRawTransaction signs the inputs of a hex raw transaction spending
+// outputs of an address of the local wallet: signrawtransaction hexstring
+// fromaddress. Like sendtoaddress it takes the address, the wallet having no
+// default account, and like bitcoind it returns the transaction with whether
+// every input is signed.
+func rpcSignRawTransaction(bc *Blockchain, params []json.RawMessage) (any, error) {
+	var data, from string
+	err := parseParams(params, 2, &data, &from)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := DecodeRawTransaction(data)
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParameter, err.Error()}
+	}
+
+	wallet := NewWallet()
+	complete, err := SignRawTransaction(tx, from, &UTXOSet{bc}, wallet)
+	if err != nil {
+		return nil, &rpcError{rpcVerifyRejected, err.Error()}
+	}
+	wallet.SaveToFile()
+
+	return rpcSignResult{EncodeRawTransaction(tx), complete}, nil
+}
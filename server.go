@@ -0,0 +1,1150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// nodeRetryInterval is how long to wait before reconnecting to a configured peer
+const nodeRetryInterval = 10 * time.Second
+
+// nodeDialTimeout is how long to wait when connecting to a node
+const nodeDialTimeout = 10 * time.Second
+
+// rejectWaitTimeout is how long a wallet handing a transaction to a node waits
+// for it to be rejected before assuming it was accepted
+const rejectWaitTimeout = 2 * time.Second
+
+// blockRequestTimeout is how long to wait for a requested block before asking
+// another peer announcing it
+const blockRequestTimeout = time.Minute
+
+// maxInvItems is the maximum number of hashes in an inventory message
+const maxInvItems = 500
+
+// Protocol versions. Nodes exchange their versions when connecting and drop
+// peers speaking a version older than minProtocolVersion.
+const (
+	protocolVersion    = 1
+	minProtocolVersion = 1
+)
+
+// Service bits announced in the version message
+const (
+	serviceFullNode = 1 << 0 // The node has the full chain and serves blocks
+	serviceSnappy   = 1 << 1 // The node wants block messages compressed with snappy
+)
+
+// Network message commands
+const (
+	cmdVersion   = "version"   // First message on a connection, payload version
+	cmdVerack    = "verack"    // Acknowledges the peer's version message, no payload
+	cmdGetBlocks = "getblocks" // Ask for the hashes of the blocks after the last common block, payload getBlocks
+	cmdInv       = "inv"       // Announce blocks the sender has, payload inventory
+	cmdGetData   = "getdata"   // Ask for announced blocks, payload inventory
+	cmdBlock     = "block"     // A block, payload the serialized block
+	cmdTx        = "tx"        // A transaction to relay, payload the serialized transaction
+	cmdReject    = "reject"    // A transaction from the peer was rejected, payload reject
+
+	cmdFilterLoad  = "filterload"  // Only relay transactions matching a filter, payload BloomFilter, see bloom.go
+	cmdFilterAdd   = "filteradd"   // Add an element to the loaded filter, payload filterAdd
+	cmdFilterClear = "filterclear" // Drop the loaded filter, no payload
+	cmdMerkleBlock = "merkleblock" // A block requested by a peer with a filter, payload merkleBlock
+)
+
+// message is a single network message. Messages are framed one after another
+// on the TCP connection to a peer, see writeMessage.
+type message struct {
+	Command string // One of the cmd constants
+	Payload []byte // GOB encoded payload, depending on the command
+}
+
+// version introduces a node to a peer when connecting
+type version struct {
+	Version    int    // Protocol version of the sender
+	Services   uint64 // Service bits of the sender
+	BestHeight int    // Height of the sender's active tip, -1 without a chain
+	ChainWork  []byte // Big-endian chain work of the sender's active tip, empty without a chain
+	// Fingerprint of the sender's chain, see chainFingerprint, empty without a
+	// chain. Nodes with different fingerprints are on different chains.
+	Fingerprint string
+	// Lowest fee rate the sender's mempool accepts, in coins per 1000 bytes,
+	// see minRelayFee. Transactions paying less aren't relayed to it.
+	MinRelayFee int
+}
+
+// getBlocks asks a peer for the blocks of its active chain following the last
+// block both nodes have in common
+type getBlocks struct {
+	Locator [][]byte // Hashes of the sender's active chain, see blockLocator
+}
+
+// reject tells a peer why a transaction it sent was rejected
+type reject struct {
+	Txid   []byte // ID of the rejected transaction
+	Reason string // Why it was rejected
+}
+
+// inventory lists blocks by their hashes, to announce them or ask for them
+type inventory struct {
+	Items [][]byte // Block hashes, at most maxInvItems
+}
+
+// peer is a connection to another node. Only the handshake messages are
+// accepted from a peer until it is ready, that is both sides have exchanged
+// version messages and we have received a verack for ours.
+type peer struct {
+	addr     string     // Address of the other node
+	outbound bool       // Whether we dialed the connection, so addr is the node's listening address
+	conn     net.Conn   // The connection
+	mu       sync.Mutex // Serializes writes to the connection
+
+	version    *version    // The peer's version message, nil until received
+	gotVerack  bool        // Whether the peer acknowledged our version
+	ready      atomic.Bool // Whether the handshake is complete
+	bestHeight int         // Best height the peer announced in its version
+	compress   bool        // Whether both sides announced serviceSnappy, so block payloads are compressed
+	syncHash   []byte      // Last hash of a full inventory from the peer, see handleInv
+
+	filterMu sync.Mutex   // Guards filter
+	filter   *BloomFilter // Filter the peer loaded, nil to relay it everything, see bloom.go
+}
+
+// send writes a message to the peer
+// Parameters:
+//   - command: The message command
+//   - payload: The encoded payload
+func (p *peer) send(command string, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return writeMessage(p.conn, message{command, payload})
+}
+
+// Roles of a node
+const (
+	roleFull   = "full"   // Validates and relays blocks and transactions
+	roleMiner  = "miner"  // Also mines the pending transactions into blocks
+	roleWallet = "wallet" // Follows the chain for its wallet, ignoring the transactions of peers
+)
+
+// ServerConfig holds the options of a node
+type ServerConfig struct {
+	Port          int       // TCP port to listen on
+	Peers         []string  // Addresses (host:port) of nodes to always stay connected to
+	Seeds         []string  // Addresses (host:port) of seed nodes to discover the network with
+	DNSSeeds      []string  // Host names resolving to the addresses of seed nodes
+	MaxOutbound   int       // Maximum number of connections to discovered nodes
+	Role          string    // One of the role constants
+	RewardAddress string    // Address the block rewards of a miner are paid to
+	Compress      bool      // Whether to compress block messages to peers supporting it
+	TLS           bool      // Whether to encrypt connections with TLS
+	TLSPinFile    string    // PEM file with the certificates of the nodes to trust, empty to trust any
+	HTTPAddr      string    // Address to serve the HTTP API on, empty for none
+	GRPCAddr      string    // Address to serve the gRPC API on, empty for none
+	Webhooks      []Webhook // URLs to notify of new blocks and payments to watched addresses
+}
+
+// Server is a node of the network. It accepts connections from other nodes,
+// keeps connections to the configured peers open, and exchanges blocks and
+// transactions with them so every node converges to the same chain.
+type Server struct {
+	config    ServerConfig // The node options
+	clientTLS *tls.Config  // TLS configuration to dial nodes with, nil without TLS
+
+	mu           sync.Mutex             // Guards bc, its mempool, orphans, orphanBlocks, rejected, inFlight, syncBlocks, syncPeer, syncProgress and stopMining
+	bc           *Blockchain            // The local chain, nil until downloaded from a peer
+	stopMining   context.CancelFunc     // Cancels the block being mined, nil when not mining
+	orphans      map[string]orphan      // Hex ID -> transaction waiting for its parents, see orphans.go
+	orphanBlocks map[string]orphanBlock // Hex hash -> block waiting for its parent, see orphanblocks.go
+	rejected     map[string]bool        // Hex hashes of blocks that failed validation
+	inFlight     map[string]time.Time   // Hex hash -> when the block was requested from a peer
+	syncBlocks   []*Block               // Blocks of a full inventory waiting to be imported together, see syncbatch.go
+	syncPeer     *peer                  // The peer syncBlocks came from
+	syncProgress *progressTracker       // Progress of syncing up to the height of the peers, nil when synced
+
+	connsMu sync.Mutex     // Guards conns
+	conns   map[*peer]bool // Open peer connections
+
+	knownPeers *PeerStore // Peers connected to before, persisted in the peers file
+	events     *eventFeed // Blocks connected to the chain and accepted transactions, for API subscribers
+
+	addrsMu    sync.Mutex           // Guards candidates and outbound
+	candidates map[string]time.Time // Discovered address -> last connection attempt
+	outbound   map[string]bool      // Discovered addresses currently connected to
+}
+
+// NewServer creates a node
+// Parameters:
+//   - config: The node options
+//   - bc: The local chain, nil for a new node downloading the chain from its peers
+func NewServer(config ServerConfig, bc *Blockchain) *Server {
+	if config.MaxOutbound <= 0 {
+		config.MaxOutbound = defaultMaxOutbound
+	}
+
+	return &Server{
+		config:       config,
+		bc:           bc,
+		knownPeers:   LoadPeerStore(),
+		events:       newEventFeed(),
+		candidates:   make(map[string]time.Time),
+		outbound:     make(map[string]bool),
+		orphans:      make(map[string]orphan),
+		orphanBlocks: make(map[string]orphanBlock),
+		rejected:     make(map[string]bool),
+		inFlight:     make(map[string]time.Time),
+		conns:        make(map[*peer]bool),
+	}
+}
+
+// Start runs the node. It connects to the configured peers and to nodes found
+// through the seeds, and serves incoming connections until the listener fails.
+func (s *Server) Start() error {
+	var serverTLS *tls.Config
+	if s.config.TLS {
+		cert, err := loadOrCreateCertificate()
+		if err != nil {
+			return err
+		}
+
+		s.clientTLS, err = clientTLSConfig(s.config.TLSPinFile, &cert)
+		if err != nil {
+			return err
+		}
+		serverTLS = serverTLSConfig(cert)
+
+		slog.Info("TLS certificate", hashAttr("fingerprint", certFingerprint(cert.Certificate[0])))
+		if s.config.TLSPinFile == "" {
+			slog.Warn("No pinned certificates, nodes connected to aren't authenticated")
+		}
+	}
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", s.config.Port))
+	if err != nil {
+		return err
+	}
+	if serverTLS != nil {
+		ln = tls.NewListener(ln, serverTLS)
+	}
+	defer ln.Close()
+	slog.Info("Node listening", "port", s.config.Port)
+
+	for _, addr := range s.config.Peers {
+		go s.connectPeer(addr)
+	}
+
+	s.addCandidates(s.knownPeers.Addresses())
+	s.addCandidates(s.config.Seeds)
+	s.addCandidates(s.resolveDNSSeeds())
+	go s.manageConnections()
+	go s.expirePending()
+
+	if s.config.HTTPAddr != "" {
+		go func() {
+			err := s.API().ListenAndServe(s.config.HTTPAddr, serverTLS)
+			slog.Error("HTTP API stopped", "err", err)
+		}()
+	}
+	if s.config.GRPCAddr != "" {
+		go func() {
+			err := s.API().ServeGRPC(s.config.GRPCAddr, serverTLS)
+			slog.Error("gRPC API stopped", "err", err)
+		}()
+	}
+	s.API().RunWebhooks(s.config.Webhooks)
+
+	// A miner restarted with pending transactions mines them right away
+	s.mu.Lock()
+	if s.config.Role == roleMiner && s.bc != nil && len(Mempool{s.bc}.Transactions()) > 0 {
+		s.minePending()
+	}
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handlePeer(conn, conn.RemoteAddr().String(), false)
+	}
+}
+
+// Shutdown closes the database, so the node can exit without corrupting it
+func (s *Server) Shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopMining != nil {
+		s.stopMining()
+		s.stopMining = nil
+	}
+	if s.bc != nil {
+		s.flushSyncBlocks()
+		s.bc.db.Close()
+		s.bc = nil
+	}
+}
+
+// connectPeer keeps a connection to a configured peer open, reconnecting
+// whenever it drops
+func (s *Server) connectPeer(addr string) {
+	for {
+		conn, err := dialNode(addr, s.clientTLS)
+		if err != nil {
+			slog.Warn("Can't connect to peer", "peer", addr, "err", err)
+			s.knownPeers.RecordFailure(addr)
+		} else {
+			s.handlePeer(conn, addr, true)
+		}
+
+		time.Sleep(nodeRetryInterval)
+	}
+}
+
+// handlePeer serves a connection until it's closed. Both sides start with the
+// version handshake.
+// Parameters:
+//   - conn: The connection
+//   - addr: Address of the other node
+//   - outbound: Whether we dialed the connection
+func (s *Server) handlePeer(conn net.Conn, addr string, outbound bool) {
+	p := &peer{addr: addr, outbound: outbound, conn: conn}
+
+	s.connsMu.Lock()
+	s.conns[p] = true
+	s.connsMu.Unlock()
+	slog.Info("Connected to peer", "peer", addr)
+
+	defer func() {
+		s.connsMu.Lock()
+		delete(s.conns, p)
+		s.connsMu.Unlock()
+		conn.Close()
+
+		s.mu.Lock()
+		if s.syncPeer == p {
+			s.flushSyncBlocks()
+		}
+		s.mu.Unlock()
+		slog.Info("Disconnected from peer", "peer", addr)
+	}()
+
+	err := p.send(cmdVersion, encodePayload(s.version()))
+	if err != nil {
+		slog.Warn("Can't send message", "command", cmdVersion, "peer", addr, "err", err)
+		return
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		msg, err := readMessage(r)
+		if errors.Is(err, errBadChecksum) {
+			slog.Warn("Message dropped", "command", msg.Command, "peer", addr, "err", err)
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Warn("Reading from peer failed", "peer", addr, "err", err)
+			}
+			return
+		}
+
+		s.handleMessage(p, msg)
+	}
+}
+
+// handleMessage dispatches a message received from a peer
+func (s *Server) handleMessage(p *peer, msg message) {
+	var err error
+
+	if !p.ready.Load() && msg.Command != cmdVersion && msg.Command != cmdVerack {
+		slog.Warn("Message rejected, handshake not complete", "command", msg.Command, "peer", p.addr)
+		return
+	}
+
+	switch msg.Command {
+	case cmdVersion:
+		err = s.handleVersion(p, msg.Payload)
+	case cmdVerack:
+		err = s.handleVerack(p)
+	case cmdGetBlocks:
+		err = s.handleGetBlocks(p, msg.Payload)
+	case cmdInv:
+		err = s.handleInv(p, msg.Payload)
+	case cmdGetData:
+		err = s.handleGetData(p, msg.Payload)
+	case cmdBlock:
+		err = s.handleBlock(p, msg.Payload)
+	case cmdTx:
+		err = s.handleTx(p, msg.Payload)
+	case cmdReject:
+		err = handleReject(p, msg.Payload)
+	case cmdFilterLoad:
+		err = s.handleFilterLoad(p, msg.Payload)
+	case cmdFilterAdd:
+		err = s.handleFilterAdd(p, msg.Payload)
+	case cmdFilterClear:
+		err = s.handleFilterClear(p)
+	default:
+		err = fmt.Errorf("unknown command %q", msg.Command)
+	}
+
+	if err != nil {
+		slog.Warn("Message rejected", "command", msg.Command, "peer", p.addr, "err", err)
+	}
+}
+
+// version builds the version message announcing this node
+func (s *Server) version() version {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v := version{Version: protocolVersion, BestHeight: -1, MinRelayFee: minRelayFee}
+	if s.config.Compress {
+		v.Services |= serviceSnappy
+	}
+	if s.bc != nil {
+		v.Services |= serviceFullNode
+		v.BestHeight = s.bc.GetBestHeight()
+
+		work, err := s.bc.ChainWork(s.bc.tip)
+		if err != nil {
+			log.Panic(err)
+		}
+		v.ChainWork = work.Bytes()
+		v.Fingerprint = s.bc.Fingerprint()
+	}
+
+	return v
+}
+
+// handleVersion records a peer's version message and acknowledges it. Peers
+// with an unsupported protocol version, or on another chain than ours, are
+// disconnected.
+func (s *Server) handleVersion(p *peer, payload []byte) error {
+	if p.version != nil {
+		return errors.New("duplicate version message")
+	}
+
+	var v version
+	err := decodePayload(payload, &v)
+	if err != nil {
+		return err
+	}
+
+	if v.Version < minProtocolVersion {
+		p.conn.Close()
+		return fmt.Errorf("protocol version %d is too old, need at least %d", v.Version, minProtocolVersion)
+	}
+
+	// Nodes on different networks already differ in their magic, see wire.go,
+	// but not on chains of the same network with another genesis block or
+	// other parameters
+	ours := s.version().Fingerprint
+	if ours != "" && v.Fingerprint != "" && v.Fingerprint != ours {
+		p.conn.Close()
+		return fmt.Errorf("peer is on chain %s, not %s", v.Fingerprint, ours)
+	}
+
+	p.version = &v
+	p.compress = s.config.Compress && v.Services&serviceSnappy != 0
+	p.bestHeight = v.BestHeight
+
+	err = p.send(cmdVerack, nil)
+	if err != nil {
+		return err
+	}
+
+	s.completeHandshake(p)
+	return nil
+}
+
+// handleVerack records that a peer acknowledged our version message
+func (s *Server) handleVerack(p *peer) error {
+	if p.gotVerack {
+		return errors.New("duplicate verack message")
+	}
+
+	p.gotVerack = true
+	s.completeHandshake(p)
+	return nil
+}
+
+// completeHandshake marks a peer ready once versions have been exchanged and
+// acknowledged. If the peer's chain has more work, we start syncing from it.
+// Peers too old to announce their chain work are synced from if their chain
+// is longer.
+func (s *Server) completeHandshake(p *peer) {
+	if p.version == nil || !p.gotVerack {
+		return
+	}
+
+	p.ready.Store(true)
+	slog.Info("Handshake complete", "peer", p.addr, "version", p.version.Version, "height", p.bestHeight)
+
+	if p.outbound {
+		s.knownPeers.RecordSuccess(p.addr)
+	}
+
+	ours := s.version()
+	if len(p.version.ChainWork) == 0 && p.bestHeight > ours.BestHeight {
+		s.requestBlocks(p)
+	} else if new(big.Int).SetBytes(p.version.ChainWork).Cmp(new(big.Int).SetBytes(ours.ChainWork)) > 0 {
+		s.requestBlocks(p)
+	}
+}
+
+// broadcast sends a message to all connected peers except one
+// Parameters:
+//   - command: The message command
+//   - payload: The encoded payload
+//   - except: Peer to skip, usually the one the data came from, or nil
+func (s *Server) broadcast(command string, payload []byte, except *peer) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	for p := range s.conns {
+		if p == except || !p.ready.Load() {
+			continue
+		}
+
+		err := p.send(command, payload)
+		if err != nil {
+			slog.Warn("Can't send message", "command", command, "peer", p.addr, "err", err)
+		}
+	}
+}
+
+// relayTransaction sends a transaction to all connected peers except one,
+// skipping the peers whose filter it doesn't match and the ones whose
+// mempool would reject its fee rate
+// Parameters:
+//   - tx: The transaction
+//   - fee: The fee it pays
+//   - except: Peer to skip, the one it came from, or nil
+func (s *Server) relayTransaction(tx *Transaction, fee int, except *peer) {
+	payload := encodePayload(tx)
+	size := len(tx.Serialize())
+
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	for p := range s.conns {
+		if p == except || !p.ready.Load() || belowFeeRate(fee, size, p.version.MinRelayFee) || !p.matchesFilter(tx) {
+			continue
+		}
+
+		err := p.send(cmdTx, payload)
+		if err != nil {
+			slog.Warn("Can't send message", "command", cmdTx, "peer", p.addr, "err", err)
+		}
+	}
+}
+
+// requestBlocks asks a peer for the blocks we're missing
+func (s *Server) requestBlocks(p *peer) {
+	s.mu.Lock()
+	var locator [][]byte
+	if s.bc != nil {
+		locator = s.bc.blockLocator()
+	}
+	s.mu.Unlock()
+
+	err := p.send(cmdGetBlocks, encodePayload(getBlocks{locator}))
+	if err != nil {
+		slog.Warn("Can't send message", "command", cmdGetBlocks, "peer", p.addr, "err", err)
+	}
+}
+
+// handleGetBlocks announces to a peer the blocks of the active chain after
+// the last block of its locator we have on our active chain, or the whole
+// chain if there's none. At most maxInvItems blocks are announced at once,
+// the peer asks for more when it has them.
+func (s *Server) handleGetBlocks(p *peer, payload []byte) error {
+	var req getBlocks
+	err := decodePayload(payload, &req)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bc == nil {
+		return nil
+	}
+
+	fork := -1
+	for _, hash := range req.Locator {
+		block, err := s.bc.GetBlockHeader(hash)
+		if err == nil && s.bc.IsInActiveChain(block) {
+			fork = block.Height
+			break
+		}
+	}
+
+	// The peer needs blocks this node pruned, it has to get them elsewhere
+	if fork < s.bc.PrunedHeight() {
+		return nil
+	}
+
+	var inv inventory
+	for height := fork + 1; height <= s.bc.GetBestHeight() && len(inv.Items) < maxInvItems; height++ {
+		hash, err := s.bc.GetBlockHash(height)
+		if err != nil {
+			return err
+		}
+		inv.Items = append(inv.Items, hash)
+	}
+	if len(inv.Items) == 0 {
+		return nil
+	}
+
+	return p.send(cmdInv, encodePayload(inv))
+}
+
+// handleInv asks a peer for the announced blocks we don't have and haven't
+// already asked another peer for
+func (s *Server) handleInv(p *peer, payload []byte) error {
+	var inv inventory
+	err := decodePayload(payload, &inv)
+	if err != nil {
+		return err
+	}
+	if len(inv.Items) > maxInvItems {
+		return fmt.Errorf("inventory has %d items, more than %d", len(inv.Items), maxInvItems)
+	}
+
+	// A full inventory means the peer has more blocks, ask for them once this batch arrived
+	if len(inv.Items) == maxInvItems {
+		p.syncHash = inv.Items[len(inv.Items)-1]
+	}
+
+	s.mu.Lock()
+	var req inventory
+	for _, hash := range inv.Items {
+		id := hex.EncodeToString(hash)
+		if s.rejected[id] || (s.bc != nil && s.bc.hasBlock(hash)) || s.isQueuedSyncBlock(hash) {
+			continue
+		}
+		if _, ok := s.orphanBlocks[id]; ok {
+			continue
+		}
+		if requested, ok := s.inFlight[id]; ok && time.Since(requested) < blockRequestTimeout {
+			continue
+		}
+
+		s.inFlight[id] = time.Now()
+		req.Items = append(req.Items, hash)
+	}
+	s.mu.Unlock()
+
+	if len(req.Items) == 0 {
+		return nil
+	}
+
+	return p.send(cmdGetData, encodePayload(req))
+}
+
+// handleGetData sends a peer the blocks it asked for, filtered if it loaded
+// a filter
+func (s *Server) handleGetData(p *peer, payload []byte) error {
+	var req inventory
+	err := decodePayload(payload, &req)
+	if err != nil {
+		return err
+	}
+	if len(req.Items) > maxInvItems {
+		return fmt.Errorf("getdata has %d items, more than %d", len(req.Items), maxInvItems)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bc == nil {
+		return nil
+	}
+
+	for _, hash := range req.Items {
+		block, err := s.bc.GetBlock(hash)
+		if err != nil {
+			return err
+		}
+		if block.IsPruned() {
+			continue
+		}
+		if p.hasFilter() {
+			err = sendMerkleBlock(p, block)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		payload := encodePayload(block)
+		if p.compress {
+			payload = compressPayload(payload)
+		}
+
+		err = p.send(cmdBlock, payload)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleBlock adds a block received from a peer and announces it to the other
+// peers if it's new. A node without a chain creates one from the genesis block.
+func (s *Server) handleBlock(p *peer, payload []byte) error {
+	if p.compress {
+		var err error
+		payload, err = decompressPayload(payload)
+		if err != nil {
+			return err
+		}
+	}
+
+	var block Block
+	err := decodePayload(payload, &block)
+	if err != nil {
+		return err
+	}
+
+	if block.Height > p.bestHeight {
+		p.bestHeight = block.Height
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hash := hex.EncodeToString(block.Hash)
+	delete(s.inFlight, hash)
+
+	if s.bc == nil {
+		if len(block.PrevBlockHash) != 0 {
+			return nil
+		}
+
+		err = checkBlockHeader(&block)
+		if err != nil {
+			return err
+		}
+
+		s.bc = InitBlockchain(&block)
+		slog.Info("Created chain from the genesis block of a peer", "chain", s.bc.Fingerprint(), hashAttr("hash", block.Hash), "peer", p.addr)
+		return nil
+	}
+
+	// Descendants of an invalid block are invalid too, and asking for their
+	// parent again would only get the same invalid block
+	if s.rejected[hash] || s.rejected[hex.EncodeToString(block.PrevBlockHash)] {
+		s.rejected[hash] = true
+		return fmt.Errorf("block %s or its parent is invalid", hash)
+	}
+
+	// A peer offering a chain without our checkpoints is on another chain
+	err = s.bc.CheckCheckpoints(&block)
+	if err != nil {
+		s.rejected[hash] = true
+		p.conn.Close()
+		return err
+	}
+
+	// Blocks of a long chain being downloaded are imported in batches
+	if s.queueSyncBlock(&block, p) {
+		return nil
+	}
+
+	if !s.bc.hasBlock(block.PrevBlockHash) {
+		// We're missing blocks in between, keep this one until they arrive and ask for them
+		s.holdOrphanBlock(&block, p)
+		go s.requestBlocks(p)
+		return nil
+	}
+
+	err = s.addBlock(&block, p)
+	if err != nil {
+		return err
+	}
+	s.connectOrphanBlocks(block.Hash)
+
+	return nil
+}
+
+// addBlock adds a block whose parent is stored to the chain and announces it
+// to the other peers if it's new. The caller must hold s.mu.
+// Parameters:
+//   - block: The block
+//   - p: The peer it came from, nil for blocks submitted to the HTTP API
+func (s *Server) addBlock(block *Block, p *peer) error {
+	hash := hex.EncodeToString(block.Hash)
+
+	added, err := s.bc.AddBlock(block)
+	if err != nil {
+		s.rejected[hash] = true
+		s.rejectOrphanBlocks(block.Hash)
+		return err
+	}
+	if !added {
+		return nil
+	}
+	if p != nil {
+		slog.Info("Added block", hashAttr("hash", block.Hash), "height", block.Height, "peer", p.addr)
+		s.reportSyncProgress(block.Height, block.Height, p)
+	} else {
+		slog.Info("Added block", hashAttr("hash", block.Hash), "height", block.Height, "peer", "api")
+	}
+	if s.bc.IsInActiveChain(block) {
+		s.events.publish(Event{Type: eventBlockConnected, Block: block})
+		s.restartMining()
+	}
+
+	// Connecting the block removed its transactions from the mempool, but
+	// switching branches may have invalidated others. It may also hold the
+	// parents of orphans.
+	s.dropInvalidPending()
+	s.processOrphans()
+
+	// The last block of a full inventory arrived, continue syncing
+	if p != nil && bytes.Equal(block.Hash, p.syncHash) {
+		p.syncHash = nil
+		go s.requestBlocks(p)
+	}
+
+	go s.broadcast(cmdInv, encodePayload(inventory{[][]byte{block.Hash}}), p)
+	return nil
+}
+
+// submitBlock adds a block mined by an external miner, posted to the HTTP
+// API, and announces it to the peers. Unlike blocks from peers, a block whose
+// parent is missing is rejected instead of held as an orphan.
+func (s *Server) submitBlock(block *Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bc == nil {
+		return errNoChain
+	}
+	s.flushSyncBlocks()
+	if s.bc.hasBlock(block.Hash) {
+		return errDuplicateBlock
+	}
+	if !s.bc.hasBlock(block.PrevBlockHash) {
+		return fmt.Errorf("parent %x of block %x not found", block.PrevBlockHash, block.Hash)
+	}
+
+	err := s.addBlock(block, nil)
+	if err != nil {
+		return err
+	}
+	s.connectOrphanBlocks(block.Hash)
+
+	return nil
+}
+
+// handleTx validates a transaction received from a peer, adds it to the
+// mempool and relays it to the other peers if it's new. A mining
+// node mines it into a block. The peer is told if the transaction is rejected.
+func (s *Server) handleTx(p *peer, payload []byte) error {
+	// A wallet node only relays its own transactions
+	if s.config.Role == roleWallet {
+		return nil
+	}
+
+	var tx Transaction
+	err := decodePayload(payload, &tx)
+	if err != nil {
+		return err
+	}
+
+	err = s.acceptTransaction(&tx, p)
+	if err != nil {
+		sendErr := p.send(cmdReject, encodePayload(reject{tx.ID, err.Error()}))
+		if sendErr != nil {
+			slog.Warn("Can't send message", "command", cmdReject, "peer", p.addr, "err", sendErr)
+		}
+	}
+
+	return err
+}
+
+// acceptTransaction adds a valid new transaction to the mempool and relays
+// it to all peers but the one it came from. The peer is nil for
+// transactions posted to the HTTP API.
+func (s *Server) acceptTransaction(tx *Transaction, from *peer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bc == nil {
+		return nil
+	}
+
+	return s.addTransaction(tx, from)
+}
+
+// addTransaction does the work of acceptTransaction. A transaction from a
+// peer spending outputs of missing transactions is held as an orphan
+// instead of being rejected. The caller must hold s.mu.
+func (s *Server) addTransaction(tx *Transaction, from *peer) error {
+	// Transactions we already know are ignored, so relaying stops once every node has them
+	err := Mempool{s.bc}.Add(tx)
+	if errors.Is(err, errKnownTransaction) {
+		return nil
+	}
+	if err != nil {
+		if from != nil && s.holdOrphan(tx, from) {
+			return nil
+		}
+		return err
+	}
+
+	txID := hex.EncodeToString(tx.ID)
+	if from != nil {
+		slog.Info("Accepted transaction", "txid", txID, "peer", from.addr)
+	} else {
+		slog.Info("Accepted transaction", "txid", txID, "peer", "api")
+	}
+	s.events.publish(Event{Type: eventTxAccepted, Tx: tx})
+	go s.relayTransaction(tx, Mempool{s.bc}.Fee(tx), from)
+
+	if s.config.Role == roleMiner {
+		s.minePending()
+	}
+
+	return nil
+}
+
+// handleReject logs a rejection of a transaction we relayed to a peer
+func handleReject(p *peer, payload []byte) error {
+	var r reject
+	err := decodePayload(payload, &r)
+	if err != nil {
+		return err
+	}
+
+	slog.Warn("Transaction rejected by peer", hashAttr("txid", r.Txid), "peer", p.addr, "reason", r.Reason)
+	return nil
+}
+
+// dropInvalidPending removes mempool transactions that a new chain tip made
+// invalid, because another transaction spent their inputs. The caller must
+// hold s.mu.
+func (s *Server) dropInvalidPending() {
+	dropped := Mempool{s.bc}.DropInvalid()
+	for txID, err := range dropped {
+		slog.Warn("Dropped pending transaction", "txid", txID, "err", err)
+	}
+}
+
+// expirePending evicts the mempool transactions that waited longer than
+// mempoolExpiry to be mined, every mempoolExpiryInterval until the program
+// exits. Each one is published as a tx.expired event, so the wallet that sent
+// it can send it again or spend its outputs another way.
+func (s *Server) expirePending() {
+	for {
+		time.Sleep(mempoolExpiryInterval)
+
+		s.mu.Lock()
+		if s.bc != nil {
+			expired := Mempool{s.bc}.Expire()
+			for _, tx := range expired {
+				slog.Info("Pending transaction expired unmined", hashAttr("txid", tx.ID), "expiry", mempoolExpiry)
+				s.events.publish(Event{Type: eventTxExpired, Tx: tx})
+			}
+
+			// Drop them from the block being mined too
+			if len(expired) > 0 && s.stopMining != nil {
+				s.minePending()
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// minePending starts mining the mempool into a new block, the transactions
+// with the highest fee rates that fit, paying the reward and their fees to
+// the node's reward address. A block already being mined is dropped for the new one.
+// The proof of work runs without holding s.mu, so the node keeps handling
+// peers meanwhile, and the block is added and announced to the peers once
+// it's found. Mining goes on with the next block while transactions are
+// left. The caller must hold s.mu.
+func (s *Server) minePending() {
+	if s.stopMining != nil {
+		s.stopMining()
+	}
+
+	txs := Mempool{s.bc}.AssembleBlock(s.config.RewardAddress)
+	block := s.bc.blockTemplate(txs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopMining = cancel
+
+	go func() {
+		err := block.Mine(ctx)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		// Dropped for another block after the solution was found
+		if ctx.Err() != nil {
+			return
+		}
+		cancel()
+		s.stopMining = nil
+
+		err = s.bc.storeMinedBlock(block)
+		if err != nil {
+			slog.Warn("Dropped mined block", hashAttr("hash", block.Hash), "err", err)
+			return
+		}
+		slog.Info("Mined block", hashAttr("hash", block.Hash), "height", block.Height, "transactions", len(txs))
+		s.events.publish(Event{Type: eventBlockConnected, Block: block})
+
+		go s.broadcast(cmdInv, encodePayload(inventory{[][]byte{block.Hash}}), nil)
+		s.processOrphans()
+
+		// Transactions that didn't fit go into the next block
+		if s.stopMining == nil && len(Mempool{s.bc}.Transactions()) > 0 {
+			s.minePending()
+		}
+	}()
+}
+
+// restartMining drops the block being mined after the tip changed, since it
+// extends a block that's no longer the tip, and mines the mempool on the new
+// tip if it isn't empty. The caller must hold s.mu.
+func (s *Server) restartMining() {
+	if s.stopMining == nil {
+		return
+	}
+
+	s.stopMining()
+	s.stopMining = nil
+	slog.Info("Stopped mining on the previous tip")
+
+	if len(Mempool{s.bc}.Transactions()) > 0 {
+		s.minePending()
+	}
+}
+
+// blockLocator lists hashes of the active chain so a peer can find the last
+// block we have in common: the 10 most recent blocks, then going back with
+// doubling steps, and always the genesis block
+func (bc *Blockchain) blockLocator() [][]byte {
+	var locator [][]byte
+
+	step := 1
+	for height := bc.GetBestHeight(); height > 0; height -= step {
+		hash, err := bc.GetBlockHash(height)
+		if err != nil {
+			log.Panic(err)
+		}
+		locator = append(locator, hash)
+
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+
+	genesis, err := bc.GetBlockHash(0)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return append(locator, genesis)
+}
+
+// SendTransaction hands a transaction to a running node instead of mining it
+// locally. The node validates it, keeps it until it's mined and relays it to
+// its peers.
+// Parameters:
+//   - addr: Address (host:port) of the node
+//   - config: TLS configuration, nil if the node doesn't use TLS
+//   - tx: The transaction
+func SendTransaction(addr string, config *tls.Config, tx *Transaction) error {
+	conn, err := dialNode(addr, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	// A wallet has no chain to offer, it only announces itself to get past the handshake
+	err = writeMessage(conn, message{cmdVersion, encodePayload(version{Version: protocolVersion, BestHeight: -1})})
+	if err != nil {
+		return err
+	}
+
+	for gotVersion, gotVerack := false, false; !gotVersion || !gotVerack; {
+		msg, err := readMessage(r)
+		if err != nil {
+			return fmt.Errorf("handshake with %s failed: %w", addr, err)
+		}
+
+		switch msg.Command {
+		case cmdVersion:
+			gotVersion = true
+			err = writeMessage(conn, message{cmdVerack, nil})
+			if err != nil {
+				return err
+			}
+		case cmdVerack:
+			gotVerack = true
+		}
+	}
+
+	err = writeMessage(conn, message{cmdTx, encodePayload(tx)})
+	if err != nil {
+		return err
+	}
+
+	// The node only answers if it rejects the transaction
+	err = conn.SetReadDeadline(time.Now().Add(rejectWaitTimeout))
+	if err != nil {
+		return err
+	}
+	for {
+		msg, err := readMessage(r)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil
+		}
+		if errors.Is(err, errBadChecksum) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if msg.Command == cmdReject {
+			var r reject
+			err = decodePayload(msg.Payload, &r)
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(r.Txid, tx.ID) {
+				return fmt.Errorf("transaction rejected by %s: %s", addr, r.Reason)
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// The chain is kept in a Store, a key/value database of named buckets like
+// BoltDB's, so the chain logic doesn't depend on one database. Every read
+// runs in a View and every write in an Update, a transaction applied
+// atomically: either all the writes of an Update are stored or none, which
+// is what keeps a block and the chain state derived from it consistent, see
+// connectBlock. Keys within a bucket are kept sorted, so cursors visit them
+// in byte order. BoltDB is the backend of the blockchain files, see
+// bolt_store.go, and with -ephemeral the chain is kept in memory instead, see
+// memory_store.go.
+
+// Errors of stores
+var (
+	errBucketNotFound = errors.New("bucket not found")
+	errBucketExists   = errors.New("bucket already exists")
+)
+
+// ephemeral is whether the chain is kept in memory, not in dbFile, set with
+// -ephemeral
+var ephemeral = false
+
+// ephemeralStore is the chain of the process when ephemeral, nil until it's
+// created
+var ephemeralStore *memoryStore
+
+// openStore opens the database of the chain: dbFile, or when ephemeral the
+// in-memory store shared by the whole process
+func openStore() (Store, error) {
+	if !ephemeral {
+		return openBoltStore(dbFile)
+	}
+
+	if ephemeralStore == nil {
+		ephemeralStore = newMemoryStore()
+	}
+	return ephemeralStore, nil
+}
+
+// Store is a database of buckets
+type Store interface {
+	// View runs a read-only transaction
+	View(fn func(tx StoreTx) error) error
+	// Update runs a read-write transaction, applying its writes only if fn
+	// returns nil
+	Update(fn func(tx StoreTx) error) error
+	// Backup writes a consistent copy of the database to w, as a BoltDB file
+	// like the blockchain files, while other transactions go on
+	Backup(w io.Writer) error
+	// Close releases the database
+	Close() error
+}
+
+// StoreTx is a transaction of a Store. Values read in it are only valid until
+// it ends.
+type StoreTx interface {
+	// Bucket returns a bucket, nil if it doesn't exist
+	Bucket(name []byte) StoreBucket
+	// CreateBucket creates a bucket, failing with errBucketExists if it exists
+	CreateBucket(name []byte) (StoreBucket, error)
+	// CreateBucketIfNotExists returns a bucket, creating it if needed
+	CreateBucketIfNotExists(name []byte) (StoreBucket, error)
+	// DeleteBucket deletes a bucket and its keys, failing with
+	// errBucketNotFound if it doesn't exist
+	DeleteBucket(name []byte) error
+}
+
+// StoreBucket is a bucket of keys and values
+type StoreBucket interface {
+	// Get returns the value of a key, nil if it has none
+	Get(key []byte) []byte
+	// Put sets the value of a key
+	Put(key, value []byte) error
+	// Delete removes a key, if it exists
+	Delete(key []byte) error
+	// Cursor returns a cursor over the keys in order
+	Cursor() StoreCursor
+	// ForEach calls fn for each key in order, stopping at its first error
+	ForEach(fn func(k, v []byte) error) error
+	// KeyCount returns the number of keys
+	KeyCount() int
+}
+
+// StoreCursor iterates over the keys of a bucket in order. The methods return
+// a nil key once there are no more keys.
+type StoreCursor interface {
+	// First moves to the first key
+	First() (key, value []byte)
+	// Next moves to the next key
+	Next() (key, value []byte)
+	// Seek moves to the first key at or after a key
+	Seek(seek []byte) (key, value []byte)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"log/slog"
+)
+
+// A node downloading a long chain gets it in full inventories of maxInvItems
+// blocks (see handleInv), which arrive one block message at a time. Rather
+// than connecting each in a database transaction of its own, the blocks of a
+// full inventory extending the tip are queued and imported together with
+// ImportBlocks once importBatchSize of them arrived, or the last block of the
+// inventory did. Anything else arriving flushes the queue first, so blocks are
+// still added in order, and so does the peer disconnecting.
+
+// queueSyncBlock queues a block of a full inventory extending the tip or the
+// queued blocks, importing the queue once it's full or the inventory
+// complete. The caller must hold s.mu.
+// Parameters:
+//   - block: The block received
+//   - p: The peer it came from
+//
+// Returns:
+//   - bool: Whether the block was queued, otherwise it's added as usual
+func (s *Server) queueSyncBlock(block *Block, p *peer) bool {
+	if p.syncHash == nil {
+		s.flushSyncBlocks()
+		return false
+	}
+
+	last := s.bc.tip
+	if n := len(s.syncBlocks); n > 0 {
+		last = s.syncBlocks[n-1].Hash
+	}
+	if s.syncPeer != p || !bytes.Equal(block.PrevBlockHash, last) {
+		s.flushSyncBlocks()
+		if !bytes.Equal(block.PrevBlockHash, s.bc.tip) {
+			return false
+		}
+	}
+
+	s.syncBlocks = append(s.syncBlocks, block)
+	s.syncPeer = p
+	if len(s.syncBlocks) >= importBatchSize || bytes.Equal(block.Hash, p.syncHash) {
+		s.flushSyncBlocks()
+	}
+
+	return true
+}
+
+// isQueuedSyncBlock checks whether a block is queued to be imported. The
+// caller must hold s.mu.
+func (s *Server) isQueuedSyncBlock(hash []byte) bool {
+	for _, block := range s.syncBlocks {
+		if bytes.Equal(block.Hash, hash) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// flushSyncBlocks imports the queued blocks and announces them to the other
+// peers, like addBlock does for a single block. The caller must hold s.mu.
+func (s *Server) flushSyncBlocks() {
+	blocks, p := s.syncBlocks, s.syncPeer
+	s.syncBlocks, s.syncPeer = nil, nil
+	if len(blocks) == 0 || s.bc == nil {
+		return
+	}
+
+	n, err := s.bc.ImportBlocks(blocks)
+	if err != nil {
+		hash := hex.EncodeToString(blocks[n].Hash)
+		slog.Warn("Block rejected", "hash", hash, "peer", p.addr, "err", err)
+		s.rejected[hash] = true
+		s.rejectOrphanBlocks(blocks[n].Hash)
+	}
+	imported := blocks[:n]
+	if len(imported) == 0 {
+		return
+	}
+
+	last := imported[len(imported)-1]
+	slog.Info("Imported blocks", "blocks", len(imported), hashAttr("hash", last.Hash), "height", last.Height, "peer", p.addr)
+	s.reportSyncProgress(imported[0].Height, last.Height, p)
+
+	var inv inventory
+	for _, block := range imported {
+		if s.bc.IsInActiveChain(block) {
+			s.events.publish(Event{Type: eventBlockConnected, Block: block})
+		}
+		inv.Items = append(inv.Items, block.Hash)
+	}
+	s.restartMining()
+	s.dropInvalidPending()
+	s.processOrphans()
+	for _, block := range imported {
+		s.connectOrphanBlocks(block.Hash)
+	}
+
+	// The last block of the full inventory arrived, continue syncing
+	if bytes.Equal(last.Hash, p.syncHash) {
+		p.syncHash = nil
+		go s.requestBlocks(p)
+	}
+
+	go s.broadcast(cmdInv, encodePayload(inv), p)
+}
+
+// reportSyncProgress logs the progress of downloading the chain up to the
+// best height of a peer every progressInterval, starting once a node is
+// behind and stopping once it caught up. The caller must hold s.mu.
+// Parameters:
+//   - from: Height of the first block just added
+//   - height: Height of the last block just added
+//   - p: The peer they came from
+func (s *Server) reportSyncProgress(from, height int, p *peer) {
+	if s.syncProgress == nil {
+		if height >= p.bestHeight {
+			return
+		}
+		s.syncProgress = newProgressTracker(logProgress{}, "Syncing blocks", from, p.bestHeight+1)
+	}
+
+	// Blocks are counted from the genesis block, a block more than the height
+	s.syncProgress.update(height+1, max(p.bestHeight, height)+1)
+	if height >= p.bestHeight {
+		s.syncProgress = nil
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+// An output with a lock height can't be spent before it, like a Bitcoin
+// output whose script starts with OP_CHECKLOCKTIMEVERIFY (BIP 65): blocks and
+// the mempool reject a transaction spending it in a block lower than the lock
+// height, so the coins are held back by consensus rather than by the wallet
+// of their owner. Transaction lock times (see locktime.go) delay when a
+// payment can be mined; lock heights delay when its recipient can spend it,
+// for vesting or savings. A lock height of 0 doesn't lock the output.
+
+// IsSpendableAt checks whether a transaction of a block can spend the output
+// Parameters:
+//   - height: Height of the block
+func (out TXOutput) IsSpendableAt(height int) bool {
+	return height >= out.LockHeight
+}
+
+// hasTimeLockedOutputs checks whether an output of the transaction has a
+// lock height
+func (tx Transaction) hasTimeLockedOutputs() bool {
+	for _, out := range tx.Vout {
+		if out.LockHeight != 0 {
+			return true
+		}
+	}
+
+	return false
+}
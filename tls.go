@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// Files holding the TLS certificate and private key of a node, moved by
+// selectNetwork
+var (
+	tlsCertFile = "node.crt"
+	tlsKeyFile  = "node.key"
+)
+
+// tlsCertValidity is how long a generated certificate is valid for
+const tlsCertValidity = 10 * 365 * 24 * time.Hour
+
+// Connections can optionally be encrypted with TLS. There is no certificate
+// authority in a peer-to-peer network, so every node generates a self-signed
+// certificate on its first TLS run. Without pinned certificates the traffic is
+// encrypted but the other side isn't authenticated; with them, a connection is
+// only kept if the node dialed presents one of the pinned certificates.
+
+// loadOrCreateCertificate loads the node's certificate, generating a
+// self-signed one if there is none yet
+// Returns:
+//   - tls.Certificate: The certificate and its private key
+func loadOrCreateCertificate() (tls.Certificate, error) {
+	if _, err := os.Stat(tlsCertFile); os.IsNotExist(err) {
+		err = createCertificate()
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+
+	return tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+}
+
+// createCertificate generates a self-signed certificate and writes it and its
+// private key to the certificate files
+func createCertificate() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "go-blockchain node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(tlsCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(tlsKeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Generated TLS certificate", "file", tlsCertFile)
+	return os.WriteFile(tlsCertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// certFingerprint returns the SHA-256 hash of a DER encoded certificate
+func certFingerprint(der []byte) []byte {
+	hash := sha256.Sum256(der)
+	return hash[:]
+}
+
+// loadPinnedCertificates reads the certificates to trust from a PEM file
+// Parameters:
+//   - filename: File with one or more PEM certificates, usually other nodes' node.crt
+//
+// Returns:
+//   - [][]byte: The DER encoded certificates
+func loadPinnedCertificates(filename string) ([][]byte, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var pins [][]byte
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			pins = append(pins, block.Bytes)
+		}
+	}
+
+	if len(pins) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", filename)
+	}
+
+	return pins, nil
+}
+
+// clientTLSConfig builds the TLS configuration to dial nodes with
+// Parameters:
+//   - pinFile: File with the certificates to trust, empty to accept any certificate
+//   - cert: Certificate to present to the node, nil for none
+func clientTLSConfig(pinFile string, cert *tls.Certificate) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// Node certificates are self-signed, so they're checked against the pins
+		// instead of a certificate authority
+		InsecureSkipVerify: true,
+	}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+
+	if pinFile == "" {
+		return config, nil
+	}
+
+	pins, err := loadPinnedCertificates(pinFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("node presented no certificate")
+		}
+		for _, pin := range pins {
+			if bytes.Equal(rawCerts[0], pin) {
+				return nil
+			}
+		}
+		return fmt.Errorf("certificate %x is not pinned", certFingerprint(rawCerts[0]))
+	}
+
+	return config, nil
+}
+
+// serverTLSConfig builds the TLS configuration to accept connections with
+// Parameters:
+//   - cert: The node's certificate
+func serverTLSConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+}
+
+// dialNode opens a connection to a node
+// Parameters:
+//   - addr: Address (host:port) of the node
+//   - config: TLS configuration, nil for a plain TCP connection
+func dialNode(addr string, config *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: nodeDialTimeout}
+	if config == nil {
+		return dialer.Dial("tcp", addr)
+	}
+
+	return tls.DialWithDialer(dialer, "tcp", addr, config)
+}
@@ -3,24 +3,37 @@ package main
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/gob"
-	"encoding/hex"
 	"fmt"
 	"log"
+	"strings"
 )
 
 // subsidy is the amount of reward given for mining a new block.
 // In Bitcoin, this value is halved approximately every 4 years.
-// Starting at 50 BTC, then 25 BTC, 12.5 BTC, and so on.
-const subsidy = 10
+// Starting at 50 BTC, then 25 BTC, 12.5 BTC, and so on. Here it only halves
+// for chains created with a halving_interval, see blockSubsidy.
+var subsidy = 10
+
+// maxMoney is the most coins an output may hold, and the value of the inputs,
+// the outputs or the reward of a transaction add up to, like Bitcoin's
+// MAX_MONEY. Bounding every value and sum keeps them far from overflowing.
+const maxMoney = 21_000_000 * 100_000_000
+
+// validMoney checks whether an amount is between 0 and maxMoney
+func validMoney(value int) bool {
+	return value >= 0 && value <= maxMoney
+}
 
 // Transaction represents a blockchain transaction, similar to Bitcoin's structure.
 // It contains inputs (references to previous outputs) and outputs (new coins).
 // The transaction ID is a hash of the entire transaction data.
 type Transaction struct {
-	ID   []byte     // Unique identifier of the transaction (hash of its contents)
-	Vin  []TXInput  // Array of transaction inputs (money being spent)
-	Vout []TXOutput // Array of transaction outputs (money being created/transferred)
+	ID       []byte     // Unique identifier of the transaction (hash of its contents)
+	Vin      []TXInput  // Array of transaction inputs (money being spent)
+	Vout     []TXOutput // Array of transaction outputs (money being created/transferred)
+	LockTime int64      // Height or Unix time before which it can't be mined, 0 for none, see locktime.go
 }
 
 // IsCoinbase checks whether the transaction is a coinbase transaction.
@@ -34,25 +47,106 @@ func (tx Transaction) IsCoinbase() bool {
 	return len(tx.Vin) == 1 && len(tx.Vin[0].Txid) == 0 && tx.Vin[0].Vout == -1
 }
 
-// SetID calculates and sets the transaction ID.
-// The ID is a SHA-256 hash of the entire transaction data (inputs and outputs)
-// encoded using GOB encoding (Go's binary format).
-func (tx *Transaction) SetID() {
+// Serialize converts the transaction into a byte array using GOB encoding.
+// Returns:
+//   - []byte: Serialized transaction data
+func (tx Transaction) Serialize() []byte {
 	var encoded bytes.Buffer
-	var hash [32]byte
 
-	// Create a new GOB encoder and encode the transaction
 	enc := gob.NewEncoder(&encoded)
 	err := enc.Encode(tx)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	// Calculate SHA-256 hash of the encoded transaction
-	hash = sha256.Sum256(encoded.Bytes())
+	return encoded.Bytes()
+}
+
+// SetID calculates and sets the transaction ID.
+// The ID is a SHA-256 hash of the transaction data (inputs and outputs) laid
+// out in a fixed binary format. GOB isn't used for this: its output depends
+// on the order types were first encoded in the running process, so nodes
+// recomputing the ID of a received transaction could get a different one.
+func (tx *Transaction) SetID() {
+	var data []byte
+
+	data = binary.BigEndian.AppendUint32(data, uint32(len(tx.Vin)))
+	for _, in := range tx.Vin {
+		data = appendVarBytes(data, in.Txid)
+		data = binary.BigEndian.AppendUint64(data, uint64(int64(in.Vout)))
+		data = appendVarBytes(data, []byte(in.ScriptSig))
+	}
+
+	data = binary.BigEndian.AppendUint32(data, uint32(len(tx.Vout)))
+	for _, out := range tx.Vout {
+		data = binary.BigEndian.AppendUint64(data, uint64(int64(out.Value)))
+		data = appendVarBytes(data, []byte(out.ScriptPubKey))
+	}
+
+	// Transactions created before lock times existed didn't hash one
+	if tx.LockTime != 0 {
+		data = binary.BigEndian.AppendUint64(data, uint64(tx.LockTime))
+	}
+
+	// Nor the NFTs of their outputs
+	if tx.carriesNFTs() {
+		for _, out := range tx.Vout {
+			data = appendVarBytes(data, out.NFT)
+		}
+	}
+
+	// Nor their lock heights
+	if tx.hasTimeLockedOutputs() {
+		for _, out := range tx.Vout {
+			data = binary.BigEndian.AppendUint64(data, uint64(int64(out.LockHeight)))
+		}
+	}
+
+	hash := sha256.Sum256(data)
 	tx.ID = hash[:]
 }
 
+// appendVarBytes appends a length-prefixed byte string
+func appendVarBytes(data, b []byte) []byte {
+	data = binary.BigEndian.AppendUint32(data, uint32(len(b)))
+	return append(data, b...)
+}
+
+// String returns a human-readable representation of the transaction,
+// listing its inputs and outputs.
+func (tx Transaction) String() string {
+	var lines []string
+
+	lines = append(lines, fmt.Sprintf("--- Transaction %x:", tx.ID))
+	if tx.LockTime != 0 {
+		lines = append(lines, fmt.Sprintf("     Lock time: %s", describeLockTime(tx.LockTime)))
+	}
+
+	for i, input := range tx.Vin {
+		lines = append(lines, fmt.Sprintf("     Input %d:", i))
+		lines = append(lines, fmt.Sprintf("       TXID:      %x", input.Txid))
+		lines = append(lines, fmt.Sprintf("       Out:       %d", input.Vout))
+		lines = append(lines, fmt.Sprintf("       ScriptSig: %s", input.ScriptSig))
+	}
+
+	for i, output := range tx.Vout {
+		lines = append(lines, fmt.Sprintf("     Output %d:", i))
+		lines = append(lines, fmt.Sprintf("       Value:        %d", output.Value))
+		lines = append(lines, fmt.Sprintf("       ScriptPubKey: %s", output.ScriptPubKey))
+		if output.IsDataCarrier() {
+			lines = append(lines, fmt.Sprintf("       Data:         %q", output.CarriedData()))
+		}
+		if len(output.NFT) > 0 {
+			lines = append(lines, fmt.Sprintf("       NFT:          %x", output.NFT))
+		}
+		if output.LockHeight != 0 {
+			lines = append(lines, fmt.Sprintf("       Locked until: height %d", output.LockHeight))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
 // TXInput represents a transaction input.
 // In a blockchain, inputs are references to previous transaction outputs
 // that are being spent in the current transaction.
@@ -68,6 +162,8 @@ type TXInput struct {
 type TXOutput struct {
 	Value        int    // The amount of coins
 	ScriptPubKey string // The script that specifies spending conditions (usually contains the owner's address)
+	NFT          []byte // ID of the NFT the output carries, nil for none, see nft.go
+	LockHeight   int    // Height of the first block that may spend it, 0 for none, see timelock.go
 }
 
 // CanUnlockOutputWith checks if the provided data can unlock this input.
@@ -90,66 +186,154 @@ func (out *TXOutput) CanBeUnlockedWith(unlockingData string) bool {
 // Parameters:
 //   - to: The address that will receive the mining reward
 //   - data: Optional data to include in the transaction (like a message)
-func NewCoinbaseTX(to, data string) *Transaction {
+//   - value: The reward paid
+func NewCoinbaseTX(to, data string, value int) *Transaction {
 	if data == "" {
 		data = fmt.Sprintf("Reward to '%s'", to)
 	}
 
 	// Create input: empty txID, vout = -1, and data as ScriptSig
 	txin := TXInput{[]byte{}, -1, data}
-	// Create output: value = mining reward, ScriptPubKey = recipient's address
-	txout := TXOutput{subsidy, to}
+	// Create output: value = mining reward, ScriptPubKey = recipient's address.
+	// Coinbase outputs must have a value, so once the subsidy ran out a
+	// block without fees pays nothing
+	var txouts []TXOutput
+	if value > 0 {
+		txouts = append(txouts, TXOutput{value, to, nil, 0})
+	}
 	// Create and return the transaction
-	tx := Transaction{nil, []TXInput{txin}, []TXOutput{txout}}
+	tx := Transaction{nil, []TXInput{txin}, txouts, 0}
 	tx.SetID()
 
 	return &tx
 }
 
+// NewRewardTX creates the coinbase transaction paying the reward of a mined
+// block. The height makes the coinbase of every block unique.
+// Parameters:
+//   - to: The address that will receive the mining reward
+//   - height: Height of the block being mined
+func NewRewardTX(to string, height int) *Transaction {
+	return NewCoinbaseTX(to, fmt.Sprintf("Reward to '%s' at height %d", to, height), blockSubsidy(height))
+}
+
+// SendOptions are the optional settings of a new transaction
+type SendOptions struct {
+	Fee      int    // Fee paid to the miner of the transaction, 0 for none
+	Data     []byte // Data to attach in a data-carrier output, nil for none, see datacarrier.go
+	LockTime int64  // Height or Unix time before which it can't be mined, 0 for none, see locktime.go
+
+	// LockedUntil is the height from which the recipient can spend the
+	// payment, 0 for none, see timelock.go
+	LockedUntil int
+
+	// CoinSelection is the strategy choosing the outputs to spend, see
+	// coinselect.go, empty for defaultCoinSelection
+	CoinSelection string
+}
+
 // NewUTXOTransaction creates a new transaction transferring value between addresses.
 // This implements the UTXO (Unspent Transaction Output) model used by Bitcoin.
+// Funds are collected from the sender's address and all of its change addresses,
+// and any change is sent to a freshly derived change address instead of back to
+// the sender. Outputs locked in the wallet are never selected. The fee is
+// collected on top of the amount and left out of the outputs, for the miner,
+// along with change too small to be worth spending (see dust.go), and the
+// data is attached after the payment, which can be locked until a height.
+// The outputs spent are chosen with the coin selection strategy of the options.
 // Parameters:
 //   - from: Sender's address
 //   - to: Recipient's address
 //   - amount: Amount to send
-//   - bc: Pointer to the blockchain to verify and find UTXOs
-func NewUTXOTransaction(from, to string, amount int, bc *Blockchain) *Transaction {
-	var inputs []TXInput
+//   - options: The fee, data, lock time, lock height and coin selection
+//   - UTXOSet: The UTXO set to find spendable outputs in
+//   - wallet: The wallet tracking the sender's change addresses
+func NewUTXOTransaction(from, to string, amount int, options SendOptions, UTXOSet *UTXOSet, wallet *Wallet) *Transaction {
+	needed := amount + options.Fee
+	inputs, acc := selectFunds(from, needed, options.CoinSelection, UTXOSet, wallet)
+
+	// Build a list of outputs
+	// First output is the payment to the recipient
 	var outputs []TXOutput
+	payment := TXOutput{amount, to, nil, options.LockedUntil}
+	if payment.IsDust() {
+		log.Panicf("ERROR: Amount %d is dust, spending it would cost %d", amount, dustThreshold(payment))
+	}
+	outputs = append(outputs, payment)
+	if options.Data != nil {
+		outputs = append(outputs, NewDataOutput(options.Data))
+	}
+	outputs = append(outputs, changeOutputs(from, acc-needed, wallet)...)
 
-	// Find and verify sufficient funds in the blockchain
-	acc, validOutputs := bc.FindSpendableOutputs(from, amount)
+	// Create, set ID, and return the transaction
+	tx := Transaction{nil, inputs, outputs, options.LockTime}
+	tx.SetID()
 
-	if acc < amount {
-		log.Panic("ERROR: Not enough funds")
+	return &tx
+}
+
+// selectFunds chooses outputs of the sender and its change addresses with a
+// coin selection strategy, skipping the outputs locked in the wallet, and
+// panics if they can't cover the amount needed
+// Parameters:
+//   - from: Sender's address
+//   - needed: Value the inputs must cover, nothing is selected for 0
+//   - coinSelection: The coin selection strategy, see coinselect.go
+//   - UTXOSet: The UTXO set to find spendable outputs in
+//   - wallet: The wallet tracking the sender's change addresses
+//
+// Returns:
+//   - []TXInput: Inputs spending the selected outputs, unlocked by the address owning each
+//   - int: Value of the selected outputs
+func selectFunds(from string, needed int, coinSelection string, UTXOSet *UTXOSet, wallet *Wallet) ([]TXInput, int) {
+	if needed == 0 {
+		return nil, 0
 	}
 
-	// Build a list of inputs by referencing previous outputs
-	for txid, outs := range validOutputs {
-		txID, err := hex.DecodeString(txid)
-		if err != nil {
-			log.Panic(err)
-		}
+	selector, err := lookupCoinSelector(coinSelection)
+	if err != nil {
+		log.Panic(err)
+	}
 
-		// Create an input for each output we're spending
-		for _, out := range outs {
-			input := TXInput{txID, out, from}
-			inputs = append(inputs, input)
-		}
+	// Find and verify sufficient funds across all of the sender's addresses
+	var candidates []SpendableOutput
+	for _, address := range wallet.Addresses(from) {
+		candidates = append(candidates, UTXOSet.FindSpendableOutputs(address, wallet.LockedOutputs)...)
 	}
 
-	// Build a list of outputs
-	// First output is the payment to the recipient
-	outputs = append(outputs, TXOutput{amount, to})
+	selected := selector(candidates, needed)
+	if selected == nil {
+		log.Panic("ERROR: Not enough funds")
+	}
 
-	// If there are leftover funds, send them back to sender as change
-	if acc > amount {
-		outputs = append(outputs, TXOutput{acc - amount, from})
+	// Create an input for each output we're spending,
+	// unlocked by the address that owns the output
+	var inputs []TXInput
+	acc := 0
+	for _, s := range selected {
+		inputs = append(inputs, TXInput{s.Txid, s.Vout, s.Output.ScriptPubKey})
+		acc += s.Output.Value
 	}
 
-	// Create, set ID, and return the transaction
-	tx := Transaction{nil, inputs, outputs}
-	tx.SetID()
+	return inputs, acc
+}
 
-	return &tx
+// changeOutputs returns the output paying leftover funds to a fresh change
+// address of the sender, none if there are none or they're dust and left to
+// the miner
+// Parameters:
+//   - from: Sender's address
+//   - change: The leftover funds
+//   - wallet: The wallet deriving the change address
+func changeOutputs(from string, change int, wallet *Wallet) []TXOutput {
+	if change <= 0 {
+		return nil
+	}
+
+	out := TXOutput{change, wallet.deriveChangeAddress(from, len(wallet.ChangeAddresses[from])), nil, 0}
+	if out.IsDust() {
+		return nil
+	}
+
+	return []TXOutput{{change, wallet.NewChangeAddress(from), nil, 0}}
 }
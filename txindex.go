@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// txIndexBucket is the bucket mapping transaction IDs to the hash of the block containing them
+const txIndexBucket = "txindex"
+
+// FindTransaction looks up a transaction of the active chain by its ID
+// Parameters:
+//   - id: ID of the transaction
+//
+// Returns:
+//   - Transaction: The transaction
+func (bc *Blockchain) FindTransaction(id []byte) (Transaction, error) {
+	block, err := bc.TransactionBlock(id)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if block.IsPruned() {
+		return Transaction{}, fmt.Errorf("transaction %x of block %x: %w", id, block.Hash, errPrunedData)
+	}
+
+	for _, tx := range block.Transactions {
+		if bytes.Equal(tx.ID, id) {
+			return *tx, nil
+		}
+	}
+
+	return Transaction{}, fmt.Errorf("transaction %x is missing from block %x", id, block.Hash)
+}
+
+// TransactionBlock looks up the block of the active chain containing a transaction
+// Parameters:
+//   - id: ID of the transaction
+//
+// Returns:
+//   - *Block: The block containing the transaction
+func (bc *Blockchain) TransactionBlock(id []byte) (*Block, error) {
+	var block *Block
+
+	err := bc.db.View(func(tx StoreTx) error {
+		blockHash := tx.Bucket([]byte(txIndexBucket)).Get(id)
+		if blockHash == nil {
+			return fmt.Errorf("transaction %x not found", id)
+		}
+
+		block = getBlock(tx, blockHash)
+		if block == nil {
+			return fmt.Errorf("block %x of transaction %x not found", blockHash, id)
+		}
+
+		return nil
+	})
+
+	return block, err
+}
+
+// Confirmations counts the blocks from the tip down to and including a block
+// of the active chain
+// Parameters:
+//   - block: The block
+//
+// Returns:
+//   - int: Number of confirmations, 1 for the tip
+func (bc *Blockchain) Confirmations(block *Block) (int, error) {
+	if !bc.IsInActiveChain(block) {
+		return 0, errors.New("block is not on the active chain")
+	}
+
+	return bc.GetBestHeight() - block.Height + 1, nil
+}
+
+// updateTransactionIndex records the block of every transaction in a new block
+// Parameters:
+//   - tx: The database transaction storing the block
+//   - block: The block being added to the chain
+func updateTransactionIndex(tx StoreTx, block *Block) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(txIndexBucket))
+	if err != nil {
+		return err
+	}
+
+	for _, transaction := range block.Transactions {
+		err = b.Put(transaction.ID, block.Hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reindexTransactions rebuilds the transaction index from the active chain
+// Parameters:
+//   - progress: Told how far the rebuild got, may be nil
+func (bc *Blockchain) reindexTransactions(progress ProgressReporter) {
+	err := bc.db.Update(func(tx StoreTx) error {
+		err := tx.DeleteBucket([]byte(txIndexBucket))
+		if err != nil && err != errBucketNotFound {
+			return err
+		}
+
+		total := DeserializeBlock(tx.Bucket([]byte(blocksBucket)).Get(bc.tip)).Height + 1
+		tracker := newProgressTracker(progress, "Rebuilding the transaction index", 0, total)
+
+		// Walk back from the tip and index every block of the active chain
+		for hash, indexed := bc.tip, 0; len(hash) > 0; {
+			block := getBlock(tx, hash)
+
+			err = updateTransactionIndex(tx, block)
+			if err != nil {
+				return err
+			}
+			indexed++
+			tracker.update(indexed, total)
+
+			hash = block.PrevBlockHash
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+)
+
+// listunspent lists the unspent outputs of an address, or of every address of
+// the wallet, like Bitcoin Core's listunspent: the outpoint, the value, the
+// confirmations of the block that created it and whether coin selection may
+// spend it. An output it can't spend says why, see unspendableReason. This is
+// for choosing outputs by hand with lockunspent or createrawtransaction, and
+// for tracking down a balance that doesn't add up.
+
+// UnspentOutput is an unspent output listed by listunspent
+type UnspentOutput struct {
+	Txid          []byte   // ID of the transaction containing the output
+	Vout          int      // Index of the output in the transaction
+	Output        TXOutput // The output
+	Confirmations int      // Blocks from the tip down to the one containing the transaction
+	Unspendable   string   // Why coin selection can't spend it, empty if it can
+}
+
+// unspendableReason returns why coin selection can't spend an output, see
+// FindSpendableOutputs
+// Parameters:
+//   - out: The output
+//   - outpoint: Its outpoint, see outpointKey
+//   - locked: Outpoints the user locked, may be nil
+//   - pending: mempoolSpentBucket, may be nil
+//   - next: Height of the next block
+//
+// Returns:
+//   - string: The reason, empty if it can be spent
+func unspendableReason(out TXOutput, outpoint string, locked map[string]bool, pending StoreBucket, next int) string {
+	switch {
+	case locked[outpoint]:
+		return "locked"
+	case pending != nil && pending.Get([]byte(outpoint)) != nil:
+		return "spent by a pending transaction"
+	case len(out.NFT) > 0:
+		return "carries an NFT"
+	case !out.IsSpendableAt(next):
+		return fmt.Sprintf("locked until height %d", out.LockHeight)
+	}
+
+	return ""
+}
+
+// ListUnspent lists the unspent outputs of an address in the order of the
+// address index
+// Parameters:
+//   - address: The address
+//   - locked: Outpoints the user locked, may be nil
+//
+// Returns:
+//   - []UnspentOutput: The outputs
+func (u UTXOSet) ListUnspent(address string, locked map[string]bool) []UnspentOutput {
+	var unspent []UnspentOutput
+	best := u.Blockchain.GetBestHeight()
+
+	err := u.Blockchain.db.View(func(tx StoreTx) error {
+		pending := tx.Bucket([]byte(mempoolSpentBucket))
+		txIndex := tx.Bucket([]byte(txIndexBucket))
+		headers := tx.Bucket([]byte(blocksBucket))
+
+		forEachAddressOutput(tx, address, func(txID []byte, outIdx int, out TXOutput) bool {
+			outpoint := outpointKey(hex.EncodeToString(txID), outIdx)
+
+			output := UnspentOutput{
+				Txid:        bytes.Clone(txID),
+				Vout:        outIdx,
+				Output:      out,
+				Unspendable: unspendableReason(out, outpoint, locked, pending, best+1),
+			}
+			if blockHash := txIndex.Get(txID); blockHash != nil {
+				if header := headers.Get(blockHash); header != nil {
+					output.Confirmations = best - DeserializeBlock(header).Height + 1
+				}
+			}
+			unspent = append(unspent, output)
+
+			return true
+		})
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return unspent
+}
@@ -16,3 +16,14 @@ func IntToHex(num int64) []byte {
 
 	return buff.Bytes()
 }
+
+// HexToInt converts a byte array created by IntToHex back to an int64
+func HexToInt(data []byte) int64 {
+	var num int64
+	err := binary.Read(bytes.NewReader(data), binary.BigEndian, &num)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return num
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"log"
+	"sort"
+)
+
+// utxoBucket is the bucket holding the UTXO set, keyed by transaction ID
+const utxoBucket = "chainstate"
+
+// UTXOSet is the set of all unspent transaction outputs, persisted in its own
+// bucket. Looking up outputs in it is much cheaper than scanning the whole
+// blockchain, which is what balance queries and coin selection used to do.
+// The set is updated in the same database transaction that stores each new block.
+type UTXOSet struct {
+	Blockchain *Blockchain // The blockchain the UTXO set belongs to
+}
+
+// TXOutputs holds the unspent outputs of a single transaction
+type TXOutputs struct {
+	Outputs map[int]TXOutput // Output index -> unspent output
+}
+
+// Indexes returns the output indexes in ascending order, so outputs are
+// always visited in the same order
+func (outs TXOutputs) Indexes() []int {
+	var indexes []int
+	for outIdx := range outs.Outputs {
+		indexes = append(indexes, outIdx)
+	}
+	sort.Ints(indexes)
+
+	return indexes
+}
+
+// Serialize converts the outputs into a byte array using GOB encoding
+func (outs TXOutputs) Serialize() []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(outs)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+// DeserializeOutputs converts a byte array back into TXOutputs
+func DeserializeOutputs(data []byte) TXOutputs {
+	var outputs TXOutputs
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&outputs)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return outputs
+}
+
+// FindSpendableOutputs finds the unspent outputs of an address that a new
+// transaction can spend, for coin selection to choose from (see
+// coinselect.go). Outputs are read from the address index with a single range
+// scan, in its order. Outputs already spent by a mempool transaction,
+// outputs carrying NFTs and outputs locked past the next block are skipped.
+// Parameters:
+//   - address: The address to find spendable outputs for
+//   - locked: Outpoints (see outpointKey) that must not be selected, may be nil
+//
+// Returns:
+//   - []SpendableOutput: The spendable outputs
+func (u UTXOSet) FindSpendableOutputs(address string, locked map[string]bool) []SpendableOutput {
+	var spendable []SpendableOutput
+	next := u.Blockchain.GetBestHeight() + 1
+
+	err := u.Blockchain.db.View(func(tx StoreTx) error {
+		pending := tx.Bucket([]byte(mempoolSpentBucket))
+
+		forEachAddressOutput(tx, address, func(txID []byte, outIdx int, out TXOutput) bool {
+			outpoint := outpointKey(hex.EncodeToString(txID), outIdx)
+
+			// Skip outputs the user locked to exclude them from coin selection,
+			// outputs pending transactions spend, outputs carrying NFTs,
+			// which only move with nft transfer, and outputs the next block
+			// can't spend yet
+			if unspendableReason(out, outpoint, locked, pending, next) == "" {
+				// Keys are only valid during the transaction
+				spendable = append(spendable, SpendableOutput{bytes.Clone(txID), outIdx, out})
+			}
+
+			return true
+		})
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return spendable
+}
+
+// FindUTXO finds all unspent transaction outputs for an address.
+// This is used to calculate account balance. Outputs are read from the
+// address index with a single range scan.
+// Parameters:
+//   - address: The address to find UTXOs for
+func (u UTXOSet) FindUTXO(address string) []TXOutput {
+	var UTXOs []TXOutput
+
+	err := u.Blockchain.db.View(func(tx StoreTx) error {
+		forEachAddressOutput(tx, address, func(txID []byte, outIdx int, out TXOutput) bool {
+			UTXOs = append(UTXOs, out)
+			return true
+		})
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return UTXOs
+}
+
+// FindUnspentOutput looks up a single unspent output owned by an address.
+// Parameters:
+//   - address: The address owning the output
+//   - txID: ID of the transaction containing the output
+//   - vout: Index of the output in the transaction
+//
+// Returns:
+//   - TXOutput: The output
+//   - bool: false if the output doesn't exist, was already spent, or isn't owned by the address
+func (u UTXOSet) FindUnspentOutput(address string, txID []byte, vout int) (TXOutput, bool) {
+	out, found := u.FindOutput(txID, vout)
+	return out, found && out.CanBeUnlockedWith(address)
+}
+
+// FindOutput looks up a single unspent output, whoever owns it
+// Parameters:
+//   - txID: ID of the transaction containing the output
+//   - vout: Index of the output in the transaction
+//
+// Returns:
+//   - TXOutput: The output
+//   - bool: false if the output doesn't exist or was already spent
+func (u UTXOSet) FindOutput(txID []byte, vout int) (TXOutput, bool) {
+	var out TXOutput
+	found := false
+
+	err := u.Blockchain.db.View(func(tx StoreTx) error {
+		data := tx.Bucket([]byte(utxoBucket)).Get(txID)
+		if data == nil {
+			return nil
+		}
+
+		out, found = cachedOutputs(txID, data).Outputs[vout]
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return out, found
+}
+
+// CountTransactions returns the number of transactions with unspent outputs
+func (u UTXOSet) CountTransactions() int {
+	counter := 0
+
+	err := u.Blockchain.db.View(func(tx StoreTx) error {
+		counter = tx.Bucket([]byte(utxoBucket)).KeyCount()
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return counter
+}
+
+// Stats counts the unspent outputs and adds up their values, the coins in
+// circulation
+// Returns:
+//   - int: Number of unspent outputs
+//   - int: Their total value
+func (u UTXOSet) Stats() (int, int) {
+	outputs, total := 0, 0
+
+	err := u.Blockchain.db.View(func(tx StoreTx) error {
+		c := tx.Bucket([]byte(utxoBucket)).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			for _, out := range DeserializeOutputs(v).Outputs {
+				outputs++
+				total += out.Value
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return outputs, total
+}
+
+// Reindex rebuilds the UTXO set, its address index and the balance cache from
+// scratch by scanning the whole blockchain
+// Parameters:
+//   - progress: Told how far the scan got, may be nil
+func (u UTXOSet) Reindex(progress ProgressReporter) {
+	UTXO := u.Blockchain.FindUTXO(newProgressTracker(progress, "Rebuilding the UTXO set", 0, 0))
+
+	err := u.Blockchain.db.Update(func(tx StoreTx) error {
+		// Drop the old set, if there is one, and start over
+		err := tx.DeleteBucket([]byte(utxoBucket))
+		if err != nil && err != errBucketNotFound {
+			return err
+		}
+
+		b, err := tx.CreateBucket([]byte(utxoBucket))
+		if err != nil {
+			return err
+		}
+
+		for txID, outs := range UTXO {
+			key, err := hex.DecodeString(txID)
+			if err != nil {
+				return err
+			}
+
+			err = b.Put(key, outs.Serialize())
+			if err != nil {
+				return err
+			}
+		}
+
+		err = reindexAddresses(tx, UTXO)
+		if err != nil {
+			return err
+		}
+
+		return reindexBalances(tx, UTXO)
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// findSpentOutputs looks up every output spent by a block, either in the UTXO
+// set or among the outputs created earlier in the same block. It must run
+// before the UTXO set is updated for the block.
+// Parameters:
+//   - tx: The database transaction storing the block
+//   - block: The block being added to the chain
+//
+// Returns:
+//   - map[string]TXOutput: Outpoint (see outpointKey) -> spent output
+func findSpentOutputs(tx StoreTx, block *Block) map[string]TXOutput {
+	spent := make(map[string]TXOutput)
+	created := make(map[string]TXOutput)
+	utxos := tx.Bucket([]byte(utxoBucket))
+
+	for _, transaction := range block.Transactions {
+		if !transaction.IsCoinbase() {
+			for _, vin := range transaction.Vin {
+				key := outpointKey(hex.EncodeToString(vin.Txid), vin.Vout)
+
+				out, ok := created[key]
+				if !ok && utxos != nil {
+					if data := utxos.Get(vin.Txid); data != nil {
+						out, ok = DeserializeOutputs(data).Outputs[vin.Vout]
+					}
+				}
+				if ok {
+					spent[key] = out
+				}
+			}
+		}
+
+		for outIdx, out := range transaction.Vout {
+			created[outpointKey(hex.EncodeToString(transaction.ID), outIdx)] = out
+		}
+	}
+
+	return spent
+}
+
+// updateUTXOSet applies a new block to the UTXO set: outputs spent by the
+// block's transactions are removed and the outputs they create are added.
+// It runs inside the database transaction storing the block, so the UTXO set
+// always matches the tip.
+// Parameters:
+//   - tx: The database transaction storing the block
+//   - block: The block being added to the chain
+func updateUTXOSet(tx StoreTx, block *Block) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(utxoBucket))
+	if err != nil {
+		return err
+	}
+
+	for _, transaction := range block.Transactions {
+		// Remove the outputs spent by this transaction
+		if !transaction.IsCoinbase() {
+			for _, vin := range transaction.Vin {
+				data := b.Get(vin.Txid)
+				if data == nil {
+					continue
+				}
+
+				outs := DeserializeOutputs(data)
+				delete(outs.Outputs, vin.Vout)
+
+				if len(outs.Outputs) == 0 {
+					err = b.Delete(vin.Txid)
+				} else {
+					err = b.Put(vin.Txid, outs.Serialize())
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		// Add the outputs created by this transaction, data carriers can't be spent
+		newOutputs := TXOutputs{make(map[int]TXOutput)}
+		for outIdx, out := range transaction.Vout {
+			if !out.IsDataCarrier() {
+				newOutputs.Outputs[outIdx] = out
+			}
+		}
+		if len(newOutputs.Outputs) == 0 {
+			continue
+		}
+
+		err = b.Put(transaction.ID, newOutputs.Serialize())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
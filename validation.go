@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+)
+
+// Blocks and transactions received from peers can't be trusted, so they are
+// checked against the consensus rules before being stored or relayed.
+
+// checkTransactionID makes sure a transaction's ID is the hash of its contents
+func checkTransactionID(transaction *Transaction) error {
+	tx := Transaction{nil, transaction.Vin, transaction.Vout, transaction.LockTime}
+	tx.SetID()
+
+	if !bytes.Equal(tx.ID, transaction.ID) {
+		return fmt.Errorf("transaction %x has an invalid ID", transaction.ID)
+	}
+
+	return nil
+}
+
+// checkTransactionInputs validates the inputs of a non-coinbase transaction:
+// every input must spend an existing unspent output it can unlock, no output may
+// be spent twice, and the spent value must cover the value of the new outputs,
+// which must be positive except for valid data-carrier outputs. NFTs must be
+// passed on or minted as nft.go describes, and spent outputs must have
+// reached their lock height, see timelock.go.
+// What's left over is the fee, collected by the coinbase of the block.
+// Parameters:
+//   - transaction: The transaction to check
+//   - height: Height of the block including it
+//   - lookup: Returns the unspent output at an outpoint (see outpointKey)
+//   - spent: Outpoints already spent by other transactions being validated
+//     together, updated with the outpoints spent by this transaction
+func checkTransactionInputs(transaction *Transaction, height int, lookup func(outpoint string, txID []byte, vout int) (TXOutput, bool), spent map[string]bool) error {
+	if len(transaction.Vin) == 0 || len(transaction.Vout) == 0 {
+		return fmt.Errorf("transaction %x must have inputs and outputs", transaction.ID)
+	}
+
+	in, out := 0, 0
+	carried := make(map[string]bool)
+	for i, vin := range transaction.Vin {
+		outpoint := outpointKey(hex.EncodeToString(vin.Txid), vin.Vout)
+		if spent[outpoint] {
+			return fmt.Errorf("transaction %x input %d spends output %s twice", transaction.ID, i, outpoint)
+		}
+
+		prevOut, ok := lookup(outpoint, vin.Txid, vin.Vout)
+		if !ok || prevOut.IsDataCarrier() {
+			return fmt.Errorf("transaction %x input %d spends missing or spent output %s", transaction.ID, i, outpoint)
+		}
+		if !vin.CanUnlockOutputWith(prevOut.ScriptPubKey) {
+			return fmt.Errorf("transaction %x input %d can't unlock output %s", transaction.ID, i, outpoint)
+		}
+		if !prevOut.IsSpendableAt(height) {
+			return fmt.Errorf("transaction %x input %d spends output %s, locked until height %d", transaction.ID, i, outpoint, prevOut.LockHeight)
+		}
+
+		spent[outpoint] = true
+		in += prevOut.Value
+		if !validMoney(prevOut.Value) || !validMoney(in) {
+			return fmt.Errorf("transaction %x inputs add up to more than %d", transaction.ID, maxMoney)
+		}
+		if len(prevOut.NFT) > 0 {
+			carried[hex.EncodeToString(prevOut.NFT)] = true
+		}
+	}
+
+	for i, vout := range transaction.Vout {
+		if vout.IsDataCarrier() {
+			err := checkDataCarrier(vout)
+			if err != nil {
+				return fmt.Errorf("transaction %x output %d: %w", transaction.ID, i, err)
+			}
+			continue
+		}
+		if vout.Value <= 0 || vout.Value > maxMoney {
+			return fmt.Errorf("transaction %x has an output with invalid value %d", transaction.ID, vout.Value)
+		}
+		if vout.LockHeight < 0 {
+			return fmt.Errorf("transaction %x output %d has invalid lock height %d", transaction.ID, i, vout.LockHeight)
+		}
+		out += vout.Value
+		if !validMoney(out) {
+			return fmt.Errorf("transaction %x outputs add up to more than %d", transaction.ID, maxMoney)
+		}
+	}
+
+	if in < out {
+		return fmt.Errorf("transaction %x outputs (%d) spend more than its inputs (%d)", transaction.ID, out, in)
+	}
+
+	return checkNFTs(transaction, carried)
+}
+
+// chainStateLookup returns a lookup function for checkTransactionInputs reading
+// the UTXO set, and also finding the outputs in created
+func chainStateLookup(tx StoreTx, created map[string]TXOutput) func(string, []byte, int) (TXOutput, bool) {
+	utxos := tx.Bucket([]byte(utxoBucket))
+
+	return func(outpoint string, txID []byte, vout int) (TXOutput, bool) {
+		if out, ok := created[outpoint]; ok {
+			return out, true
+		}
+
+		data := utxos.Get(txID)
+		if data == nil {
+			return TXOutput{}, false
+		}
+
+		out, ok := cachedOutputs(txID, data).Outputs[vout]
+		return out, ok
+	}
+}
+
+// VerifyTransaction checks that a transaction can be added on top of the
+// current UTXO set and neither it nor the outputs it spends are locked past
+// the next block
+// Parameters:
+//   - transaction: The transaction to check
+func (u UTXOSet) VerifyTransaction(transaction *Transaction) error {
+	if transaction.IsCoinbase() {
+		return errors.New("coinbase transactions are only valid in blocks")
+	}
+
+	err := checkTransactionID(transaction)
+	if err != nil {
+		return err
+	}
+
+	err = u.Blockchain.db.View(func(tx StoreTx) error {
+		tip := DeserializeBlock(tx.Bucket([]byte(blocksBucket)).Get(u.Blockchain.tip))
+		err := checkFinalForNextBlock(tx, tip, transaction)
+		if err != nil {
+			return err
+		}
+
+		return checkTransactionInputs(transaction, tip.Height+1, chainStateLookup(tx, nil), make(map[string]bool))
+	})
+
+	return err
+}
+
+// Timestamp rules, as in Bitcoin
+const (
+	medianTimeSpan     = 11            // Number of blocks whose median timestamp a new block must be newer than
+	maxFutureBlockTime = 2 * time.Hour // How far ahead of the local clock a block's timestamp may be
+)
+
+// A block is checked in three stages before being connected: checkBlockHeader
+// needs nothing but the block, checkBlockContext the branch it extends, and
+// checkBlockTransactions the UTXO set of that branch, so it only runs for
+// blocks being connected. Side-branch blocks get the first two when stored.
+
+// checkBlockHeader validates a block on its own: the hash must match the
+// contents and meet the proof-of-work target it carries, which must be
+// between the hardest and the easiest targets, only the genesis block can
+// record a proof-of-work algorithm and it must be a known one, the timestamp can't be too
+// far in the future and the block can't be larger than maxBlockSize
+func checkBlockHeader(block *Block) error {
+	if target := block.Target(); target.Cmp(hardestTarget()) < 0 || target.Cmp(powLimit()) > 0 {
+		return fmt.Errorf("block %x has target %08x, outside of the allowed targets", block.Hash, block.Bits)
+	}
+
+	if block.PowAlgorithm != "" {
+		if block.Height != 0 {
+			return fmt.Errorf("block %x records a proof-of-work algorithm, only the genesis block can", block.Hash)
+		}
+		_, err := lookupHasher(block.PowAlgorithm)
+		if err != nil {
+			return fmt.Errorf("block %x: %w", block.Hash, err)
+		}
+	}
+
+	pow := NewProofOfWork(block)
+	hash := pow.hasher.Hash(pow.prepareData(block.Nonce))
+
+	if !bytes.Equal(hash[:], block.Hash) {
+		return fmt.Errorf("block %x has an invalid hash", block.Hash)
+	}
+	if !pow.Validate() {
+		return fmt.Errorf("block %x doesn't meet the proof-of-work target", block.Hash)
+	}
+
+	if limit := time.Now().Add(maxFutureBlockTime).Unix(); block.Timestamp > limit {
+		return fmt.Errorf("block %x has timestamp %d, more than %v in the future", block.Hash, block.Timestamp, maxFutureBlockTime)
+	}
+
+	// Checked before side-branch blocks are stored too, so no block can bloat the database
+	if size := block.Size(); size > maxBlockSize {
+		return fmt.Errorf("block %x has %d bytes, more than the limit of %d", block.Hash, size, maxBlockSize)
+	}
+
+	return nil
+}
+
+// checkBlockContext validates a block against the block it extends: it must
+// link to it, have the next height, carry the target the difficulty
+// adjustment expects, be newer than the median time past and only include
+// transactions whose lock time passed
+// Parameters:
+//   - tx: The database transaction
+//   - block: The block to check
+//   - parent: The block it extends
+func checkBlockContext(tx StoreTx, block, parent *Block) error {
+	if !bytes.Equal(block.PrevBlockHash, parent.Hash) {
+		return fmt.Errorf("block %x doesn't extend block %x", block.Hash, parent.Hash)
+	}
+	if block.Height != parent.Height+1 {
+		return fmt.Errorf("block %x has height %d, expected %d", block.Hash, block.Height, parent.Height+1)
+	}
+
+	err := checkBlockTarget(tx, block, parent)
+	if err != nil {
+		return err
+	}
+
+	mtp, err := medianTimePast(tx, parent)
+	if err != nil {
+		return err
+	}
+	if block.Timestamp <= mtp {
+		return fmt.Errorf("block %x has timestamp %d, not after the median time past %d", block.Hash, block.Timestamp, mtp)
+	}
+
+	err = checkLockTimes(tx, block, parent)
+	if err != nil {
+		return err
+	}
+
+	return checkDeployments(tx, block, parent)
+}
+
+// medianTimePast returns the median timestamp of a block and the ones before
+// it, medianTimeSpan blocks in all. Timestamps set by miners can be off, but
+// the median of several only moves forward, so a block extending them must
+// be newer.
+// Parameters:
+//   - tx: The database transaction
+//   - block: The last block of the span
+func medianTimePast(tx StoreTx, block *Block) (int64, error) {
+	blocks := tx.Bucket([]byte(blocksBucket))
+
+	var timestamps []int64
+	for {
+		timestamps = append(timestamps, block.Timestamp)
+		if len(timestamps) == medianTimeSpan || len(block.PrevBlockHash) == 0 {
+			break
+		}
+
+		data := blocks.Get(block.PrevBlockHash)
+		if data == nil {
+			return 0, fmt.Errorf("block %x not found", block.PrevBlockHash)
+		}
+		block = DeserializeBlock(data)
+	}
+
+	slices.Sort(timestamps)
+	return timestamps[len(timestamps)/2], nil
+}
+
+// checkBlockTarget checks that a block carries the target the difficulty
+// adjustment expects after its parent, see nextTarget. Blocks of side
+// branches are checked too, since they compete with the active chain on work.
+// Parameters:
+//   - tx: The database transaction
+//   - block: The block to check
+//   - parent: The block it extends
+func checkBlockTarget(tx StoreTx, block, parent *Block) error {
+	bits, err := nextTarget(tx, parent)
+	if err != nil {
+		return err
+	}
+	if block.Target().Cmp(compactToBig(bits)) != 0 {
+		return fmt.Errorf("block %x has target %08x, expected %08x", block.Hash, bigToCompact(block.Target()), bits)
+	}
+
+	return nil
+}
+
+// checkBlockTransactions validates the transactions of a block being
+// connected on top of the active tip: only the first may be a coinbase, which
+// pays at most the subsidy plus the fees of the other transactions, no transaction may appear twice or repeat one of
+// the active chain, no output may be spent twice, and every other
+// transaction must spend unspent outputs of the chain or of earlier
+// transactions of the block. Blocks mined before blocks paid a reward have
+// no coinbase.
+// Parameters:
+//   - tx: The database transaction
+//   - block: The block to check
+func checkBlockTransactions(tx StoreTx, block *Block) error {
+	if len(block.Transactions) == 0 {
+		return fmt.Errorf("block %x has no transactions", block.Hash)
+	}
+
+	err := checkBlockSpends(block)
+	if err != nil {
+		return err
+	}
+	err = checkTransactionIDs(block.Transactions)
+	if err != nil {
+		return err
+	}
+
+	created := make(map[string]TXOutput)
+	spent := make(map[string]bool)
+	seen := make(map[string]bool)
+	lookup := chainStateLookup(tx, created)
+	txIndex := tx.Bucket([]byte(txIndexBucket))
+	reward, fees := 0, 0
+
+	for i, transaction := range block.Transactions {
+		// Outputs are keyed by transaction ID, a repeated transaction would overwrite them
+		txID := hex.EncodeToString(transaction.ID)
+		if seen[txID] {
+			return fmt.Errorf("block %x contains transaction %s twice", block.Hash, txID)
+		}
+		seen[txID] = true
+		if txIndex != nil && txIndex.Get(transaction.ID) != nil {
+			return fmt.Errorf("block %x repeats transaction %s of block %x", block.Hash, txID, txIndex.Get(transaction.ID))
+		}
+
+		if transaction.IsCoinbase() {
+			if i != 0 {
+				return fmt.Errorf("block %x has a coinbase that isn't the first transaction", block.Hash)
+			}
+
+			for _, out := range transaction.Vout {
+				if len(out.NFT) > 0 {
+					return fmt.Errorf("block %x has a coinbase carrying NFT %x", block.Hash, out.NFT)
+				}
+				// A negative output would let the others pay more than the reward
+				if out.Value <= 0 || out.Value > maxMoney {
+					return fmt.Errorf("block %x has a coinbase output with invalid value %d", block.Hash, out.Value)
+				}
+				reward += out.Value
+				if !validMoney(reward) {
+					return fmt.Errorf("block %x has a coinbase paying more than %d", block.Hash, maxMoney)
+				}
+			}
+		} else {
+			// Blocks up to the last checkpoint are known to be valid, and
+			// checkCheckpoints keeps them on the chain leading to it
+			if block.Height > lastCheckpointHeight() {
+				err = checkTransactionInputs(transaction, block.Height, lookup, spent)
+				if err != nil {
+					return err
+				}
+			}
+			fees += transactionFee(lookup, transaction)
+			if !validMoney(fees) {
+				return fmt.Errorf("block %x collects fees of more than %d", block.Hash, maxMoney)
+			}
+		}
+
+		for outIdx, out := range transaction.Vout {
+			created[outpointKey(txID, outIdx)] = out
+		}
+	}
+
+	if reward > blockSubsidy(block.Height)+fees {
+		return fmt.Errorf("block %x pays a reward of %d, more than the subsidy %d plus the fees %d", block.Hash, reward, blockSubsidy(block.Height), fees)
+	}
+
+	return nil
+}
+
+// checkBlockSpends rejects a block spending an output twice, in one
+// transaction or two. It needs no chain state, so it also runs for blocks up
+// to the last checkpoint, whose inputs aren't checked otherwise: connecting a
+// double spend would corrupt the UTXO set.
+func checkBlockSpends(block *Block) error {
+	spentBy := make(map[string][]byte) // Outpoint -> ID of the transaction spending it
+
+	for _, transaction := range block.Transactions {
+		if transaction.IsCoinbase() {
+			continue
+		}
+
+		for _, vin := range transaction.Vin {
+			outpoint := outpointKey(hex.EncodeToString(vin.Txid), vin.Vout)
+			if other, ok := spentBy[outpoint]; ok {
+				return fmt.Errorf("block %x spends output %s twice, in transactions %x and %x", block.Hash, outpoint, other, transaction.ID)
+			}
+			spentBy[outpoint] = transaction.ID
+		}
+	}
+
+	return nil
+}
+
+// validateBlock runs every check a block must pass to be connected on top of
+// the active tip. It runs inside the database transaction that would connect
+// the block.
+// Parameters:
+//   - tx: The database transaction
+//   - block: The block to check
+//   - parent: The block it extends, the current tip
+func validateBlock(tx StoreTx, block, parent *Block) error {
+	err := checkBlockHeader(block)
+	if err != nil {
+		return err
+	}
+
+	err = checkBlockContext(tx, block, parent)
+	if err != nil {
+		return err
+	}
+
+	return checkBlockTransactions(tx, block)
+}
+
+// hasBlock checks whether a block is already stored, whether or not it's on
+// the active chain
+func (bc *Blockchain) hasBlock(hash []byte) bool {
+	found := false
+
+	err := bc.db.View(func(tx StoreTx) error {
+		found = tx.Bucket([]byte(blocksBucket)).Get(hash) != nil
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return found
+}
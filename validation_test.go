@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+// testTransaction returns a transaction spending the inputs and paying the
+// values to an address
+func testTransaction(inputs []TXInput, to string, values ...int) *Transaction {
+	tx := Transaction{Vin: inputs}
+	for _, value := range values {
+		tx.Vout = append(tx.Vout, TXOutput{Value: value, ScriptPubKey: to})
+	}
+	tx.SetID()
+
+	return &tx
+}
+
+// testChainState returns a store whose UTXO set holds the outputs of the
+// transactions
+func testChainState(t *testing.T, transactions ...*Transaction) Store {
+	store := newMemoryStore()
+	err := store.Update(func(tx StoreTx) error {
+		utxos, err := tx.CreateBucket([]byte(utxoBucket))
+		if err != nil {
+			return err
+		}
+
+		for _, transaction := range transactions {
+			outs := TXOutputs{make(map[int]TXOutput)}
+			for i, out := range transaction.Vout {
+				outs.Outputs[i] = out
+			}
+			err = utxos.Put(transaction.ID, outs.Serialize())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store
+}
+
+func TestCheckBlockTransactionsFees(t *testing.T) {
+	funding := NewCoinbaseTX("alice", "funding", 10)
+	store := testChainState(t, funding)
+
+	// The second transaction spends an output of the first, both paying a fee
+	first := testTransaction([]TXInput{{funding.ID, 0, "alice"}}, "alice", 9)
+	second := testTransaction([]TXInput{{first.ID, 0, "alice"}}, "bob", 7)
+	fees := 1 + 2
+
+	tests := []struct {
+		name   string
+		reward int
+		valid  bool
+	}{
+		{"claims the fees", blockSubsidy(1) + fees, true},
+		{"claims the subsidy", blockSubsidy(1), true},
+		{"claims more than the fees", blockSubsidy(1) + fees + 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block := &Block{Height: 1, Transactions: []*Transaction{NewCoinbaseTX("miner", "", tt.reward), first, second}}
+			err := store.View(func(tx StoreTx) error {
+				return checkBlockTransactions(tx, block)
+			})
+			if tt.valid && err != nil {
+				t.Errorf("valid block rejected: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("block paying more than the subsidy plus the fees accepted")
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+// walletFile is the file where the wallet data is stored, moved by selectNetwork
+var walletFile = "wallet.dat"
+
+// changeGapLimit is how many not yet known change addresses are derived ahead
+// when checking whether an address belongs to an owner. This lets a wallet
+// recognize change addresses derived by another copy of the same wallet.
+const changeGapLimit = 20
+
+// walletSeedSize is the size in bytes of the seed change addresses are
+// derived from
+const walletSeedSize = 32
+
+// Wallet keeps track of the change addresses derived for each address.
+// Instead of sending change back to the sender, every spend pays its change
+// to a fresh address derived from the sender's address and the wallet's random
+// seed, so nobody without the wallet can tell it's change. The wallet remembers
+// these derived addresses so balances can still be aggregated per owner.
+// The wallet also holds the outputs the user locked to keep them out of
+// automatic coin selection, the addresses it used as its own and the
+// transactions it replaced with bumpfee.
+type Wallet struct {
+	ChangeAddresses map[string][]string // Owner address -> change addresses derived for it, in derivation order
+	LockedOutputs   map[string]bool     // Outpoints (see outpointKey) excluded from coin selection
+	Seed            []byte              // Random secret change addresses are derived from
+	OwnAddresses    map[string]bool     // Addresses the wallet created the chain with, mined to or sent from
+	Replacements    map[string]string   // Hex ID of a transaction made by bumpfee -> hex ID of the one it replaced
+}
+
+// NewWallet creates a Wallet instance, loading the existing wallet file if there is one.
+// A new wallet, or one saved before wallets had a seed, gets a random seed,
+// stored with the wallet the next time it's saved. The change addresses an
+// older wallet already derived stay recorded.
+// Returns:
+//   - *Wallet: The loaded (or empty) wallet
+func NewWallet() *Wallet {
+	wallet := Wallet{make(map[string][]string), make(map[string]bool), nil, make(map[string]bool), make(map[string]string)}
+
+	if _, err := os.Stat(walletFile); err == nil {
+		err := wallet.LoadFromFile()
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	if len(wallet.Seed) == 0 {
+		wallet.Seed = make([]byte, walletSeedSize)
+		_, err := rand.Read(wallet.Seed)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	return &wallet
+}
+
+// NewChangeAddress derives the next unused change address for an owner address
+// and records it in the wallet. Addresses are derived deterministically, similar
+// to an HD wallet chain: the n-th change address is the HMAC of the owner
+// address combined with the index n, keyed with the wallet's seed.
+// Parameters:
+//   - owner: The address the change belongs to
+//
+// Returns:
+//   - string: The freshly derived change address
+func (w *Wallet) NewChangeAddress(owner string) string {
+	w.AddAddress(owner)
+	address := w.deriveChangeAddress(owner, len(w.ChangeAddresses[owner]))
+	w.ChangeAddresses[owner] = append(w.ChangeAddresses[owner], address)
+
+	return address
+}
+
+// IsOwnAddress checks whether an address is the owner address or one of its
+// change addresses. Change addresses that this wallet hasn't derived yet are
+// found by deriving up to changeGapLimit addresses ahead; any found this way
+// are recorded in the wallet.
+// Parameters:
+//   - owner: The owner address
+//   - address: The address to check
+//
+// Returns:
+//   - bool: true if the address belongs to the owner
+func (w *Wallet) IsOwnAddress(owner, address string) bool {
+	for _, addr := range w.Addresses(owner) {
+		if addr == address {
+			return true
+		}
+	}
+
+	known := len(w.ChangeAddresses[owner])
+	for index := known; index < known+changeGapLimit; index++ {
+		if w.deriveChangeAddress(owner, index) == address {
+			// Record every address up to the one found so indexes stay in sync
+			for len(w.ChangeAddresses[owner]) <= index {
+				w.NewChangeAddress(owner)
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+// Addresses returns every address whose outputs belong to the owner:
+// the owner address itself followed by all of its change addresses.
+// Parameters:
+//   - owner: The address to collect addresses for
+//
+// Returns:
+//   - []string: The owner address and its change addresses
+func (w *Wallet) Addresses(owner string) []string {
+	return append([]string{owner}, w.ChangeAddresses[owner]...)
+}
+
+// SetSeed replaces the seed change addresses are derived from, so a copy of
+// the wallet on another machine, like an offline signer, recognizes the
+// change addresses this one derives. Change addresses already derived stay
+// recorded.
+// Parameters:
+//   - seed: The seed, see dumpseed
+func (w *Wallet) SetSeed(seed []byte) error {
+	if len(seed) != walletSeedSize {
+		return fmt.Errorf("the seed must be %d bytes, not %d", walletSeedSize, len(seed))
+	}
+
+	w.Seed = seed
+	return nil
+}
+
+// AddAddress records an address as one of the wallet's own
+// Parameters:
+//   - address: The address the wallet uses
+//
+// Returns:
+//   - bool: false if the wallet already had the address
+func (w *Wallet) AddAddress(address string) bool {
+	if w.OwnAddresses[address] {
+		return false
+	}
+
+	w.OwnAddresses[address] = true
+	return true
+}
+
+// Owners returns the owner addresses of the wallet, sorted: its own addresses
+// and, for wallets saved before these were recorded, the ones it derived
+// change addresses for
+func (w *Wallet) Owners() []string {
+	owners := make([]string, 0, len(w.OwnAddresses))
+	for owner := range w.OwnAddresses {
+		owners = append(owners, owner)
+	}
+	for owner := range w.ChangeAddresses {
+		if !w.OwnAddresses[owner] {
+			owners = append(owners, owner)
+		}
+	}
+	sort.Strings(owners)
+
+	return owners
+}
+
+// rememberAddress records an address as one of the wallet's own in the wallet
+// file, for addresses used without deriving change, like reward addresses
+// Parameters:
+//   - address: The address the wallet uses
+func rememberAddress(address string) {
+	wallet := NewWallet()
+	if wallet.AddAddress(address) {
+		wallet.SaveToFile()
+	}
+}
+
+// LockOutput excludes an output from automatic coin selection
+// Parameters:
+//   - txID: Hex ID of the transaction containing the output
+//   - vout: Index of the output in the transaction
+func (w *Wallet) LockOutput(txID string, vout int) {
+	w.LockedOutputs[outpointKey(txID, vout)] = true
+}
+
+// UnlockOutput makes a locked output available to coin selection again
+// Parameters:
+//   - txID: Hex ID of the transaction containing the output
+//   - vout: Index of the output in the transaction
+//
+// Returns:
+//   - bool: false if the output wasn't locked
+func (w *Wallet) UnlockOutput(txID string, vout int) bool {
+	key := outpointKey(txID, vout)
+	if !w.LockedOutputs[key] {
+		return false
+	}
+
+	delete(w.LockedOutputs, key)
+	return true
+}
+
+// AddReplacement records that a transaction replaced another one, for the
+// history of the wallet
+// Parameters:
+//   - replacement: ID of the new transaction, see bumpfee
+//   - original: ID of the transaction it replaced
+func (w *Wallet) AddReplacement(replacement, original []byte) {
+	w.Replacements[hex.EncodeToString(replacement)] = hex.EncodeToString(original)
+}
+
+// outpointKey builds the "txid:vout" key identifying a transaction output
+func outpointKey(txID string, vout int) string {
+	return fmt.Sprintf("%s:%d", txID, vout)
+}
+
+// deriveChangeAddress derives the change address with the given index for an
+// owner address, prefixed with the chain's address version if it has one
+func (w *Wallet) deriveChangeAddress(owner string, index int) string {
+	mac := hmac.New(sha256.New, w.Seed)
+	fmt.Fprintf(mac, "%s/change/%d", owner, index)
+	hash := mac.Sum(nil)
+	if addressVersion != 0 {
+		return hex.EncodeToString(append([]byte{addressVersion}, hash[:20]...))
+	}
+	return hex.EncodeToString(hash[:20])
+}
+
+// LoadFromFile reads the wallet data from the wallet file
+func (w *Wallet) LoadFromFile() error {
+	content, err := os.ReadFile(walletFile)
+	if err != nil {
+		return err
+	}
+
+	// Decode the file contents into the wallet structure
+	decoder := gob.NewDecoder(bytes.NewReader(content))
+	return decoder.Decode(w)
+}
+
+// SaveToFile writes the wallet data to the wallet file
+func (w *Wallet) SaveToFile() {
+	var content bytes.Buffer
+
+	encoder := gob.NewEncoder(&content)
+	err := encoder.Encode(w)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = os.WriteFile(walletFile, content.Bytes(), 0600)
+	if err != nil {
+		log.Panic(err)
+	}
+}
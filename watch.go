@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// watchRetryInterval is how long watch waits before connecting to the feed
+// again after losing it
+const watchRetryInterval = 5 * time.Second
+
+// watch tails the blocks connected to the chain of a running node, like
+// tail -f: it subscribes to the block.connected events of the WebSocket feed
+// of the API of the node or of serve (see ws.go), and prints a line for each
+// block as it arrives. The database stays with the node, so watch runs next
+// to it, or on another machine. Given an address, only the blocks with a
+// transaction spending from or paying to it or one of its change addresses
+// are printed. A feed lost, because the node restarted or watch fell behind,
+// is connected to again.
+
+// watchFeedURL returns the URL of the WebSocket feed of an API
+// Parameters:
+//   - api: HOST:PORT of the HTTP API, or the ws:// or wss:// URL of its feed
+func watchFeedURL(api string) string {
+	if strings.HasPrefix(api, "ws://") || strings.HasPrefix(api, "wss://") {
+		return api
+	}
+
+	return "ws://" + api + "/ws"
+}
+
+// blockTouches checks whether a block has a transaction spending from or
+// paying to one of a set of addresses
+// Parameters:
+//   - block: The block in the format of the API
+//   - addresses: The addresses
+func blockTouches(block *BlockInfo, addresses map[string]bool) bool {
+	for _, tx := range block.Tx {
+		for _, in := range tx.Vin {
+			if !in.Coinbase && addresses[in.ScriptSig] {
+				return true
+			}
+		}
+		for _, out := range tx.Vout {
+			if addresses[out.Address] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// rewardAddress returns the address the coinbase of a block pays, empty if
+// it has none
+func rewardAddress(block *BlockInfo) string {
+	if len(block.Tx) == 0 || len(block.Tx[0].Vout) == 0 {
+		return ""
+	}
+
+	return block.Tx[0].Vout[0].Address
+}
+
+// watchBlocks reads the block.connected events of a WebSocket feed until the
+// connection fails
+// Parameters:
+//   - url: URL of the feed
+//   - connected: Called once the feed is connected
+//   - fn: Called with each block connected
+//
+// Returns:
+//   - error: Why the feed was lost
+func watchBlocks(url string, connected func(), fn func(block *BlockInfo)) error {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	connected()
+
+	for {
+		var ev wsEvent
+		err := conn.ReadJSON(&ev)
+		if err != nil {
+			return err
+		}
+		if ev.Type != eventBlockConnected || ev.Block == nil {
+			continue
+		}
+
+		fn(ev.Block)
+	}
+}
+
+// formatWatchedBlock returns the line watch prints for a block
+func formatWatchedBlock(block *BlockInfo) string {
+	line := fmt.Sprintf("Block %d %s, %d transactions", block.Height, block.Hash, len(block.Tx))
+	if reward := rewardAddress(block); reward != "" {
+		line += fmt.Sprintf(", reward to '%s'", reward)
+	}
+
+	return line
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Delivery of webhook notifications
+const (
+	webhookAttempts       = 6                 // Deliveries of a notification before giving up
+	webhookInitialBackoff = time.Second       // Wait before the first retry, doubled after each one
+	webhookTimeout        = 10 * time.Second  // How long a receiver may take to answer
+	webhookQueueSize      = 256               // Notifications waiting per webhook before new ones are dropped
+	webhookSignatureKey   = "X-Signature-256" // Header with the HMAC-SHA256 of the body
+	webhookEventKey       = "X-Event-Type"    // Header with the type of the notification
+)
+
+// eventAddressReceived is the webhook notification that a watched address
+// received funds in a connected block
+const eventAddressReceived = "address.received"
+
+// Webhook is a URL notified of chain events, as configured in a webhooks file
+type Webhook struct {
+	URL       string   `json:"url"`       // URL the notifications are posted to
+	Secret    string   `json:"secret"`    // Key of the HMAC signing the notifications
+	Events    []string `json:"events"`    // block.connected, address.received and/or tx.expired, empty for all
+	Addresses []string `json:"addresses"` // Addresses watched for address.received and tx.expired
+}
+
+// webhookNotification is the JSON body posted to webhooks
+type webhookNotification struct {
+	Type    string           `json:"type"`              // block.connected, address.received or tx.expired
+	Time    int64            `json:"time"`              // Unix timestamp of the notification
+	Block   *BlockInfo       `json:"block,omitempty"`   // The connected block, for block.connected
+	Address string           `json:"address,omitempty"` // The watched address, for address.received and tx.expired
+	Amount  int              `json:"amount,omitempty"`  // Coins the address received, for address.received
+	Tx      *TransactionInfo `json:"tx,omitempty"`      // The paying transaction, or the expired one
+	Hex     string           `json:"hex,omitempty"`     // The expired raw transaction, for tx.expired, to send it again
+}
+
+// LoadWebhooks reads a webhooks file, a JSON array of webhooks
+// Parameters:
+//   - filename: The file to read
+//
+// Returns:
+//   - []Webhook: The configured webhooks
+func LoadWebhooks(filename string) ([]Webhook, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var hooks []Webhook
+	err = json.Unmarshal(content, &hooks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhooks file %s: %w", filename, err)
+	}
+
+	for _, hook := range hooks {
+		if hook.URL == "" || hook.Secret == "" {
+			return nil, fmt.Errorf("invalid webhooks file %s: every webhook needs a url and a secret", filename)
+		}
+		for _, ev := range hook.Events {
+			if ev != eventBlockConnected && ev != eventAddressReceived && ev != eventTxExpired {
+				return nil, fmt.Errorf("invalid webhooks file %s: unknown event %q", filename, ev)
+			}
+		}
+	}
+
+	return hooks, nil
+}
+
+// wants tells whether the webhook is notified of a type of event
+func (hook *Webhook) wants(eventType string) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+
+	for _, ev := range hook.Events {
+		if ev == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sign returns the signature header of a body: "sha256=" and the hex
+// HMAC-SHA256 of the body keyed with the webhook's secret. Receivers compute
+// the same to check that a notification comes from us.
+func (hook *Webhook) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(hook.Secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookNotifications returns the notifications of a block for a webhook
+func (a *APIServer) webhookNotifications(hook *Webhook, block *Block) []webhookNotification {
+	var notes []webhookNotification
+	now := time.Now().Unix()
+
+	if hook.wants(eventBlockConnected) {
+		v, err := a.withChain(func(bc *Blockchain) (any, error) {
+			return NewBlockInfo(bc, block), nil
+		})
+		if err == nil {
+			info := v.(BlockInfo)
+			notes = append(notes, webhookNotification{Type: eventBlockConnected, Time: now, Block: &info})
+		}
+	}
+
+	if hook.wants(eventAddressReceived) {
+		for _, tx := range block.Transactions {
+			for _, addr := range hook.Addresses {
+				amount := 0
+				for _, out := range tx.Vout {
+					if out.CanBeUnlockedWith(addr) {
+						amount += out.Value
+					}
+				}
+				if amount == 0 {
+					continue
+				}
+
+				info := NewTransactionInfo(tx)
+				info.BlockHash = hex.EncodeToString(block.Hash)
+				info.Confirmations = 1
+				notes = append(notes, webhookNotification{
+					Type:    eventAddressReceived,
+					Time:    now,
+					Address: addr,
+					Amount:  amount,
+					Tx:      &info,
+				})
+			}
+		}
+	}
+
+	return notes
+}
+
+// expiryNotifications returns the notifications of an expired transaction
+// for a webhook, one for each watched address it spends from or pays to
+func expiryNotifications(hook *Webhook, tx *Transaction) []webhookNotification {
+	if !hook.wants(eventTxExpired) {
+		return nil
+	}
+
+	var notes []webhookNotification
+	now := time.Now().Unix()
+	for _, addr := range hook.Addresses {
+		if !tx.involves(addr) {
+			continue
+		}
+
+		info := NewTransactionInfo(tx)
+		notes = append(notes, webhookNotification{
+			Type:    eventTxExpired,
+			Time:    now,
+			Address: addr,
+			Tx:      &info,
+			Hex:     EncodeRawTransaction(tx),
+		})
+	}
+
+	return notes
+}
+
+// RunWebhooks notifies the webhooks of every block connected to the chain
+// and every transaction expiring from the mempool from now on, until the
+// program exits. Each webhook has its own queue, so a
+// slow or failing receiver doesn't delay the others.
+func (a *APIServer) RunWebhooks(hooks []Webhook) {
+	if len(hooks) == 0 {
+		return
+	}
+
+	queues := make([]chan webhookNotification, len(hooks))
+	for i := range hooks {
+		queues[i] = make(chan webhookNotification, webhookQueueSize)
+		go deliverWebhooks(&hooks[i], queues[i])
+	}
+
+	events := a.events.subscribe()
+	go func() {
+		for {
+			ev, ok := <-events
+			if !ok {
+				slog.Warn("Webhooks fell behind the chain, some blocks were not notified")
+				events = a.events.subscribe()
+				continue
+			}
+			if ev.Type != eventBlockConnected && ev.Type != eventTxExpired {
+				continue
+			}
+
+			for i := range hooks {
+				var notes []webhookNotification
+				if ev.Type == eventTxExpired {
+					notes = expiryNotifications(&hooks[i], ev.Tx)
+				} else {
+					notes = a.webhookNotifications(&hooks[i], ev.Block)
+				}
+
+				for _, note := range notes {
+					select {
+					case queues[i] <- note:
+					default:
+						slog.Warn("Webhook queue is full, dropping notification", "url", hooks[i].URL, "type", note.Type)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// deliverWebhooks posts the queued notifications to a webhook in order
+func deliverWebhooks(hook *Webhook, queue <-chan webhookNotification) {
+	client := &http.Client{Timeout: webhookTimeout}
+
+	for note := range queue {
+		body, err := json.Marshal(note)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		backoff := webhookInitialBackoff
+		for attempt := 1; ; attempt++ {
+			err = postWebhook(client, hook, note.Type, body)
+			if err == nil {
+				break
+			}
+			if attempt == webhookAttempts {
+				slog.Warn("Giving up on webhook notification", "url", hook.URL, "type", note.Type, "err", err)
+				break
+			}
+
+			slog.Warn("Notifying webhook failed, retrying", "url", hook.URL, "backoff", backoff, "err", err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// postWebhook posts a signed notification once
+// Parameters:
+//   - client: The HTTP client
+//   - hook: The webhook
+//   - eventType: Type of the notification
+//   - body: JSON body of the notification
+func postWebhook(client *http.Client, hook *Webhook, eventType string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventKey, eventType)
+	req.Header.Set(webhookSignatureKey, hook.sign(body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+
+	return nil
+}
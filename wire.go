@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+// networkMagic starts every message, so nodes of different networks, or
+// programs that aren't nodes at all, can't be mistaken for peers. This is
+// the magic of mainnet, see network.go for the others
+var networkMagic = [4]byte{0xfa, 0xbf, 0xb5, 0xda}
+
+// Message envelope layout
+const (
+	commandSize    = 12                                 // Command name, padded with zero bytes
+	checksumSize   = 4                                  // First bytes of the SHA-256 hash of the payload
+	msgHeaderSize  = 4 + commandSize + 4 + checksumSize // Magic, command, payload length and checksum
+	maxPayloadSize = 32 * 1024 * 1024                   // Larger payloads are refused before being read
+)
+
+// errBadChecksum is returned for a message whose payload doesn't match its
+// checksum. The envelope was read completely, so the connection is still in
+// sync and the next message can be read.
+var errBadChecksum = errors.New("payload checksum mismatch")
+
+// Every message on a connection is framed by a fixed size header:
+//
+//	magic (4 bytes) | command (12 bytes) | payload length (4 bytes, big endian) | checksum (4 bytes)
+//
+// followed by the payload. The length lets a reader know how much to expect,
+// so a truncated message is detected instead of being decoded, and the checksum
+// catches a corrupted payload.
+
+// payloadChecksum returns the checksum of a payload
+func payloadChecksum(payload []byte) []byte {
+	hash := sha256.Sum256(payload)
+	return hash[:checksumSize]
+}
+
+// writeMessage frames a message and writes it with a single write
+// Parameters:
+//   - w: The connection
+//   - msg: The message
+func writeMessage(w io.Writer, msg message) error {
+	if len(msg.Command) > commandSize {
+		return fmt.Errorf("command %q is too long", msg.Command)
+	}
+	if len(msg.Payload) > maxPayloadSize {
+		return fmt.Errorf("%s payload of %d bytes is too large", msg.Command, len(msg.Payload))
+	}
+
+	frame := make([]byte, msgHeaderSize, msgHeaderSize+len(msg.Payload))
+	copy(frame[0:4], networkMagic[:])
+	copy(frame[4:4+commandSize], msg.Command)
+	binary.BigEndian.PutUint32(frame[4+commandSize:], uint32(len(msg.Payload)))
+	copy(frame[8+commandSize:], payloadChecksum(msg.Payload))
+	frame = append(frame, msg.Payload...)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// readMessage reads the next framed message
+// Parameters:
+//   - r: The connection
+//
+// Returns:
+//   - message: The message
+//   - error: io.EOF if the connection was closed between messages, errBadChecksum
+//     if only the payload is corrupted, or why the stream can't be read any more
+func readMessage(r io.Reader) (message, error) {
+	header := make([]byte, msgHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if errors.Is(err, io.EOF) {
+		return message{}, io.EOF
+	}
+	if err != nil {
+		return message{}, fmt.Errorf("truncated message header: %w", err)
+	}
+
+	if !bytes.Equal(header[0:4], networkMagic[:]) {
+		return message{}, fmt.Errorf("wrong network magic %x", header[0:4])
+	}
+
+	command := string(bytes.TrimRight(header[4:4+commandSize], "\x00"))
+	length := binary.BigEndian.Uint32(header[4+commandSize:])
+	if length > maxPayloadSize {
+		return message{}, fmt.Errorf("%s payload of %d bytes is too large", command, length)
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return message{}, fmt.Errorf("truncated %s payload: %w", command, err)
+	}
+
+	msg := message{command, payload}
+	if !bytes.Equal(header[8+commandSize:], payloadChecksum(payload)) {
+		return msg, errBadChecksum
+	}
+	if length == 0 {
+		msg.Payload = nil
+	}
+
+	return msg, nil
+}
+
+// Block messages are the bulk of the traffic while syncing, and the addresses
+// repeated across their transactions compress well. Nodes started with compression
+// announce the serviceSnappy bit, and when both sides of a connection did, the
+// block payloads sent over it are snappy compressed.
+
+// compressPayload compresses a block payload for a peer that negotiated compression
+func compressPayload(payload []byte) []byte {
+	return snappy.Encode(nil, payload)
+}
+
+// decompressPayload decompresses a block payload, refusing payloads that would
+// grow beyond maxPayloadSize
+func decompressPayload(data []byte) ([]byte, error) {
+	size, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed payload: %w", err)
+	}
+	if size > maxPayloadSize {
+		return nil, fmt.Errorf("compressed payload of %d bytes is too large", size)
+	}
+
+	return snappy.Decode(nil, data)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Limits of WebSocket connections
+const (
+	wsWriteTimeout   = 10 * time.Second // How long writing an event may take
+	wsPongTimeout    = 60 * time.Second // How long a client may stay silent before it is dropped
+	wsPingInterval   = 50 * time.Second // How often clients are pinged, below wsPongTimeout
+	wsMaxMessageSize = 64 * 1024        // Largest message accepted from a client
+)
+
+// wsUpgrader upgrades HTTP requests to WebSocket connections. The feed is
+// public and read-only, so browser pages of any origin may connect.
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsEvent is an event in the JSON format of the WebSocket feed
+type wsEvent struct {
+	Type  string           `json:"type"`            // One of the event constants
+	Block *BlockInfo       `json:"block,omitempty"` // The block, for block.connected
+	Tx    *TransactionInfo `json:"tx,omitempty"`    // The transaction, for the tx events
+	Hex   string           `json:"hex,omitempty"`   // The raw transaction, for tx.expired, to send it again
+}
+
+// wsFilterMessage is a message from a client changing its address filter
+type wsFilterMessage struct {
+	Op        string   `json:"op"`        // "subscribe" or "unsubscribe"
+	Addresses []string `json:"addresses"` // Addresses to add to or remove from the filter
+}
+
+// handleWebSocket answers GET /ws, pushing events to the client until it
+// disconnects. Without a filter every event is sent; once addresses are
+// subscribed, with ?address=ADDR query params or filter messages,
+// transaction events are only sent for transactions spending from or paying
+// to one of them. Block events are always sent.
+func (a *APIServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already answered with an error status
+		return
+	}
+	defer conn.Close()
+
+	filter := make(map[string]bool)
+	for _, addr := range r.URL.Query()["address"] {
+		filter[addr] = true
+	}
+
+	events := a.events.subscribe()
+	defer a.events.unsubscribe(events)
+
+	updates := make(chan wsFilterMessage)
+	done := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go readWebSocket(conn, updates, done, stop)
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+
+		case msg := <-updates:
+			for _, addr := range msg.Addresses {
+				if msg.Op == "unsubscribe" {
+					delete(filter, addr)
+				} else {
+					filter[addr] = true
+				}
+			}
+
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+			if err != nil {
+				return
+			}
+
+		case ev, ok := <-events:
+			if !ok {
+				msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "fell behind, reconnect")
+				conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteTimeout))
+				return
+			}
+
+			for _, ev := range append([]Event{ev}, confirmedEvents(ev)...) {
+				if ev.Tx != nil && !matchesFilter(ev.Tx, filter) {
+					continue
+				}
+
+				out, err := a.newWSEvent(ev)
+				if err != nil {
+					slog.Warn("Converting event failed", "type", ev.Type, "err", err)
+					continue
+				}
+
+				conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+				err = conn.WriteJSON(out)
+				if err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// readWebSocket reads the filter messages of a client until the connection
+// fails, then closes done
+// Parameters:
+//   - conn: The connection
+//   - updates: Receives the filter messages
+//   - done: Closed when the connection fails
+//   - stop: Closed when the handler stops taking filter messages
+func readWebSocket(conn *websocket.Conn, updates chan<- wsFilterMessage, done, stop chan struct{}) {
+	defer close(done)
+
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		// Malformed messages are ignored
+		var msg wsFilterMessage
+		if json.Unmarshal(data, &msg) != nil {
+			continue
+		}
+
+		select {
+		case updates <- msg:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// matchesFilter tells whether a transaction passes an address filter, which
+// every transaction passes while it is empty
+func matchesFilter(tx *Transaction, filter map[string]bool) bool {
+	if len(filter) == 0 {
+		return true
+	}
+
+	for addr := range filter {
+		if tx.involves(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newWSEvent converts an event to the JSON format of the feed
+func (a *APIServer) newWSEvent(ev Event) (*wsEvent, error) {
+	out := &wsEvent{Type: ev.Type}
+
+	switch ev.Type {
+	case eventBlockConnected:
+		v, err := a.withChain(func(bc *Blockchain) (any, error) {
+			return NewBlockInfo(bc, ev.Block), nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		info := v.(BlockInfo)
+		out.Block = &info
+
+	case eventTxAccepted:
+		info := NewTransactionInfo(ev.Tx)
+		out.Tx = &info
+
+	case eventTxConfirmed:
+		info := NewTransactionInfo(ev.Tx)
+		info.BlockHash = hex.EncodeToString(ev.Block.Hash)
+		info.Confirmations = 1
+		out.Tx = &info
+
+	case eventTxExpired:
+		info := NewTransactionInfo(ev.Tx)
+		out.Tx = &info
+		out.Hex = EncodeRawTransaction(ev.Tx)
+	}
+
+	return out, nil
+}